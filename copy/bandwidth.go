@@ -0,0 +1,80 @@
+package copy
+
+import (
+	"context"
+	"io"
+	"math"
+
+	"golang.org/x/time/rate"
+)
+
+// bandwidthLimiterChunkSize is the maximum number of bytes a single Read through a BandwidthLimiter
+// transfers at once; it is also the burst size of the underlying token bucket.
+const bandwidthLimiterChunkSize = 32 * 1024
+
+// BandwidthLimiter limits the combined throughput, in bytes per second, of all blob streams using it.
+// A single BandwidthLimiter can be shared by parallel layer copies and by several copy.Image calls,
+// and its limit can be changed at any time using SetLimit.
+type BandwidthLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewBandwidthLimiter returns a BandwidthLimiter allowing at most bytesPerSecond bytes per second.
+// A value of 0 means no limit.
+func NewBandwidthLimiter(bytesPerSecond uint64) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		limiter: rate.NewLimiter(bandwidthToLimit(bytesPerSecond), bandwidthLimiterChunkSize),
+	}
+}
+
+// bandwidthToLimit converts a BandwidthLimiter limit to a rate.Limit.
+func bandwidthToLimit(bytesPerSecond uint64) rate.Limit {
+	if bytesPerSecond == 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSecond)
+}
+
+// SetLimit changes the limit to bytesPerSecond bytes per second; 0 means no limit.
+// Transfers already in progress are affected immediately.
+func (l *BandwidthLimiter) SetLimit(bytesPerSecond uint64) {
+	l.limiter.SetLimit(bandwidthToLimit(bytesPerSecond))
+}
+
+// Limit returns the current limit in bytes per second; 0 means no limit.
+func (l *BandwidthLimiter) Limit() uint64 {
+	limit := l.limiter.Limit()
+	if limit == rate.Inf || limit > math.MaxUint64 {
+		return 0
+	}
+	return uint64(limit)
+}
+
+// newReader returns an io.Reader with contents of source, throttled by l.
+// It is valid to call this on a nil *BandwidthLimiter, which returns source unmodified.
+func (l *BandwidthLimiter) newReader(ctx context.Context, source io.Reader) io.Reader {
+	if l == nil {
+		return source
+	}
+	return &bandwidthLimitedReader{ctx: ctx, source: source, limiter: l.limiter}
+}
+
+// bandwidthLimitedReader is an io.Reader which throttles reading from source using limiter.
+type bandwidthLimitedReader struct {
+	ctx     context.Context
+	source  io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *bandwidthLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthLimiterChunkSize {
+		p = p[:bandwidthLimiterChunkSize]
+	}
+	n, err := r.source.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
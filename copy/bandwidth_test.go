@@ -0,0 +1,63 @@
+package copy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthLimiterLimit(t *testing.T) {
+	l := NewBandwidthLimiter(0)
+	assert.Equal(t, uint64(0), l.Limit())
+	l.SetLimit(1024)
+	assert.Equal(t, uint64(1024), l.Limit())
+	l.SetLimit(0)
+	assert.Equal(t, uint64(0), l.Limit())
+}
+
+func TestBandwidthLimiterNewReader(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte{0x5a}, 3*bandwidthLimiterChunkSize)
+
+	// A nil limiter returns the source unmodified.
+	var nilLimiter *BandwidthLimiter
+	source := bytes.NewReader(data)
+	assert.Equal(t, source, nilLimiter.newReader(ctx, source))
+
+	// The contents are not modified.
+	l := NewBandwidthLimiter(0)
+	res, err := ioutil.ReadAll(l.newReader(ctx, bytes.NewReader(data)))
+	require.NoError(t, err)
+	assert.Equal(t, data, res)
+
+	// The limit is applied: the first bandwidthLimiterChunkSize bytes are available immediately as a burst,
+	// and they are accounted for in the limiter, so that reading more would have to wait for about as many seconds.
+	// Check the limiter's reservations instead of waiting for real, so that the test does not depend on timing.
+	l = NewBandwidthLimiter(1)
+	res, err = ioutil.ReadAll(io.LimitReader(l.newReader(ctx, bytes.NewReader(data)), bandwidthLimiterChunkSize))
+	require.NoError(t, err)
+	assert.Equal(t, data[:bandwidthLimiterChunkSize], res)
+	reservation := l.limiter.ReserveN(time.Now(), bandwidthLimiterChunkSize)
+	require.True(t, reservation.OK())
+	assert.True(t, reservation.Delay() > bandwidthLimiterChunkSize/2*time.Second, reservation.Delay())
+	reservation.Cancel()
+	// Raising the limit affects the reservations immediately.
+	l.SetLimit(2 * bandwidthLimiterChunkSize)
+	reservation = l.limiter.ReserveN(time.Now(), bandwidthLimiterChunkSize)
+	require.True(t, reservation.OK())
+	assert.True(t, reservation.Delay() <= time.Second, reservation.Delay())
+	reservation.Cancel()
+
+	// Waiting for the limiter honors ctx.
+	l = NewBandwidthLimiter(1)
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = io.Copy(ioutil.Discard, l.newReader(cancelledCtx, bytes.NewReader(data)))
+	assert.Error(t, err)
+}
@@ -16,8 +16,10 @@ import (
 	"github.com/containers/image/v5/image"
 	internalblobinfocache "github.com/containers/image/v5/internal/blobinfocache"
 	"github.com/containers/image/v5/internal/pkg/platform"
+	internalTypes "github.com/containers/image/v5/internal/types"
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/pkg/blobinfocache"
+	"github.com/containers/image/v5/pkg/blobinfocache/memory"
 	"github.com/containers/image/v5/pkg/compression"
 	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/transports"
@@ -121,6 +123,14 @@ type copier struct {
 	ociDecryptConfig     *encconfig.DecryptConfig
 	ociEncryptConfig     *encconfig.EncryptConfig
 	maxParallelDownloads uint
+	transferLimiter      *TransferLimiter
+	srcLimiterKey        string // Key of rawSource in transferLimiter
+	destLimiterKey       string // Key of dest in transferLimiter
+	readBandwidth        *BandwidthLimiter
+	writeBandwidth       *BandwidthLimiter
+	downloadDeduplicator *BlobDownloadDeduplicator
+	srcDownloadScope     string               // Scope of rawSource in downloadDeduplicator
+	verification         *verificationResults // Non-nil only in VerifyImage
 }
 
 // imageCopier tracks state specific to a single image (possibly an item of a manifest list)
@@ -128,6 +138,7 @@ type imageCopier struct {
 	c                  *copier
 	manifestUpdates    *types.ManifestUpdateOptions
 	src                types.Image
+	targetInstance     *digest.Digest // The instance digest in the source list, or nil when copying a single image
 	diffIDsAreNeeded   bool
 	canModifyManifest  bool
 	canSubstituteBlobs bool
@@ -173,7 +184,7 @@ type Options struct {
 	SourceCtx        *types.SystemContext
 	DestinationCtx   *types.SystemContext
 	ProgressInterval time.Duration                 // time to wait between reports to signal the progress channel
-	Progress         chan types.ProgressProperties // Reported to when ProgressInterval has arrived for a single artifact+offset.
+	Progress         chan types.ProgressProperties // Reported to when ProgressInterval has arrived for a single artifact+offset, and when the destination applies layers in Commit.
 	// manifest MIME type of image set by user. "" is default and means use the autodetection to the the manifest MIME type
 	ForceManifestMIMEType string
 	ImageListSelection    ImageListSelection // set to either CopySystemImage (the default), CopyAllImages, or CopySpecificImages to control which instances we copy when the source reference is a list; ignored if the source reference is not a list
@@ -198,6 +209,22 @@ type Options struct {
 	// exists (and is equivalent). Making the eventual (no-op) copy more performant for this case. Enabling the option
 	// is slightly pessimistic if the destination image doesn't exist, or is not equivalent.
 	OptimizeDestinationImageAlreadyExists bool
+	// InstanceErrorHandling is set to either AbortOnInstanceError (the default), SkipFailedInstances, or KeepFailedInstances
+	// to control what happens when copying a single instance of a manifest list fails; ignored if the source reference is not a list.
+	// If any instances fail and the rest of the list is copied, Image returns the written manifest list along with a PartialListCopyError.
+	InstanceErrorHandling InstanceErrorHandling
+	// If TransferLimiter is not nil, it bounds the number of concurrent blob downloads and uploads per registry host,
+	// shared with all other copy.Image calls using the same TransferLimiter.
+	TransferLimiter *TransferLimiter
+	// If ReadBandwidthLimiter is not nil, it limits the combined rate at which blobs are read from the source.
+	// If WriteBandwidthLimiter is not nil, it limits the combined rate at which blobs are written to the destination.
+	// The same limiter can be shared by several copy.Image calls, and its limit can be changed while copies are running.
+	ReadBandwidthLimiter  *BandwidthLimiter
+	WriteBandwidthLimiter *BandwidthLimiter
+	// If BlobDownloadDeduplicator is not nil, concurrent downloads of the same blob from the same source, by this and other
+	// copy.Image calls using the same BlobDownloadDeduplicator, are performed only once; the other copies wait and then
+	// try to reuse the blob at their destination.
+	BlobDownloadDeduplicator *BlobDownloadDeduplicator
 }
 
 // validateImageListSelection returns an error if the passed-in value is not one that we recognize as a valid ImageListSelection value
@@ -213,7 +240,14 @@ func validateImageListSelection(selection ImageListSelection) error {
 // Image copies image from srcRef to destRef, using policyContext to validate
 // source image admissibility.  It returns the manifest which was written to
 // the new copy of the image.
+// If options.InstanceErrorHandling allowed some instances of a manifest list to fail,
+// it returns both the manifest list which was written and a PartialListCopyError.
 func Image(ctx context.Context, policyContext *signature.PolicyContext, destRef, srcRef types.ImageReference, options *Options) (copiedManifest []byte, retErr error) {
+	return copyImage(ctx, policyContext, destRef, srcRef, options, nil)
+}
+
+// copyImage implements Image, and VerifyImage if verification is not nil.
+func copyImage(ctx context.Context, policyContext *signature.PolicyContext, destRef, srcRef types.ImageReference, options *Options, verification *verificationResults) (copiedManifest []byte, retErr error) {
 	// NOTE this function uses an output parameter for the error return value.
 	// Setting this and returning is the ideal way to return an error.
 	//
@@ -226,6 +260,9 @@ func Image(ctx context.Context, policyContext *signature.PolicyContext, destRef,
 	if err := validateImageListSelection(options.ImageListSelection); err != nil {
 		return nil, err
 	}
+	if err := validateInstanceErrorHandling(options.InstanceErrorHandling); err != nil {
+		return nil, err
+	}
 
 	reportWriter := ioutil.Discard
 
@@ -262,6 +299,11 @@ func Image(ctx context.Context, policyContext *signature.PolicyContext, destRef,
 	}
 	copyInParallel := dest.HasThreadSafePutBlob() && rawSource.HasThreadSafeGetBlob()
 
+	cache := blobinfocache.DefaultCache(options.DestinationCtx)
+	if verification != nil {
+		// VerifyImage must not write anything, not even to the on-disk cache, and must not rely on data recorded by earlier copies.
+		cache = memory.New()
+	}
 	c := &copier{
 		dest:             dest,
 		rawSource:        rawSource,
@@ -273,10 +315,18 @@ func Image(ctx context.Context, policyContext *signature.PolicyContext, destRef,
 		// FIXME? The cache is used for sources and destinations equally, but we only have a SourceCtx and DestinationCtx.
 		// For now, use DestinationCtx (because blob reuse changes the behavior of the destination side more); eventually
 		// we might want to add a separate CommonCtx — or would that be too confusing?
-		blobInfoCache:        internalblobinfocache.FromBlobInfoCache(blobinfocache.DefaultCache(options.DestinationCtx)),
+		blobInfoCache:        internalblobinfocache.FromBlobInfoCache(cache),
 		ociDecryptConfig:     options.OciDecryptConfig,
 		ociEncryptConfig:     options.OciEncryptConfig,
 		maxParallelDownloads: options.MaxParallelDownloads,
+		transferLimiter:      options.TransferLimiter,
+		srcLimiterKey:        transferLimiterKey(srcRef),
+		destLimiterKey:       transferLimiterKey(destRef),
+		readBandwidth:        options.ReadBandwidthLimiter,
+		writeBandwidth:       options.WriteBandwidthLimiter,
+		downloadDeduplicator: options.BlobDownloadDeduplicator,
+		srcDownloadScope:     blobDownloadScope(srcRef),
+		verification:         verification,
 	}
 	// Default to using gzip compression unless specified otherwise.
 	if options.DestinationCtx == nil || options.DestinationCtx.CompressionFormat == nil {
@@ -293,6 +343,7 @@ func Image(ctx context.Context, policyContext *signature.PolicyContext, destRef,
 		c.compressionLevel = options.DestinationCtx.CompressionLevel
 	}
 
+	var instanceFailures []InstanceCopyFailure
 	unparsedToplevel := image.UnparsedInstance(rawSource, nil)
 	multiImage, err := isMultiImage(ctx, unparsedToplevel)
 	if err != nil {
@@ -337,18 +388,35 @@ func Image(ctx context.Context, policyContext *signature.PolicyContext, destRef,
 		case CopySpecificImages:
 			logrus.Debugf("Source is a manifest list; copying some instances")
 		}
-		if copiedManifest, _, err = c.copyMultipleImages(ctx, policyContext, options, unparsedToplevel); err != nil {
+		if copiedManifest, _, instanceFailures, err = c.copyMultipleImages(ctx, policyContext, options, unparsedToplevel); err != nil {
 			return nil, err
 		}
 	}
 
-	if err := c.dest.Commit(ctx, unparsedToplevel); err != nil {
+	if err := c.commit(ctx, unparsedToplevel); err != nil {
 		return nil, errors.Wrap(err, "Error committing the finished image")
 	}
 
+	if len(instanceFailures) != 0 {
+		return copiedManifest, PartialListCopyError{
+			Failures: instanceFailures,
+			Omitted:  options.InstanceErrorHandling == SkipFailedInstances,
+		}
+	}
 	return copiedManifest, nil
 }
 
+// commit commits the image to the destination, asking it to report the progress of doing so, if it can and c.progress is set.
+func (c *copier) commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	if dest, ok := c.dest.(internalTypes.ImageDestinationWithCommitOptions); ok && c.progress != nil && c.progressInterval > 0 {
+		return dest.CommitWithOptions(ctx, unparsedToplevel, internalTypes.CommitOptions{
+			Progress:         c.progress,
+			ProgressInterval: c.progressInterval,
+		})
+	}
+	return c.dest.Commit(ctx, unparsedToplevel)
+}
+
 // Checks if the destination supports accepting multiple images by checking if it can support
 // manifest types that are lists of other manifests.
 func supportsMultipleImages(dest types.ImageDestination) bool {
@@ -406,15 +474,17 @@ func compareImageDestinationManifestEqual(ctx context.Context, options *Options,
 
 // copyMultipleImages copies some or all of an image list's instances, using
 // policyContext to validate source image admissibility.
-func (c *copier) copyMultipleImages(ctx context.Context, policyContext *signature.PolicyContext, options *Options, unparsedToplevel *image.UnparsedImage) (copiedManifest []byte, copiedManifestType string, retErr error) {
+// If options.InstanceErrorHandling allows it, instances which fail to copy are returned in instanceFailures
+// instead of aborting the copy.
+func (c *copier) copyMultipleImages(ctx context.Context, policyContext *signature.PolicyContext, options *Options, unparsedToplevel *image.UnparsedImage) (copiedManifest []byte, copiedManifestType string, instanceFailures []InstanceCopyFailure, retErr error) {
 	// Parse the list and get a copy of the original value after it's re-encoded.
 	manifestList, manifestType, err := unparsedToplevel.Manifest(ctx)
 	if err != nil {
-		return nil, "", errors.Wrapf(err, "Error reading manifest list")
+		return nil, "", nil, errors.Wrapf(err, "Error reading manifest list")
 	}
 	originalList, err := manifest.ListFromBlob(manifestList, manifestType)
 	if err != nil {
-		return nil, "", errors.Wrapf(err, "Error parsing manifest list %q", string(manifestList))
+		return nil, "", nil, errors.Wrapf(err, "Error parsing manifest list %q", string(manifestList))
 	}
 	updatedList := originalList.Clone()
 
@@ -426,14 +496,14 @@ func (c *copier) copyMultipleImages(ctx context.Context, policyContext *signatur
 		c.Printf("Getting image list signatures\n")
 		s, err := c.rawSource.GetSignatures(ctx, nil)
 		if err != nil {
-			return nil, "", errors.Wrap(err, "Error reading signatures")
+			return nil, "", nil, errors.Wrap(err, "Error reading signatures")
 		}
 		sigs = s
 	}
 	if len(sigs) != 0 {
 		c.Printf("Checking if image list destination supports signatures\n")
 		if err := c.dest.SupportsSignatures(ctx); err != nil {
-			return nil, "", errors.Wrapf(err, "Can not copy signatures to %s", transports.ImageName(c.dest.Reference()))
+			return nil, "", nil, errors.Wrapf(err, "Can not copy signatures to %s", transports.ImageName(c.dest.Reference()))
 		}
 	}
 	canModifyManifestList := (len(sigs) == 0)
@@ -448,11 +518,11 @@ func (c *copier) copyMultipleImages(ctx context.Context, policyContext *signatur
 	}
 	selectedListType, otherManifestMIMETypeCandidates, err := c.determineListConversion(manifestType, c.dest.SupportedManifestMIMETypes(), forceListMIMEType)
 	if err != nil {
-		return nil, "", errors.Wrapf(err, "Error determining manifest list type to write to destination")
+		return nil, "", nil, errors.Wrapf(err, "Error determining manifest list type to write to destination")
 	}
 	if selectedListType != originalList.MIMEType() {
 		if !canModifyManifestList {
-			return nil, "", errors.Errorf("Error: manifest list must be converted to type %q to be written to destination, but that would invalidate signatures", selectedListType)
+			return nil, "", nil, errors.Errorf("Error: manifest list must be converted to type %q to be written to destination, but that would invalidate signatures", selectedListType)
 		}
 	}
 
@@ -477,7 +547,7 @@ func (c *copier) copyMultipleImages(ctx context.Context, policyContext *signatur
 			if skip {
 				update, err := updatedList.Instance(instanceDigest)
 				if err != nil {
-					return nil, "", err
+					return nil, "", nil, err
 				}
 				logrus.Debugf("Skipping instance %s (%d/%d)", instanceDigest, i+1, len(instanceDigests))
 				// Record the digest/size/type of the manifest that we didn't copy.
@@ -486,11 +556,23 @@ func (c *copier) copyMultipleImages(ctx context.Context, policyContext *signatur
 			}
 		}
 		logrus.Debugf("Copying instance %s (%d/%d)", instanceDigest, i+1, len(instanceDigests))
-		c.Printf("Copying image %s (%d/%d)\n", instanceDigest, instancesCopied+1, imagesToCopy)
+		c.Printf("Copying image %s (%d/%d)\n", instanceDigest, instancesCopied+len(instanceFailures)+1, imagesToCopy)
 		unparsedInstance := image.UnparsedInstance(c.rawSource, &instanceDigest)
 		updatedManifest, updatedManifestType, updatedManifestDigest, err := c.copyOneImage(ctx, policyContext, options, unparsedToplevel, unparsedInstance, &instanceDigest)
 		if err != nil {
-			return nil, "", err
+			if options.InstanceErrorHandling == AbortOnInstanceError || ctx.Err() != nil {
+				return nil, "", nil, err
+			}
+			logrus.Debugf("Copying instance %s failed, continuing with other instances: %v", instanceDigest, err)
+			c.Printf("Error copying image %s, skipping it: %v\n", instanceDigest, err)
+			instanceFailures = append(instanceFailures, InstanceCopyFailure{Instance: instanceDigest, Err: err})
+			update, err := updatedList.Instance(instanceDigest)
+			if err != nil {
+				return nil, "", nil, err
+			}
+			// Record the original digest/size/type; with SkipFailedInstances, the entry is removed below.
+			updates[i] = update
+			continue
 		}
 		instancesCopied++
 		// Record the result of a possible conversion here.
@@ -504,7 +586,25 @@ func (c *copier) copyMultipleImages(ctx context.Context, policyContext *signatur
 
 	// Now reset the digest/size/types of the manifests in the list to account for any conversions that we made.
 	if err = updatedList.UpdateInstances(updates); err != nil {
-		return nil, "", errors.Wrapf(err, "Error updating manifest list")
+		return nil, "", nil, errors.Wrapf(err, "Error updating manifest list")
+	}
+
+	if len(instanceFailures) != 0 {
+		if instancesCopied == 0 {
+			return nil, "", nil, errors.Wrap(PartialListCopyError{Failures: instanceFailures}, "Error copying manifest list, no instances were copied")
+		}
+		if options.InstanceErrorHandling == SkipFailedInstances {
+			if !canModifyManifestList {
+				return nil, "", nil, errors.Errorf("Error: failed instances must be removed from the manifest list, but that would invalidate signatures: %v", PartialListCopyError{Failures: instanceFailures, Omitted: true})
+			}
+			failed := map[digest.Digest]struct{}{}
+			for _, f := range instanceFailures {
+				failed[f.Instance] = struct{}{}
+			}
+			if updatedList, err = removeListInstances(updatedList, failed); err != nil {
+				return nil, "", nil, err
+			}
+		}
 	}
 
 	// Iterate through supported list types, preferred format first.
@@ -519,7 +619,7 @@ func (c *copier) copyMultipleImages(ctx context.Context, policyContext *signatur
 		if thisListType != updatedList.MIMEType() {
 			attemptedList, err = updatedList.ConvertToMIMEType(thisListType)
 			if err != nil {
-				return nil, "", errors.Wrapf(err, "Error converting manifest list to list with MIME type %q", thisListType)
+				return nil, "", nil, errors.Wrapf(err, "Error converting manifest list to list with MIME type %q", thisListType)
 			}
 		}
 
@@ -527,17 +627,17 @@ func (c *copier) copyMultipleImages(ctx context.Context, policyContext *signatur
 		// by serializing them both so that we can compare them.
 		attemptedManifestList, err := attemptedList.Serialize()
 		if err != nil {
-			return nil, "", errors.Wrapf(err, "Error encoding updated manifest list (%q: %#v)", updatedList.MIMEType(), updatedList.Instances())
+			return nil, "", nil, errors.Wrapf(err, "Error encoding updated manifest list (%q: %#v)", updatedList.MIMEType(), updatedList.Instances())
 		}
 		originalManifestList, err := originalList.Serialize()
 		if err != nil {
-			return nil, "", errors.Wrapf(err, "Error encoding original manifest list for comparison (%q: %#v)", originalList.MIMEType(), originalList.Instances())
+			return nil, "", nil, errors.Wrapf(err, "Error encoding original manifest list for comparison (%q: %#v)", originalList.MIMEType(), originalList.Instances())
 		}
 
 		// If we can't just use the original value, but we have to change it, flag an error.
 		if !bytes.Equal(attemptedManifestList, originalManifestList) {
 			if !canModifyManifestList {
-				return nil, "", errors.Errorf("Error: manifest list must be converted to type %q to be written to destination, but that would invalidate signatures", thisListType)
+				return nil, "", nil, errors.Errorf("Error: manifest list must be converted to type %q to be written to destination, but that would invalidate signatures", thisListType)
 			}
 			logrus.Debugf("Manifest list has been updated")
 		} else {
@@ -557,24 +657,24 @@ func (c *copier) copyMultipleImages(ctx context.Context, policyContext *signatur
 		break
 	}
 	if errs != nil {
-		return nil, "", fmt.Errorf("Uploading manifest list failed, attempted the following formats: %s", strings.Join(errs, ", "))
+		return nil, "", nil, fmt.Errorf("Uploading manifest list failed, attempted the following formats: %s", strings.Join(errs, ", "))
 	}
 
 	// Sign the manifest list.
 	if options.SignBy != "" {
 		newSig, err := c.createSignature(manifestList, options.SignBy)
 		if err != nil {
-			return nil, "", err
+			return nil, "", nil, err
 		}
 		sigs = append(sigs, newSig)
 	}
 
 	c.Printf("Storing list signatures\n")
 	if err := c.dest.PutSignatures(ctx, sigs, nil); err != nil {
-		return nil, "", errors.Wrap(err, "Error writing signatures")
+		return nil, "", nil, errors.Wrap(err, "Error writing signatures")
 	}
 
-	return manifestList, selectedListType, nil
+	return manifestList, selectedListType, instanceFailures, nil
 }
 
 // copyOneImage copies a single (non-manifest-list) image unparsedImage, using policyContext to validate
@@ -659,6 +759,7 @@ func (c *copier) copyOneImage(ctx context.Context, policyContext *signature.Poli
 		c:               c,
 		manifestUpdates: &types.ManifestUpdateOptions{InformationOnly: types.ManifestUpdateInformation{Destination: c.dest}},
 		src:             src,
+		targetInstance:  targetInstance,
 		// diffIDsAreNeeded is computed later
 		canModifyManifest: len(sigs) == 0 && !destIsDigestedReference,
 		ociEncryptLayers:  options.OciEncryptLayers,
@@ -899,6 +1000,28 @@ func (ic *imageCopier) copyLayers(ctx context.Context) error {
 		copySemaphore = semaphore.NewWeighted(int64(1))
 	}
 
+	// Empty layers don't modify the layer stack; destinations processing layers in order need to know which ones they are.
+	emptyLayers := make([]bool, numLayers)
+	srcManifest, srcManifestType, err := ic.src.Manifest(ctx)
+	if err != nil {
+		return err
+	}
+	if man, err := manifest.FromBlob(srcManifest, srcManifestType); err == nil {
+		if manifestLayerInfos := man.LayerInfos(); len(manifestLayerInfos) == numLayers {
+			for i, info := range manifestLayerInfos {
+				emptyLayers[i] = info.EmptyLayer
+			}
+		}
+	}
+
+	// Destinations which can create layers from parts of their blobs need the expected DiffIDs to verify the result.
+	expectedDiffIDs := make([]digest.Digest, numLayers)
+	if ic.canPullPartially(srcInfos) {
+		if config, err := ic.src.OCIConfig(ctx); err == nil && len(config.RootFS.DiffIDs) == numLayers {
+			copy(expectedDiffIDs, config.RootFS.DiffIDs)
+		}
+	}
+
 	data := make([]copyLayerData, numLayers)
 	copyLayerHelper := func(index int, srcLayer types.BlobInfo, toEncrypt bool, pool *mpb.Progress) {
 		defer copySemaphore.Release(1)
@@ -915,7 +1038,13 @@ func (ic *imageCopier) copyLayers(ctx context.Context) error {
 				logrus.Debugf("Skipping foreign layer %q copy to %s", cld.destInfo.Digest, ic.c.dest.Reference().Transport().Name())
 			}
 		} else {
-			cld.destInfo, cld.diffID, cld.err = ic.copyLayer(ctx, srcLayer, toEncrypt, pool)
+			// Layer indices are ambiguous when several instances of a list are copied to the same destination,
+			// so destinations processing layers in order only get them when copying a single image.
+			var layerIndex *int
+			if ic.targetInstance == nil {
+				layerIndex = &index
+			}
+			cld.destInfo, cld.diffID, cld.err = ic.copyLayer(ctx, srcLayer, toEncrypt, pool, layerIndex, emptyLayers[index], expectedDiffIDs[index])
 		}
 		data[index] = cld
 	}
@@ -963,13 +1092,24 @@ func (ic *imageCopier) copyLayers(ctx context.Context) error {
 
 	destInfos := make([]types.BlobInfo, numLayers)
 	diffIDs := make([]digest.Digest, numLayers)
+	verificationFailed := false
 	for i, cld := range data {
 		if cld.err != nil {
-			return cld.err
+			if ic.c.verification == nil {
+				return cld.err
+			}
+			ic.c.verification.record(ic.targetInstance, srcInfos[i].Digest, cld.err)
+			verificationFailed = true
+			continue
 		}
 		destInfos[i] = cld.destInfo
 		diffIDs[i] = cld.diffID
 	}
+	if ic.c.verification != nil {
+		if !ic.verifyDiffIDs(ctx, srcInfos, diffIDs) || verificationFailed {
+			return errVerificationFailed
+		}
+	}
 
 	// WARNING: If you are adding new reasons to change ic.manifestUpdates, also update the
 	// OptimizeDestinationImageAlreadyExists short-circuit conditions
@@ -1111,7 +1251,7 @@ func (c *copier) copyConfig(ctx context.Context, src types.Image) error {
 			progressPool, progressCleanup := c.newProgressPool(ctx)
 			defer progressCleanup()
 			bar := c.createProgressBar(progressPool, srcInfo, "config", "done")
-			destInfo, err := c.copyBlobFromStream(ctx, bytes.NewReader(configBlob), srcInfo, nil, false, true, false, bar)
+			destInfo, err := c.copyBlobFromStream(ctx, bytes.NewReader(configBlob), srcInfo, nil, false, true, false, bar, nil, false)
 			if err != nil {
 				return types.BlobInfo{}, err
 			}
@@ -1136,37 +1276,95 @@ type diffIDResult struct {
 }
 
 // copyLayer copies a layer with srcInfo (with known Digest and Annotations and possibly known Size) in src to dest, perhaps (de/re/)compressing it,
-// and returns a complete blobInfo of the copied layer, and a value for LayerDiffIDs if diffIDIsNeeded
-func (ic *imageCopier) copyLayer(ctx context.Context, srcInfo types.BlobInfo, toEncrypt bool, pool *mpb.Progress) (types.BlobInfo, digest.Digest, error) {
-	cachedDiffID := ic.c.blobInfoCache.UncompressedDigest(srcInfo.Digest) // May be ""
-	// Diffs are needed if we are encrypting an image or trying to decrypt an image
-	diffIDIsNeeded := ic.diffIDsAreNeeded && cachedDiffID == "" || toEncrypt || (isOciEncrypted(srcInfo.MediaType) && ic.c.ociDecryptConfig != nil)
-
-	// If we already have the blob, and we don't need to compute the diffID, then we don't need to read it from the source.
-	if !diffIDIsNeeded {
-		// TODO: at this point we don't know whether or not a blob we end up reusing is compressed using an algorithm
-		// that is acceptable for use on layers in the manifest that we'll be writing later, so if we end up reusing
-		// a blob that's compressed with e.g. zstd, but we're only allowed to write a v2s2 manifest, this will cause
-		// a failure when we eventually try to update the manifest with the digest and MIME type of the reused blob.
-		// Fixing that will probably require passing more information to TryReusingBlob() than the current version of
-		// the ImageDestination interface lets us pass in.
-		reused, blobInfo, err := ic.c.dest.TryReusingBlob(ctx, srcInfo, ic.c.blobInfoCache, ic.canSubstituteBlobs)
-		if err != nil {
-			return types.BlobInfo{}, "", errors.Wrapf(err, "Error trying to reuse blob %s at destination", srcInfo.Digest)
-		}
-		if reused {
-			logrus.Debugf("Skipping blob %s (already present):", srcInfo.Digest)
-			bar := ic.c.createProgressBar(pool, srcInfo, "blob", "skipped: already exists")
-			bar.SetTotal(0, true)
-
-			// Throw an event that the layer has been skipped
-			if ic.c.progress != nil && ic.c.progressInterval > 0 {
-				ic.c.progress <- types.ProgressProperties{
-					Event:    types.ProgressEventSkipped,
-					Artifact: srcInfo,
+// and returns a complete blobInfo of the copied layer, and a value for LayerDiffIDs if diffIDIsNeeded.
+// layerIndex is the index of the layer in ic.src.LayerInfos(), or nil if it should not be passed to the destination,
+// and emptyLayer is true if it is an “empty”/“throwaway” layer.
+// expectedDiffID is the layer's DiffID according to the image's config, if a partial pull may be attempted, or "".
+func (ic *imageCopier) copyLayer(ctx context.Context, srcInfo types.BlobInfo, toEncrypt bool, pool *mpb.Progress, layerIndex *int, emptyLayer bool, expectedDiffID digest.Digest) (types.BlobInfo, digest.Digest, error) {
+	var cachedDiffID digest.Digest
+	var diffIDIsNeeded bool
+	for {
+		cachedDiffID = ic.c.blobInfoCache.UncompressedDigest(srcInfo.Digest) // May be ""
+		// Diffs are needed if we are encrypting an image or trying to decrypt an image
+		diffIDIsNeeded = ic.diffIDsAreNeeded && cachedDiffID == "" || toEncrypt || (isOciEncrypted(srcInfo.MediaType) && ic.c.ociDecryptConfig != nil)
+		// VerifyImage always computes DiffIDs, unless they can't be computed because the layer is encrypted.
+		if ic.c.verification != nil && (!isOciEncrypted(srcInfo.MediaType) || ic.c.ociDecryptConfig != nil) {
+			diffIDIsNeeded = true
+		}
+
+		// If we already have the blob, and we don't need to compute the diffID, then we don't need to read it from the source.
+		if !diffIDIsNeeded {
+			// TODO: at this point we don't know whether or not a blob we end up reusing is compressed using an algorithm
+			// that is acceptable for use on layers in the manifest that we'll be writing later, so if we end up reusing
+			// a blob that's compressed with e.g. zstd, but we're only allowed to write a v2s2 manifest, this will cause
+			// a failure when we eventually try to update the manifest with the digest and MIME type of the reused blob.
+			// Fixing that will probably require passing more information to TryReusingBlob() than the current version of
+			// the ImageDestination interface lets us pass in.
+			var reused bool
+			var blobInfo types.BlobInfo
+			var err error
+			if dest, ok := ic.c.dest.(internalTypes.ImageDestinationWithOptions); ok {
+				reused, blobInfo, err = dest.TryReusingBlobWithOptions(ctx, srcInfo, internalTypes.TryReusingBlobOptions{
+					Cache:         ic.c.blobInfoCache,
+					CanSubstitute: ic.canSubstituteBlobs,
+					EmptyLayer:    emptyLayer,
+					LayerIndex:    layerIndex,
+				})
+			} else {
+				reused, blobInfo, err = ic.c.dest.TryReusingBlob(ctx, srcInfo, ic.c.blobInfoCache, ic.canSubstituteBlobs)
+			}
+			if err != nil {
+				return types.BlobInfo{}, "", errors.Wrapf(err, "Error trying to reuse blob %s at destination", srcInfo.Digest)
+			}
+			if reused {
+				logrus.Debugf("Skipping blob %s (already present):", srcInfo.Digest)
+				bar := ic.c.createProgressBar(pool, srcInfo, "blob", "skipped: already exists")
+				bar.SetTotal(0, true)
+
+				// Throw an event that the layer has been skipped
+				if ic.c.progress != nil && ic.c.progressInterval > 0 {
+					ic.c.progress <- types.ProgressProperties{
+						Event:    types.ProgressEventSkipped,
+						Artifact: srcInfo,
+					}
 				}
+				return blobInfo, cachedDiffID, nil
 			}
-			return blobInfo, cachedDiffID, nil
+		}
+
+		if ic.c.downloadDeduplicator == nil {
+			break
+		}
+		wait, downloadDone := ic.c.downloadDeduplicator.startDownload(ic.c.srcDownloadScope, srcInfo.Digest)
+		if wait == nil {
+			defer downloadDone()
+			break
+		}
+		// Another copy is downloading the same blob; wait for it, and then try reusing the blob again.
+		logrus.Debugf("Waiting for a concurrent download of blob %s", srcInfo.Digest)
+		select {
+		case <-ctx.Done():
+			return types.BlobInfo{}, "", ctx.Err()
+		case <-wait:
+		}
+	}
+
+	releaseDownload, err := ic.c.transferLimiter.acquireDownload(ctx, ic.c.srcLimiterKey)
+	if err != nil {
+		return types.BlobInfo{}, "", err
+	}
+	defer releaseDownload()
+
+	// A destination which can create the layer from parts of the blob may not need to download all of it.
+	var bar *mpb.Bar
+	if expectedDiffID != "" && !toEncrypt && layerMayBeChunked(srcInfo.MediaType) {
+		bar = ic.c.createProgressBar(pool, srcInfo, "blob", "done")
+		blobInfo, pulled, err := ic.copyLayerPartially(ctx, srcInfo, bar, layerIndex, emptyLayer, expectedDiffID)
+		if err != nil {
+			return types.BlobInfo{}, "", err
+		}
+		if pulled {
+			return blobInfo, expectedDiffID, nil
 		}
 	}
 
@@ -1177,9 +1375,11 @@ func (ic *imageCopier) copyLayer(ctx context.Context, srcInfo types.BlobInfo, to
 	}
 	defer srcStream.Close()
 
-	bar := ic.c.createProgressBar(pool, srcInfo, "blob", "done")
+	if bar == nil {
+		bar = ic.c.createProgressBar(pool, srcInfo, "blob", "done")
+	}
 
-	blobInfo, diffIDChan, err := ic.copyLayerFromStream(ctx, srcStream, types.BlobInfo{Digest: srcInfo.Digest, Size: srcBlobSize, MediaType: srcInfo.MediaType, Annotations: srcInfo.Annotations}, diffIDIsNeeded, toEncrypt, bar)
+	blobInfo, diffIDChan, err := ic.copyLayerFromStream(ctx, srcStream, types.BlobInfo{Digest: srcInfo.Digest, Size: srcBlobSize, MediaType: srcInfo.MediaType, Annotations: srcInfo.Annotations}, diffIDIsNeeded, toEncrypt, bar, layerIndex, emptyLayer)
 	if err != nil {
 		return types.BlobInfo{}, "", err
 	}
@@ -1205,12 +1405,110 @@ func (ic *imageCopier) copyLayer(ctx context.Context, srcInfo types.BlobInfo, to
 	return blobInfo, diffID, nil
 }
 
+// canPullPartially returns true if the destination may be able to create some of the layers in srcInfos from parts of
+// their blobs in the source.
+func (ic *imageCopier) canPullPartially(srcInfos []types.BlobInfo) bool {
+	if _, ok := ic.c.dest.(internalTypes.ImageDestinationPartial); !ok {
+		return false
+	}
+	if _, ok := ic.c.rawSource.(internalTypes.BlobChunkAccessor); !ok {
+		return false
+	}
+	// VerifyImage, and encryption or decryption, need to read all of every layer.
+	if ic.c.verification != nil || ic.ociEncryptLayers != nil || ic.c.ociDecryptConfig != nil {
+		return false
+	}
+	for _, srcInfo := range srcInfos {
+		if layerMayBeChunked(srcInfo.MediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// layerMayBeChunked returns true if a layer blob with mediaType may be in the pkg/chunked format, which is only
+// used for zstd-compressed layers; other blobs are not worth probing for it.
+func layerMayBeChunked(mediaType string) bool {
+	return mediaType == imgspecv1.MediaTypeImageLayerZstd || mediaType == imgspecv1.MediaTypeImageLayerNonDistributableZstd
+}
+
+// copyLayerPartially is an implementation detail of copyLayer; it asks the destination to create the layer with srcInfo
+// using only the parts of the blob it needs, and returns a complete blobInfo of the copied layer and true if it did so,
+// or false if the caller should download the whole blob instead.
+func (ic *imageCopier) copyLayerPartially(ctx context.Context, srcInfo types.BlobInfo, bar *mpb.Bar, layerIndex *int, emptyLayer bool, expectedDiffID digest.Digest) (types.BlobInfo, bool, error) {
+	dest, ok := ic.c.dest.(internalTypes.ImageDestinationPartial)
+	if !ok {
+		return types.BlobInfo{}, false, nil
+	}
+	chunkAccessor, ok := ic.c.rawSource.(internalTypes.BlobChunkAccessor)
+	if !ok {
+		return types.BlobInfo{}, false, nil
+	}
+	blobInfo, err := dest.PutBlobPartial(ctx, &progressBlobChunkAccessor{c: ic.c, wrapped: chunkAccessor, bar: bar}, srcInfo, internalTypes.PutBlobPartialOptions{
+		Cache:      ic.c.blobInfoCache,
+		EmptyLayer: emptyLayer,
+		LayerIndex: layerIndex,
+		DiffID:     expectedDiffID,
+	})
+	if err != nil {
+		if errors.Cause(err) == internalTypes.ErrFallbackToOrdinaryLayerDownload {
+			logrus.Debugf("Falling back to downloading all of blob %s", srcInfo.Digest)
+			bar.SetCurrent(0)
+			return types.BlobInfo{}, false, nil
+		}
+		return types.BlobInfo{}, false, errors.Wrapf(err, "Error copying parts of blob %s", srcInfo.Digest)
+	}
+	logrus.Debugf("Copied blob %s partially", srcInfo.Digest)
+	bar.SetTotal(srcInfo.Size, true)
+	return blobInfo, true, nil
+}
+
+// progressBlobChunkAccessor wraps a BlobChunkAccessor, throttling reads and reporting the progress of a partial pull.
+type progressBlobChunkAccessor struct {
+	c       *copier
+	wrapped internalTypes.BlobChunkAccessor
+	bar     *mpb.Bar
+}
+
+// GetBlobAt implements internalTypes.BlobChunkAccessor.
+func (a *progressBlobChunkAccessor) GetBlobAt(ctx context.Context, info types.BlobInfo, chunks []internalTypes.ImageSourceChunk) (io.ReadCloser, error) {
+	stream, err := a.wrapped.GetBlobAt(ctx, info, chunks)
+	if err != nil {
+		return nil, err
+	}
+	return &progressReadCloser{
+		reader: a.c.readBandwidth.newReader(ctx, stream),
+		closer: stream,
+		bar:    a.bar,
+	}, nil
+}
+
+// progressReadCloser is an io.ReadCloser which counts the data read in a progress bar; unlike mpb.Bar.ProxyReader,
+// it does not complete the bar at the end of the stream.
+type progressReadCloser struct {
+	reader io.Reader
+	closer io.Closer
+	bar    *mpb.Bar
+}
+
+// Read implements io.Reader.
+func (r *progressReadCloser) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.bar.IncrBy(n)
+	return n, err
+}
+
+// Close implements io.Closer.
+func (r *progressReadCloser) Close() error {
+	return r.closer.Close()
+}
+
 // copyLayerFromStream is an implementation detail of copyLayer; mostly providing a separate “defer” scope.
 // it copies a blob with srcInfo (with known Digest and Annotations and possibly known Size) from srcStream to dest,
 // perhaps (de/re/)compressing the stream,
 // and returns a complete blobInfo of the copied blob and perhaps a <-chan diffIDResult if diffIDIsNeeded, to be read by the caller.
 func (ic *imageCopier) copyLayerFromStream(ctx context.Context, srcStream io.Reader, srcInfo types.BlobInfo,
-	diffIDIsNeeded bool, toEncrypt bool, bar *mpb.Bar) (types.BlobInfo, <-chan diffIDResult, error) {
+	diffIDIsNeeded bool, toEncrypt bool, bar *mpb.Bar, layerIndex *int, emptyLayer bool) (types.BlobInfo, <-chan diffIDResult, error) {
 	var getDiffIDRecorder func(compression.DecompressorFunc) io.Writer // = nil
 	var diffIDChan chan diffIDResult
 
@@ -1235,7 +1533,7 @@ func (ic *imageCopier) copyLayerFromStream(ctx context.Context, srcStream io.Rea
 		}
 	}
 
-	blobInfo, err := ic.c.copyBlobFromStream(ctx, srcStream, srcInfo, getDiffIDRecorder, ic.canModifyManifest, false, toEncrypt, bar) // Sets err to nil on success
+	blobInfo, err := ic.c.copyBlobFromStream(ctx, srcStream, srcInfo, getDiffIDRecorder, ic.canModifyManifest, false, toEncrypt, bar, layerIndex, emptyLayer) // Sets err to nil on success
 	return blobInfo, diffIDChan, err
 	// We need the defer … pipeWriter.CloseWithError() to happen HERE so that the caller can block on reading from diffIDChan
 }
@@ -1285,9 +1583,10 @@ func (r errorAnnotationReader) Read(b []byte) (n int, err error) {
 // perhaps sending a copy to an io.Writer if getOriginalLayerCopyWriter != nil,
 // perhaps (de/re/)compressing it if canModifyBlob,
 // and returns a complete blobInfo of the copied blob.
+// layerIndex is the index of the layer in the source image's LayerInfos(), or nil if the blob is not a layer.
 func (c *copier) copyBlobFromStream(ctx context.Context, srcStream io.Reader, srcInfo types.BlobInfo,
 	getOriginalLayerCopyWriter func(decompressor compression.DecompressorFunc) io.Writer,
-	canModifyBlob bool, isConfig bool, toEncrypt bool, bar *mpb.Bar) (types.BlobInfo, error) {
+	canModifyBlob bool, isConfig bool, toEncrypt bool, bar *mpb.Bar, layerIndex *int, emptyLayer bool) (types.BlobInfo, error) {
 	if isConfig { // This is guaranteed by the caller, but set it here to be explicit.
 		canModifyBlob = false
 	}
@@ -1295,6 +1594,9 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcStream io.Reader, sr
 	// The copying happens through a pipeline of connected io.Readers.
 	// === Input: srcStream
 
+	// === Throttle reading from the source, if required.
+	srcStream = c.readBandwidth.newReader(ctx, srcStream)
+
 	// === Process input through digestingReader to validate against the expected digest.
 	// Be paranoid; in case PutBlob somehow managed to ignore an error from digestingReader,
 	// use a separate validation failure indicator.
@@ -1474,8 +1776,27 @@ func (c *copier) copyBlobFromStream(ctx context.Context, srcStream io.Reader, sr
 		destStream = progressReader
 	}
 
+	// === Throttle writing to the destination, if required.
+	destStream = c.writeBandwidth.newReader(ctx, destStream)
+
 	// === Finally, send the layer stream to dest.
-	uploadedInfo, err := c.dest.PutBlob(ctx, &errorAnnotationReader{destStream}, inputInfo, c.blobInfoCache, isConfig)
+	// Uploads only wait for a slot while possibly holding a download slot, never the other way around, so this can't deadlock.
+	releaseUpload, err := c.transferLimiter.acquireUpload(ctx, c.destLimiterKey)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	var uploadedInfo types.BlobInfo
+	if dest, ok := c.dest.(internalTypes.ImageDestinationWithOptions); ok {
+		uploadedInfo, err = dest.PutBlobWithOptions(ctx, &errorAnnotationReader{destStream}, inputInfo, internalTypes.PutBlobOptions{
+			Cache:      c.blobInfoCache,
+			IsConfig:   isConfig,
+			EmptyLayer: emptyLayer,
+			LayerIndex: layerIndex,
+		})
+	} else {
+		uploadedInfo, err = c.dest.PutBlob(ctx, &errorAnnotationReader{destStream}, inputInfo, c.blobInfoCache, isConfig)
+	}
+	releaseUpload()
 	if err != nil {
 		return types.BlobInfo{}, errors.Wrap(err, "Error writing blob")
 	}
@@ -7,8 +7,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/pkg/compression"
 	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -142,3 +144,20 @@ func TestComputeDiffID(t *testing.T) {
 	_, err = computeDiffID(reader, nil)
 	assert.Error(t, err)
 }
+
+func TestLayerMayBeChunked(t *testing.T) {
+	for _, c := range []struct {
+		mediaType string
+		expected  bool
+	}{
+		{imgspecv1.MediaTypeImageLayerZstd, true},
+		{imgspecv1.MediaTypeImageLayerNonDistributableZstd, true},
+		{imgspecv1.MediaTypeImageLayerZstd + "+encrypted", false},
+		{imgspecv1.MediaTypeImageLayerGzip, false},
+		{imgspecv1.MediaTypeImageLayer, false},
+		{manifest.DockerV2Schema2LayerMediaType, false},
+		{"", false},
+	} {
+		assert.Equal(t, c.expected, layerMayBeChunked(c.mediaType), c.mediaType)
+	}
+}
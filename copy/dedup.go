@@ -0,0 +1,64 @@
+package copy
+
+import (
+	"sync"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// BlobDownloadDeduplicator detects concurrent downloads of the same blob from the same source scope
+// across all copy.Image calls which share it via Options.BlobDownloadDeduplicator.
+// Only one of the concurrent downloads proceeds; the others wait for it to finish, and then
+// try to reuse the blob at their destination using TryReusingBlob, downloading it themselves only if that fails.
+// A single BlobDownloadDeduplicator is safe for concurrent use, and is typically created once per process.
+type BlobDownloadDeduplicator struct {
+	mutex      sync.Mutex // Protects inProgress
+	inProgress map[blobDownloadKey]chan struct{}
+}
+
+// blobDownloadKey identifies a blob download for BlobDownloadDeduplicator.
+type blobDownloadKey struct {
+	scope  string
+	digest digest.Digest
+}
+
+// NewBlobDownloadDeduplicator returns a new BlobDownloadDeduplicator.
+func NewBlobDownloadDeduplicator() *BlobDownloadDeduplicator {
+	return &BlobDownloadDeduplicator{
+		inProgress: map[blobDownloadKey]chan struct{}{},
+	}
+}
+
+// blobDownloadScope returns the scope within which blobs of ref are considered identical by BlobDownloadDeduplicator.
+// References with a Docker reference are scoped to the repository, without a tag or digest;
+// other references are scoped to the whole reference.
+func blobDownloadScope(ref types.ImageReference) string {
+	if named := ref.DockerReference(); named != nil {
+		return ref.Transport().Name() + ":" + reference.TrimNamed(named).String()
+	}
+	return ref.Transport().Name() + ":" + ref.StringWithinTransport()
+}
+
+// startDownload registers a download of blobDigest from scope.
+// If no other download of the same blob is in progress, it returns (nil, done), and the caller must call done() after
+// the download is finished (successfully or not).
+// Otherwise it returns (wait, nil), and wait is closed when the other download is finished; the caller can then
+// try to reuse the blob, or call startDownload again.
+func (d *BlobDownloadDeduplicator) startDownload(scope string, blobDigest digest.Digest) (<-chan struct{}, func()) {
+	key := blobDownloadKey{scope: scope, digest: blobDigest}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if wait, ok := d.inProgress[key]; ok {
+		return wait, nil
+	}
+	ch := make(chan struct{})
+	d.inProgress[key] = ch
+	return nil, func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		delete(d.inProgress, key)
+		close(ch)
+	}
+}
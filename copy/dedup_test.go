@@ -0,0 +1,60 @@
+package copy
+
+import (
+	"testing"
+
+	"github.com/containers/image/v5/docker"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobDownloadScope(t *testing.T) {
+	ref1, err := docker.ParseReference("//quay.io/example/image:latest")
+	require.NoError(t, err)
+	ref2, err := docker.ParseReference("//quay.io/example/image:other")
+	require.NoError(t, err)
+	ref3, err := docker.ParseReference("//quay.io/example/other:latest")
+	require.NoError(t, err)
+	assert.Equal(t, "docker:quay.io/example/image", blobDownloadScope(ref1))
+	assert.Equal(t, blobDownloadScope(ref1), blobDownloadScope(ref2))
+	assert.NotEqual(t, blobDownloadScope(ref1), blobDownloadScope(ref3))
+}
+
+func TestBlobDownloadDeduplicatorStartDownload(t *testing.T) {
+	const d1 = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000001")
+	const d2 = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000002")
+	d := NewBlobDownloadDeduplicator()
+
+	wait, done := d.startDownload("a", d1)
+	assert.Nil(t, wait)
+	require.NotNil(t, done)
+
+	// A concurrent download of the same blob must wait
+	wait2, done2 := d.startDownload("a", d1)
+	require.NotNil(t, wait2)
+	assert.Nil(t, done2)
+	select {
+	case <-wait2:
+		t.Fatal("wait channel closed before the download finished")
+	default:
+	}
+
+	// Other blobs, or the same blob in other scopes, are independent
+	wait3, done3 := d.startDownload("a", d2)
+	assert.Nil(t, wait3)
+	require.NotNil(t, done3)
+	wait4, done4 := d.startDownload("b", d1)
+	assert.Nil(t, wait4)
+	require.NotNil(t, done4)
+
+	done()
+	<-wait2 // Must not block
+	// The download can be started again
+	wait5, done5 := d.startDownload("a", d1)
+	assert.Nil(t, wait5)
+	require.NotNil(t, done5)
+	done5()
+	done3()
+	done4()
+}
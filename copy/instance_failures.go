@@ -0,0 +1,101 @@
+package copy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// AbortOnInstanceError is the default value which, when set in
+	// Options.InstanceErrorHandling, indicates that a failure to copy any
+	// single instance of a manifest list aborts the whole copy.
+	AbortOnInstanceError InstanceErrorHandling = iota
+	// SkipFailedInstances is a value which, when set in
+	// Options.InstanceErrorHandling, indicates that instances of a manifest
+	// list which fail to copy are recorded and omitted from the list written
+	// to the destination, while the remaining instances are copied as usual.
+	// Omitting instances changes the list, so this fails if the list is signed
+	// and the signatures are not removed.
+	SkipFailedInstances
+	// KeepFailedInstances is a value which, when set in
+	// Options.InstanceErrorHandling, indicates that instances of a manifest
+	// list which fail to copy are recorded, but the entries for them in the
+	// list written to the destination are kept unchanged (and refer to
+	// manifests which may not exist at the destination).
+	KeepFailedInstances
+)
+
+// InstanceErrorHandling is one of AbortOnInstanceError, SkipFailedInstances,
+// or KeepFailedInstances, to control whether copy.Image aborts when copying
+// an instance of a manifest list fails, or continues with the other instances.
+type InstanceErrorHandling int
+
+// validateInstanceErrorHandling returns an error if the passed-in value is not one that we recognize as a valid InstanceErrorHandling value
+func validateInstanceErrorHandling(handling InstanceErrorHandling) error {
+	switch handling {
+	case AbortOnInstanceError, SkipFailedInstances, KeepFailedInstances:
+		return nil
+	default:
+		return errors.Errorf("Invalid value for options.InstanceErrorHandling: %d", handling)
+	}
+}
+
+// InstanceCopyFailure records a failure to copy a single instance of a manifest list.
+type InstanceCopyFailure struct {
+	Instance digest.Digest // The digest of the instance in the source list
+	Err      error
+}
+
+// PartialListCopyError is returned by copy.Image, along with the manifest list
+// which was written, if Options.InstanceErrorHandling allowed some instances of a
+// manifest list to fail to copy while the rest of the list was copied successfully.
+type PartialListCopyError struct {
+	Failures []InstanceCopyFailure
+	// Omitted is true if the failed instances were removed from the list written
+	// to the destination, false if their entries were kept unchanged.
+	Omitted bool
+}
+
+func (e PartialListCopyError) Error() string {
+	failures := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		failures[i] = fmt.Sprintf("%s: %v", f.Instance, f.Err)
+	}
+	action := "kept in"
+	if e.Omitted {
+		action = "omitted from"
+	}
+	return fmt.Sprintf("Error copying %d instance(s) of the manifest list, %s the list written to the destination: %s",
+		len(e.Failures), action, strings.Join(failures, "; "))
+}
+
+// removeListInstances returns a copy of list without the instances in toRemove.
+func removeListInstances(list manifest.List, toRemove map[digest.Digest]struct{}) (manifest.List, error) {
+	switch l := list.Clone().(type) {
+	case *manifest.Schema2List:
+		kept := []manifest.Schema2ManifestDescriptor{}
+		for _, m := range l.Manifests {
+			if _, ok := toRemove[m.Digest]; !ok {
+				kept = append(kept, m)
+			}
+		}
+		l.Manifests = kept
+		return l, nil
+	case *manifest.OCI1Index:
+		kept := []imgspecv1.Descriptor{}
+		for _, m := range l.Manifests {
+			if _, ok := toRemove[m.Digest]; !ok {
+				kept = append(kept, m)
+			}
+		}
+		l.Manifests = kept
+		return l, nil
+	default:
+		return nil, errors.Errorf("Internal error: removing instances from manifest list type %q is not supported", list.MIMEType())
+	}
+}
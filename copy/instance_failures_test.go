@@ -0,0 +1,168 @@
+package copy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/directory"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateInstanceErrorHandling(t *testing.T) {
+	for _, h := range []InstanceErrorHandling{AbortOnInstanceError, SkipFailedInstances, KeepFailedInstances} {
+		assert.NoError(t, validateInstanceErrorHandling(h))
+	}
+	assert.Error(t, validateInstanceErrorHandling(InstanceErrorHandling(42)))
+}
+
+func TestPartialListCopyErrorError(t *testing.T) {
+	e := PartialListCopyError{
+		Failures: []InstanceCopyFailure{
+			{Instance: "sha256:0000000000000000000000000000000000000000000000000000000000000001", Err: errors.New("blob unknown")},
+		},
+		Omitted: true,
+	}
+	assert.Contains(t, e.Error(), "omitted from")
+	assert.Contains(t, e.Error(), "sha256:0000000000000000000000000000000000000000000000000000000000000001: blob unknown")
+	e.Omitted = false
+	assert.Contains(t, e.Error(), "kept in")
+}
+
+func TestRemoveListInstances(t *testing.T) {
+	for _, fixture := range []string{"v2list.manifest.json", "ociv1.image.index.json"} {
+		blob, err := ioutil.ReadFile(filepath.Join("..", "manifest", "fixtures", fixture))
+		require.NoError(t, err)
+		list, err := manifest.ListFromBlob(blob, manifest.GuessMIMEType(blob))
+		require.NoError(t, err, fixture)
+		instances := list.Instances()
+		require.True(t, len(instances) >= 2, fixture)
+
+		updated, err := removeListInstances(list, map[digest.Digest]struct{}{instances[0]: {}})
+		require.NoError(t, err, fixture)
+		assert.Equal(t, instances[1:], updated.Instances(), fixture)
+		assert.Equal(t, instances, list.Instances(), fixture) // The original is not modified
+
+		updated, err = removeListInstances(list, map[digest.Digest]struct{}{})
+		require.NoError(t, err, fixture)
+		assert.Equal(t, instances, updated.Instances(), fixture)
+	}
+}
+
+// makeTestDirList creates a dir: image with a manifest list of instances for each of archs, each with a single layer,
+// and returns the directory, the instance digests, and the layer digests.
+func makeTestDirList(t *testing.T, archs []string) (string, []digest.Digest, []digest.Digest) {
+	dir, err := ioutil.TempDir("", "instance-failures-test")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "version"), []byte("Directory Transport Version: 1.1\n"), 0644)
+	require.NoError(t, err)
+
+	instances := []manifest.Schema2ManifestDescriptor{}
+	instanceDigests := []digest.Digest{}
+	layerDigests := []digest.Digest{}
+	for _, arch := range archs {
+		layer, diffID := makeTestLayer(t, "layer for "+arch)
+		layerDigest := writeBlob(t, dir, layer)
+		config, err := json.Marshal(imgspecv1.Image{
+			Architecture: arch,
+			OS:           "linux",
+			RootFS:       imgspecv1.RootFS{Type: "layers", DiffIDs: []digest.Digest{diffID}},
+		})
+		require.NoError(t, err)
+		configDigest := writeBlob(t, dir, config)
+		m := manifest.Schema2FromComponents(manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2ConfigMediaType, Size: int64(len(config)), Digest: configDigest},
+			[]manifest.Schema2Descriptor{{MediaType: manifest.DockerV2Schema2LayerMediaType, Size: int64(len(layer)), Digest: layerDigest}})
+		manifestBlob, err := m.Serialize()
+		require.NoError(t, err)
+		instanceDigest := digest.FromBytes(manifestBlob)
+		err = ioutil.WriteFile(filepath.Join(dir, instanceDigest.Encoded()+".manifest.json"), manifestBlob, 0644)
+		require.NoError(t, err)
+		instances = append(instances, manifest.Schema2ManifestDescriptor{
+			Schema2Descriptor: manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2MediaType, Size: int64(len(manifestBlob)), Digest: instanceDigest},
+			Platform:          manifest.Schema2PlatformSpec{Architecture: arch, OS: "linux"},
+		})
+		instanceDigests = append(instanceDigests, instanceDigest)
+		layerDigests = append(layerDigests, layerDigest)
+	}
+	listBlob, err := manifest.Schema2ListFromComponents(instances).Serialize()
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "manifest.json"), listBlob, 0644)
+	require.NoError(t, err)
+	return dir, instanceDigests, layerDigests
+}
+
+func TestCopyMultipleImagesWithFailedInstance(t *testing.T) {
+	ctx := context.Background()
+	policyContext, err := signature.NewPolicyContext(&signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}})
+	require.NoError(t, err)
+	defer func() { _ = policyContext.Destroy() }()
+
+	srcDir, instances, layers := makeTestDirList(t, []string{"amd64", "arm64", "ppc64le"})
+	defer os.RemoveAll(srcDir)
+	// The second instance fails to copy because its layer does not match its digest.
+	err = ioutil.WriteFile(filepath.Join(srcDir, layers[1].Encoded()), []byte("corrupt"), 0644)
+	require.NoError(t, err)
+	srcRef, err := directory.NewReference(srcDir)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		handling          InstanceErrorHandling
+		expectedInstances []digest.Digest // nil if the copy is expected to fail as a whole
+	}{
+		{AbortOnInstanceError, nil},
+		{SkipFailedInstances, []digest.Digest{instances[0], instances[2]}},
+		{KeepFailedInstances, instances},
+	} {
+		destDir, err := ioutil.TempDir("", "instance-failures-test-dest")
+		require.NoError(t, err)
+		defer os.RemoveAll(destDir)
+		destRef, err := directory.NewReference(destDir)
+		require.NoError(t, err)
+
+		copiedManifest, err := Image(ctx, policyContext, destRef, srcRef, &Options{
+			ImageListSelection:    CopyAllImages,
+			InstanceErrorHandling: c.handling,
+		})
+		require.Error(t, err, c.handling)
+		partial, isPartial := errors.Cause(err).(PartialListCopyError)
+		if c.expectedInstances == nil {
+			assert.False(t, isPartial, c.handling)
+			assert.Nil(t, copiedManifest, c.handling)
+			_, err = os.Stat(filepath.Join(destDir, "manifest.json"))
+			assert.True(t, os.IsNotExist(err), c.handling)
+			continue
+		}
+
+		require.True(t, isPartial, "%d: %#v", c.handling, err)
+		require.Len(t, partial.Failures, 1, c.handling)
+		assert.Equal(t, instances[1], partial.Failures[0].Instance, c.handling)
+		assert.Error(t, partial.Failures[0].Err, c.handling)
+		assert.Equal(t, c.handling == SkipFailedInstances, partial.Omitted, c.handling)
+
+		// The returned manifest list is the one written to the destination, and lists the expected instances.
+		writtenManifest, err := ioutil.ReadFile(filepath.Join(destDir, "manifest.json"))
+		require.NoError(t, err)
+		assert.Equal(t, writtenManifest, copiedManifest, c.handling)
+		list, err := manifest.ListFromBlob(writtenManifest, manifest.GuessMIMEType(writtenManifest))
+		require.NoError(t, err, c.handling)
+		assert.Equal(t, c.expectedInstances, list.Instances(), c.handling)
+		// The instances which were copied successfully were written, the failed one was not.
+		for i, instance := range instances {
+			_, err := os.Stat(filepath.Join(destDir, instance.Encoded()+".manifest.json"))
+			if i == 1 {
+				assert.True(t, os.IsNotExist(err), c.handling)
+			} else {
+				assert.NoError(t, err, c.handling)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package copy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+)
+
+// TransferLimiter bounds the number of concurrent blob downloads (GetBlob) and uploads (PutBlob)
+// per registry host, across all copy.Image calls which share it via Options.TransferLimiter.
+// A single TransferLimiter is safe for concurrent use, and is typically created once per process.
+//
+// Limits are applied in addition to the per-copy Options.MaxParallelDownloads.
+type TransferLimiter struct {
+	maxDownloads int64
+	maxUploads   int64
+
+	mutex     sync.Mutex // Protects downloads and uploads
+	downloads map[string]*semaphore.Weighted
+	uploads   map[string]*semaphore.Weighted
+}
+
+// NewTransferLimiter returns a TransferLimiter allowing at most maxDownloadsPerHost concurrent downloads
+// and maxUploadsPerHost concurrent uploads from/to a single registry host.
+// A value of 0 means that the respective direction is not limited.
+func NewTransferLimiter(maxDownloadsPerHost, maxUploadsPerHost uint) *TransferLimiter {
+	return &TransferLimiter{
+		maxDownloads: int64(maxDownloadsPerHost),
+		maxUploads:   int64(maxUploadsPerHost),
+		downloads:    map[string]*semaphore.Weighted{},
+		uploads:      map[string]*semaphore.Weighted{},
+	}
+}
+
+// transferLimiterKey returns the key used to group transfers involving ref.
+// References with a Docker reference are grouped by transport and registry host;
+// other references are grouped only by transport.
+func transferLimiterKey(ref types.ImageReference) string {
+	key := ref.Transport().Name()
+	if named := ref.DockerReference(); named != nil {
+		key = key + "/" + reference.Domain(named)
+	}
+	return key
+}
+
+// semaphoreFor returns the semaphore for key in sems, creating it with max weight if necessary.
+func (l *TransferLimiter) semaphoreFor(sems map[string]*semaphore.Weighted, max int64, key string) *semaphore.Weighted {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	sem, ok := sems[key]
+	if !ok {
+		sem = semaphore.NewWeighted(max)
+		sems[key] = sem
+	}
+	return sem
+}
+
+// acquire waits for a slot in sems[key], and returns a function to release it.
+func (l *TransferLimiter) acquire(ctx context.Context, sems map[string]*semaphore.Weighted, max int64, key string) (func(), error) {
+	if max == 0 {
+		return func() {}, nil
+	}
+	sem := l.semaphoreFor(sems, max, key)
+	if err := sem.Acquire(ctx, 1); err != nil {
+		return nil, errors.Wrapf(err, "Error waiting for a transfer slot for %s", key)
+	}
+	return func() { sem.Release(1) }, nil
+}
+
+// acquireDownload waits until a download from the host identified by key may start, and returns a function to call when it is done.
+// It is valid to call this on a nil *TransferLimiter, which does not limit anything.
+func (l *TransferLimiter) acquireDownload(ctx context.Context, key string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	return l.acquire(ctx, l.downloads, l.maxDownloads, key)
+}
+
+// acquireUpload waits until an upload to the host identified by key may start, and returns a function to call when it is done.
+// It is valid to call this on a nil *TransferLimiter, which does not limit anything.
+func (l *TransferLimiter) acquireUpload(ctx context.Context, key string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	return l.acquire(ctx, l.uploads, l.maxUploads, key)
+}
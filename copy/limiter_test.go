@@ -0,0 +1,70 @@
+package copy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/directory"
+	"github.com/containers/image/v5/docker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferLimiterKey(t *testing.T) {
+	ref, err := docker.ParseReference("//quay.io/example/image:latest")
+	require.NoError(t, err)
+	assert.Equal(t, "docker/quay.io", transferLimiterKey(ref))
+
+	ref, err = docker.ParseReference("//busybox")
+	require.NoError(t, err)
+	assert.Equal(t, "docker/docker.io", transferLimiterKey(ref))
+
+	tmpDir, err := ioutil.TempDir("", "limiter-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	ref, err = directory.NewReference(tmpDir)
+	require.NoError(t, err)
+	assert.Equal(t, "dir", transferLimiterKey(ref))
+}
+
+func TestTransferLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	// A nil limiter does not limit anything
+	var nilLimiter *TransferLimiter
+	for i := 0; i < 10; i++ {
+		_, err := nilLimiter.acquireDownload(ctx, "a")
+		require.NoError(t, err)
+		_, err = nilLimiter.acquireUpload(ctx, "a")
+		require.NoError(t, err)
+	}
+
+	l := NewTransferLimiter(2, 0)
+	release1, err := l.acquireDownload(ctx, "a")
+	require.NoError(t, err)
+	release2, err := l.acquireDownload(ctx, "a")
+	require.NoError(t, err)
+
+	// Other keys, and uploads (0 == unlimited), are not affected.
+	_, err = l.acquireDownload(ctx, "b")
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = l.acquireUpload(ctx, "a")
+		require.NoError(t, err)
+	}
+
+	// A third download from "a" must wait.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = l.acquireDownload(timeoutCtx, "a")
+	assert.Error(t, err)
+
+	release1()
+	release3, err := l.acquireDownload(ctx, "a")
+	require.NoError(t, err)
+	release2()
+	release3()
+}
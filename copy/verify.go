@@ -0,0 +1,282 @@
+package copy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// errVerificationFailed is returned by imageCopier.copyLayers in VerifyImage after recording the individual failures.
+var errVerificationFailed = errors.New("Image verification failed")
+
+// VerificationFailure records a single problem found by VerifyImage.
+type VerificationFailure struct {
+	Instance digest.Digest // The instance digest in the source manifest list, or "" for a single image
+	Blob     digest.Digest // The blob which failed verification, or "" if the problem is not specific to a blob
+	Err      error
+}
+
+// VerificationError is returned by VerifyImage if any problems were found.
+type VerificationError struct {
+	Failures []VerificationFailure
+}
+
+func (e VerificationError) Error() string {
+	failures := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		var location []string
+		if f.Instance != "" {
+			location = append(location, fmt.Sprintf("instance %s", f.Instance))
+		}
+		if f.Blob != "" {
+			location = append(location, fmt.Sprintf("blob %s", f.Blob))
+		}
+		if len(location) != 0 {
+			failures[i] = fmt.Sprintf("%s: %v", strings.Join(location, ", "), f.Err)
+		} else {
+			failures[i] = f.Err.Error()
+		}
+	}
+	return fmt.Sprintf("Image verification found %d problem(s): %s", len(e.Failures), strings.Join(failures, "; "))
+}
+
+// verificationResults collects VerificationFailures from possibly concurrent layer copies.
+type verificationResults struct {
+	mutex    sync.Mutex // Protects failures
+	failures []VerificationFailure
+}
+
+// record adds a failure of blob (or "") in instance (or nil) to v.
+func (v *verificationResults) record(instance *digest.Digest, blob digest.Digest, err error) {
+	f := VerificationFailure{Blob: blob, Err: err}
+	if instance != nil {
+		f.Instance = *instance
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.failures = append(v.failures, f)
+}
+
+// hasFailuresForInstance returns true if v contains a failure recorded for instance.
+func (v *verificationResults) hasFailuresForInstance(instance digest.Digest) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, f := range v.failures {
+		if f.Instance == instance {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyImage reads the image at srcRef, using policyContext to validate source image admissibility,
+// and verifies that every layer and the config match their digests, and that the layers’ DiffIDs match the
+// config’s rootfs.diff_ids, without writing anything (not even to the on-disk blob info cache).
+// If options.ImageListSelection is CopyAllImages or CopySpecificImages and srcRef refers to a manifest list,
+// all of the selected instances are verified.
+//
+// Verification continues after finding a problem; if any problems are found, VerifyImage returns a VerificationError
+// listing all of them. Other errors, e.g. failing to access the source at all, are returned as usual.
+// Options which only affect the destination, or signing, are ignored.
+func VerifyImage(ctx context.Context, policyContext *signature.PolicyContext, srcRef types.ImageReference, options *Options) error {
+	opts := Options{}
+	if options != nil {
+		opts = *options
+	}
+	opts.SignBy = ""
+	opts.DestinationCtx = nil
+	opts.ForceManifestMIMEType = ""
+	opts.OciEncryptConfig = nil
+	opts.OciEncryptLayers = nil
+	opts.OptimizeDestinationImageAlreadyExists = false
+	opts.InstanceErrorHandling = KeepFailedInstances
+
+	verification := &verificationResults{}
+	_, err := copyImage(ctx, policyContext, verifyReference{}, srcRef, &opts, verification)
+	if err != nil {
+		partial, ok := errors.Cause(err).(PartialListCopyError)
+		if !ok {
+			if errors.Cause(err) != errVerificationFailed {
+				if len(verification.failures) == 0 {
+					return err
+				}
+				verification.record(nil, "", err)
+			}
+		} else {
+			for _, f := range partial.Failures {
+				if errors.Cause(f.Err) == errVerificationFailed && verification.hasFailuresForInstance(f.Instance) {
+					continue // Already recorded in detail
+				}
+				instance := f.Instance
+				verification.record(&instance, "", f.Err)
+			}
+		}
+	}
+	if len(verification.failures) != 0 {
+		return VerificationError{Failures: verification.failures}
+	}
+	return nil
+}
+
+// verifyDiffIDs compares diffIDs, computed for layers srcInfos, with the rootfs.diff_ids of ic.src’s config,
+// recording any problems in ic.c.verification. It returns false if any problems were found.
+// diffIDs may contain "" entries for layers where the DiffID is not known; those are not compared.
+func (ic *imageCopier) verifyDiffIDs(ctx context.Context, srcInfos []types.BlobInfo, diffIDs []digest.Digest) bool {
+	config, err := ic.src.OCIConfig(ctx)
+	if err != nil {
+		ic.c.verification.record(ic.targetInstance, ic.src.ConfigInfo().Digest, errors.Wrap(err, "Error reading image config"))
+		return false
+	}
+	expected := config.RootFS.DiffIDs
+	if len(expected) == 0 {
+		return true // E.g. schema1 images do not record DiffIDs
+	}
+	if len(expected) != len(diffIDs) {
+		ic.c.verification.record(ic.targetInstance, ic.src.ConfigInfo().Digest, errors.Errorf("Config lists %d layer DiffIDs, but the image has %d layers", len(expected), len(diffIDs)))
+		return false
+	}
+	ok := true
+	for i, diffID := range diffIDs {
+		if diffID != "" && diffID != expected[i] {
+			ic.c.verification.record(ic.targetInstance, srcInfos[i].Digest, errors.Errorf("Layer DiffID %s does not match rootfs.diff_ids entry %s", diffID, expected[i]))
+			ok = false
+		}
+	}
+	return ok
+}
+
+// verifyTransport is the types.ImageTransport of verifyReference.
+type verifyTransport struct{}
+
+func (t verifyTransport) Name() string {
+	return "internal-verify"
+}
+
+func (t verifyTransport) ParseReference(reference string) (types.ImageReference, error) {
+	return nil, errors.New("Internal error: verifyTransport.ParseReference is not supported")
+}
+
+func (t verifyTransport) ValidatePolicyConfigurationScope(scope string) error {
+	return errors.New("Internal error: verifyTransport.ValidatePolicyConfigurationScope is not supported")
+}
+
+// verifyReference is the destination reference used by VerifyImage; it accepts everything and stores nothing.
+type verifyReference struct{}
+
+func (ref verifyReference) Transport() types.ImageTransport {
+	return verifyTransport{}
+}
+
+func (ref verifyReference) StringWithinTransport() string {
+	return ""
+}
+
+func (ref verifyReference) DockerReference() reference.Named {
+	return nil
+}
+
+func (ref verifyReference) PolicyConfigurationIdentity() string {
+	return ""
+}
+
+func (ref verifyReference) PolicyConfigurationNamespaces() []string {
+	return []string{}
+}
+
+func (ref verifyReference) NewImage(ctx context.Context, sys *types.SystemContext) (types.ImageCloser, error) {
+	return nil, errors.New("Internal error: verifyReference.NewImage is not supported")
+}
+
+func (ref verifyReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	return nil, errors.New("Internal error: verifyReference.NewImageSource is not supported")
+}
+
+func (ref verifyReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	return verifyDestination{}, nil
+}
+
+func (ref verifyReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
+	return errors.New("Internal error: verifyReference.DeleteImage is not supported")
+}
+
+// verifyDestination is a types.ImageDestination which reads, and discards, all blobs.
+type verifyDestination struct{}
+
+func (d verifyDestination) Reference() types.ImageReference {
+	return verifyReference{}
+}
+
+func (d verifyDestination) Close() error {
+	return nil
+}
+
+func (d verifyDestination) SupportedManifestMIMETypes() []string {
+	return nil // Anything goes, so that the manifest is never converted.
+}
+
+func (d verifyDestination) SupportsSignatures(ctx context.Context) error {
+	return nil
+}
+
+func (d verifyDestination) DesiredLayerCompression() types.LayerCompression {
+	return types.PreserveOriginal
+}
+
+func (d verifyDestination) AcceptsForeignLayerURLs() bool {
+	return false // Read and verify foreign layers as well.
+}
+
+func (d verifyDestination) MustMatchRuntimeOS() bool {
+	return false
+}
+
+func (d verifyDestination) IgnoresEmbeddedDockerReference() bool {
+	return true
+}
+
+// PutBlob reads all of stream, which makes the caller’s digestingReader validate it, and discards it.
+func (d verifyDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(ioutil.Discard, io.TeeReader(stream, digester.Hash()))
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	if inputInfo.Size != -1 && size != inputInfo.Size {
+		return types.BlobInfo{}, errors.Errorf("Size mismatch when reading blob %s: expected %d, got %d", inputInfo.Digest, inputInfo.Size, size)
+	}
+	blobDigest := inputInfo.Digest
+	if blobDigest == "" {
+		blobDigest = digester.Digest()
+	}
+	return types.BlobInfo{Digest: blobDigest, Size: size}, nil
+}
+
+func (d verifyDestination) HasThreadSafePutBlob() bool {
+	return true
+}
+
+// TryReusingBlob always returns false, so that every blob is read and verified.
+func (d verifyDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	return false, types.BlobInfo{}, nil
+}
+
+func (d verifyDestination) PutManifest(ctx context.Context, manifest []byte, instanceDigest *digest.Digest) error {
+	return nil
+}
+
+func (d verifyDestination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
+	return nil
+}
+
+func (d verifyDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	return nil
+}
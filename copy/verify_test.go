@@ -0,0 +1,146 @@
+package copy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/directory"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeBlob writes contents into dir as a blob in the dir: transport format, and returns its digest.
+func writeBlob(t *testing.T, dir string, contents []byte) digest.Digest {
+	d := digest.FromBytes(contents)
+	err := ioutil.WriteFile(filepath.Join(dir, d.Encoded()), contents, 0644)
+	require.NoError(t, err)
+	return d
+}
+
+// makeTestLayer returns a gzip-compressed layer containing a single file with contents, and its DiffID.
+func makeTestLayer(t *testing.T, contents string) ([]byte, digest.Digest) {
+	tarBuf := bytes.Buffer{}
+	tw := tar.NewWriter(&tarBuf)
+	err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+	require.NoError(t, err)
+	_, err = tw.Write([]byte(contents))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	gzBuf := bytes.Buffer{}
+	gw := gzip.NewWriter(&gzBuf)
+	_, err = gw.Write(tarBuf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return gzBuf.Bytes(), digest.FromBytes(tarBuf.Bytes())
+}
+
+// makeTestDirImage creates a dir: image with two layers, using configDiffIDs (or the correct values, if nil)
+// as rootfs.diff_ids, and returns the directory, the layer digests and the config digest.
+func makeTestDirImage(t *testing.T, configDiffIDs []digest.Digest) (string, []digest.Digest, digest.Digest) {
+	dir, err := ioutil.TempDir("", "verify-test")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "version"), []byte("Directory Transport Version: 1.1\n"), 0644)
+	require.NoError(t, err)
+
+	layerDescriptors := []manifest.Schema2Descriptor{}
+	layerDigests := []digest.Digest{}
+	diffIDs := []digest.Digest{}
+	for _, contents := range []string{"layer 1", "layer 2"} {
+		layer, diffID := makeTestLayer(t, contents)
+		d := writeBlob(t, dir, layer)
+		layerDescriptors = append(layerDescriptors, manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2LayerMediaType, Size: int64(len(layer)), Digest: d})
+		layerDigests = append(layerDigests, d)
+		diffIDs = append(diffIDs, diffID)
+	}
+	if configDiffIDs == nil {
+		configDiffIDs = diffIDs
+	}
+	config, err := json.Marshal(imgspecv1.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       imgspecv1.RootFS{Type: "layers", DiffIDs: configDiffIDs},
+	})
+	require.NoError(t, err)
+	configDigest := writeBlob(t, dir, config)
+
+	m := manifest.Schema2FromComponents(manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2ConfigMediaType, Size: int64(len(config)), Digest: configDigest},
+		layerDescriptors)
+	manifestBlob, err := m.Serialize()
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "manifest.json"), manifestBlob, 0644)
+	require.NoError(t, err)
+	return dir, layerDigests, configDigest
+}
+
+func TestVerifyImage(t *testing.T) {
+	ctx := context.Background()
+	policyContext, err := signature.NewPolicyContext(&signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}})
+	require.NoError(t, err)
+	defer func() { _ = policyContext.Destroy() }()
+
+	// A valid image
+	dir, _, _ := makeTestDirImage(t, nil)
+	defer os.RemoveAll(dir)
+	ref, err := directory.NewReference(dir)
+	require.NoError(t, err)
+	err = VerifyImage(ctx, policyContext, ref, nil)
+	assert.NoError(t, err)
+
+	// Both layers are corrupt; both are reported.
+	dir, layerDigests, _ := makeTestDirImage(t, nil)
+	defer os.RemoveAll(dir)
+	for _, d := range layerDigests {
+		err = ioutil.WriteFile(filepath.Join(dir, d.Encoded()), []byte("corrupt"), 0644)
+		require.NoError(t, err)
+	}
+	ref, err = directory.NewReference(dir)
+	require.NoError(t, err)
+	err = VerifyImage(ctx, policyContext, ref, &Options{})
+	require.Error(t, err)
+	verr, ok := errors.Cause(err).(VerificationError)
+	require.True(t, ok, "%#v", err)
+	require.Len(t, verr.Failures, 2)
+	failedBlobs := []digest.Digest{verr.Failures[0].Blob, verr.Failures[1].Blob}
+	assert.ElementsMatch(t, layerDigests, failedBlobs)
+
+	// The config's rootfs.diff_ids do not match the layers
+	wrongDiffID := digest.FromString("wrong")
+	dir, layerDigests, _ = makeTestDirImage(t, []digest.Digest{wrongDiffID, wrongDiffID})
+	defer os.RemoveAll(dir)
+	ref, err = directory.NewReference(dir)
+	require.NoError(t, err)
+	err = VerifyImage(ctx, policyContext, ref, nil)
+	require.Error(t, err)
+	verr, ok = errors.Cause(err).(VerificationError)
+	require.True(t, ok, "%#v", err)
+	require.Len(t, verr.Failures, 2)
+	failedBlobs = []digest.Digest{verr.Failures[0].Blob, verr.Failures[1].Blob}
+	assert.ElementsMatch(t, layerDigests, failedBlobs)
+
+	// The config is corrupt
+	dir, _, configDigest := makeTestDirImage(t, nil)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, configDigest.Encoded()), []byte("corrupt"), 0644)
+	require.NoError(t, err)
+	ref, err = directory.NewReference(dir)
+	require.NoError(t, err)
+	err = VerifyImage(ctx, policyContext, ref, nil)
+	require.Error(t, err)
+	verr, ok = errors.Cause(err).(VerificationError)
+	require.True(t, ok, "%#v", err)
+	require.Len(t, verr.Failures, 1)
+	assert.Equal(t, configDigest, verr.Failures[0].Blob)
+}
@@ -0,0 +1,52 @@
+package directory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// imageFileNameRegexp matches names of all files this transport writes into an image directory:
+// blobs, manifests and signatures (both for the top-level manifest and for per-instance manifests),
+// the version file, and temporary files left over by an interrupted PutBlob.
+var imageFileNameRegexp = regexp.MustCompile(`^(?:(?:[0-9a-f]{64}|[0-9a-f]{96}|[0-9a-f]{128})(?:\.manifest\.json|\.signature-[1-9][0-9]*)?|manifest\.json|signature-[1-9][0-9]*|version|dir-put-blob[0-9]+)$`)
+
+// deleteImage implements DeleteImage for ref.
+func (ref dirReference) deleteImage() error {
+	contents, err := ioutil.ReadFile(ref.versionPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotContainerImageDir
+		}
+		return err
+	}
+	if string(contents) != version {
+		return ErrNotContainerImageDir
+	}
+
+	files, err := ioutil.ReadDir(ref.resolvedPath)
+	if err != nil {
+		return err
+	}
+	// Check everything first, so that we don't delete anything if the directory contains unexpected data.
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !imageFileNameRegexp.MatchString(file.Name()) {
+			return errors.Wrapf(ErrNotContainerImageDir, "unexpected %q in %q", file.Name(), ref.resolvedPath)
+		}
+	}
+	for _, file := range files {
+		if file.Name() == "version" {
+			continue
+		}
+		logrus.Debugf("Deleting %s from %s", file.Name(), ref.resolvedPath)
+		if err := os.Remove(filepath.Join(ref.resolvedPath, file.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// Remove the version file last, so that the directory is still recognized as an image directory if anything above fails.
+	return os.Remove(ref.versionPath())
+}
@@ -161,8 +161,11 @@ func (ref dirReference) NewImageDestination(ctx context.Context, sys *types.Syst
 }
 
 // DeleteImage deletes the named image from the registry, if supported.
+// Only files written by this transport (the version file, manifests, signatures and blobs) are removed, and the
+// directory itself is left in place; if the directory contains anything else, nothing is deleted and
+// an error wrapping ErrNotContainerImageDir is returned.
 func (ref dirReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
-	return errors.Errorf("Deleting images not implemented for dir: images")
+	return ref.deleteImage()
 }
 
 // manifestPath returns a path for the manifest within a directory using our conventions.
@@ -1,6 +1,7 @@
 package directory
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
 	"os"
@@ -8,8 +9,10 @@ import (
 	"testing"
 
 	_ "github.com/containers/image/v5/internal/testing/explicitfilepath-tmpdir"
+	"github.com/containers/image/v5/pkg/blobinfocache/memory"
 	"github.com/containers/image/v5/types"
 	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -200,11 +203,65 @@ func TestReferenceNewImageDestination(t *testing.T) {
 	defer dest.Close()
 }
 
+// putTestImage writes an image with a blob, a per-instance manifest and signatures to ref.
+func putTestImage(t *testing.T, ref types.ImageReference) {
+	dest, err := ref.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	blob := []byte("blob contents")
+	_, err = dest.PutBlob(context.Background(), bytes.NewReader(blob), types.BlobInfo{Digest: digest.FromBytes(blob), Size: int64(len(blob))}, memory.New(), false)
+	require.NoError(t, err)
+	instanceDigest := digest.FromString("instance")
+	err = dest.PutManifest(context.Background(), []byte("instance manifest"), &instanceDigest)
+	require.NoError(t, err)
+	err = dest.PutSignatures(context.Background(), [][]byte{[]byte("instance sig")}, &instanceDigest)
+	require.NoError(t, err)
+	err = dest.PutManifest(context.Background(), []byte("manifest"), nil)
+	require.NoError(t, err)
+	err = dest.PutSignatures(context.Background(), [][]byte{[]byte("sig1"), []byte("sig2")}, nil)
+	require.NoError(t, err)
+	err = dest.Commit(context.Background(), nil)
+	require.NoError(t, err)
+}
+
 func TestReferenceDeleteImage(t *testing.T) {
+	// An empty directory is not an image directory
 	ref, tmpDir := refToTempDir(t)
 	defer os.RemoveAll(tmpDir)
 	err := ref.DeleteImage(context.Background(), nil)
 	assert.Error(t, err)
+
+	// A complete image is deleted, leaving the directory in place
+	putTestImage(t, ref)
+	files, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, files, 7) // version, blob, 2 manifests, 3 signatures
+	err = ref.DeleteImage(context.Background(), nil)
+	require.NoError(t, err)
+	files, err = ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, files, 0)
+
+	// Unexpected contents are not deleted
+	for _, unexpected := range []string{"unexpected", "manifest.json.bak", "0123"} {
+		putTestImage(t, ref)
+		unexpectedPath := filepath.Join(tmpDir, unexpected)
+		err = ioutil.WriteFile(unexpectedPath, []byte{}, 0644)
+		require.NoError(t, err, unexpected)
+		err = ref.DeleteImage(context.Background(), nil)
+		assert.Error(t, err, unexpected)
+		assert.Equal(t, ErrNotContainerImageDir, errors.Cause(err), unexpected)
+		_, err = os.Stat(ref.(dirReference).manifestPath(nil))
+		assert.NoError(t, err, unexpected)
+		err = os.Remove(unexpectedPath)
+		require.NoError(t, err, unexpected)
+	}
+	err = os.Mkdir(filepath.Join(tmpDir, "subdir"), 0755)
+	require.NoError(t, err)
+	err = ref.DeleteImage(context.Background(), nil)
+	assert.Error(t, err)
+	_, err = os.Stat(ref.(dirReference).versionPath())
+	assert.NoError(t, err)
 }
 
 func TestReferenceManifestPath(t *testing.T) {
@@ -5,6 +5,7 @@ import (
 	"io"
 
 	"github.com/containers/image/v5/docker/internal/tarfile"
+	"github.com/containers/image/v5/internal/archivecompression"
 	"github.com/containers/image/v5/types"
 	"github.com/pkg/errors"
 )
@@ -13,6 +14,7 @@ type archiveImageDestination struct {
 	*tarfile.Destination // Implements most of types.ImageDestination
 	ref                  archiveReference
 	archive              *tarfile.Writer // Should only be closed if writer != nil
+	compressor           io.WriteCloser  // Compresses the archive, if requested, into writer; nil if the archive is shared
 	writer               io.Closer       // May be nil if the archive is shared
 }
 
@@ -22,20 +24,30 @@ func newImageDestination(sys *types.SystemContext, ref archiveReference) (types.
 	}
 
 	var archive *tarfile.Writer
+	var compressor io.WriteCloser
 	var writer io.Closer
 	if ref.archiveWriter != nil {
 		archive = ref.archiveWriter
+		compressor = nil
 		writer = nil
 	} else {
 		fh, err := openArchiveForWriting(ref.path)
 		if err != nil {
 			return nil, err
 		}
+		c, err := archivecompression.NewWriter(sys, ref.path, fh)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
 
-		archive = tarfile.NewWriter(fh)
+		archive = tarfile.NewWriter(c)
+		compressor = c
 		writer = fh
 	}
 	tarDest := tarfile.NewDestination(sys, archive, ref.ref)
+	tarDest.AcceptSignatures()
+	tarDest.AcceptManifestLists()
 	if sys != nil && sys.DockerArchiveAdditionalTags != nil {
 		tarDest.AddRepoTags(sys.DockerArchiveAdditionalTags)
 	}
@@ -43,6 +55,7 @@ func newImageDestination(sys *types.SystemContext, ref archiveReference) (types.
 		Destination: tarDest,
 		ref:         ref,
 		archive:     archive,
+		compressor:  compressor,
 		writer:      writer,
 	}, nil
 }
@@ -60,6 +73,9 @@ func (d *archiveImageDestination) Reference() types.ImageReference {
 
 // Close removes resources associated with an initialized ImageDestination, if any.
 func (d *archiveImageDestination) Close() error {
+	if d.compressor != nil { // Not committed; release the compressor's resources, the archive is incomplete anyway.
+		d.compressor.Close()
+	}
 	if d.writer != nil {
 		return d.writer.Close()
 	}
@@ -72,7 +88,12 @@ func (d *archiveImageDestination) Close() error {
 // - Uploaded data MAY be removed or MAY remain around if Close() is called without Commit() (i.e. rollback is allowed but not guaranteed)
 func (d *archiveImageDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
 	if d.writer != nil {
-		return d.archive.Close()
+		if err := d.archive.Close(); err != nil {
+			return err
+		}
+		err := d.compressor.Close()
+		d.compressor = nil
+		return err
 	}
 	return nil
 }
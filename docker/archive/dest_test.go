@@ -0,0 +1,67 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/memory"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDestinationCompressedArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "docker-archive-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	archivePath := filepath.Join(tmpDir, "archive.tar.gz")
+
+	ref, err := ParseReference(archivePath + ":example.com/ns/image:tag")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	cache := memory.New()
+	layer := []byte("layer contents")
+	layerDigest := digest.FromBytes(layer)
+	_, err = dest.PutBlob(context.Background(), bytes.NewReader(layer), types.BlobInfo{Digest: layerDigest, Size: int64(len(layer))}, cache, false)
+	require.NoError(t, err)
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":["` + layerDigest.String() + `"]}}`)
+	configInfo, err := dest.PutBlob(context.Background(), bytes.NewReader(config), types.BlobInfo{Size: -1}, cache, true)
+	require.NoError(t, err)
+	m, err := manifest.Schema2FromComponents(
+		manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2ConfigMediaType, Size: configInfo.Size, Digest: configInfo.Digest},
+		[]manifest.Schema2Descriptor{{MediaType: manifest.DockerV2Schema2LayerMediaType, Size: int64(len(layer)), Digest: layerDigest}},
+	).Serialize()
+	require.NoError(t, err)
+	err = dest.PutManifest(context.Background(), m, nil)
+	require.NoError(t, err)
+	err = dest.Commit(context.Background(), nil)
+	require.NoError(t, err)
+	err = dest.Close()
+	require.NoError(t, err)
+
+	file, err := os.Open(archivePath)
+	require.NoError(t, err)
+	defer file.Close()
+	algorithm, _, _, err := compression.DetectCompressionFormat(file)
+	require.NoError(t, err)
+	assert.Equal(t, compression.Gzip.Name(), algorithm.Name())
+
+	src, err := ref.NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	stream, _, err := src.GetBlob(context.Background(), types.BlobInfo{Digest: layerDigest, Size: -1}, cache)
+	require.NoError(t, err)
+	defer stream.Close()
+	contents, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, layer, contents)
+}
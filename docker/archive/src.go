@@ -21,7 +21,8 @@ func newImageSource(ctx context.Context, sys *types.SystemContext, ref archiveRe
 		archive = ref.archiveReader
 		closeArchive = false
 	} else {
-		a, err := tarfile.NewReaderFromFile(sys, ref.path)
+		// This source is the only user of the archive, so it can be read in a single pass if it is not a regular file.
+		a, err := tarfile.NewStreamingReaderFromFile(sys, ref.path)
 		if err != nil {
 			return nil, err
 		}
@@ -6,30 +6,39 @@ import (
 
 	"github.com/containers/image/v5/docker/internal/tarfile"
 	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/internal/archivecompression"
 	"github.com/containers/image/v5/types"
 	"github.com/pkg/errors"
 )
 
 // Writer manages a single in-progress Docker archive and allows adding images to it.
 type Writer struct {
-	path    string // The original, user-specified path; not the maintained temporary file, if any
-	archive *tarfile.Writer
-	writer  io.Closer
+	path       string // The original, user-specified path; not the maintained temporary file, if any
+	archive    *tarfile.Writer
+	compressor io.WriteCloser // Compresses the archive, if requested, into writer
+	writer     io.Closer
 }
 
 // NewWriter returns a Writer for path.
+// The archive is compressed if requested by sys.ArchiveCompressionFormat, or by the suffix of path.
 // The caller should call .Close() on the returned object.
 func NewWriter(sys *types.SystemContext, path string) (*Writer, error) {
 	fh, err := openArchiveForWriting(path)
 	if err != nil {
 		return nil, err
 	}
-	archive := tarfile.NewWriter(fh)
+	compressor, err := archivecompression.NewWriter(sys, path, fh)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	archive := tarfile.NewWriter(compressor)
 
 	return &Writer{
-		path:    path,
-		archive: archive,
-		writer:  fh,
+		path:       path,
+		archive:    archive,
+		compressor: compressor,
+		writer:     fh,
 	}, nil
 }
 
@@ -38,6 +47,9 @@ func NewWriter(sys *types.SystemContext, path string) (*Writer, error) {
 // No more images can be added after this is called.
 func (w *Writer) Close() error {
 	err := w.archive.Close()
+	if err2 := w.compressor.Close(); err2 != nil && err == nil {
+		err = err2
+	}
 	if err2 := w.writer.Close(); err2 != nil && err == nil {
 		err = err2
 	}
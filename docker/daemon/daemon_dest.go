@@ -2,12 +2,19 @@ package daemon
 
 import (
 	"context"
+	"encoding/json"
 	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/containers/image/v5/docker/internal/tarfile"
 	"github.com/containers/image/v5/docker/reference"
+	internalTypes "github.com/containers/image/v5/internal/types"
 	"github.com/containers/image/v5/types"
 	"github.com/docker/docker/client"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -20,6 +27,7 @@ type daemonImageDestination struct {
 	// For talking to imageLoadGoroutine
 	goroutineCancel context.CancelFunc
 	statusChannel   <-chan error
+	messages        *loadMessageQueue
 	writer          *io.PipeWriter
 	// Other state
 	committed bool // writer has been closed
@@ -49,9 +57,13 @@ func newImageDestination(ctx context.Context, sys *types.SystemContext, ref daem
 	archive := tarfile.NewWriter(writer)
 	// Commit() may never be called, so we may never read from this channel; so, make this buffered to allow imageLoadGoroutine to write status and terminate even if we never read it.
 	statusChannel := make(chan error, 1)
+	// The daemon sends messages while it is reading the image, long before Commit() is called; so they are queued
+	// instead of sent over a channel, to allow imageLoadGoroutine to keep reading the response (and the daemon to keep
+	// reading the image) even if nobody is processing the messages yet.
+	messages := newLoadMessageQueue()
 
 	goroutineContext, goroutineCancel := context.WithCancel(ctx)
-	go imageLoadGoroutine(goroutineContext, c, reader, statusChannel)
+	go imageLoadGoroutine(goroutineContext, c, reader, statusChannel, messages)
 
 	return &daemonImageDestination{
 		ref:                ref,
@@ -60,13 +72,15 @@ func newImageDestination(ctx context.Context, sys *types.SystemContext, ref daem
 		archive:            archive,
 		goroutineCancel:    goroutineCancel,
 		statusChannel:      statusChannel,
+		messages:           messages,
 		writer:             writer,
 		committed:          false,
 	}, nil
 }
 
-// imageLoadGoroutine accepts tar stream on reader, sends it to c, and reports error or success by writing to statusChannel
-func imageLoadGoroutine(ctx context.Context, c *client.Client, reader *io.PipeReader, statusChannel chan<- error) {
+// imageLoadGoroutine accepts tar stream on reader, sends it to c, adds the daemon's messages other than errors to messages,
+// and reports error or success by writing to statusChannel
+func imageLoadGoroutine(ctx context.Context, c *client.Client, reader *io.PipeReader, statusChannel chan<- error, messages *loadMessageQueue) {
 	err := errors.New("Internal error: unexpected panic in imageLoadGoroutine")
 	defer func() {
 		logrus.Debugf("docker-daemon: sending done, status %v", err)
@@ -82,12 +96,184 @@ func imageLoadGoroutine(ctx context.Context, c *client.Client, reader *io.PipeRe
 		}
 	}()
 
-	resp, err := c.ImageLoad(ctx, reader, true)
+	// Ask for progress messages (quiet == false); Commit() decides whether to report them.
+	resp, err := c.ImageLoad(ctx, reader, false)
 	if err != nil {
 		err = errors.Wrap(err, "Error saving image to docker engine")
 		return
 	}
 	defer resp.Body.Close()
+	err = processLoadResponse(resp.Body, resp.JSON, messages)
+}
+
+// loadMessage is a message in the JSON stream returned by the docker daemon when loading an image.
+// This is the subset of github.com/docker/docker/pkg/jsonmessage.JSONMessage we use.
+type loadMessage struct {
+	Stream         string              `json:"stream,omitempty"`
+	Status         string              `json:"status,omitempty"`
+	ID             string              `json:"id,omitempty"`
+	ProgressDetail *loadProgressDetail `json:"progressDetail,omitempty"`
+	ErrorDetail    *struct {
+		Message string `json:"message,omitempty"`
+	} `json:"errorDetail,omitempty"`
+	ErrorMessage string `json:"error,omitempty"` // Deprecated by the daemon in favor of ErrorDetail, but still sent.
+}
+
+// loadProgressDetail is the progress of loading a layer, in a loadMessage.
+type loadProgressDetail struct {
+	Current int64 `json:"current,omitempty"`
+	Total   int64 `json:"total,omitempty"`
+}
+
+// loadMessageQueue collects the daemon's messages from imageLoadGoroutine until CommitWithOptions processes them.
+// Adding a message never blocks; to limit memory usage, consecutive progress messages about the same layer
+// are coalesced, keeping only the most recent one (which includes all progress made).
+type loadMessageQueue struct {
+	notify   chan struct{} // Has a pending value if messages may have been added since the last take()
+	mutex    sync.Mutex    // Protects messages
+	messages []loadMessage
+}
+
+// newLoadMessageQueue returns an empty loadMessageQueue.
+func newLoadMessageQueue() *loadMessageQueue {
+	return &loadMessageQueue{notify: make(chan struct{}, 1)}
+}
+
+// add queues msg.
+func (q *loadMessageQueue) add(msg loadMessage) {
+	q.mutex.Lock()
+	if n := len(q.messages); n > 0 && q.messages[n-1].ProgressDetail != nil && msg.ProgressDetail != nil &&
+		msg.ID != "" && q.messages[n-1].ID == msg.ID {
+		q.messages[n-1] = msg
+	} else {
+		q.messages = append(q.messages, msg)
+	}
+	q.mutex.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default: // A notification is already pending.
+	}
+}
+
+// take removes and returns all queued messages.
+func (q *loadMessageQueue) take() []loadMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	res := q.messages
+	q.messages = nil
+	return res
+}
+
+// processLoadResponse reads the daemon's response to an image load request from body, which is a stream of JSON messages if isJSON,
+// until the daemon is done; it adds messages to messages, and fails if the daemon reports an error.
+func processLoadResponse(body io.Reader, isJSON bool, messages *loadMessageQueue) error {
+	if !isJSON { // Very old daemons send plain text.
+		text, err := ioutil.ReadAll(body)
+		if err != nil {
+			return errors.Wrap(err, "Error reading response from docker engine")
+		}
+		logrus.Debugf("docker-daemon: %s", strings.TrimSpace(string(text)))
+		return nil
+	}
+	decoder := json.NewDecoder(body)
+	for {
+		var msg loadMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "Error reading response from docker engine")
+		}
+		if msg.ErrorDetail != nil || msg.ErrorMessage != "" {
+			message := msg.ErrorMessage
+			if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+				message = msg.ErrorDetail.Message
+			}
+			return errors.Errorf("Error loading image into docker engine: %s", message)
+		}
+		if msg.Stream != "" {
+			logrus.Debugf("docker-daemon: %s", strings.TrimSpace(msg.Stream))
+		}
+		messages.add(msg)
+	}
+}
+
+// loadProgressReporter translates the daemon's progress messages about loading layers into ProgressEventApply* events.
+type loadProgressReporter struct {
+	channel  chan<- types.ProgressProperties
+	interval time.Duration
+	layers   map[digest.Digest]types.BlobInfo // Layers of the image, indexed by DiffID
+	// The layer currently being loaded, if any
+	currentID    string // "" if none
+	artifact     types.BlobInfo
+	lastUpdate   time.Time
+	offset       uint64
+	offsetUpdate uint64
+}
+
+// report processes msg.
+func (r *loadProgressReporter) report(msg loadMessage) {
+	if msg.ID == "" || msg.ProgressDetail == nil {
+		return
+	}
+	if msg.ID != r.currentID {
+		r.done()
+		artifact, ok := r.layerForID(msg.ID)
+		if !ok {
+			return
+		}
+		r.currentID = msg.ID
+		r.artifact = artifact
+		r.lastUpdate = time.Now()
+		r.offset = 0
+		r.offsetUpdate = 0
+		r.channel <- types.ProgressProperties{
+			Event:    types.ProgressEventApplyNewArtifact,
+			Artifact: r.artifact,
+		}
+	}
+	if current := uint64(msg.ProgressDetail.Current); current > r.offset {
+		r.offsetUpdate += current - r.offset
+		r.offset = current
+	}
+	if msg.ProgressDetail.Total > 0 && msg.ProgressDetail.Current >= msg.ProgressDetail.Total {
+		r.done()
+		return
+	}
+	if time.Since(r.lastUpdate) > r.interval {
+		r.channel <- types.ProgressProperties{
+			Event:        types.ProgressEventApplyRead,
+			Artifact:     r.artifact,
+			Offset:       r.offset,
+			OffsetUpdate: r.offsetUpdate,
+		}
+		r.lastUpdate = time.Now()
+		r.offsetUpdate = 0
+	}
+}
+
+// layerForID returns the layer the daemon refers to using id, which is a prefix of the hex part of its DiffID.
+func (r *loadProgressReporter) layerForID(id string) (types.BlobInfo, bool) {
+	for diffID, layer := range r.layers {
+		if strings.HasPrefix(diffID.Hex(), id) {
+			return layer, true
+		}
+	}
+	return types.BlobInfo{}, false
+}
+
+// done reports that loading the current layer, if any, has finished.
+func (r *loadProgressReporter) done() {
+	if r.currentID == "" {
+		return
+	}
+	r.channel <- types.ProgressProperties{
+		Event:        types.ProgressEventApplyDone,
+		Artifact:     r.artifact,
+		Offset:       r.offset,
+		OffsetUpdate: r.offsetUpdate,
+	}
+	r.currentID = ""
 }
 
 // DesiredLayerCompression indicates if layers must be compressed, decompressed or preserved
@@ -132,6 +318,24 @@ func (d *daemonImageDestination) Reference() types.ImageReference {
 // - Uploaded data MAY be visible to others before Commit() is called
 // - Uploaded data MAY be removed or MAY remain around if Close() is called without Commit() (i.e. rollback is allowed but not guaranteed)
 func (d *daemonImageDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	return d.CommitWithOptions(ctx, unparsedToplevel, internalTypes.CommitOptions{})
+}
+
+// CommitWithOptions is a variant of Commit; if options.Progress is set, it reports the progress of the daemon loading each layer.
+func (d *daemonImageDestination) CommitWithOptions(ctx context.Context, unparsedToplevel types.UnparsedImage, options internalTypes.CommitOptions) error {
+	var reporter *loadProgressReporter
+	if options.Progress != nil {
+		layers, err := d.Destination.LayersByDiffID()
+		if err != nil {
+			return err
+		}
+		reporter = &loadProgressReporter{
+			channel:  options.Progress,
+			interval: options.ProgressInterval,
+			layers:   layers,
+		}
+	}
+
 	logrus.Debugf("docker-daemon: Closing tar stream")
 	if err := d.archive.Close(); err != nil {
 		return err
@@ -142,10 +346,26 @@ func (d *daemonImageDestination) Commit(ctx context.Context, unparsedToplevel ty
 	d.committed = true // We may still fail, but we are done sending to imageLoadGoroutine.
 
 	logrus.Debugf("docker-daemon: Waiting for status")
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-d.statusChannel:
-		return err
+	// All messages are queued before the status is sent, so the messages are complete after receiving the status.
+	reportQueued := func() {
+		for _, msg := range d.messages.take() {
+			if reporter != nil {
+				reporter.report(msg)
+			}
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.messages.notify:
+			reportQueued()
+		case err := <-d.statusChannel:
+			reportQueued()
+			if reporter != nil && err == nil {
+				reporter.done()
+			}
+			return err
+		}
 	}
 }
@@ -0,0 +1,124 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectLoadResponse returns the result of processLoadResponse for body, and the messages it has queued.
+func collectLoadResponse(body string, isJSON bool) ([]loadMessage, error) {
+	messages := newLoadMessageQueue()
+	err := processLoadResponse(strings.NewReader(body), isJSON, messages)
+	return messages.take(), err
+}
+
+func TestProcessLoadResponse(t *testing.T) {
+	// Success
+	messages, err := collectLoadResponse(`{"status":"Loading layer","progressDetail":{"current":512,"total":1024},"id":"0123456789ab"}`+"\n"+
+		`{"stream":"Loaded image: busybox:latest\n"}`+"\n", true)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "0123456789ab", messages[0].ID)
+	require.NotNil(t, messages[0].ProgressDetail)
+	assert.Equal(t, int64(512), messages[0].ProgressDetail.Current)
+	assert.Equal(t, int64(1024), messages[0].ProgressDetail.Total)
+	assert.Equal(t, "Loaded image: busybox:latest\n", messages[1].Stream)
+
+	// Errors reported by the daemon
+	for _, c := range []string{
+		`{"errorDetail":{"message":"open /var/lib/docker/tmp/x: no such file or directory"},"error":"open /var/lib/docker/tmp/x: no such file or directory"}`,
+		`{"error":"open /var/lib/docker/tmp/x: no such file or directory"}`,
+	} {
+		_, err := collectLoadResponse(`{"status":"Loading layer","id":"0123456789ab"}`+"\n"+c, true)
+		require.Error(t, err, c)
+		assert.Contains(t, err.Error(), "no such file or directory", c)
+	}
+
+	// Invalid JSON
+	_, err = collectLoadResponse(`{"stream":`, true)
+	assert.Error(t, err)
+
+	// Plain text
+	messages, err = collectLoadResponse("Loaded image: busybox:latest\n", false)
+	require.NoError(t, err)
+	assert.Len(t, messages, 0)
+}
+
+func TestLoadMessageQueue(t *testing.T) {
+	progress := func(id string, current, total int64) loadMessage {
+		return loadMessage{Status: "Loading layer", ID: id, ProgressDetail: &loadProgressDetail{Current: current, Total: total}}
+	}
+	q := newLoadMessageQueue()
+	assert.Empty(t, q.take())
+
+	// Adding messages never blocks, and consecutive progress messages about a layer are coalesced.
+	for _, msg := range []loadMessage{
+		progress("layer1", 1, 3),
+		progress("layer1", 2, 3),
+		progress("layer1", 3, 3),
+		progress("layer2", 1, 2),
+		{Stream: "Loaded image: busybox:latest\n"},
+		{Stream: "Loaded image: busybox:other\n"},
+	} {
+		q.add(msg)
+	}
+	select {
+	case <-q.notify:
+	default:
+		t.Fatal("No notification is pending")
+	}
+	assert.Equal(t, []loadMessage{
+		progress("layer1", 3, 3),
+		progress("layer2", 1, 2),
+		{Stream: "Loaded image: busybox:latest\n"},
+		{Stream: "Loaded image: busybox:other\n"},
+	}, q.take())
+	assert.Empty(t, q.take())
+	q.add(progress("layer2", 2, 2))
+	assert.Equal(t, []loadMessage{progress("layer2", 2, 2)}, q.take())
+}
+
+func TestLoadProgressReporter(t *testing.T) {
+	layer1 := types.BlobInfo{Digest: digest.FromString("layer1"), Size: 1024}
+	layer2 := types.BlobInfo{Digest: digest.FromString("layer2"), Size: 2048}
+	diffID1 := digest.FromString("diffID1")
+	diffID2 := digest.FromString("diffID2")
+	channel := make(chan types.ProgressProperties, 100)
+	reporter := &loadProgressReporter{
+		channel:  channel,
+		interval: 0,
+		layers:   map[digest.Digest]types.BlobInfo{diffID1: layer1, diffID2: layer2},
+	}
+	progress := func(id string, current, total int64) loadMessage {
+		return loadMessage{Status: "Loading layer", ID: id, ProgressDetail: &loadProgressDetail{Current: current, Total: total}}
+	}
+	for _, msg := range []loadMessage{
+		progress(diffID1.Hex()[:12], 512, 1024),
+		progress(diffID1.Hex()[:12], 1024, 1024),
+		progress("unknown", 10, 20), // Ignored
+		progress(diffID2.Hex()[:12], 1024, 2048),
+		{Stream: "Loaded image: busybox:latest\n"},
+	} {
+		reporter.report(msg)
+	}
+	reporter.done()
+	close(channel)
+
+	events := []types.ProgressProperties{}
+	for p := range channel {
+		events = append(events, p)
+	}
+	assert.Equal(t, []types.ProgressProperties{
+		{Event: types.ProgressEventApplyNewArtifact, Artifact: layer1},
+		{Event: types.ProgressEventApplyRead, Artifact: layer1, Offset: 512, OffsetUpdate: 512},
+		{Event: types.ProgressEventApplyDone, Artifact: layer1, Offset: 1024, OffsetUpdate: 512},
+		{Event: types.ProgressEventApplyNewArtifact, Artifact: layer2},
+		{Event: types.ProgressEventApplyRead, Artifact: layer2, Offset: 1024, OffsetUpdate: 1024},
+		{Event: types.ProgressEventApplyDone, Artifact: layer2, Offset: 1024, OffsetUpdate: 0},
+	}, events)
+}
@@ -2,9 +2,12 @@ package daemon
 
 import (
 	"context"
+	"io"
 
 	"github.com/containers/image/v5/docker/internal/tarfile"
 	"github.com/containers/image/v5/types"
+	"github.com/docker/docker/client"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -16,36 +19,79 @@ type daemonImageSource struct {
 // newImageSource returns a types.ImageSource for the specified image reference.
 // The caller must call .Close() on the returned ImageSource.
 //
-// It would be great if we were able to stream the input tar as it is being
-// sent; but Docker sends the top-level manifest, which determines which paths
-// to look for, at the end, so in we will need to seek back and re-read, several times.
+// The input tar is read as it is being sent, without copying all of it to a temporary file first.
+// Docker sends the top-level manifest at the end, so instead of using it to locate the image's components,
+// we ask the daemon for the image ID (the config digest) and the layer DiffIDs, and find the config and the layers by the digests
+// of their contents, which allows reading them in the order the daemon sends them; see tarfile.NewStreamingReaderForImage.
+// The generated manifest must contain the sizes of all layers, so the first export is read completely without storing the layers,
+// and the layers are then copied from a second export of the same image.
 // (We could, perhaps, expect an exact sequence, assume that the first plaintext file
 // is the config, and that the following len(RootFS) files are the layers, but that feels
 // way too brittle.)
 func newImageSource(ctx context.Context, sys *types.SystemContext, ref daemonReference) (types.ImageSource, error) {
+	if ref.archiveReader != nil {
+		return &daemonImageSource{
+			ref:    ref,
+			Source: tarfile.NewSourceForImage(ref.archiveReader, false, ref.configDigest, ref.diffIDs),
+		}, nil
+	}
+
 	c, err := newDockerClient(sys)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error initializing docker engine client")
 	}
 	// Per NewReference(), ref.StringWithinTransport() is either an image ID (config digest), or a !reference.NameOnly() reference.
 	// Either way ImageSave should create a tarball with exactly one image.
-	inputStream, err := c.ImageSave(ctx, []string{ref.StringWithinTransport()})
+	configDigest, diffIDs, err := inspectImage(ctx, c, ref)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error loading image from docker engine")
+		return nil, err
+	}
+	// Use the ID, not the original reference, so that the exported image is the one we have just inspected,
+	// even if the reference is concurrently moved to a different image.
+	export := func() (io.ReadCloser, error) {
+		inputStream, err := c.ImageSave(ctx, []string{configDigest.String()})
+		if err != nil {
+			return nil, errors.Wrap(err, "Error loading image from docker engine")
+		}
+		return inputStream, nil
+	}
+	inputStream, err := export()
+	if err != nil {
+		return nil, err
 	}
-	defer inputStream.Close()
 
-	archive, err := tarfile.NewReaderFromStream(sys, inputStream)
+	archive, err := tarfile.NewStreamingReaderForImage(sys, inputStream, export) // Takes ownership of inputStream
 	if err != nil {
 		return nil, err
 	}
-	src := tarfile.NewSource(archive, true, nil, -1)
+	src := tarfile.NewSourceForImage(archive, true, configDigest, diffIDs)
 	return &daemonImageSource{
 		ref:    ref,
 		Source: src,
 	}, nil
 }
 
+// inspectImage returns the ID (config digest) and the layer DiffIDs of the image ref refers to in the daemon c.
+func inspectImage(ctx context.Context, c *client.Client, ref daemonReference) (digest.Digest, []digest.Digest, error) {
+	inspect, _, err := c.ImageInspectWithRaw(ctx, ref.StringWithinTransport())
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "Error inspecting image %s in docker engine", ref.StringWithinTransport())
+	}
+	configDigest, err := digest.Parse(inspect.ID)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "Invalid image ID %q reported by docker engine", inspect.ID)
+	}
+	diffIDs := []digest.Digest{}
+	for _, layer := range inspect.RootFS.Layers {
+		diffID, err := digest.Parse(layer)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "Invalid layer DiffID %q reported by docker engine for image %s", layer, inspect.ID)
+		}
+		diffIDs = append(diffIDs, diffID)
+	}
+	return configDigest, diffIDs, nil
+}
+
 // Reference returns the reference used to set up this source, _as specified by the user_
 // (not as the image itself, or its underlying storage, claims).  This can be used e.g. to determine which public keys are trusted for this image.
 func (s *daemonImageSource) Reference() types.ImageReference {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/containers/image/v5/docker/internal/tarfile"
 	"github.com/containers/image/v5/docker/policyconfiguration"
 	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/image"
@@ -57,6 +58,10 @@ func (t daemonTransport) ValidatePolicyConfigurationScope(scope string) error {
 type daemonReference struct {
 	id  digest.Digest
 	ref reference.Named // !reference.IsNameOnly
+	// If not nil, the image is read from this shared export of several images, see Reader.
+	archiveReader *tarfile.Reader
+	configDigest  digest.Digest   // The image ID within archiveReader, set if archiveReader is set.
+	diffIDs       []digest.Digest // The layer DiffIDs of the image, as reported by the daemon, set if archiveReader is set.
 }
 
 // ParseReference converts a string, which should not start with the ImageTransport.Name prefix, into an ImageReference.
@@ -0,0 +1,80 @@
+package daemon
+
+import (
+	"context"
+
+	"github.com/containers/image/v5/docker/internal/tarfile"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Reader exports several images from a docker daemon using a single save request, and allows accessing
+// the individual images with less overhead than creating image references individually
+// (because layers shared by the images are exported only once).
+type Reader struct {
+	archive *tarfile.Reader
+	refs    []types.ImageReference
+}
+
+// NewReader asks the docker daemon to export the images refs refer to, which must be from docker/daemon.Transport.
+// The caller should call .Close() on the returned object.
+func NewReader(ctx context.Context, sys *types.SystemContext, refs []types.ImageReference) (*Reader, error) {
+	c, err := newDockerClient(sys)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error initializing docker engine client")
+	}
+
+	// Refer to the images using their IDs, so that each exported image is the one we have inspected,
+	// even if the references are concurrently moved to different images.
+	boundRefs := []daemonReference{}
+	ids := []string{}
+	seenIDs := map[digest.Digest]struct{}{}
+	for _, ref := range refs {
+		daemonRef, ok := ref.(daemonReference)
+		if !ok {
+			return nil, errors.Errorf("Internal error: NewReader called for a non-docker/daemon ImageReference %s", transports.ImageName(ref))
+		}
+		if daemonRef.archiveReader != nil {
+			return nil, errors.Errorf("Internal error: NewReader called for a reader-bound reference %s", daemonRef.StringWithinTransport())
+		}
+		configDigest, diffIDs, err := inspectImage(ctx, c, daemonRef)
+		if err != nil {
+			return nil, err
+		}
+		daemonRef.configDigest = configDigest
+		daemonRef.diffIDs = diffIDs
+		boundRefs = append(boundRefs, daemonRef)
+		if _, ok := seenIDs[configDigest]; !ok {
+			seenIDs[configDigest] = struct{}{}
+			ids = append(ids, configDigest.String())
+		}
+	}
+
+	inputStream, err := c.ImageSave(ctx, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error loading images from docker engine")
+	}
+	archive, err := tarfile.NewStreamingReaderForImages(sys, inputStream) // Takes ownership of inputStream
+	if err != nil {
+		return nil, err
+	}
+	res := &Reader{archive: archive}
+	for _, ref := range boundRefs {
+		ref.archiveReader = archive
+		res.refs = append(res.refs, ref)
+	}
+	return res, nil
+}
+
+// Close releases resources associated with the Reader, including the temporary files holding parts of the export, if any.
+func (r *Reader) Close() error {
+	return r.archive.Close()
+}
+
+// List returns references to the images in the Reader, in the order of the refs passed to NewReader.
+// The references are valid only until the Reader is closed.
+func (r *Reader) List() []types.ImageReference {
+	return r.refs
+}
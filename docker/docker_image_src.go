@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/internal/iolimits"
+	internalTypes "github.com/containers/image/v5/internal/types"
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/pkg/sysregistriesv2"
 	"github.com/containers/image/v5/types"
@@ -296,6 +298,172 @@ func (s *dockerImageSource) GetBlob(ctx context.Context, info types.BlobInfo, ca
 	return res.Body, getBlobSize(res), nil
 }
 
+// maxRangesPerRequest is the maximum number of ranges GetBlobAt asks for in a single HTTP request.
+const maxRangesPerRequest = 64
+
+// GetBlobAt returns a stream containing the concatenated contents of the specified chunks of the blob, in order.
+// The chunks must be sorted by Offset, and must not overlap.
+// If the registry does not support range requests, it returns internalTypes.ErrRangesNotSupported; if the registry
+// does not return all of the requested ranges, reading the stream fails with an error whose cause is that error.
+func (s *dockerImageSource) GetBlobAt(ctx context.Context, info types.BlobInfo, chunks []internalTypes.ImageSourceChunk) (io.ReadCloser, error) {
+	if len(info.URLs) != 0 {
+		return nil, internalTypes.ErrRangesNotSupported
+	}
+	nonEmpty := []internalTypes.ImageSourceChunk{}
+	for _, chunk := range chunks {
+		if chunk.Length != 0 {
+			nonEmpty = append(nonEmpty, chunk)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	batches := [][]internalTypes.ImageSourceChunk{}
+	for len(nonEmpty) > maxRangesPerRequest {
+		batches = append(batches, nonEmpty[:maxRangesPerRequest])
+		nonEmpty = nonEmpty[maxRangesPerRequest:]
+	}
+	batches = append(batches, nonEmpty)
+
+	path := fmt.Sprintf(blobsPath, reference.Path(s.physicalRef.ref), info.Digest.String())
+	logrus.Debugf("Downloading %d chunks of %s", len(chunks), path)
+	// Make the first request right away, so that callers can fall back to GetBlob if it fails.
+	res, err := s.fetchBlobRanges(ctx, path, batches[0])
+	if err != nil {
+		return nil, err
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		err := writeBlobRanges(pipeWriter, res, batches[0])
+		for _, batch := range batches[1:] {
+			if err != nil {
+				break
+			}
+			res, err = s.fetchBlobRanges(ctx, path, batch)
+			if err == nil {
+				err = writeBlobRanges(pipeWriter, res, batch)
+			}
+		}
+		pipeWriter.CloseWithError(err) // CloseWithError(nil) is equivalent to Close()
+	}()
+	return pipeReader, nil
+}
+
+// fetchBlobRanges requests chunks of the blob at path, and returns the response, which is known to contain partial content.
+func (s *dockerImageSource) fetchBlobRanges(ctx context.Context, path string, chunks []internalTypes.ImageSourceChunk) (*http.Response, error) {
+	ranges := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		ranges[i] = fmt.Sprintf("%d-%d", chunk.Offset, chunk.Offset+chunk.Length-1)
+	}
+	headers := map[string][]string{
+		"Range": {"bytes=" + strings.Join(ranges, ",")},
+	}
+	res, err := s.c.makeRequest(ctx, "GET", path, headers, nil, v2Auth, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		return res, nil
+	case http.StatusOK:
+		res.Body.Close()
+		return nil, internalTypes.ErrRangesNotSupported
+	default:
+		err := httpResponseToError(res, "Error fetching blob chunks")
+		res.Body.Close()
+		return nil, err
+	}
+}
+
+// writeBlobRanges writes the data of chunks, which were requested by fetchBlobRanges, from res to dest, and closes res.Body.
+// The server may return the ranges in a single part, or in a multipart/byteranges body; and it may have merged some of the
+// requested ranges.  If the server did not return the requested ranges, the cause of the returned error is
+// internalTypes.ErrRangesNotSupported, so that callers can fall back to reading the whole blob.
+func writeBlobRanges(dest io.Writer, res *http.Response, chunks []internalTypes.ImageSourceChunk) error {
+	defer res.Body.Close()
+
+	var nextPart func() (string, io.Reader, error) // Returns the Content-Range and the body of the next part, or io.EOF
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err == nil && mediaType == "multipart/byteranges" {
+		mr := multipart.NewReader(res.Body, params["boundary"])
+		nextPart = func() (string, io.Reader, error) {
+			part, err := mr.NextPart()
+			if err != nil {
+				return "", nil, err
+			}
+			return part.Header.Get("Content-Range"), part, nil
+		}
+	} else {
+		returned := false
+		nextPart = func() (string, io.Reader, error) {
+			if returned {
+				return "", nil, io.EOF
+			}
+			returned = true
+			return res.Header.Get("Content-Range"), res.Body, nil
+		}
+	}
+
+	for len(chunks) > 0 {
+		contentRange, part, err := nextPart()
+		if err == io.EOF {
+			return errors.Wrapf(internalTypes.ErrRangesNotSupported, "Error fetching blob chunks: %d requested ranges missing in response", len(chunks))
+		}
+		if err != nil {
+			return errors.Wrap(err, "Error reading blob chunks")
+		}
+		start, end, err := parseContentRange(contentRange)
+		if err != nil {
+			return err
+		}
+		pos := start
+		consumed := false
+		for len(chunks) > 0 && chunks[0].Offset >= pos && chunks[0].Offset+chunks[0].Length-1 <= end {
+			if _, err := io.CopyN(ioutil.Discard, part, int64(chunks[0].Offset-pos)); err != nil {
+				return errors.Wrap(err, "Error reading blob chunks")
+			}
+			if _, err := io.CopyN(dest, part, int64(chunks[0].Length)); err != nil {
+				return errors.Wrap(err, "Error reading blob chunks")
+			}
+			pos = chunks[0].Offset + chunks[0].Length
+			chunks = chunks[1:]
+			consumed = true
+		}
+		if !consumed {
+			return errors.Wrapf(internalTypes.ErrRangesNotSupported, "Error fetching blob chunks: unexpected range %q in response", contentRange)
+		}
+	}
+	return nil
+}
+
+// parseContentRange parses a Content-Range header value of a partial response, and returns the first and last offset.
+func parseContentRange(value string) (uint64, uint64, error) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(value, prefix) {
+		return 0, 0, errors.Errorf("invalid Content-Range %q", value)
+	}
+	byteRange := strings.TrimPrefix(value, prefix)
+	if i := strings.IndexByte(byteRange, '/'); i != -1 {
+		byteRange = byteRange[:i]
+	}
+	parts := strings.Split(byteRange, "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("invalid Content-Range %q", value)
+	}
+	start, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid Content-Range %q", value)
+	}
+	end, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid Content-Range %q", value)
+	}
+	if end < start {
+		return 0, 0, errors.Errorf("invalid Content-Range %q", value)
+	}
+	return start, end, nil
+}
+
 // GetSignatures returns the image's signatures.  It may use a remote (= slow) service.
 // If instanceDigest is not nil, it contains a digest of the specific manifest instance to retrieve signatures for
 // (when the primary manifest is a manifest list); this never happens if the primary manifest is not a manifest list
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
 	"net/http"
@@ -10,8 +11,12 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
+	internalTypes "github.com/containers/image/v5/internal/types"
 	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -95,3 +100,110 @@ func TestSimplifyContentType(t *testing.T) {
 		assert.Equal(t, c.expected, out, c.input)
 	}
 }
+
+func TestDockerImageSourceGetBlobAt(t *testing.T) {
+	blob := make([]byte, 1000)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	blobDigest := digest.FromBytes(blob)
+	manifestPathRegex := regexp.MustCompile("^/v2/.*/manifests/latest$")
+	supportsRanges := true
+	onlyFirstRange := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v2/":
+			rw.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodGet && manifestPathRegex.MatchString(r.URL.Path):
+			rw.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/blobs/"+blobDigest.String()):
+			if !supportsRanges {
+				r.Header.Del("Range")
+			}
+			if onlyFirstRange {
+				r.Header.Set("Range", strings.SplitN(r.Header.Get("Range"), ",", 2)[0])
+			}
+			http.ServeContent(rw, r, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			require.FailNowf(t, "Unexpected request", "%v %v", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	registryURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	registriesConf, err := ioutil.TempFile("", "docker-image-src")
+	require.NoError(t, err)
+	defer registriesConf.Close()
+	defer os.Remove(registriesConf.Name())
+
+	ref, err := ParseReference("//" + registryURL.Host + "/busybox:latest")
+	require.NoError(t, err)
+	src, err := ref.NewImageSource(context.Background(), &types.SystemContext{
+		RegistriesDirPath:           "/this/doesnt/exist",
+		DockerPerHostCertDirPath:    "/this/doesnt/exist",
+		SystemRegistriesConfPath:    registriesConf.Name(),
+		DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+	})
+	require.NoError(t, err)
+	defer src.Close()
+	accessor, ok := src.(internalTypes.BlobChunkAccessor)
+	require.True(t, ok)
+
+	manyChunks := []internalTypes.ImageSourceChunk{}
+	for i := uint64(0); i < 2*maxRangesPerRequest+1; i++ {
+		manyChunks = append(manyChunks, internalTypes.ImageSourceChunk{Offset: 3 * i, Length: 2})
+	}
+	for _, chunks := range [][]internalTypes.ImageSourceChunk{
+		{},
+		{{Offset: 10, Length: 5}},
+		{{Offset: 0, Length: 1}, {Offset: 1, Length: 0}, {Offset: 500, Length: 100}, {Offset: 999, Length: 1}},
+		manyChunks,
+	} {
+		expected := []byte{}
+		for _, chunk := range chunks {
+			expected = append(expected, blob[chunk.Offset:chunk.Offset+chunk.Length]...)
+		}
+		stream, err := accessor.GetBlobAt(context.Background(), types.BlobInfo{Digest: blobDigest, Size: -1}, chunks)
+		require.NoError(t, err)
+		contents, err := ioutil.ReadAll(stream)
+		require.NoError(t, err)
+		assert.Equal(t, expected, contents)
+		err = stream.Close()
+		require.NoError(t, err)
+	}
+
+	// A registry which returns only some of the ranges is detected while reading.
+	onlyFirstRange = true
+	stream, err := accessor.GetBlobAt(context.Background(), types.BlobInfo{Digest: blobDigest, Size: -1}, []internalTypes.ImageSourceChunk{{Offset: 10, Length: 5}, {Offset: 500, Length: 100}})
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(stream)
+	assert.Equal(t, internalTypes.ErrRangesNotSupported, errors.Cause(err))
+	stream.Close()
+	onlyFirstRange = false
+
+	supportsRanges = false
+	_, err = accessor.GetBlobAt(context.Background(), types.BlobInfo{Digest: blobDigest, Size: -1}, []internalTypes.ImageSourceChunk{{Offset: 10, Length: 5}})
+	assert.Equal(t, internalTypes.ErrRangesNotSupported, err)
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, c := range []struct {
+		input      string
+		start, end uint64
+	}{
+		{"bytes 0-0/1", 0, 0},
+		{"bytes 10-20/*", 10, 20},
+		{"bytes 10-20", 10, 20},
+	} {
+		start, end, err := parseContentRange(c.input)
+		require.NoError(t, err, c.input)
+		assert.Equal(t, c.start, start, c.input)
+		assert.Equal(t, c.end, end, c.input)
+	}
+	for _, input := range []string{"", "bytes */100", "bytes 20-10/100", "bytes 1-2-3/100", "items 0-1/2", "bytes x-1/2", "bytes 1-x/2"} {
+		_, _, err := parseContentRange(input)
+		assert.Error(t, err, input)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
 	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -23,8 +24,13 @@ type Destination struct {
 	archive  *Writer
 	repoTags []reference.NamedTagged
 	// Other state.
-	config []byte
-	sysCtx *types.SystemContext
+	acceptsSignatures    bool
+	acceptsManifestLists bool
+	configs              map[digest.Digest][]byte // Configs sent by PutBlob, indexed by digest
+	instances            map[digest.Digest][]byte // Per-instance manifests, set by PutManifest with instanceDigest != nil
+	manifest             []byte                   // Set by PutManifest with instanceDigest == nil, if it is not a manifest list
+	configDigest         digest.Digest            // Config digest of manifest, set by PutManifest
+	sysCtx               *types.SystemContext
 }
 
 // NewDestination returns a tarfile.Destination adding images to the specified Writer.
@@ -34,9 +40,11 @@ func NewDestination(sys *types.SystemContext, archive *Writer, ref reference.Nam
 		repoTags = append(repoTags, ref)
 	}
 	return &Destination{
-		archive:  archive,
-		repoTags: repoTags,
-		sysCtx:   sys,
+		archive:   archive,
+		repoTags:  repoTags,
+		configs:   map[digest.Digest][]byte{},
+		instances: map[digest.Digest][]byte{},
+		sysCtx:    sys,
 	}
 }
 
@@ -45,18 +53,44 @@ func (d *Destination) AddRepoTags(tags []reference.NamedTagged) {
 	d.repoTags = append(d.repoTags, tags...)
 }
 
+// AcceptSignatures makes the destination store signatures, along with the original manifest they refer to, in the archive.
+// Otherwise signatures are rejected; that is appropriate e.g. when the archive is only an intermediate format
+// consumed by (docker load), which would drop them.
+func (d *Destination) AcceptSignatures() {
+	d.acceptsSignatures = true
+}
+
+// AcceptManifestLists makes the destination store manifest lists, with all of their instances, in the archive,
+// using an OCI index.json; only the default instance is visible to (docker load).
+// Otherwise only single images are accepted; that is appropriate e.g. when the archive is only an intermediate format
+// consumed by (docker load), which would not make any use of the other instances.
+func (d *Destination) AcceptManifestLists() {
+	d.acceptsManifestLists = true
+}
+
 // SupportedManifestMIMETypes tells which manifest mime types the destination supports
 // If an empty slice or nil it's returned, then any mime type can be tried to upload
 func (d *Destination) SupportedManifestMIMETypes() []string {
+	if !d.acceptsManifestLists {
+		return []string{
+			manifest.DockerV2Schema2MediaType, // We rely on the types.Image.UpdatedImage schema conversion capabilities.
+		}
+	}
 	return []string{
 		manifest.DockerV2Schema2MediaType, // We rely on the types.Image.UpdatedImage schema conversion capabilities.
+		// Instances of manifest lists must be schema2 as well, but the list itself is stored in its original format.
+		manifest.DockerV2ListMediaType,
+		imgspecv1.MediaTypeImageIndex,
 	}
 }
 
 // SupportsSignatures returns an error (to be displayed to the user) if the destination certainly can't store signatures.
 // Note: It is still possible for PutSignatures to fail if SupportsSignatures returns nil.
 func (d *Destination) SupportsSignatures(ctx context.Context) error {
-	return errors.Errorf("Storing signatures for docker tar files is not supported")
+	if !d.acceptsSignatures {
+		return errors.Errorf("Storing signatures for docker tar files is not supported")
+	}
+	return nil
 }
 
 // AcceptsForeignLayerURLs returns false iff foreign layers in manifest should be actually
@@ -142,7 +176,7 @@ func (d *Destination) PutBlob(ctx context.Context, stream io.Reader, inputInfo t
 		if err != nil {
 			return types.BlobInfo{}, errors.Wrap(err, "Error reading Config file stream")
 		}
-		d.config = buf
+		d.configs[inputInfo.Digest] = buf
 		if err := d.archive.sendFileLocked(d.archive.configPath(inputInfo.Digest), inputInfo.Size, bytes.NewReader(buf)); err != nil {
 			return types.BlobInfo{}, errors.Wrap(err, "Error writing Config file")
 		}
@@ -174,23 +208,83 @@ func (d *Destination) TryReusingBlob(ctx context.Context, info types.BlobInfo, c
 }
 
 // PutManifest writes manifest to the destination.
-// The instanceDigest value is expected to always be nil, because this transport does not support manifest lists, so
-// there can be no secondary manifests.
+// If instanceDigest is not nil, it contains a digest of the specific manifest instance to write the manifest for
+// (when the primary manifest is a manifest list); this should always be nil if the primary manifest is not a manifest list.
+// Per-instance manifests are only recorded, and written when the manifest list itself is written.
 // FIXME? This should also receive a MIME type if known, to differentiate between schema versions.
 // If the destination is in principle available, refuses this manifest type (e.g. it does not recognize the schema),
 // but may accept a different manifest type, the returned error must be an ManifestTypeRejectedError.
 func (d *Destination) PutManifest(ctx context.Context, m []byte, instanceDigest *digest.Digest) error {
+	if instanceDigest == nil {
+		if mimeType := manifest.GuessMIMEType(m); manifest.MIMETypeIsMultiImage(mimeType) {
+			if !d.acceptsManifestLists {
+				return errors.Errorf("Storing manifest lists is not supported")
+			}
+			return d.putManifestList(m, mimeType)
+		}
+	}
+	// We do not bother with types.ManifestTypeRejectedError; our .SupportedManifestMIMETypes() above is already providing only one alternative
+	// for single images, so the caller trying a different manifest kind would be pointless.
+	man, err := parseSchema2Manifest(m)
+	if err != nil {
+		return err
+	}
 	if instanceDigest != nil {
-		return errors.New(`Manifest lists are not supported for docker tar files`)
+		d.instances[*instanceDigest] = m
+		return nil
 	}
-	// We do not bother with types.ManifestTypeRejectedError; our .SupportedManifestMIMETypes() above is already providing only one alternative,
-	// so the caller trying a different manifest kind would be pointless.
-	var man manifest.Schema2
-	if err := json.Unmarshal(m, &man); err != nil {
-		return errors.Wrap(err, "Error parsing manifest")
+
+	if err := d.archive.lock(); err != nil {
+		return err
 	}
-	if man.SchemaVersion != 2 || man.MediaType != manifest.DockerV2Schema2MediaType {
-		return errors.Errorf("Unsupported manifest type, need a Docker schema 2 manifest")
+	defer d.archive.unlock()
+
+	if err := d.archive.writeLegacyMetadataLocked(man.LayersDescriptors, d.configs[man.ConfigDescriptor.Digest], d.repoTags); err != nil {
+		return err
+	}
+
+	if err := d.archive.ensureManifestItemLocked(man.LayersDescriptors, man.ConfigDescriptor.Digest, d.repoTags); err != nil {
+		return err
+	}
+	manifestDigest, err := manifest.Digest(m)
+	if err != nil {
+		return err
+	}
+	d.archive.recordOCIImageLocked(ociManifest{digest: manifestDigest, mimeType: manifest.DockerV2Schema2MediaType, manifest: m}, nil, d.repoTags)
+	d.manifest = m
+	d.configDigest = man.ConfigDescriptor.Digest
+	return nil
+}
+
+// putManifestList writes a manifest list m with mimeType, and all of its instances previously recorded by PutManifest.
+// The legacy metadata and manifest.json refer to a single default instance, chosen by platform if possible;
+// the full list is recorded for an OCI index.json.
+func (d *Destination) putManifestList(m []byte, mimeType string) error {
+	list, err := manifest.ListFromBlob(m, mimeType)
+	if err != nil {
+		return errors.Wrap(err, "Error parsing manifest list")
+	}
+	defaultInstance, err := d.chooseDefaultInstance(list)
+	if err != nil {
+		return err
+	}
+	man, err := parseSchema2Manifest(d.instances[defaultInstance])
+	if err != nil {
+		return err
+	}
+	configBytes, ok := d.configs[man.ConfigDescriptor.Digest]
+	if !ok {
+		return errors.Errorf("Config %s of instance %s has not been written", man.ConfigDescriptor.Digest, defaultInstance)
+	}
+	instances := []ociManifest{}
+	for _, instanceDigest := range list.Instances() {
+		if instanceManifest, ok := d.instances[instanceDigest]; ok {
+			instances = append(instances, ociManifest{digest: instanceDigest, mimeType: manifest.DockerV2Schema2MediaType, manifest: instanceManifest})
+		}
+	}
+	listDigest, err := manifest.Digest(m)
+	if err != nil {
+		return err
 	}
 
 	if err := d.archive.lock(); err != nil {
@@ -198,22 +292,103 @@ func (d *Destination) PutManifest(ctx context.Context, m []byte, instanceDigest
 	}
 	defer d.archive.unlock()
 
-	if err := d.archive.writeLegacyMetadataLocked(man.LayersDescriptors, d.config, d.repoTags); err != nil {
+	if err := d.archive.writeLegacyMetadataLocked(man.LayersDescriptors, configBytes, d.repoTags); err != nil {
+		return err
+	}
+	if err := d.archive.ensureManifestItemLocked(man.LayersDescriptors, man.ConfigDescriptor.Digest, d.repoTags); err != nil {
 		return err
 	}
+	d.archive.recordOCIImageLocked(ociManifest{digest: listDigest, mimeType: mimeType, manifest: m}, instances, d.repoTags)
+	return nil
+}
+
+// chooseDefaultInstance returns the digest of an instance of list, which has been recorded by PutManifest,
+// to use for the legacy metadata and manifest.json.  It prefers the instance matching the platform in d.sysCtx,
+// and falls back to the first recorded instance (e.g. if only some of the instances were copied).
+func (d *Destination) chooseDefaultInstance(list manifest.List) (digest.Digest, error) {
+	if instanceDigest, err := list.ChooseInstance(d.sysCtx); err == nil {
+		if _, ok := d.instances[instanceDigest]; ok {
+			return instanceDigest, nil
+		}
+	}
+	for _, instanceDigest := range list.Instances() {
+		if _, ok := d.instances[instanceDigest]; ok {
+			logrus.Debugf("Using instance %s as the default image of the manifest list", instanceDigest)
+			return instanceDigest, nil
+		}
+	}
+	return "", errors.New("None of the instances of the manifest list have been written")
+}
+
+// LayersByDiffID returns the layers of the images recorded by PutManifest, indexed by their DiffIDs in the images' configs.
+// Images with configs which have not been written by PutBlob are ignored.
+func (d *Destination) LayersByDiffID() (map[digest.Digest]types.BlobInfo, error) {
+	manifests := [][]byte{}
+	if d.manifest != nil {
+		manifests = append(manifests, d.manifest)
+	}
+	for _, m := range d.instances {
+		manifests = append(manifests, m)
+	}
+	res := map[digest.Digest]types.BlobInfo{}
+	for _, m := range manifests {
+		man, err := parseSchema2Manifest(m)
+		if err != nil {
+			return nil, err
+		}
+		configBytes, ok := d.configs[man.ConfigDescriptor.Digest]
+		if !ok {
+			continue
+		}
+		var config manifest.Schema2Image
+		if err := json.Unmarshal(configBytes, &config); err != nil {
+			return nil, errors.Wrapf(err, "Error parsing config %s", man.ConfigDescriptor.Digest)
+		}
+		if config.RootFS == nil || len(config.RootFS.DiffIDs) != len(man.LayersDescriptors) {
+			return nil, errors.Errorf("Inconsistent layer count in config %s", man.ConfigDescriptor.Digest)
+		}
+		for i, l := range man.LayersDescriptors {
+			res[config.RootFS.DiffIDs[i]] = types.BlobInfo{Digest: l.Digest, Size: l.Size}
+		}
+	}
+	return res, nil
+}
 
-	return d.archive.ensureManifestItemLocked(man.LayersDescriptors, man.ConfigDescriptor.Digest, d.repoTags)
+// parseSchema2Manifest parses m, which must be a Docker schema 2 manifest.
+func parseSchema2Manifest(m []byte) (*manifest.Schema2, error) {
+	var man manifest.Schema2
+	if err := json.Unmarshal(m, &man); err != nil {
+		return nil, errors.Wrap(err, "Error parsing manifest")
+	}
+	if man.SchemaVersion != 2 || man.MediaType != manifest.DockerV2Schema2MediaType {
+		return nil, errors.Errorf("Unsupported manifest type, need a Docker schema 2 manifest")
+	}
+	return &man, nil
 }
 
-// PutSignatures would add the given signatures to the docker tarfile (currently not supported).
-// The instanceDigest value is expected to always be nil, because this transport does not support manifest lists, so
-// there can be no secondary manifests.  MUST be called after PutManifest (signatures reference manifest contents).
+// PutSignatures adds the given signatures to the docker tarfile, if enabled by AcceptSignatures.
+// The signatures, and the original manifest they refer to, are stored as separate files referenced
+// from the ManifestItem.Manifest and ManifestItem.Signatures fields of the image's manifest.json entry.
+// Layers are stored as the blobs referenced by the manifest, so compressed layers remain available for the signed manifest.
+// Signatures of manifest lists, or of their instances, are not supported.
+// MUST be called after PutManifest (signatures reference manifest contents).
 func (d *Destination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
+	if len(signatures) == 0 {
+		return nil
+	}
 	if instanceDigest != nil {
-		return errors.Errorf(`Manifest lists are not supported for docker tar files`)
+		return errors.Errorf("Storing signatures of manifest list instances in docker tar files is not supported")
 	}
-	if len(signatures) != 0 {
+	if !d.acceptsSignatures {
 		return errors.Errorf("Storing signatures for docker tar files is not supported")
 	}
-	return nil
+	if d.manifest == nil {
+		return errors.New("Unknown manifest, or a manifest list, can't add signatures")
+	}
+	if err := d.archive.lock(); err != nil {
+		return err
+	}
+	defer d.archive.unlock()
+
+	return d.archive.recordSignaturesLocked(d.configDigest, d.manifest, signatures)
 }
@@ -0,0 +1,171 @@
+package tarfile
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/internal/iolimits"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/memory"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putTestInstance writes a single-layer image for arch as an instance into dest, and returns a descriptor for the list.
+func putTestInstance(t *testing.T, dest *Destination, arch string) manifest.Schema2ManifestDescriptor {
+	ctx := context.Background()
+	cache := memory.New()
+
+	layer := []byte("layer for " + arch)
+	layerDigest := digest.FromBytes(layer)
+	_, err := dest.PutBlob(ctx, bytes.NewReader(layer), types.BlobInfo{Digest: layerDigest, Size: int64(len(layer))}, cache, false)
+	require.NoError(t, err)
+	config := []byte(`{"architecture":"` + arch + `","os":"linux","rootfs":{"type":"layers","diff_ids":["` + layerDigest.String() + `"]}}`)
+	configInfo, err := dest.PutBlob(ctx, bytes.NewReader(config), types.BlobInfo{Size: -1}, cache, true)
+	require.NoError(t, err)
+	m, err := manifest.Schema2FromComponents(
+		manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2ConfigMediaType, Size: configInfo.Size, Digest: configInfo.Digest},
+		[]manifest.Schema2Descriptor{{MediaType: manifest.DockerV2Schema2LayerMediaType, Size: int64(len(layer)), Digest: layerDigest}},
+	).Serialize()
+	require.NoError(t, err)
+	instanceDigest := digest.FromBytes(m)
+	err = dest.PutManifest(ctx, m, &instanceDigest)
+	require.NoError(t, err)
+	err = dest.PutSignatures(ctx, [][]byte{}, &instanceDigest)
+	require.NoError(t, err)
+	return manifest.Schema2ManifestDescriptor{
+		Schema2Descriptor: manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2MediaType, Size: int64(len(m)), Digest: instanceDigest},
+		Platform:          manifest.Schema2PlatformSpec{Architecture: arch, OS: "linux"},
+	}
+}
+
+func TestDestinationManifestList(t *testing.T) {
+	ctx := context.Background()
+	var tarfileBuffer bytes.Buffer
+	named, err := reference.ParseNormalizedNamed("example.com/ns/list:tag")
+	require.NoError(t, err)
+	tagged, ok := named.(reference.NamedTagged)
+	require.True(t, ok)
+
+	writer := NewWriter(&tarfileBuffer)
+	dest := NewDestination(&types.SystemContext{ArchitectureChoice: "arm64", OSChoice: "linux"}, writer, tagged)
+	assert.Equal(t, []string{manifest.DockerV2Schema2MediaType}, dest.SupportedManifestMIMETypes())
+	dest.AcceptManifestLists()
+	assert.Contains(t, dest.SupportedManifestMIMETypes(), manifest.DockerV2ListMediaType)
+	amd64 := putTestInstance(t, dest, "amd64")
+	arm64 := putTestInstance(t, dest, "arm64")
+	list, err := manifest.Schema2ListFromComponents([]manifest.Schema2ManifestDescriptor{amd64, arm64}).Serialize()
+	require.NoError(t, err)
+	err = dest.PutManifest(ctx, list, nil)
+	require.NoError(t, err)
+	err = dest.PutSignatures(ctx, [][]byte{[]byte("sig")}, nil)
+	assert.Error(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+	archive := tarfileBuffer.Bytes()
+
+	// The legacy metadata refers to the instance matching the platform.
+	reader, err := NewReaderFromStream(nil, bytes.NewReader(archive))
+	require.NoError(t, err)
+	defer reader.Close()
+	item, _, err := reader.ChooseManifestItem(tagged, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com/ns/list:tag"}, item.RepoTags)
+	config, err := reader.readTarComponent(item.Config, iolimits.MaxConfigBodySize)
+	require.NoError(t, err)
+	assert.Contains(t, string(config), `"architecture":"arm64"`)
+
+	// The OCI index refers to the full list, and all blobs are present.
+	files := map[string][]byte{}
+	links := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		switch h.Typeflag {
+		case tar.TypeReg:
+			contents, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			files[h.Name] = contents
+		case tar.TypeLink:
+			links[h.Name] = h.Linkname
+		}
+	}
+	var index imgspecv1.Index
+	err = json.Unmarshal(files["index.json"], &index)
+	require.NoError(t, err)
+	require.Len(t, index.Manifests, 1)
+	listDigest := digest.FromBytes(list)
+	assert.Equal(t, manifest.DockerV2ListMediaType, index.Manifests[0].MediaType)
+	assert.Equal(t, listDigest, index.Manifests[0].Digest)
+	assert.Equal(t, map[string]string{
+		imgspecv1.AnnotationRefName:   "tag",
+		containerdImageNameAnnotation: "example.com/ns/list:tag",
+	}, index.Manifests[0].Annotations)
+	assert.Contains(t, files, "oci-layout")
+	assert.Equal(t, list, files["blobs/sha256/"+listDigest.Hex()])
+	for _, instance := range []manifest.Schema2ManifestDescriptor{amd64, arm64} {
+		m, ok := files["blobs/sha256/"+instance.Digest.Hex()]
+		require.True(t, ok)
+		parsed, err := manifest.Schema2FromManifest(m)
+		require.NoError(t, err)
+		assert.Equal(t, parsed.ConfigDescriptor.Digest.Hex()+".json", links["blobs/sha256/"+parsed.ConfigDescriptor.Digest.Hex()])
+		for _, layer := range parsed.LayersDescriptors {
+			assert.Equal(t, layer.Digest.Hex()+".tar", links["blobs/sha256/"+layer.Digest.Hex()])
+		}
+	}
+}
+
+func TestDestinationSingleImageHasNoOCIIndex(t *testing.T) {
+	var tarfileBuffer bytes.Buffer
+	writer := NewWriter(&tarfileBuffer)
+	dest := NewDestination(nil, writer, nil)
+	instance := putTestInstance(t, dest, "amd64")
+	err := dest.PutManifest(context.Background(), dest.instances[instance.Digest], nil)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	tr := tar.NewReader(&tarfileBuffer)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.NotEqual(t, "index.json", h.Name)
+		assert.NotEqual(t, "oci-layout", h.Name)
+	}
+}
+
+func TestDestinationLayersByDiffID(t *testing.T) {
+	writer := NewWriter(ioutil.Discard)
+	dest := NewDestination(nil, writer, nil)
+	layers, err := dest.LayersByDiffID()
+	require.NoError(t, err)
+	assert.Len(t, layers, 0)
+
+	putTestInstance(t, dest, "amd64")
+	putTestInstance(t, dest, "arm64")
+	layers, err = dest.LayersByDiffID()
+	require.NoError(t, err)
+	assert.Len(t, layers, 2)
+	for _, arch := range []string{"amd64", "arm64"} {
+		layer := []byte("layer for " + arch)
+		assert.Equal(t, types.BlobInfo{Digest: digest.FromBytes(layer), Size: int64(len(layer))}, layers[digest.FromBytes(layer)], arch)
+	}
+	err = writer.Close()
+	require.NoError(t, err)
+}
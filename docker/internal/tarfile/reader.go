@@ -20,12 +20,13 @@ import (
 type Reader struct {
 	// None of the fields below are modified after the archive is created, until .Close();
 	// this allows concurrent readers of the same archive.
-	path          string         // "" if the archive has already been closed.
+	path          string         // "" if the archive has already been closed, or if it is read from stream.
 	removeOnClose bool           // Remove file on close if true
-	Manifest      []ManifestItem // Guaranteed to exist after the archive is created.
+	stream        *streamReader  // Set if the archive is read from a stream; nil if it has already been closed.
+	Manifest      []ManifestItem // Guaranteed to exist after the archive is created, unless it was created by NewStreamingReaderForImage(s).
 }
 
-// NewReaderFromFile returns a Reader for the specified path.
+// NewReaderFromFile returns a Reader for the specified path, which can be either compressed or uncompressed.
 // The caller should call .Close() on the returned archive when done.
 func NewReaderFromFile(sys *types.SystemContext, path string) (*Reader, error) {
 	file, err := os.Open(path)
@@ -34,14 +35,17 @@ func NewReaderFromFile(sys *types.SystemContext, path string) (*Reader, error) {
 	}
 	defer file.Close()
 
-	// If the file is already not compressed we can just return the file itself
-	// as a source. Otherwise we pass the stream to NewReaderFromStream.
-	stream, isCompressed, err := compression.AutoDecompress(file)
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error statting file %q", path)
+	}
+	// If the file is an uncompressed regular file we can just return the file itself
+	// as a source. Otherwise we pass the stream to NewReaderFromStream, which decompresses it.
+	decompressor, stream, err := compression.DetectCompression(file)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Error detecting compression for file %q", path)
 	}
-	defer stream.Close()
-	if !isCompressed {
+	if decompressor == nil && fi.Mode().IsRegular() {
 		return newReader(path, false)
 	}
 	return NewReaderFromStream(sys, stream)
@@ -87,14 +91,139 @@ func NewReaderFromStream(sys *types.SystemContext, inputStream io.Reader) (*Read
 	return newReader(tarCopyFile.Name(), true)
 }
 
+// NewStreamingReaderFromFile returns a Reader for the specified path, which can be either compressed or uncompressed,
+// suitable for reading a single image as NewStreamingReader.
+// An uncompressed regular file is read in place, and without the restrictions of NewStreamingReader.
+// A compressed regular file is read again when a component which has already been passed is needed, instead of
+// storing the components in temporary files.
+// The caller should call .Close() on the returned archive when done.
+func NewStreamingReaderFromFile(sys *types.SystemContext, path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening file %q", path)
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			file.Close()
+		}
+	}()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error statting file %q", path)
+	}
+	decompressor, stream, err := compression.DetectCompression(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error detecting compression for file %q", path)
+	}
+	if decompressor == nil && fi.Mode().IsRegular() {
+		file.Close()
+		succeeded = true
+		return newReader(path, false)
+	}
+	var reopen func() (io.ReadCloser, error)
+	if fi.Mode().IsRegular() {
+		reopen = func() (io.ReadCloser, error) {
+			return os.Open(path)
+		}
+	}
+	succeeded = true
+	return newStreamingReader(sys, readCloser{Reader: stream, Closer: file}, reopen)
+}
+
+// readCloser combines an io.Reader and an io.Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// NewStreamingReader returns a Reader for the specified inputStream, which can be either compressed or uncompressed,
+// reading it only once, in order, and only as far as necessary, instead of copying all of it to a temporary file first.
+// Components which must be read ahead of their use are kept in memory if they are small, or in individual
+// temporary files otherwise; components which are not referenced by manifest.json are discarded.
+//
+// This is intended for a single Source reading one image: components which are handed out directly from the stream
+// can only be read once; stored components are kept until the Reader is closed.  Generating a manifest requires
+// the sizes of all layers, so it reads (and stores) all of them, unless they precede manifest.json anyway.
+//
+// The Reader takes ownership of inputStream, and closes it when the Reader is closed (or if creating it fails).
+// The caller should call .Close() on the returned archive when done.
+func NewStreamingReader(sys *types.SystemContext, inputStream io.ReadCloser) (*Reader, error) {
+	return newStreamingReader(sys, inputStream, nil)
+}
+
+// newStreamingReader is NewStreamingReader, with an optional reopen function which returns a new stream with the same contents
+// as inputStream; layers which have already been passed are then read again, instead of being stored in temporary files.
+func newStreamingReader(sys *types.SystemContext, inputStream io.ReadCloser, reopen func() (io.ReadCloser, error)) (*Reader, error) {
+	stream, err := newStreamReader(sys, inputStream, reopen)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newArchiveReader(Reader{stream: stream})
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, item := range r.Manifest {
+		paths = append(paths, item.Config)
+		paths = append(paths, item.Layers...)
+		if item.Manifest != "" {
+			paths = append(paths, item.Manifest)
+		}
+		paths = append(paths, item.Signatures...)
+	}
+	stream.setWanted(paths)
+	return r, nil
+}
+
+// NewStreamingReaderForImage returns a Reader for inputStream, which contains a single image, reading it in order
+// like NewStreamingReader, but without reading manifest.json up front: components are instead found by the digests of their
+// contents, starting from the image's config (see NewSourceForImage). This allows finding the layers as soon as
+// the stream reaches them, even if manifest.json is at the end of the archive, as is the case with (docker save).
+// A layer can only be identified after it has been read completely, so the first pass over inputStream stores all of them.
+// If reopen is not nil, it must return a new stream with the same contents as inputStream; the first pass then only records
+// the digests and sizes of the layers, and the layers are read from a second pass, in the order of the stream;
+// only layers which the stream reaches before they are requested are stored.
+//
+// The returned Reader has no Manifest, and can only be used with NewSourceForImage, by a single Source.
+// The Reader takes ownership of inputStream, and closes it when the Reader is closed (or if creating it fails).
+// The caller should call .Close() on the returned archive when done.
+func NewStreamingReaderForImage(sys *types.SystemContext, inputStream io.ReadCloser, reopen func() (io.ReadCloser, error)) (*Reader, error) {
+	stream, err := newDigestIndexingStreamReader(sys, inputStream, reopen, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{stream: stream}, nil
+}
+
+// NewStreamingReaderForImages is like NewStreamingReaderForImage, but inputStream can contain several images, possibly sharing layers,
+// each of which can be read using NewSourceForImage. Components are never handed out directly from the stream, and all of them
+// are kept until the Reader is closed, so that they can be read by more than one Source.
+// The Reader takes ownership of inputStream, and closes it when the Reader is closed (or if creating it fails).
+// The caller should call .Close() on the returned archive when done.
+func NewStreamingReaderForImages(sys *types.SystemContext, inputStream io.ReadCloser) (*Reader, error) {
+	stream, err := newDigestIndexingStreamReader(sys, inputStream, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{stream: stream}, nil
+}
+
 // newReader creates a Reader for the specified path and removeOnClose flag.
 // The caller should call .Close() on the returned archive when done.
 func newReader(path string, removeOnClose bool) (*Reader, error) {
-	// This is a valid enough archive, except Manifest is not yet filled.
-	r := Reader{
+	return newArchiveReader(Reader{
 		path:          path,
 		removeOnClose: removeOnClose,
-	}
+	})
+}
+
+// newArchiveReader fills in Manifest of r, which must have the other members set.
+// r is closed on failure.
+// The caller should call .Close() on the returned archive when done.
+func newArchiveReader(r Reader) (*Reader, error) {
+	// r is a valid enough archive, except Manifest is not yet filled.
 	succeeded := false
 	defer func() {
 		if !succeeded {
@@ -122,6 +251,10 @@ func newReader(path string, removeOnClose bool) (*Reader, error) {
 
 // Close removes resources associated with an initialized Reader, if any.
 func (r *Reader) Close() error {
+	if stream := r.stream; stream != nil {
+		r.stream = nil // Mark the archive as closed
+		return stream.close()
+	}
 	path := r.path
 	r.path = "" // Mark the archive as closed
 	if r.removeOnClose {
@@ -183,9 +316,14 @@ func (t *tarReadCloser) Close() error {
 // openTarComponent returns a ReadCloser for the specific file within the archive.
 // This is linear scan; we assume that the tar file will have a fairly small amount of files (~layers),
 // and that filesystem caching will make the repeated seeking over the (uncompressed) tarPath cheap enough.
+// (Archives read from a stream are read in order instead, see NewStreamingReader.)
 // It is safe to call this method from multiple goroutines simultaneously.
 // The caller should call .Close() on the returned stream.
 func (r *Reader) openTarComponent(componentPath string) (io.ReadCloser, error) {
+	if r.stream != nil {
+		rc, _, err := r.stream.openTarComponent(componentPath)
+		return rc, err
+	}
 	// This is only a sanity check; if anyone did concurrently close ra, this access is technically
 	// racy against the write in .Close().
 	if r.path == "" {
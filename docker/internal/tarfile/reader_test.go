@@ -0,0 +1,59 @@
+package tarfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReaderFromFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "docker-tar-reader")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	const fixture = "../../archive/fixtures/almostempty.tar"
+	uncompressed, err := ioutil.ReadFile(fixture)
+	require.NoError(t, err)
+
+	// An uncompressed regular file is read in place.
+	reader, err := NewReaderFromFile(nil, fixture)
+	require.NoError(t, err)
+	assert.Equal(t, fixture, reader.path)
+	assert.False(t, reader.removeOnClose)
+	assert.Len(t, reader.Manifest, 1)
+	err = reader.Close()
+	require.NoError(t, err)
+
+	// Compressed files are decompressed into a temporary file.
+	for _, algorithm := range []compression.Algorithm{compression.Gzip, compression.Zstd, compression.Xz} {
+		path := filepath.Join(tmpDir, "archive."+algorithm.Name())
+		var compressed bytes.Buffer
+		w, err := compression.CompressStream(&compressed, algorithm, nil)
+		require.NoError(t, err)
+		_, err = w.Write(uncompressed)
+		require.NoError(t, err)
+		err = w.Close()
+		require.NoError(t, err)
+		err = ioutil.WriteFile(path, compressed.Bytes(), 0644)
+		require.NoError(t, err)
+
+		reader, err := NewReaderFromFile(nil, path)
+		require.NoError(t, err, algorithm.Name())
+		assert.NotEqual(t, path, reader.path, algorithm.Name())
+		assert.True(t, reader.removeOnClose, algorithm.Name())
+		assert.Len(t, reader.Manifest, 1, algorithm.Name())
+		copied, err := ioutil.ReadFile(reader.path)
+		require.NoError(t, err, algorithm.Name())
+		assert.Equal(t, uncompressed, copied, algorithm.Name())
+		tempPath := reader.path
+		err = reader.Close()
+		require.NoError(t, err, algorithm.Name())
+		_, err = os.Lstat(tempPath)
+		assert.True(t, os.IsNotExist(err), algorithm.Name())
+	}
+}
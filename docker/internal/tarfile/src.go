@@ -18,6 +18,7 @@ import (
 	"github.com/containers/image/v5/types"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // Source is a partial implementation of types.ImageSource for reading from tarPath.
@@ -27,12 +28,20 @@ type Source struct {
 	// If ref is nil and sourceIndex is -1, indicates the only image in the archive.
 	ref         reference.NamedTagged // May be nil
 	sourceIndex int                   // May be -1
+	// If set, the image is found by its config digest instead of using manifest.json, see NewSourceForImage.
+	imageConfigDigest digest.Digest
+	imageDiffIDs      []digest.Digest // The layer DiffIDs reported for the image with imageConfigDigest, if not nil.
 	// The following data is only available after ensureCachedDataIsPresent() succeeds
 	tarManifest       *ManifestItem // nil if not available yet.
 	configBytes       []byte
 	configDigest      digest.Digest
 	orderedDiffIDList []digest.Digest
 	knownLayers       map[digest.Digest]*layerInfo
+	layerSizesLock    sync.Mutex // Protects the size members of knownLayers, which may be updated by ensureLayerSizesAreKnown.
+	storedManifest    []byte     // Contents of tarManifest.Manifest, or nil if not set.
+	// Layers of storedManifest which are not stored uncompressed, indexed by their digests in storedManifest.
+	storedLayers     map[digest.Digest]*layerInfo
+	ignoreSignatures bool // tarManifest.Manifest does not match the image, so tarManifest.Signatures can't be used.
 	// Other state
 	generatedManifest []byte    // Private cache for GetManifest(), nil if not set yet.
 	cacheDataLock     sync.Once // Private state for ensureCachedDataIsPresent to make it concurrency-safe
@@ -40,8 +49,9 @@ type Source struct {
 }
 
 type layerInfo struct {
-	path string
-	size int64
+	path        string // "" if the layer is found by its digest, see NewSourceForImage.
+	size        int64  // -1 if not known.
+	archiveSize int64  // Size of the file at path in the archive, before decompression; -1 if not known.
 }
 
 // NewSource returns a tarfile.Source for an image in the specified archive matching ref
@@ -56,6 +66,23 @@ func NewSource(archive *Reader, closeArchive bool, ref reference.NamedTagged, so
 	}
 }
 
+// NewSourceForImage returns a tarfile.Source for the image with the specified config digest in archive, which must have been created
+// by NewStreamingReaderForImage or NewStreamingReaderForImages. If diffIDs is not nil, it is the list of the image's layer DiffIDs,
+// as reported by the archive's producer; the image's config must match it.
+// Neither the config nor the layers have to wait for manifest.json to be read. However, a layer can only be identified after
+// all of it has been read and its digest computed, so generating the manifest, which must contain the sizes of all layers,
+// reads all of them; they are only measured if the archive can be read again, and stored otherwise.
+// The archive will be closed if closeArchive
+func NewSourceForImage(archive *Reader, closeArchive bool, configDigest digest.Digest, diffIDs []digest.Digest) *Source {
+	return &Source{
+		archive:           archive,
+		closeArchive:      closeArchive,
+		sourceIndex:       -1,
+		imageConfigDigest: configDigest,
+		imageDiffIDs:      diffIDs,
+	}
+}
+
 // ensureCachedDataIsPresent loads data necessary for any of the public accessors.
 // It is safe to call this from multi-threaded code.
 func (s *Source) ensureCachedDataIsPresent() error {
@@ -68,6 +95,10 @@ func (s *Source) ensureCachedDataIsPresent() error {
 // ensureCachedDataIsPresentPrivate is a private implementation detail of ensureCachedDataIsPresent.
 // Call ensureCachedDataIsPresent instead.
 func (s *Source) ensureCachedDataIsPresentPrivate() error {
+	if s.imageConfigDigest != "" {
+		return s.ensureImageDataIsPresent()
+	}
+
 	tarManifest, _, err := s.archive.ChooseManifestItem(s.ref, s.sourceIndex)
 	if err != nil {
 		return err
@@ -90,16 +121,119 @@ func (s *Source) ensureCachedDataIsPresentPrivate() error {
 	if err != nil {
 		return err
 	}
+	configDigest := digest.FromBytes(configBytes)
+
+	var storedManifest []byte
+	var storedLayers map[digest.Digest]*layerInfo
+	ignoreSignatures := false
+	if tarManifest.Manifest != "" {
+		storedManifest, err = s.archive.readTarComponent(tarManifest.Manifest, iolimits.MaxManifestBodySize)
+		if err != nil {
+			return err
+		}
+		storedLayers, err = checkStoredManifest(storedManifest, configDigest, parsedConfig.RootFS.DiffIDs, knownLayers)
+		if err != nil {
+			// The image itself is still usable, with a generated manifest; only the signatures can't be verified.
+			logrus.Warnf("Ignoring manifest %s and signatures of it: %v", tarManifest.Manifest, err)
+			storedManifest = nil
+			ignoreSignatures = true
+		}
+	} else if len(tarManifest.Signatures) != 0 {
+		return errors.Errorf("Invalid manifest.json item: signatures are present, but the manifest they refer to is not")
+	}
 
 	// Success; commit.
 	s.tarManifest = tarManifest
 	s.configBytes = configBytes
-	s.configDigest = digest.FromBytes(configBytes)
+	s.configDigest = configDigest
+	s.orderedDiffIDList = parsedConfig.RootFS.DiffIDs
+	s.knownLayers = knownLayers
+	s.storedManifest = storedManifest
+	s.storedLayers = storedLayers
+	s.ignoreSignatures = ignoreSignatures
+	return nil
+}
+
+// ensureImageDataIsPresent is the variant of ensureCachedDataIsPresentPrivate for sources created by NewSourceForImage.
+func (s *Source) ensureImageDataIsPresent() error {
+	rc, _, err := s.archive.stream.openTarComponentByDigest(s.imageConfigDigest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	configBytes, err := iolimits.ReadAtMost(rc, iolimits.MaxConfigBodySize)
+	if err != nil {
+		return errors.Wrapf(err, "Error reading config %s", s.imageConfigDigest)
+	}
+	var parsedConfig manifest.Schema2Image // There's a lot of info there, but we only really care about layer DiffIDs.
+	if err := json.Unmarshal(configBytes, &parsedConfig); err != nil {
+		return errors.Wrapf(err, "Error decoding config %s", s.imageConfigDigest)
+	}
+	if parsedConfig.RootFS == nil {
+		return errors.Errorf("Invalid image config (rootFS is not set): %s", s.imageConfigDigest)
+	}
+	if s.imageDiffIDs != nil {
+		if len(s.imageDiffIDs) != len(parsedConfig.RootFS.DiffIDs) {
+			return errors.Errorf("Inconsistent layer count: %d reported for the image, %d in config", len(s.imageDiffIDs), len(parsedConfig.RootFS.DiffIDs))
+		}
+		for i, diffID := range s.imageDiffIDs {
+			if parsedConfig.RootFS.DiffIDs[i] != diffID {
+				return errors.Errorf("Layer %d DiffID %s reported for the image does not match DiffID %s in config", i, diffID, parsedConfig.RootFS.DiffIDs[i])
+			}
+		}
+	}
+
+	knownLayers := map[digest.Digest]*layerInfo{}
+	for _, diffID := range parsedConfig.RootFS.DiffIDs {
+		knownLayers[diffID] = &layerInfo{path: "", size: -1, archiveSize: -1}
+	}
+
+	// Success; commit.
+	s.configBytes = configBytes
+	s.configDigest = s.imageConfigDigest
 	s.orderedDiffIDList = parsedConfig.RootFS.DiffIDs
 	s.knownLayers = knownLayers
 	return nil
 }
 
+// checkStoredManifest verifies that manifestBytes, stored in the archive, describe exactly the image with configDigest
+// and layers with diffIDs (as found in knownLayers), so that it can be returned instead of a generated manifest.
+// Layers with digests which don't match their DiffIDs are the original compressed blobs, stored at the same paths as the layers
+// are found by their DiffIDs; checkStoredManifest returns them, indexed by their digests in manifestBytes.
+func checkStoredManifest(manifestBytes []byte, configDigest digest.Digest, diffIDs []digest.Digest, knownLayers map[digest.Digest]*layerInfo) (map[digest.Digest]*layerInfo, error) {
+	if mt := manifest.GuessMIMEType(manifestBytes); mt != manifest.DockerV2Schema2MediaType {
+		return nil, errors.Errorf("Unexpected manifest type %q", mt)
+	}
+	m, err := manifest.Schema2FromManifest(manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+	if m.ConfigDescriptor.Digest != configDigest {
+		return nil, errors.Errorf("Config digest %s does not match the image config %s", m.ConfigDescriptor.Digest, configDigest)
+	}
+	if len(m.LayersDescriptors) != len(diffIDs) {
+		return nil, errors.Errorf("Inconsistent layer count: %d in manifest, %d in config", len(m.LayersDescriptors), len(diffIDs))
+	}
+	storedLayers := map[digest.Digest]*layerInfo{}
+	for i, l := range m.LayersDescriptors {
+		li := knownLayers[diffIDs[i]]
+		if l.Digest == diffIDs[i] {
+			if li.size != -1 && l.Size != li.size {
+				return nil, errors.Errorf("Layer %s size %d does not match the stored layer size %d", l.Digest, l.Size, li.size)
+			}
+			continue
+		}
+		if li.archiveSize != -1 && l.Size != li.archiveSize {
+			return nil, errors.Errorf("Layer %d size %d does not match the size %d of the stored compressed layer %s", i, l.Size, li.archiveSize, li.path)
+		}
+		if other, ok := storedLayers[l.Digest]; ok && other.path != li.path {
+			return nil, errors.Errorf("Layer %s is stored as both %s and %s", l.Digest, other.path, li.path)
+		}
+		storedLayers[l.Digest] = &layerInfo{path: li.path, size: l.Size, archiveSize: l.Size}
+	}
+	return storedLayers, nil
+}
+
 // Close removes resources associated with an initialized Source, if any.
 func (s *Source) Close() error {
 	if s.closeArchive {
@@ -132,13 +266,28 @@ func (s *Source) prepareLayerData(tarManifest *ManifestItem, parsedConfig *manif
 			return nil, errors.Errorf("Layer tarfile %s used for two different DiffID values", layerPath)
 		}
 		li := &layerInfo{ // A new element in each iteration
-			path: layerPath,
-			size: -1,
+			path:        layerPath,
+			size:        -1,
+			archiveSize: -1,
 		}
 		knownLayers[diffID] = li
 		unknownLayerSizes[layerPath] = li
 	}
 
+	if s.archive.stream != nil {
+		// Don't read the stream any further just to find the sizes: layers which have not been read yet
+		// may still be handed out directly from the stream. Their sizes are found only if a manifest is generated.
+		for layerPath, li := range unknownLayerSizes {
+			size, err := s.archive.stream.knownUncompressedSize(layerPath)
+			if err != nil {
+				return nil, err
+			}
+			li.size = size
+			li.archiveSize = s.archive.stream.knownSize(layerPath)
+		}
+		return knownLayers, nil
+	}
+
 	// Scan the tar file to collect layer sizes.
 	file, err := os.Open(s.archive.path)
 	if err != nil {
@@ -157,25 +306,12 @@ func (s *Source) prepareLayerData(tarManifest *ManifestItem, parsedConfig *manif
 		layerPath := path.Clean(h.Name)
 		// FIXME: Cache this data across images in Reader.
 		if li, ok := unknownLayerSizes[layerPath]; ok {
-			// Since GetBlob will decompress layers that are compressed we need
-			// to do the decompression here as well, otherwise we will
-			// incorrectly report the size. Pretty critical, since tools like
-			// umoci always compress layer blobs. Obviously we only bother with
-			// the slower method of checking if it's compressed.
-			uncompressedStream, isCompressed, err := compression.AutoDecompress(t)
+			size, err := uncompressedSize(layerPath, t, h.Size)
 			if err != nil {
-				return nil, errors.Wrapf(err, "Error auto-decompressing %s to determine its size", layerPath)
-			}
-			defer uncompressedStream.Close()
-
-			uncompressedSize := h.Size
-			if isCompressed {
-				uncompressedSize, err = io.Copy(ioutil.Discard, uncompressedStream)
-				if err != nil {
-					return nil, errors.Wrapf(err, "Error reading %s to find its size", layerPath)
-				}
+				return nil, err
 			}
-			li.size = uncompressedSize
+			li.size = size
+			li.archiveSize = h.Size
 			delete(unknownLayerSizes, layerPath)
 		}
 	}
@@ -201,6 +337,13 @@ func (s *Source) GetManifest(ctx context.Context, instanceDigest *digest.Digest)
 		if err := s.ensureCachedDataIsPresent(); err != nil {
 			return nil, "", err
 		}
+		if s.storedManifest != nil {
+			// Use the original manifest, so that signatures of it can be verified.
+			return s.storedManifest, manifest.DockerV2Schema2MediaType, nil
+		}
+		if err := s.ensureLayerSizesAreKnown(); err != nil {
+			return nil, "", err
+		}
 		m := manifest.Schema2{
 			SchemaVersion: 2,
 			MediaType:     manifest.DockerV2Schema2MediaType,
@@ -219,7 +362,7 @@ func (s *Source) GetManifest(ctx context.Context, instanceDigest *digest.Digest)
 			m.LayersDescriptors = append(m.LayersDescriptors, manifest.Schema2Descriptor{
 				Digest:    diffID, // diffID is a digest of the uncompressed tarball
 				MediaType: manifest.DockerV2Schema2LayerMediaType,
-				Size:      li.size,
+				Size:      s.layerSize(li),
 			})
 		}
 		manifestBytes, err := json.Marshal(&m)
@@ -231,6 +374,55 @@ func (s *Source) GetManifest(ctx context.Context, instanceDigest *digest.Digest)
 	return s.generatedManifest, manifest.DockerV2Schema2MediaType, nil
 }
 
+// ensureLayerSizesAreKnown finds the sizes of all layers in s.knownLayers which are not known yet, reading the stream
+// of a streamed archive as far as necessary. If the archive can be read again, the layers passed on the way are only measured,
+// and read again when they are needed; otherwise they are stored.
+func (s *Source) ensureLayerSizesAreKnown() error {
+	s.layerSizesLock.Lock()
+	defer s.layerSizesLock.Unlock()
+	for diffID, li := range s.knownLayers {
+		if li.size != -1 {
+			continue
+		}
+		if s.archive.stream == nil {
+			return errors.Errorf("Internal error: unknown size of layer %s", diffID)
+		}
+		var size int64
+		var err error
+		if li.path != "" {
+			size, err = s.archive.stream.uncompressedSize(li.path)
+		} else {
+			size, err = s.layerSizeByDigest(diffID)
+		}
+		if err != nil {
+			return err
+		}
+		li.size = size
+	}
+	return nil
+}
+
+// layerSizeByDigest returns the size of the layer with diffID, for sources created by NewSourceForImage.
+func (s *Source) layerSizeByDigest(diffID digest.Digest) (int64, error) {
+	size, err := s.archive.stream.sizeByDigest(diffID)
+	if err == nil || !os.IsNotExist(errors.Cause(err)) {
+		return size, err
+	}
+	// The layer is not stored uncompressed, see openLayerByDigest.
+	layerPath, err := s.layerPathFromManifest(diffID)
+	if err != nil {
+		return -1, err
+	}
+	return s.archive.stream.uncompressedSize(layerPath)
+}
+
+// layerSize returns the size of li, or -1 if it is not known yet.
+func (s *Source) layerSize(li *layerInfo) int64 {
+	s.layerSizesLock.Lock()
+	defer s.layerSizesLock.Unlock()
+	return li.size
+}
+
 // uncompressedReadCloser is an io.ReadCloser that closes both the uncompressed stream and the underlying input.
 type uncompressedReadCloser struct {
 	io.Reader
@@ -266,8 +458,22 @@ func (s *Source) GetBlob(ctx context.Context, info types.BlobInfo, cache types.B
 		return ioutil.NopCloser(bytes.NewReader(s.configBytes)), int64(len(s.configBytes)), nil
 	}
 
+	if li, ok := s.storedLayers[info.Digest]; ok { // The original blob of a compressed layer, referenced by s.storedManifest.
+		stream, err := s.archive.openTarComponent(li.path)
+		if err != nil {
+			return nil, 0, err
+		}
+		return stream, li.size, nil
+	}
+
 	if li, ok := s.knownLayers[info.Digest]; ok { // diffID is a digest of the uncompressed tarball,
-		underlyingStream, err := s.archive.openTarComponent(li.path)
+		var underlyingStream io.ReadCloser
+		var err error
+		if li.path != "" {
+			underlyingStream, err = s.archive.openTarComponent(li.path)
+		} else {
+			underlyingStream, err = s.openLayerByDigest(info.Digest)
+		}
 		if err != nil {
 			return nil, 0, err
 		}
@@ -302,12 +508,59 @@ func (s *Source) GetBlob(ctx context.Context, info types.BlobInfo, cache types.B
 		}
 		closeUnderlyingStream = false
 
-		return newStream, li.size, nil
+		return newStream, s.layerSize(li), nil
 	}
 
 	return nil, 0, errors.Errorf("Unknown blob %s", info.Digest)
 }
 
+// openLayerByDigest returns a stream for the layer with diffID, for sources created by NewSourceForImage.
+func (s *Source) openLayerByDigest(diffID digest.Digest) (io.ReadCloser, error) {
+	rc, _, err := s.archive.stream.openTarComponentByDigest(diffID)
+	if err == nil || !os.IsNotExist(errors.Cause(err)) {
+		return rc, err
+	}
+	// The layer is not stored uncompressed, so its contents don't match diffID. The whole archive has been read by now,
+	// so find the layer's path in manifest.json instead.
+	layerPath, err := s.layerPathFromManifest(diffID)
+	if err != nil {
+		return nil, err
+	}
+	return s.archive.openTarComponent(layerPath)
+}
+
+// layerPathFromManifest returns the path of the layer with diffID, as recorded in the manifest.json item for the image with s.configDigest.
+// It should only be used after the whole archive has been read.
+func (s *Source) layerPathFromManifest(diffID digest.Digest) (string, error) {
+	manifestBytes, err := s.archive.readTarComponent(manifestFileName, iolimits.MaxTarFileManifestSize)
+	if err != nil {
+		return "", err
+	}
+	var items []ManifestItem
+	if err := json.Unmarshal(manifestBytes, &items); err != nil {
+		return "", errors.Wrap(err, "Error decoding tar manifest.json")
+	}
+	for _, item := range items {
+		configBytes, err := s.archive.readTarComponent(item.Config, iolimits.MaxConfigBodySize)
+		if err != nil {
+			return "", err
+		}
+		if digest.FromBytes(configBytes) != s.configDigest {
+			continue
+		}
+		if len(item.Layers) != len(s.orderedDiffIDList) {
+			return "", errors.Errorf("Inconsistent layer count: %d in manifest, %d in config", len(item.Layers), len(s.orderedDiffIDList))
+		}
+		for i, d := range s.orderedDiffIDList {
+			if d == diffID {
+				return path.Clean(item.Layers[i]), nil
+			}
+		}
+		return "", errors.Errorf("Internal inconsistency: layer %s not found in config", diffID)
+	}
+	return "", errors.Errorf("Image with config %s not found in manifest.json", s.configDigest)
+}
+
 // GetSignatures returns the image's signatures.  It may use a remote (= slow) service.
 // This source implementation does not support manifest lists, so the passed-in instanceDigest should always be nil,
 // as there can be no secondary manifests.
@@ -316,7 +569,24 @@ func (s *Source) GetSignatures(ctx context.Context, instanceDigest *digest.Diges
 		// How did we even get here? GetManifest(ctx, nil) has returned a manifest.DockerV2Schema2MediaType.
 		return nil, errors.Errorf(`Manifest lists are not supported by "docker-daemon:"`)
 	}
-	return [][]byte{}, nil
+	if err := s.ensureCachedDataIsPresent(); err != nil {
+		return nil, err
+	}
+	signatures := [][]byte{}
+	if s.tarManifest == nil { // NewSourceForImage; manifest.json is not read, and (docker save) never includes signatures anyway.
+		return signatures, nil
+	}
+	if s.ignoreSignatures {
+		return signatures, nil
+	}
+	for _, path := range s.tarManifest.Signatures {
+		sig, err := s.archive.readTarComponent(path, iolimits.MaxSignatureBodySize)
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, sig)
+	}
+	return signatures, nil
 }
 
 // LayerInfosForCopy returns either nil (meaning the values in the manifest are fine), or updated values for the layer
@@ -3,12 +3,15 @@ package tarfile
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"testing"
 
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/pkg/blobinfocache/memory"
+	"github.com/containers/image/v5/pkg/compression"
 	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -63,3 +66,175 @@ func TestSourcePrepareLayerData(t *testing.T) {
 		}
 	}
 }
+
+func TestSourceSignatures(t *testing.T) {
+	cache := memory.New()
+	var tarfileBuffer bytes.Buffer
+	ctx := context.Background()
+
+	layer := []byte("layer contents")
+	layerDigest := digest.FromBytes(layer)
+	config := []byte(`{"rootfs":{"type":"layers","diff_ids":["` + layerDigest.String() + `"]}}`)
+
+	writer := NewWriter(&tarfileBuffer)
+	dest := NewDestination(nil, writer, nil)
+	assert.Error(t, dest.SupportsSignatures(ctx))
+	dest.AcceptSignatures()
+	assert.NoError(t, dest.SupportsSignatures(ctx))
+
+	_, err := dest.PutBlob(ctx, bytes.NewReader(layer), types.BlobInfo{Digest: layerDigest, Size: int64(len(layer))}, cache, false)
+	require.NoError(t, err)
+	configInfo, err := dest.PutBlob(ctx, bytes.NewReader(config), types.BlobInfo{Size: -1}, cache, true)
+	require.NoError(t, err)
+	m := manifest.Schema2FromComponents(
+		manifest.Schema2Descriptor{
+			MediaType: manifest.DockerV2Schema2ConfigMediaType,
+			Size:      configInfo.Size,
+			Digest:    configInfo.Digest,
+		}, []manifest.Schema2Descriptor{{
+			MediaType: manifest.DockerV2Schema2LayerMediaType,
+			Size:      int64(len(layer)),
+			Digest:    layerDigest,
+		}})
+	// Use a formatting different from the manifest GetManifest would generate.
+	manifestBytes, err := json.MarshalIndent(m, "", "   ")
+	require.NoError(t, err)
+	signatures := [][]byte{[]byte("sig1"), []byte("sig2")}
+
+	err = dest.PutSignatures(ctx, signatures, nil)
+	assert.Error(t, err) // PutManifest has not been called yet
+	err = dest.PutManifest(ctx, manifestBytes, nil)
+	require.NoError(t, err)
+	err = dest.PutSignatures(ctx, signatures, nil)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	reader, err := NewReaderFromStream(nil, &tarfileBuffer)
+	require.NoError(t, err)
+	src := NewSource(reader, true, nil, -1)
+	defer src.Close()
+	m2, mimeType, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, manifestBytes, m2)
+	assert.Equal(t, manifest.DockerV2Schema2MediaType, mimeType)
+	sigs, err := src.GetSignatures(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, signatures, sigs)
+	items := src.TarManifest()
+	require.Len(t, items, 1)
+	assert.Equal(t, digest.FromBytes(manifestBytes).Hex()+".manifest.json", items[0].Manifest)
+	assert.Len(t, items[0].Signatures, 2)
+}
+
+func TestSourceSignaturesWithCompressedLayers(t *testing.T) {
+	cache := memory.New()
+	var tarfileBuffer bytes.Buffer
+	ctx := context.Background()
+
+	layer := []byte("layer contents")
+	var compressedBuffer bytes.Buffer
+	compressor, err := compression.CompressStream(&compressedBuffer, compression.Gzip, nil)
+	require.NoError(t, err)
+	_, err = compressor.Write(layer)
+	require.NoError(t, err)
+	err = compressor.Close()
+	require.NoError(t, err)
+	compressedLayer := compressedBuffer.Bytes()
+	compressedDigest := digest.FromBytes(compressedLayer)
+	config := []byte(`{"rootfs":{"type":"layers","diff_ids":["` + digest.FromBytes(layer).String() + `"]}}`)
+
+	writer := NewWriter(&tarfileBuffer)
+	dest := NewDestination(nil, writer, nil)
+	dest.AcceptSignatures()
+	_, err = dest.PutBlob(ctx, bytes.NewReader(compressedLayer), types.BlobInfo{Digest: compressedDigest, Size: int64(len(compressedLayer))}, cache, false)
+	require.NoError(t, err)
+	configInfo, err := dest.PutBlob(ctx, bytes.NewReader(config), types.BlobInfo{Size: -1}, cache, true)
+	require.NoError(t, err)
+	manifestBytes, err := manifest.Schema2FromComponents(
+		manifest.Schema2Descriptor{
+			MediaType: manifest.DockerV2Schema2ConfigMediaType,
+			Size:      configInfo.Size,
+			Digest:    configInfo.Digest,
+		}, []manifest.Schema2Descriptor{{
+			MediaType: manifest.DockerV2Schema2LayerMediaType,
+			Size:      int64(len(compressedLayer)),
+			Digest:    compressedDigest,
+		}}).Serialize()
+	require.NoError(t, err)
+	err = dest.PutManifest(ctx, manifestBytes, nil)
+	require.NoError(t, err)
+	signatures := [][]byte{[]byte("sig1")}
+	err = dest.PutSignatures(ctx, signatures, nil)
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	reader, err := NewReaderFromStream(nil, &tarfileBuffer)
+	require.NoError(t, err)
+	src := NewSource(reader, true, nil, -1)
+	defer src.Close()
+	m, _, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, manifestBytes, m)
+	sigs, err := src.GetSignatures(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, signatures, sigs)
+	// The compressed layer referenced by the signed manifest is available as is,
+	// and the uncompressed layer is available using its DiffID.
+	for _, c := range []struct {
+		digest   digest.Digest
+		contents []byte
+	}{
+		{compressedDigest, compressedLayer},
+		{digest.FromBytes(layer), layer},
+	} {
+		blob, size, err := src.GetBlob(ctx, types.BlobInfo{Digest: c.digest, Size: -1}, cache)
+		require.NoError(t, err)
+		blobContents, err := ioutil.ReadAll(blob)
+		require.NoError(t, err)
+		assert.Equal(t, c.contents, blobContents)
+		assert.Equal(t, int64(len(c.contents)), size)
+		err = blob.Close()
+		require.NoError(t, err)
+	}
+}
+
+func TestCheckStoredManifest(t *testing.T) {
+	layerDigest := digest.FromString("layer")
+	configDigest := digest.FromString("config")
+	knownLayers := map[digest.Digest]*layerInfo{layerDigest: {path: "layer.tar", size: 5, archiveSize: 3}}
+	valid := manifest.Schema2FromComponents(
+		manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2ConfigMediaType, Size: 6, Digest: configDigest},
+		[]manifest.Schema2Descriptor{{MediaType: manifest.DockerV2Schema2LayerMediaType, Size: 5, Digest: layerDigest}})
+
+	for _, c := range []struct {
+		name  string
+		edit  func(m *manifest.Schema2)
+		valid bool
+	}{
+		{"valid", func(m *manifest.Schema2) {}, true},
+		{"config digest", func(m *manifest.Schema2) { m.ConfigDescriptor.Digest = digest.FromString("other") }, false},
+		{"layer count", func(m *manifest.Schema2) { m.LayersDescriptors = nil }, false},
+		{"layer digest", func(m *manifest.Schema2) { m.LayersDescriptors[0].Digest = digest.FromString("other") }, false},
+		{"layer size", func(m *manifest.Schema2) { m.LayersDescriptors[0].Size = 6 }, false},
+		{"compressed layer", func(m *manifest.Schema2) {
+			m.LayersDescriptors[0].Digest = digest.FromString("compressed")
+			m.LayersDescriptors[0].Size = 3
+		}, true},
+	} {
+		m := *valid
+		m.LayersDescriptors = append([]manifest.Schema2Descriptor{}, valid.LayersDescriptors...)
+		c.edit(&m)
+		manifestBytes, err := m.Serialize()
+		require.NoError(t, err, c.name)
+		_, err = checkStoredManifest(manifestBytes, configDigest, []digest.Digest{layerDigest}, knownLayers)
+		if c.valid {
+			assert.NoError(t, err, c.name)
+		} else {
+			assert.Error(t, err, c.name)
+		}
+	}
+	_, err := checkStoredManifest([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`), configDigest, []digest.Digest{layerDigest}, knownLayers)
+	assert.Error(t, err)
+}
@@ -0,0 +1,735 @@
+package tarfile
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/containers/image/v5/internal/tmpdir"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxBufferedFileSize is the size of the largest file which is kept in memory when a streamReader has to read past it;
+// larger files are spooled into individual temporary files, or skipped and read again later.
+// This is enough for configs, signatures and the various metadata files, but not for layers.
+const maxBufferedFileSize = 1024 * 1024
+
+// streamEntry is a regular file which the stream has passed.
+type streamEntry struct {
+	size             int64         // Size in the archive.
+	uncompressedSize int64         // Size after decompression, if the file is compressed; -1 if not known.
+	pass             int           // The last pass over the input in which the stream has passed the file.
+	stored           bool          // The contents are available in data or tempFile.
+	handedOut        bool          // The contents have been handed out directly from the stream at least once.
+	data             []byte        // Contents of the file, if they are kept in memory.
+	tempFile         string        // Path to a temporary file with the contents of the file, if it was spooled.
+	digest           digest.Digest // Digest of the contents, if the streamReader indexes files by digest and it is known.
+}
+
+// componentRequest is a pending request for a component, identified by its path or by the digest of its contents.
+type componentRequest struct {
+	path      string               // path.Clean()ed; "" if the component is identified by digest.
+	digest    digest.Digest        // "" if the component is identified by path.
+	measure   bool                 // Only the size of the component is needed, so it is never handed out.
+	handedOut *handedOutReadCloser // Set when the stream reaches the component and hands it out to the request.
+}
+
+// streamReader reads a (docker save)-formatted tar archive from a stream, in order.
+//
+// Components are read from the stream only when they are needed. A component which is requested when the stream
+// reaches it is handed out directly, without storing it; the stream continues when the caller has read all of it,
+// or closed it. Small files the stream passes by are kept in memory. Larger ones are spooled into individual
+// temporary files, unless the input can be read again (see reopen): then the first pass over the input only
+// records their sizes, and a component which has been passed without storing it is read from a new pass, in which
+// all components which have not been handed out yet are stored.
+// Once manifest.json has been read, components not referenced by it are discarded. Stored components are kept
+// until the streamReader is closed, so that they can be read more than once (e.g. when a copy is retried,
+// or an image contains the same layer twice).
+type streamReader struct {
+	// mutex protects all of the members below. It is never held while reading the input.
+	mutex sync.Mutex
+	// changed is broadcast whenever the stream becomes available, or passes a component.
+	changed *sync.Cond
+	sys     *types.SystemContext
+	// reopen, if not nil, opens the input again, for another pass over it.
+	reopen       func() (io.ReadCloser, error)
+	input        io.Closer               // The original input stream.
+	uncompressed io.Closer               // The uncompressed stream which tar reads from.
+	tar          *tar.Reader             // nil after reaching the end of the current pass.
+	pass         int                     // Number of the current pass over the input, starting with 0.
+	busy         bool                    // The stream is being read without holding mutex, or a component is handed out from it.
+	closed       bool                    // The streamReader has been closed.
+	tempDir      string                  // "" until the first file is spooled.
+	entries      map[string]*streamEntry // Regular files passed so far, indexed by path.Clean(name).
+	links        map[string]string       // Targets of links read so far, indexed by path.Clean(name).
+	// digests maps digests of the contents of regular files passed so far to their paths, or is nil if files are not indexed by digest,
+	// see newDigestIndexingStreamReader.
+	digests map[digest.Digest]string
+	// keepComponents is set if components are never handed out directly from the stream, so that all of them
+	// can be read more than once; see newDigestIndexingStreamReader.
+	keepComponents bool
+	// wanted is the set of paths referenced by manifest.json, or nil if manifest.json has not been read yet.
+	// Other files are discarded.
+	wanted   map[string]struct{}
+	requests map[*componentRequest]struct{} // Requests waiting for the stream.
+	err      error                          // Set if reading the stream failed; nothing more can be read after that.
+}
+
+// newStreamReader returns a streamReader for input, which can be either compressed or uncompressed.
+// If reopen is not nil, it must return a new stream with the same contents as input; large components are then
+// read again instead of being stored in temporary files.
+// The streamReader takes ownership of input, even on failure.
+// The caller should call .close() on the returned object when done.
+func newStreamReader(sys *types.SystemContext, input io.ReadCloser, reopen func() (io.ReadCloser, error)) (*streamReader, error) {
+	uncompressed, _, err := compression.AutoDecompress(input)
+	if err != nil {
+		input.Close()
+		return nil, errors.Wrap(err, "Error auto-decompressing input")
+	}
+	s := &streamReader{
+		sys:          sys,
+		reopen:       reopen,
+		input:        input,
+		uncompressed: uncompressed,
+		tar:          tar.NewReader(uncompressed),
+		entries:      map[string]*streamEntry{},
+		links:        map[string]string{},
+		requests:     map[*componentRequest]struct{}{},
+	}
+	s.changed = sync.NewCond(&s.mutex)
+	return s, nil
+}
+
+// newDigestIndexingStreamReader is like newStreamReader, but the returned streamReader also records the digests of
+// all regular files it passes, so that they can be found using openTarComponentByDigest, before (or without) reading manifest.json.
+// If keepComponents, components are never handed out directly from the stream, so that all of them can be read more than once.
+func newDigestIndexingStreamReader(sys *types.SystemContext, input io.ReadCloser, reopen func() (io.ReadCloser, error), keepComponents bool) (*streamReader, error) {
+	s, err := newStreamReader(sys, input, reopen)
+	if err != nil {
+		return nil, err
+	}
+	s.digests = map[digest.Digest]string{}
+	s.keepComponents = keepComponents
+	return s, nil
+}
+
+// close releases resources associated with s, including any spooled files.
+func (s *streamReader) close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	if s.err == nil {
+		s.err = errors.New("Internal error: reading from a closed archive")
+	}
+	s.changed.Broadcast()
+	s.tar = nil
+	err := s.closeInputLocked()
+	if s.tempDir != "" {
+		if err2 := os.RemoveAll(s.tempDir); err2 != nil && err == nil {
+			err = err2
+		}
+		s.tempDir = ""
+	}
+	return err
+}
+
+// closeInputLocked closes the input of the current pass.
+// The caller must hold s.mutex.
+func (s *streamReader) closeInputLocked() error {
+	err := s.uncompressed.Close()
+	if err2 := s.input.Close(); err2 != nil && err == nil {
+		err = err2
+	}
+	return err
+}
+
+// setWanted records that only components at paths (and the targets of links at paths) need to be kept from now on,
+// and discards any components already read which are not needed.
+func (s *streamReader) setWanted(paths []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.wanted = map[string]struct{}{}
+	for _, p := range paths {
+		p = path.Clean(p)
+		s.wanted[p] = struct{}{}
+		if target, ok := s.links[p]; ok {
+			s.wanted[target] = struct{}{}
+		}
+	}
+	for name, e := range s.entries {
+		if _, ok := s.wanted[name]; !ok {
+			s.releaseLocked(name, e)
+			s.removeEntryLocked(name)
+		}
+	}
+}
+
+// lookupLocked returns the path and entry for componentPath, following one level of links,
+// or ("", nil) if the stream has not passed it yet.
+// The caller must hold s.mutex.
+func (s *streamReader) lookupLocked(componentPath string) (string, *streamEntry) {
+	if e, ok := s.entries[componentPath]; ok {
+		return componentPath, e
+	}
+	if target, ok := s.links[componentPath]; ok {
+		if e, ok := s.entries[target]; ok {
+			return target, e
+		}
+	}
+	return "", nil
+}
+
+// lookupRequestLocked returns the path and entry requested by req, or ("", nil) if the stream has not passed it yet.
+// The caller must hold s.mutex.
+func (s *streamReader) lookupRequestLocked(req *componentRequest) (string, *streamEntry) {
+	if req.digest != "" {
+		if name, ok := s.digests[req.digest]; ok {
+			return name, s.entries[name]
+		}
+		return "", nil
+	}
+	return s.lookupLocked(req.path)
+}
+
+// satisfied returns true if e, found for req, can be used without reading the stream.
+func (req *componentRequest) satisfied(e *streamEntry) bool {
+	return req.handedOut != nil || (e != nil && (e.stored || (req.measure && e.uncompressedSize != -1)))
+}
+
+// anyRequestAheadLocked returns true if any pending request can be satisfied by reading further in the current pass.
+// The caller must hold s.mutex.
+func (s *streamReader) anyRequestAheadLocked() bool {
+	for req := range s.requests {
+		if _, e := s.lookupRequestLocked(req); !req.satisfied(e) && (e == nil || e.pass < s.pass) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestForLocked returns a pending request which the regular file at name, with contents matching d (if not ""),
+// can be handed out to, or nil if there is none.
+// The caller must hold s.mutex.
+func (s *streamReader) requestForLocked(name string, d digest.Digest) *componentRequest {
+	for req := range s.requests {
+		if req.measure || req.handedOut != nil {
+			continue
+		}
+		if req.digest != "" {
+			if req.digest == d || s.digests[req.digest] == name {
+				return req
+			}
+		} else if req.path == name || s.links[req.path] == name {
+			return req
+		}
+	}
+	return nil
+}
+
+// waitForLocked reads the stream, or waits for other goroutines to read it, until req is satisfied, starting a new pass
+// over the input if the stream has already passed the component without storing it; description is used in error messages.
+// It returns the path and entry of the component, unless it has been handed out to req.
+// The caller must hold s.mutex; it is released while reading the stream.
+func (s *streamReader) waitForLocked(req *componentRequest, description string) (string, *streamEntry, error) {
+	s.requests[req] = struct{}{}
+	defer delete(s.requests, req)
+	for {
+		name, e := s.lookupRequestLocked(req)
+		if req.satisfied(e) {
+			return name, e, nil
+		}
+		if s.err != nil {
+			return "", nil, s.err
+		}
+		if s.busy {
+			s.changed.Wait()
+			continue
+		}
+		if s.tar != nil && s.anyRequestAheadLocked() {
+			if err := s.readNextLocked(); err != nil {
+				return "", nil, errors.Wrapf(err, "Error reading %s from the archive", description)
+			}
+			continue
+		}
+		// No pending request can be satisfied by reading further, so req has been passed in the current pass without storing it,
+		// or it is missing.
+		if s.tar == nil && (e == nil || e.pass != s.pass) {
+			return "", nil, errors.Wrapf(os.ErrNotExist, "Error reading %s from the archive", description)
+		}
+		if s.reopen == nil {
+			return "", nil, errors.Errorf("Error reading %s: it has already been read from a streamed archive", description)
+		}
+		if err := s.restartLocked(); err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+// restartLocked starts a new pass over the input.
+// The caller must hold s.mutex, the stream must not be busy, and s.reopen must not be nil.
+func (s *streamReader) restartLocked() error {
+	s.busy = true
+	s.mutex.Unlock()
+	logrus.Debugf("Reading the archive again, pass %d", s.pass+2)
+	input, err := s.reopen()
+	var uncompressed io.ReadCloser
+	if err == nil {
+		uncompressed, _, err = compression.AutoDecompress(input)
+		if err != nil {
+			input.Close()
+		}
+	}
+	s.mutex.Lock()
+	s.busy = false
+	s.changed.Broadcast()
+	if err != nil {
+		err = errors.Wrap(err, "Error reading the archive again")
+		if s.err == nil {
+			s.err = err
+		}
+		return err
+	}
+	if s.closed {
+		uncompressed.Close()
+		input.Close()
+		return s.err
+	}
+	if err := s.closeInputLocked(); err != nil {
+		logrus.Debugf("Error closing the previous pass over the archive: %v", err)
+	}
+	s.input = input
+	s.uncompressed = uncompressed
+	s.tar = tar.NewReader(uncompressed)
+	s.pass++
+	return nil
+}
+
+// readNextLocked reads the next entry from the stream, and hands it out to a pending request, stores it, or skips it,
+// if it is a regular file. At the end of the current pass, it sets s.tar to nil.
+// The caller must hold s.mutex; it is released while reading the stream.
+func (s *streamReader) readNextLocked() error {
+	t := s.tar
+	s.busy = true
+	s.mutex.Unlock()
+	h, err := t.Next()
+	var contents io.Reader = t
+	compressed := false
+	if err == nil && (h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA) {
+		var decompressor compression.DecompressorFunc
+		decompressor, contents, err = compression.DetectCompression(t)
+		compressed = decompressor != nil
+	}
+	s.mutex.Lock()
+	s.busy = false
+	s.changed.Broadcast()
+	if err == io.EOF {
+		s.tar = nil
+		return nil
+	}
+	if err != nil {
+		s.setErrLocked(err)
+		return err
+	}
+	if s.closed {
+		return s.err
+	}
+	name := path.Clean(h.Name)
+	switch h.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return s.passFileLocked(name, h, contents, compressed)
+	case tar.TypeLink:
+		s.addLinkLocked(name, path.Clean(h.Linkname))
+	case tar.TypeSymlink:
+		// The new path could easily point "outside" the archive, but we only compare it to existing tar headers without extracting the archive,
+		// so we don't care.
+		s.addLinkLocked(name, path.Join(path.Dir(name), h.Linkname))
+	}
+	return nil
+}
+
+// setErrLocked records that reading the stream failed with err.
+// The caller must hold s.mutex.
+func (s *streamReader) setErrLocked(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+	s.changed.Broadcast()
+}
+
+// addLinkLocked records a link from name to target.
+// The caller must hold s.mutex.
+func (s *streamReader) addLinkLocked(name, target string) {
+	s.links[name] = target
+	if s.wanted != nil {
+		if _, ok := s.wanted[name]; ok {
+			s.wanted[target] = struct{}{}
+		}
+	}
+}
+
+// passFileLocked handles the regular file at name, with header h and contents (compressed or not), which the stream has just reached:
+// it hands it out to a pending request, or stores it, or only records its size, unless it is not wanted.
+// The caller must hold s.mutex; it is released while reading the stream.
+func (s *streamReader) passFileLocked(name string, h *tar.Header, contents io.Reader, compressed bool) error {
+	if s.wanted != nil {
+		if _, ok := s.wanted[name]; !ok {
+			return nil // tar.Reader.Next() will skip the contents.
+		}
+	}
+	e := &streamEntry{size: h.Size, uncompressedSize: -1, pass: s.pass}
+	if !compressed {
+		e.uncompressedSize = h.Size
+	}
+	if old, ok := s.entries[name]; ok {
+		if old.pass == s.pass { // A later entry with the same name overrides the earlier one.
+			s.releaseLocked(name, old)
+			s.removeEntryLocked(name)
+		} else {
+			if old.stored { // Passed in an earlier pass, nothing more to do.
+				old.pass = s.pass
+				return nil
+			}
+			e.uncompressedSize = old.uncompressedSize
+			e.handedOut = old.handedOut
+			e.digest = old.digest
+		}
+	}
+
+	if h.Size > maxBufferedFileSize && !s.keepComponents {
+		if req := s.requestForLocked(name, e.digest); req != nil {
+			logrus.Debugf("Reading %s directly from the archive stream", name)
+			e.handedOut = true
+			s.setEntryLocked(name, e)
+			req.handedOut = &handedOutReadCloser{stream: s, reader: contents, size: h.Size}
+			s.busy = true // Until req.handedOut is read completely or closed.
+			return nil
+		}
+	}
+
+	// Components are only skipped if they can be read again; in later passes, only those which have already been handed out,
+	// so that reading all of them takes at most one more pass.
+	skip := h.Size > maxBufferedFileSize && s.reopen != nil && (s.pass == 0 || e.handedOut)
+	if h.Size > maxBufferedFileSize && !skip && s.tempDir == "" {
+		dir, err := ioutil.TempDir(tmpdir.TemporaryDirectoryForBigFiles(s.sys), "docker-tar")
+		if err != nil {
+			return errors.Wrap(err, "error creating a temporary directory")
+		}
+		s.tempDir = dir
+	}
+	tempDir := s.tempDir
+	computeDigest := s.digests != nil && e.digest == ""
+	s.busy = true
+	s.mutex.Unlock()
+	err := readStreamEntry(name, e, contents, compressed, skip, computeDigest, tempDir)
+	s.mutex.Lock()
+	s.busy = false
+	s.changed.Broadcast()
+	if err != nil {
+		s.setErrLocked(err)
+		return err
+	}
+	if s.closed {
+		s.releaseLocked(name, e)
+		return s.err
+	}
+	s.setEntryLocked(name, e)
+	return nil
+}
+
+// readStreamEntry reads contents of the regular file at name, with entry e, which has not been recorded in a streamReader yet.
+// It keeps the contents in memory if the file is small; otherwise it only records the uncompressed size if skip,
+// or spools the contents into a temporary file in tempDir. If computeDigest, it also records the digest of the contents.
+func readStreamEntry(name string, e *streamEntry, contents io.Reader, compressed, skip, computeDigest bool, tempDir string) error {
+	var dest io.Writer = ioutil.Discard
+	var buffer *bytes.Buffer
+	var file *os.File
+	switch {
+	case e.size <= maxBufferedFileSize:
+		buffer = &bytes.Buffer{}
+		dest = buffer
+	case skip:
+		logrus.Debugf("Skipping %s in the archive, it can be read again", name)
+	default:
+		f, err := ioutil.TempFile(tempDir, "component")
+		if err != nil {
+			return errors.Wrap(err, "error creating a temporary file")
+		}
+		logrus.Debugf("Spooling %s from the archive to %s", name, f.Name())
+		file = f
+		dest = file
+	}
+	var digester digest.Digester
+	if computeDigest {
+		digester = digest.Canonical.Digester()
+		dest = io.MultiWriter(dest, digester.Hash())
+	}
+
+	source := io.TeeReader(contents, dest)
+	var err error
+	if buffer == nil && file == nil && compressed && e.uncompressedSize == -1 {
+		// Find the size now, so that the component does not have to be read again just for that.
+		e.uncompressedSize, err = uncompressedSize(name, source, e.size)
+	}
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, source)
+	}
+	if file != nil {
+		if err2 := file.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+		if err != nil {
+			os.Remove(file.Name())
+			return errors.Wrapf(err, "error spooling %s to temporary file %q", name, file.Name())
+		}
+		e.tempFile = file.Name()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error reading %s", name)
+	}
+	if buffer != nil {
+		e.data = buffer.Bytes()
+	}
+	e.stored = buffer != nil || file != nil
+	if digester != nil {
+		e.digest = digester.Digest()
+	}
+	return nil
+}
+
+// setEntryLocked records e as the entry for name.
+// The caller must hold s.mutex.
+func (s *streamReader) setEntryLocked(name string, e *streamEntry) {
+	s.removeEntryLocked(name)
+	s.entries[name] = e
+	if s.digests != nil && e.digest != "" {
+		s.digests[e.digest] = name
+	}
+}
+
+// removeEntryLocked forgets the entry for name, if any, without releasing its storage.
+// The caller must hold s.mutex.
+func (s *streamReader) removeEntryLocked(name string) {
+	if old, ok := s.entries[name]; ok {
+		if old.digest != "" && s.digests[old.digest] == name {
+			delete(s.digests, old.digest)
+		}
+		delete(s.entries, name)
+	}
+}
+
+// releaseLocked frees the storage of e, which was stored for name.
+// The caller must hold s.mutex.
+func (s *streamReader) releaseLocked(name string, e *streamEntry) {
+	if e.tempFile != "" {
+		if err := os.Remove(e.tempFile); err != nil {
+			logrus.Debugf("Error removing spooled %s: %v", name, err)
+		}
+		e.tempFile = ""
+	}
+	e.data = nil
+	e.stored = false
+}
+
+// openEntryLocked returns a ReadCloser for e, which was stored for componentPath.
+// The caller must hold s.mutex.
+func (s *streamReader) openEntryLocked(componentPath string, e *streamEntry) (io.ReadCloser, error) {
+	switch {
+	case !e.stored:
+		return nil, errors.Errorf("Internal error: %s is not stored", componentPath)
+	case e.tempFile != "":
+		return os.Open(e.tempFile)
+	default:
+		return ioutil.NopCloser(bytes.NewReader(e.data)), nil
+	}
+}
+
+// handedOutReadCloser is a component read directly from the stream; the stream continues after all of it has been read,
+// or after it is closed.
+type handedOutReadCloser struct {
+	stream   *streamReader
+	reader   io.Reader
+	size     int64
+	released bool
+	err      error // The error which ended reading, if released; nil if it was closed.
+}
+
+func (r *handedOutReadCloser) Read(p []byte) (int, error) {
+	if r.released {
+		if r.err != nil {
+			return 0, r.err
+		}
+		return 0, errors.New("Internal error: reading a closed component of an archive stream")
+	}
+	n, err := r.reader.Read(p)
+	if err != nil {
+		r.release(err)
+	}
+	return n, err
+}
+
+func (r *handedOutReadCloser) Close() error {
+	r.release(nil)
+	return nil
+}
+
+// release lets the stream continue; err is the error which ended reading, if any, or nil if r was closed.
+func (r *handedOutReadCloser) release(err error) {
+	if r.released {
+		return
+	}
+	r.released = true
+	r.err = err
+	s := r.stream
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.busy = false
+	if err != nil && err != io.EOF {
+		s.setErrLocked(err)
+	}
+	s.changed.Broadcast()
+}
+
+// openTarComponent returns a ReadCloser for componentPath, and its size, reading the stream as far as necessary.
+// A component which is handed out directly from the stream can only be read again from a new pass over the input.
+// It is safe to call this method from multiple goroutines simultaneously; while a component is being
+// read directly from the stream, other callers which need the stream wait until all of it has been read,
+// or the returned ReadCloser is closed.
+// The caller should call .Close() on the returned stream.
+func (s *streamReader) openTarComponent(componentPath string) (io.ReadCloser, int64, error) {
+	componentPath = path.Clean(componentPath)
+	return s.open(&componentRequest{path: componentPath}, componentPath)
+}
+
+// openTarComponentByDigest returns a ReadCloser for a regular file with contents matching d, and its size,
+// reading the stream as far as necessary; s must have been created by newDigestIndexingStreamReader.
+// The file can only be handed out directly from the stream if its digest is already known from an earlier pass.
+// It is safe to call this method from multiple goroutines simultaneously.
+// The caller should call .Close() on the returned stream.
+func (s *streamReader) openTarComponentByDigest(d digest.Digest) (io.ReadCloser, int64, error) {
+	return s.open(&componentRequest{digest: d}, "blob "+d.String())
+}
+
+// open returns a ReadCloser for the component requested by req, and its size; description is used in error messages.
+func (s *streamReader) open(req *componentRequest, description string) (io.ReadCloser, int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name, e, err := s.waitForLocked(req, description)
+	if err != nil {
+		return nil, -1, err
+	}
+	if req.handedOut != nil {
+		return req.handedOut, req.handedOut.size, nil
+	}
+	rc, err := s.openEntryLocked(name, e)
+	if err != nil {
+		return nil, -1, err
+	}
+	return rc, e.size, nil
+}
+
+// knownUncompressedSize returns the size of componentPath after decompression, if it is compressed, if it can be determined
+// without reading the stream; otherwise it returns -1.
+func (s *streamReader) knownUncompressedSize(componentPath string) (int64, error) {
+	componentPath = path.Clean(componentPath)
+	s.mutex.Lock()
+	name, e := s.lookupLocked(componentPath)
+	s.mutex.Unlock()
+	if e == nil {
+		return -1, nil
+	}
+	return s.entryUncompressedSize(name, e)
+}
+
+// knownSize returns the size of componentPath in the archive, or -1 if the stream has not passed it yet.
+func (s *streamReader) knownSize(componentPath string) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, e := s.lookupLocked(path.Clean(componentPath)); e != nil {
+		return e.size
+	}
+	return -1
+}
+
+// uncompressedSize returns the size of componentPath after decompression, if it is compressed, reading the stream as far as necessary.
+// Components passed on the way are stored or skipped as usual, not handed out.
+func (s *streamReader) uncompressedSize(componentPath string) (int64, error) {
+	componentPath = path.Clean(componentPath)
+	return s.measure(&componentRequest{path: componentPath, measure: true}, componentPath)
+}
+
+// sizeByDigest returns the size of a regular file with contents matching d, after decompression, if it is compressed,
+// reading the stream as far as necessary; s must have been created by newDigestIndexingStreamReader.
+func (s *streamReader) sizeByDigest(d digest.Digest) (int64, error) {
+	return s.measure(&componentRequest{digest: d, measure: true}, "blob "+d.String())
+}
+
+// measure returns the size of the component requested by req after decompression, if it is compressed; description is used in error messages.
+func (s *streamReader) measure(req *componentRequest, description string) (int64, error) {
+	s.mutex.Lock()
+	name, e, err := s.waitForLocked(req, description)
+	s.mutex.Unlock()
+	if err != nil {
+		return -1, err
+	}
+	return s.entryUncompressedSize(name, e)
+}
+
+// entryUncompressedSize returns the size of e, found at componentPath, after decompression, if it is compressed,
+// or -1 if it is not known and e is not stored.
+func (s *streamReader) entryUncompressedSize(componentPath string, e *streamEntry) (int64, error) {
+	s.mutex.Lock()
+	size := e.uncompressedSize
+	var rc io.ReadCloser
+	var err error
+	if size == -1 && e.stored {
+		rc, err = s.openEntryLocked(componentPath, e)
+	}
+	s.mutex.Unlock()
+	if size != -1 || rc == nil || err != nil {
+		return size, err
+	}
+	defer rc.Close()
+	size, err = uncompressedSize(componentPath, rc, e.size)
+	if err != nil {
+		return -1, err
+	}
+	s.mutex.Lock()
+	e.uncompressedSize = size
+	s.mutex.Unlock()
+	return size, nil
+}
+
+// uncompressedSize returns the size of the file at componentPath, with contents in stream and size in the archive,
+// after decompression, if it is compressed.
+func uncompressedSize(componentPath string, stream io.Reader, size int64) (int64, error) {
+	// Since GetBlob will decompress layers that are compressed we need
+	// to do the decompression here as well, otherwise we will
+	// incorrectly report the size. Pretty critical, since tools like
+	// umoci always compress layer blobs. Obviously we only bother with
+	// the slower method of checking if it's compressed.
+	uncompressedStream, isCompressed, err := compression.AutoDecompress(stream)
+	if err != nil {
+		return -1, errors.Wrapf(err, "Error auto-decompressing %s to determine its size", componentPath)
+	}
+	defer uncompressedStream.Close()
+
+	if !isCompressed {
+		return size, nil
+	}
+	uncompressed, err := io.Copy(ioutil.Discard, uncompressedStream)
+	if err != nil {
+		return -1, errors.Wrapf(err, "Error reading %s to find its size", componentPath)
+	}
+	return uncompressed, nil
+}
@@ -0,0 +1,581 @@
+package tarfile
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/memory"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tarComponent is a file to be stored by makeTestTar.
+type tarComponent struct {
+	name     string
+	contents []byte
+	linkname string // If set, a symlink is created instead
+}
+
+// makeTestTar returns a tar file containing components, in order.
+func makeTestTar(t *testing.T, components []tarComponent) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, c := range components {
+		var err error
+		if c.linkname != "" {
+			err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: c.name, Linkname: c.linkname, Mode: 0644})
+		} else {
+			err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: c.name, Size: int64(len(c.contents)), Mode: 0644})
+			if err == nil {
+				_, err = tw.Write(c.contents)
+			}
+		}
+		require.NoError(t, err)
+	}
+	err := tw.Close()
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+// makeTestImageComponents returns the components of a single-image archive with layer, and the image's config.
+func makeTestImageComponents(t *testing.T, layer []byte) ([]byte, tarComponent, tarComponent, tarComponent) {
+	config := []byte(`{"rootfs":{"type":"layers","diff_ids":["` + digest.FromBytes(layer).String() + `"]}}`)
+	configPath := digest.FromBytes(config).Hex() + ".json"
+	manifestJSON, err := json.Marshal([]ManifestItem{{
+		Config: configPath,
+		Layers: []string{"layer/layer.tar"},
+	}})
+	require.NoError(t, err)
+	return config,
+		tarComponent{name: manifestFileName, contents: manifestJSON},
+		tarComponent{name: configPath, contents: config},
+		tarComponent{name: "layer/layer.tar", contents: layer}
+}
+
+func TestStreamingReaderSpoolsLayersBeforeManifest(t *testing.T) {
+	ctx := context.Background()
+	cache := memory.New()
+	tmpDir, err := ioutil.TempDir("", "docker-tar-stream")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	sys := &types.SystemContext{BigFilesTemporaryDir: tmpDir}
+
+	layer := bytes.Repeat([]byte{'x'}, maxBufferedFileSize+1)
+	config, manifestComponent, configComponent, layerComponent := makeTestImageComponents(t, layer)
+	unreferenced := tarComponent{name: "unreferenced", contents: bytes.Repeat([]byte{'y'}, maxBufferedFileSize+1)}
+	archive := makeTestTar(t, []tarComponent{
+		layerComponent,
+		{name: "layer/duplicate.tar", linkname: "layer.tar"},
+		unreferenced,
+		configComponent,
+		manifestComponent,
+	})
+
+	reader, err := NewStreamingReader(sys, ioutil.NopCloser(bytes.NewReader(archive)))
+	require.NoError(t, err)
+	assert.Len(t, reader.Manifest, 1)
+	// Only the referenced layer remains spooled.
+	spooled, err := ioutil.ReadDir(reader.stream.tempDir)
+	require.NoError(t, err)
+	assert.Len(t, spooled, 1)
+
+	src := NewSource(reader, true, nil, -1)
+	m, _, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	parsed, err := manifest.Schema2FromManifest(m)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(config), parsed.ConfigDescriptor.Digest)
+	require.Len(t, parsed.LayersDescriptors, 1)
+	assert.Equal(t, int64(len(layer)), parsed.LayersDescriptors[0].Size)
+
+	stream, size, err := src.GetBlob(ctx, types.BlobInfo{Digest: digest.FromBytes(layer), Size: -1}, cache)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(layer)), size)
+	contents, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, layer, contents)
+	err = stream.Close()
+	require.NoError(t, err)
+	// The spooled layer is kept until the archive is closed, so it can be read again.
+	stream, _, err = src.GetBlob(ctx, types.BlobInfo{Digest: digest.FromBytes(layer), Size: -1}, cache)
+	require.NoError(t, err)
+	contents, err = ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, layer, contents)
+	err = stream.Close()
+	require.NoError(t, err)
+
+	err = src.Close()
+	require.NoError(t, err)
+	entries, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestStreamingReaderHandsOutComponentsAfterManifest(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "docker-tar-stream")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	sys := &types.SystemContext{BigFilesTemporaryDir: tmpDir}
+
+	layer := bytes.Repeat([]byte{'x'}, maxBufferedFileSize+1)
+	config, manifestComponent, configComponent, layerComponent := makeTestImageComponents(t, layer)
+	archive := makeTestTar(t, []tarComponent{
+		manifestComponent,
+		{name: "unreferenced", contents: bytes.Repeat([]byte{'y'}, maxBufferedFileSize+1)},
+		configComponent,
+		layerComponent,
+	})
+
+	reader, err := NewStreamingReader(sys, ioutil.NopCloser(bytes.NewReader(archive)))
+	require.NoError(t, err)
+	defer reader.Close()
+
+	// The config is small, so it is kept in memory, and can be read again.
+	for i := 0; i < 2; i++ {
+		contents, err := reader.readTarComponent(configComponent.name, len(config))
+		require.NoError(t, err)
+		assert.Equal(t, config, contents)
+	}
+	// The layer is handed out directly from the stream, skipping the unreferenced file.
+	contents, err := reader.readTarComponent(layerComponent.name, len(layer))
+	require.NoError(t, err)
+	assert.Equal(t, layer, contents)
+	// Nothing had to be spooled.
+	assert.Equal(t, "", reader.stream.tempDir)
+	// The stream can't be read again.
+	_, err = reader.readTarComponent(layerComponent.name, len(layer))
+	assert.Error(t, err)
+
+	_, err = reader.readTarComponent("missing", 1)
+	assert.Error(t, err)
+}
+
+func TestStreamingReaderSourceHandsOutLayersAfterManifest(t *testing.T) {
+	ctx := context.Background()
+	cache := memory.New()
+	tmpDir, err := ioutil.TempDir("", "docker-tar-stream")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	sys := &types.SystemContext{BigFilesTemporaryDir: tmpDir}
+
+	layer := bytes.Repeat([]byte{'x'}, maxBufferedFileSize+1)
+	_, manifestComponent, configComponent, layerComponent := makeTestImageComponents(t, layer)
+	archive := makeTestTar(t, []tarComponent{manifestComponent, configComponent, layerComponent})
+
+	reader, err := NewStreamingReader(sys, ioutil.NopCloser(bytes.NewReader(archive)))
+	require.NoError(t, err)
+	src := NewSource(reader, true, nil, -1)
+	defer src.Close()
+	// Reading the layer without generating a manifest first does not store it.
+	stream, size, err := src.GetBlob(ctx, types.BlobInfo{Digest: digest.FromBytes(layer), Size: -1}, cache)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), size)
+	contents, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, layer, contents)
+	err = stream.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "", reader.stream.tempDir)
+}
+
+func TestStreamingReaderSourceFindsLayerSizesForManifest(t *testing.T) {
+	ctx := context.Background()
+	cache := memory.New()
+	tmpDir, err := ioutil.TempDir("", "docker-tar-stream")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	sys := &types.SystemContext{BigFilesTemporaryDir: tmpDir}
+
+	layer := bytes.Repeat([]byte{'x'}, maxBufferedFileSize+1)
+	_, manifestComponent, configComponent, layerComponent := makeTestImageComponents(t, layer)
+	archive := makeTestTar(t, []tarComponent{manifestComponent, configComponent, layerComponent})
+
+	reader, err := NewStreamingReader(sys, ioutil.NopCloser(bytes.NewReader(archive)))
+	require.NoError(t, err)
+	src := NewSource(reader, true, nil, -1)
+	defer src.Close()
+	// The generated manifest contains the actual layer sizes, read from the stream.
+	m, _, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	parsed, err := manifest.Schema2FromManifest(m)
+	require.NoError(t, err)
+	require.Len(t, parsed.LayersDescriptors, 1)
+	assert.Equal(t, int64(len(layer)), parsed.LayersDescriptors[0].Size)
+	for i := 0; i < 2; i++ {
+		stream, size, err := src.GetBlob(ctx, types.BlobInfo{Digest: digest.FromBytes(layer), Size: -1}, cache)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(layer)), size)
+		contents, err := ioutil.ReadAll(stream)
+		require.NoError(t, err)
+		assert.Equal(t, layer, contents)
+		err = stream.Close()
+		require.NoError(t, err)
+	}
+}
+
+func TestStreamingReaderHandedOutComponentDoesNotBlockOthers(t *testing.T) {
+	layer1 := bytes.Repeat([]byte{'x'}, maxBufferedFileSize+1)
+	layer2 := bytes.Repeat([]byte{'y'}, maxBufferedFileSize+1)
+	config, manifestComponent, configComponent, layer1Component := makeTestImageComponents(t, layer1)
+	layer2Component := tarComponent{name: "layer2/layer.tar", contents: layer2}
+	archive := makeTestTar(t, []tarComponent{manifestComponent, configComponent, layer1Component, layer2Component})
+
+	reader, err := NewStreamingReader(nil, ioutil.NopCloser(bytes.NewReader(archive)))
+	require.NoError(t, err)
+	defer reader.Close()
+	reader.stream.setWanted([]string{configComponent.name, layer1Component.name, layer2Component.name})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stream1, err := reader.openTarComponent(layer1Component.name)
+		require.NoError(t, err)
+		// Stored components can be read while a component is handed out.
+		contents, err := reader.readTarComponent(configComponent.name, len(config))
+		require.NoError(t, err)
+		assert.Equal(t, config, contents)
+		// The stream continues after the handed out component has been read completely, even if it is not closed.
+		contents, err = ioutil.ReadAll(stream1)
+		require.NoError(t, err)
+		assert.Equal(t, layer1, contents)
+		contents, err = reader.readTarComponent(layer2Component.name, len(layer2))
+		require.NoError(t, err)
+		assert.Equal(t, layer2, contents)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out reading the archive")
+	}
+	assert.Equal(t, "", reader.stream.tempDir)
+}
+
+func TestStreamingReaderFromFileReadsLayersAgain(t *testing.T) {
+	ctx := context.Background()
+	cache := memory.New()
+	tmpDir, err := ioutil.TempDir("", "docker-tar-stream")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	sys := &types.SystemContext{BigFilesTemporaryDir: tmpDir}
+
+	layer1 := bytes.Repeat([]byte{'x'}, maxBufferedFileSize+1)
+	layer2 := make([]byte, maxBufferedFileSize+1)
+	_, err = rand.New(rand.NewSource(0)).Read(layer2) // Random data, so that the compressed layer is not buffered in memory.
+	require.NoError(t, err)
+	var compressedLayer2 bytes.Buffer
+	w, err := compression.CompressStream(&compressedLayer2, compression.Gzip, nil)
+	require.NoError(t, err)
+	_, err = w.Write(layer2)
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+	config := []byte(`{"rootfs":{"type":"layers","diff_ids":["` + digest.FromBytes(layer1).String() + `","` + digest.FromBytes(layer2).String() + `"]}}`)
+	configPath := digest.FromBytes(config).Hex() + ".json"
+	manifestJSON, err := json.Marshal([]ManifestItem{{
+		Config: configPath,
+		Layers: []string{"layer1/layer.tar", "layer2/layer.tar"},
+	}})
+	require.NoError(t, err)
+	// Use the (docker save) order, with manifest.json at the end.
+	archive := makeTestTar(t, []tarComponent{
+		{name: configPath, contents: config},
+		{name: "layer1/layer.tar", contents: layer1},
+		{name: "layer2/layer.tar", contents: compressedLayer2.Bytes()},
+		{name: manifestFileName, contents: manifestJSON},
+	})
+	var compressed bytes.Buffer
+	w, err = compression.CompressStream(&compressed, compression.Gzip, nil)
+	require.NoError(t, err)
+	_, err = w.Write(archive)
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+	path := filepath.Join(tmpDir, "archive.tar.gz")
+	err = ioutil.WriteFile(path, compressed.Bytes(), 0644)
+	require.NoError(t, err)
+
+	reader, err := NewStreamingReaderFromFile(sys, path)
+	require.NoError(t, err)
+	src := NewSource(reader, true, nil, -1)
+	// The layers have been passed while looking for manifest.json; only their sizes were recorded.
+	m, _, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	parsed, err := manifest.Schema2FromManifest(m)
+	require.NoError(t, err)
+	require.Len(t, parsed.LayersDescriptors, 2)
+	assert.Equal(t, int64(len(layer1)), parsed.LayersDescriptors[0].Size)
+	assert.Equal(t, int64(len(layer2)), parsed.LayersDescriptors[1].Size)
+
+	// The layers are read from the file again, as often as necessary; they are not spooled if they are requested in order,
+	// or if they have already been read once.
+	for _, layers := range [][][]byte{{layer1, layer2}, {layer2, layer1}} {
+		for _, layer := range layers {
+			stream, size, err := src.GetBlob(ctx, types.BlobInfo{Digest: digest.FromBytes(layer), Size: -1}, cache)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(layer)), size)
+			contents, err := ioutil.ReadAll(stream)
+			require.NoError(t, err)
+			assert.Equal(t, layer, contents)
+			err = stream.Close()
+			require.NoError(t, err)
+		}
+	}
+	assert.Equal(t, "", reader.stream.tempDir)
+
+	err = src.Close()
+	require.NoError(t, err)
+}
+
+func TestNewStreamingReaderFromFile(t *testing.T) {
+	const fixture = "../../archive/fixtures/almostempty.tar"
+
+	// An uncompressed regular file is read in place.
+	reader, err := NewStreamingReaderFromFile(nil, fixture)
+	require.NoError(t, err)
+	assert.Equal(t, fixture, reader.path)
+	assert.Nil(t, reader.stream)
+	err = reader.Close()
+	require.NoError(t, err)
+
+	// A compressed file is read as a stream.
+	tmpDir, err := ioutil.TempDir("", "docker-tar-stream")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	uncompressed, err := ioutil.ReadFile(fixture)
+	require.NoError(t, err)
+	var compressed bytes.Buffer
+	w, err := compression.CompressStream(&compressed, compression.Gzip, nil)
+	require.NoError(t, err)
+	_, err = w.Write(uncompressed)
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+	path := filepath.Join(tmpDir, "archive.tar.gz")
+	err = ioutil.WriteFile(path, compressed.Bytes(), 0644)
+	require.NoError(t, err)
+	reader, err = NewStreamingReaderFromFile(nil, path)
+	require.NoError(t, err)
+	assert.NotNil(t, reader.stream)
+	assert.Len(t, reader.Manifest, 1)
+	err = reader.Close()
+	require.NoError(t, err)
+}
+
+func TestStreamingReaderForImageReadsLayersBeforeManifest(t *testing.T) {
+	ctx := context.Background()
+	cache := memory.New()
+	tmpDir, err := ioutil.TempDir("", "docker-tar-stream")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	sys := &types.SystemContext{BigFilesTemporaryDir: tmpDir}
+
+	layer := bytes.Repeat([]byte{'x'}, maxBufferedFileSize+1)
+	config, manifestComponent, configComponent, layerComponent := makeTestImageComponents(t, layer)
+	// Use the (docker save) order, with manifest.json at the end.
+	leading := []tarComponent{layerComponent, configComponent}
+	archive := makeTestTar(t, append(leading, manifestComponent))
+	prefix := makeTestTar(t, leading)
+	prefix = prefix[:len(prefix)-2*512] // Drop the end-of-archive marker.
+	require.Equal(t, prefix, archive[:len(prefix)])
+
+	// Send only the layer and the config until the layer has been read.
+	pipeReader, pipeWriter := io.Pipe()
+	layerRead := make(chan struct{})
+	go func() {
+		_, err := pipeWriter.Write(prefix)
+		if err == nil {
+			<-layerRead
+			_, err = pipeWriter.Write(archive[len(prefix):])
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	reader, err := NewStreamingReaderForImage(sys, pipeReader, nil)
+	require.NoError(t, err)
+	src := NewSourceForImage(reader, true, digest.FromBytes(config), []digest.Digest{digest.FromBytes(layer)})
+	m, _, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	parsed, err := manifest.Schema2FromManifest(m)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(config), parsed.ConfigDescriptor.Digest)
+	assert.Equal(t, int64(len(config)), parsed.ConfigDescriptor.Size)
+	require.Len(t, parsed.LayersDescriptors, 1)
+	assert.Equal(t, digest.FromBytes(layer), parsed.LayersDescriptors[0].Digest)
+	assert.Equal(t, int64(len(layer)), parsed.LayersDescriptors[0].Size)
+
+	stream, _, err := src.GetBlob(ctx, types.BlobInfo{Digest: digest.FromBytes(layer), Size: -1}, cache)
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, layer, contents)
+	err = stream.Close()
+	require.NoError(t, err)
+	close(layerRead)
+
+	sigs, err := src.GetSignatures(ctx, nil)
+	require.NoError(t, err)
+	assert.Len(t, sigs, 0)
+	_, _, err = src.GetBlob(ctx, types.BlobInfo{Digest: digest.FromString("missing"), Size: -1}, cache)
+	assert.Error(t, err)
+
+	err = src.Close()
+	require.NoError(t, err)
+	entries, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestStreamingReaderForImageReadsLayersAgain(t *testing.T) {
+	ctx := context.Background()
+	cache := memory.New()
+	tmpDir, err := ioutil.TempDir("", "docker-tar-stream")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	sys := &types.SystemContext{BigFilesTemporaryDir: tmpDir}
+
+	layer := bytes.Repeat([]byte{'x'}, maxBufferedFileSize+1)
+	config, manifestComponent, configComponent, layerComponent := makeTestImageComponents(t, layer)
+	archive := makeTestTar(t, []tarComponent{layerComponent, configComponent, manifestComponent})
+	exports := 0
+	export := func() (io.ReadCloser, error) {
+		exports++
+		return ioutil.NopCloser(bytes.NewReader(archive)), nil
+	}
+
+	// The layer DiffIDs reported for the image must match the config.
+	input, err := export()
+	require.NoError(t, err)
+	reader, err := NewStreamingReaderForImage(sys, input, export)
+	require.NoError(t, err)
+	src := NewSourceForImage(reader, true, digest.FromBytes(config), []digest.Digest{digest.FromString("other layer")})
+	_, _, err = src.GetManifest(ctx, nil)
+	assert.Error(t, err)
+	err = src.Close()
+	require.NoError(t, err)
+
+	exports = 0
+	input, err = export()
+	require.NoError(t, err)
+	reader, err = NewStreamingReaderForImage(sys, input, export)
+	require.NoError(t, err)
+	src = NewSourceForImage(reader, true, digest.FromBytes(config), []digest.Digest{digest.FromBytes(layer)})
+	defer src.Close()
+	m, _, err := src.GetManifest(ctx, nil)
+	require.NoError(t, err)
+	parsed, err := manifest.Schema2FromManifest(m)
+	require.NoError(t, err)
+	require.Len(t, parsed.LayersDescriptors, 1)
+	assert.Equal(t, int64(len(layer)), parsed.LayersDescriptors[0].Size)
+	// The layer has only been measured.
+	assert.Equal(t, 1, exports)
+	assert.Equal(t, "", reader.stream.tempDir)
+
+	// It is handed out directly from a second export.
+	stream, size, err := src.GetBlob(ctx, types.BlobInfo{Digest: digest.FromBytes(layer), Size: -1}, cache)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(layer)), size)
+	contents, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, layer, contents)
+	err = stream.Close()
+	require.NoError(t, err)
+	assert.Equal(t, 2, exports)
+	assert.Equal(t, "", reader.stream.tempDir)
+}
+
+func TestStreamingReaderForImageCompressedLayer(t *testing.T) {
+	ctx := context.Background()
+	cache := memory.New()
+
+	layer := []byte("uncompressed layer contents")
+	var compressed bytes.Buffer
+	w, err := compression.CompressStream(&compressed, compression.Gzip, nil)
+	require.NoError(t, err)
+	_, err = w.Write(layer)
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+
+	// The compressed layer does not match its DiffID, so it is found using manifest.json.
+	config, manifestComponent, configComponent, layerComponent := makeTestImageComponents(t, layer)
+	layerComponent.contents = compressed.Bytes()
+	archive := makeTestTar(t, []tarComponent{layerComponent, configComponent, manifestComponent})
+
+	reader, err := NewStreamingReaderForImage(nil, ioutil.NopCloser(bytes.NewReader(archive)), nil)
+	require.NoError(t, err)
+	src := NewSourceForImage(reader, true, digest.FromBytes(config), nil)
+	defer src.Close()
+	stream, _, err := src.GetBlob(ctx, types.BlobInfo{Digest: digest.FromBytes(layer), Size: -1}, cache)
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, layer, contents)
+	err = stream.Close()
+	require.NoError(t, err)
+}
+
+func TestStreamingReaderForImagesSharesLayers(t *testing.T) {
+	ctx := context.Background()
+	cache := memory.New()
+	tmpDir, err := ioutil.TempDir("", "docker-tar-stream")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	sys := &types.SystemContext{BigFilesTemporaryDir: tmpDir}
+
+	layer := bytes.Repeat([]byte{'x'}, maxBufferedFileSize+1)
+	config1, _, config1Component, layerComponent := makeTestImageComponents(t, layer)
+	config2 := []byte(`{"architecture":"arm64","rootfs":{"type":"layers","diff_ids":["` + digest.FromBytes(layer).String() + `"]}}`)
+	config2Component := tarComponent{name: digest.FromBytes(config2).Hex() + ".json", contents: config2}
+	manifestJSON, err := json.Marshal([]ManifestItem{
+		{Config: config1Component.name, Layers: []string{layerComponent.name}},
+		{Config: config2Component.name, Layers: []string{layerComponent.name}},
+	})
+	require.NoError(t, err)
+	archive := makeTestTar(t, []tarComponent{
+		layerComponent,
+		config1Component,
+		config2Component,
+		{name: manifestFileName, contents: manifestJSON},
+	})
+
+	reader, err := NewStreamingReaderForImages(sys, ioutil.NopCloser(bytes.NewReader(archive)))
+	require.NoError(t, err)
+	for _, config := range [][]byte{config1, config2} {
+		src := NewSourceForImage(reader, false, digest.FromBytes(config), nil)
+		configStream, _, err := src.GetBlob(ctx, types.BlobInfo{Digest: digest.FromBytes(config), Size: -1}, cache)
+		require.NoError(t, err)
+		contents, err := ioutil.ReadAll(configStream)
+		require.NoError(t, err)
+		assert.Equal(t, config, contents)
+		// The shared layer can be read by both sources.
+		stream, _, err := src.GetBlob(ctx, types.BlobInfo{Digest: digest.FromBytes(layer), Size: -1}, cache)
+		require.NoError(t, err)
+		contents, err = ioutil.ReadAll(stream)
+		require.NoError(t, err)
+		assert.Equal(t, layer, contents)
+		err = stream.Close()
+		require.NoError(t, err)
+		err = src.Close()
+		require.NoError(t, err)
+	}
+
+	err = reader.Close()
+	require.NoError(t, err)
+	entries, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
@@ -16,6 +16,12 @@ const (
 	legacyRepositoriesFileName = "repositories"
 )
 
+// Used in the OCI part of archives containing manifest lists, following the hybrid format of newer versions of (docker save).
+const (
+	ociIndexFileName              = "index.json"
+	containerdImageNameAnnotation = "io.containerd.image.name"
+)
+
 // ManifestItem is an element of the array stored in the top-level manifest.json file.
 type ManifestItem struct { // NOTE: This is visible as docker/tarfile.ManifestItem, and a part of the stable API.
 	Config       string
@@ -23,6 +29,9 @@ type ManifestItem struct { // NOTE: This is visible as docker/tarfile.ManifestIt
 	Layers       []string
 	Parent       imageID                                      `json:",omitempty"`
 	LayerSources map[digest.Digest]manifest.Schema2Descriptor `json:",omitempty"`
+	// The following fields are a containers/image extension, ignored by (docker load).
+	Manifest   string   `json:",omitempty"` // Path of the original manifest of the image, with layer blobs stored at Layers; signatures refer to it.
+	Signatures []string `json:",omitempty"` // Paths of signatures of Manifest.
 }
 
 type imageID string
@@ -15,6 +15,8 @@ import (
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
 	"github.com/opencontainers/go-digest"
+	imgspec "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -32,6 +34,22 @@ type Writer struct {
 	legacyLayers     map[string]struct{} // A set of IDs of legacy layers that have been already sent.
 	manifest         []ManifestItem
 	manifestByConfig map[digest.Digest]int // A map from config digest to an entry index in manifest above.
+	signatureFiles   map[string][]byte     // Contents of ManifestItem.Manifest and ManifestItem.Signatures files, written on Close.
+	ociImages        []ociImage            // Images to list in an OCI index.json, written on Close if any of them is a manifest list.
+}
+
+// ociManifest is a manifest to be stored as a blob in the OCI part of the archive.
+type ociManifest struct {
+	digest   digest.Digest
+	mimeType string
+	manifest []byte
+}
+
+// ociImage is a top-level manifest, with any per-instance manifests stored in the archive, and tags to use in index.json.
+type ociImage struct {
+	topLevel  ociManifest
+	instances []ociManifest
+	repoTags  []reference.NamedTagged
 }
 
 // NewWriter returns a Writer for the specified io.Writer.
@@ -44,6 +62,7 @@ func NewWriter(dest io.Writer) *Writer {
 		repositories:     map[string]map[string]string{},
 		legacyLayers:     map[string]struct{}{},
 		manifestByConfig: map[digest.Digest]int{},
+		signatureFiles:   map[string][]byte{},
 	}
 }
 
@@ -261,6 +280,161 @@ func (w *Writer) ensureManifestItemLocked(layerDescriptors []manifest.Schema2Des
 	return nil
 }
 
+// recordSignaturesLocked records manifestBytes, and signatures of it, for the manifest item using configDigest,
+// replacing any recorded earlier; they are written to the archive on Close.
+// The caller must have locked the Writer.
+func (w *Writer) recordSignaturesLocked(configDigest digest.Digest, manifestBytes []byte, signatures [][]byte) error {
+	i, ok := w.manifestByConfig[configDigest]
+	if !ok {
+		return errors.Errorf("Internal error: no manifest item for config %s", configDigest)
+	}
+	item := &w.manifest[i]
+	manifestDigest := digest.FromBytes(manifestBytes)
+	item.Manifest = w.manifestPath(manifestDigest)
+	w.signatureFiles[item.Manifest] = manifestBytes
+	item.Signatures = []string{}
+	for i, sig := range signatures {
+		path := w.signaturePath(manifestDigest, i)
+		item.Signatures = append(item.Signatures, path)
+		w.signatureFiles[path] = sig
+	}
+	return nil
+}
+
+// recordOCIImageLocked records an image, which may be a manifest list with the specified per-instance manifests,
+// to be included in an OCI index.json, along with the manifests, configs and layers it references.
+// The index.json, with all recorded images, is only written on Close if at least one of them is a manifest list;
+// so, archives without manifest lists don't change.
+// All configs and layers referenced by the manifests must have already been sent.
+// The caller must have locked the Writer.
+func (w *Writer) recordOCIImageLocked(topLevel ociManifest, instances []ociManifest, repoTags []reference.NamedTagged) {
+	w.ociImages = append(w.ociImages, ociImage{
+		topLevel:  topLevel,
+		instances: instances,
+		repoTags:  repoTags,
+	})
+}
+
+// writeOCILayoutLocked writes the OCI index.json, oci-layout and blobs recorded using recordOCIImageLocked,
+// if any of the recorded images is a manifest list.
+// Configs and layers, which are already present in the archive, are added to the blobs directory as hard links.
+// The caller must have locked the Writer.
+func (w *Writer) writeOCILayoutLocked() error {
+	hasManifestList := false
+	for _, image := range w.ociImages {
+		if manifest.MIMETypeIsMultiImage(image.topLevel.mimeType) {
+			hasManifestList = true
+			break
+		}
+	}
+	if !hasManifestList {
+		return nil
+	}
+
+	sentDirs := map[string]struct{}{}
+	sentBlobs := map[digest.Digest]struct{}{}
+	ensureDir := func(dir string) error {
+		if _, ok := sentDirs[dir]; ok {
+			return nil
+		}
+		if err := w.sendDirLocked(dir); err != nil {
+			return err
+		}
+		sentDirs[dir] = struct{}{}
+		return nil
+	}
+	// sendBlob sends a blob with blobDigest, using contents if not nil, or a hard link to existingPath.
+	sendBlob := func(blobDigest digest.Digest, contents []byte, existingPath string) error {
+		if _, ok := sentBlobs[blobDigest]; ok {
+			return nil
+		}
+		if err := blobDigest.Validate(); err != nil {
+			return errors.Wrapf(err, "unexpected digest reference %s", blobDigest)
+		}
+		if err := ensureDir("blobs"); err != nil {
+			return err
+		}
+		algorithmDir := "blobs/" + blobDigest.Algorithm().String()
+		if err := ensureDir(algorithmDir); err != nil {
+			return err
+		}
+		path := algorithmDir + "/" + blobDigest.Hex()
+		if contents != nil {
+			if err := w.sendBytesLocked(path, contents); err != nil {
+				return err
+			}
+		} else {
+			if _, ok := w.blobs[blobDigest]; !ok {
+				return errors.Errorf("Internal error: blob %s referenced from a manifest has not been sent", blobDigest)
+			}
+			if err := w.sendHardLinkLocked(path, existingPath); err != nil {
+				return err
+			}
+		}
+		sentBlobs[blobDigest] = struct{}{}
+		return nil
+	}
+
+	index := imgspecv1.Index{
+		Versioned: imgspec.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []imgspecv1.Descriptor{},
+	}
+	for _, image := range w.ociImages {
+		for _, m := range append(append([]ociManifest{}, image.instances...), image.topLevel) {
+			if !manifest.MIMETypeIsMultiImage(m.mimeType) {
+				parsed, err := manifest.FromBlob(m.manifest, m.mimeType)
+				if err != nil {
+					return errors.Wrapf(err, "Error parsing manifest %s", m.digest)
+				}
+				config := parsed.ConfigInfo()
+				if err := sendBlob(config.Digest, nil, w.configPath(config.Digest)); err != nil {
+					return errors.Wrapf(err, "Error writing config %s", config.Digest)
+				}
+				for _, layer := range parsed.LayerInfos() {
+					if err := sendBlob(layer.Digest, nil, w.physicalLayerPath(layer.Digest)); err != nil {
+						return errors.Wrapf(err, "Error writing layer %s", layer.Digest)
+					}
+				}
+			}
+			if err := sendBlob(m.digest, m.manifest, ""); err != nil {
+				return errors.Wrapf(err, "Error writing manifest %s", m.digest)
+			}
+		}
+
+		desc := imgspecv1.Descriptor{
+			MediaType: image.topLevel.mimeType,
+			Digest:    image.topLevel.digest,
+			Size:      int64(len(image.topLevel.manifest)),
+		}
+		if len(image.repoTags) == 0 {
+			index.Manifests = append(index.Manifests, desc)
+		}
+		for _, tag := range image.repoTags {
+			tagged := desc
+			// The same annotations as used by (docker save).
+			tagged.Annotations = map[string]string{
+				imgspecv1.AnnotationRefName:   tag.Tag(),
+				containerdImageNameAnnotation: fmt.Sprintf("%s:%s", tag.Name(), tag.Tag()),
+			}
+			index.Manifests = append(index.Manifests, tagged)
+		}
+	}
+
+	if err := w.sendBytesLocked(imgspecv1.ImageLayoutFile, []byte(`{"imageLayoutVersion": "1.0.0"}`)); err != nil {
+		return errors.Wrap(err, "Error writing oci-layout")
+	}
+	b, err := json.Marshal(&index)
+	if err != nil {
+		return errors.Wrap(err, "Error marshaling index.json")
+	}
+	if err := w.sendBytesLocked(ociIndexFileName, b); err != nil {
+		return errors.Wrap(err, "Error writing index.json")
+	}
+	return nil
+}
+
 // Close writes all outstanding data about images to the archive, and finishes writing data
 // to the underlying io.Writer.
 // No more images can be added after this is called.
@@ -270,6 +444,27 @@ func (w *Writer) Close() error {
 	}
 	defer w.unlock()
 
+	sentSignatureFiles := map[string]struct{}{}
+	for _, item := range w.manifest {
+		paths := item.Signatures
+		if item.Manifest != "" {
+			paths = append([]string{item.Manifest}, paths...)
+		}
+		for _, path := range paths {
+			if _, ok := sentSignatureFiles[path]; ok {
+				continue
+			}
+			if err := w.sendBytesLocked(path, w.signatureFiles[path]); err != nil {
+				return errors.Wrapf(err, "Error writing %s", path)
+			}
+			sentSignatureFiles[path] = struct{}{}
+		}
+	}
+
+	if err := w.writeOCILayoutLocked(); err != nil {
+		return err
+	}
+
 	b, err := json.Marshal(&w.manifest)
 	if err != nil {
 		return err
@@ -313,6 +508,21 @@ func (w *Writer) physicalLayerPath(layerDigest digest.Digest) string {
 	return layerDigest.Hex() + ".tar"
 }
 
+// manifestPath returns a path we choose for storing an original manifest with the specified digest.
+// NOTE: This is an internal implementation detail, not a format property, and can change
+// any time; readers must use ManifestItem.Manifest.
+func (w *Writer) manifestPath(manifestDigest digest.Digest) string {
+	return manifestDigest.Hex() + ".manifest.json"
+}
+
+// signaturePath returns a path we choose for storing a signature with the specified zero-based index
+// of a manifest with the specified digest.
+// NOTE: This is an internal implementation detail, not a format property, and can change
+// any time; readers must use ManifestItem.Signatures.
+func (w *Writer) signaturePath(manifestDigest digest.Digest, index int) string {
+	return fmt.Sprintf("%s.signature-%d", manifestDigest.Hex(), index+1)
+}
+
 type tarFI struct {
 	path      string
 	size      int64
@@ -352,6 +562,33 @@ func (w *Writer) sendSymlinkLocked(path string, target string) error {
 	return w.tar.WriteHeader(hdr)
 }
 
+// sendHardLinkLocked sends a hard link to target, which must have already been sent, into the tar stream.
+// The caller must have locked the Writer.
+func (w *Writer) sendHardLinkLocked(path string, target string) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeLink,
+		Name:     path,
+		Linkname: target,
+		Mode:     0444,
+		ModTime:  time.Unix(0, 0),
+	}
+	logrus.Debugf("Sending as tar hard link %s -> %s", path, target)
+	return w.tar.WriteHeader(hdr)
+}
+
+// sendDirLocked sends a directory into the tar stream.
+// The caller must have locked the Writer.
+func (w *Writer) sendDirLocked(path string) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     path + "/",
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	}
+	logrus.Debugf("Sending as tar directory %s", path)
+	return w.tar.WriteHeader(hdr)
+}
+
 // sendBytesLocked sends a path into the tar stream.
 // The caller must have locked the Writer.
 func (w *Writer) sendBytesLocked(path string, b []byte) error {
@@ -0,0 +1,66 @@
+// Package archivecompression chooses, and applies, the compression of docker-archive and oci-archive files being created.
+package archivecompression
+
+import (
+	"io"
+	"strings"
+
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+// suffixes maps file name suffixes to the compression algorithm implied by them.
+var suffixes = []struct {
+	suffix    string
+	algorithm compression.Algorithm
+}{
+	{".gz", compression.Gzip},
+	{".tgz", compression.Gzip},
+	{".zst", compression.Zstd},
+	{".tzst", compression.Zstd},
+	{".xz", compression.Xz},
+	{".txz", compression.Xz},
+}
+
+// Choose returns the compression algorithm to use when creating an archive at path, or nil if the archive should not be compressed.
+// sys.ArchiveCompressionFormat, if set, takes precedence over the suffix of path.
+func Choose(sys *types.SystemContext, path string) *compression.Algorithm {
+	if sys != nil && sys.ArchiveCompressionFormat != nil {
+		return sys.ArchiveCompressionFormat
+	}
+	for _, s := range suffixes {
+		if strings.HasSuffix(path, s.suffix) {
+			algorithm := s.algorithm
+			return &algorithm
+		}
+	}
+	return nil
+}
+
+// nopWriteCloser is an io.WriteCloser which does not close the underlying io.Writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// NewWriter returns an io.WriteCloser which writes data for an archive at path into dest, compressed as chosen by Choose.
+// The caller must call .Close() on the returned io.WriteCloser to finish writing the data; that does not close dest.
+func NewWriter(sys *types.SystemContext, path string, dest io.Writer) (io.WriteCloser, error) {
+	algorithm := Choose(sys, path)
+	if algorithm == nil {
+		return nopWriteCloser{dest}, nil
+	}
+	var level *int
+	if sys != nil {
+		level = sys.ArchiveCompressionLevel
+	}
+	res, err := compression.CompressStream(dest, *algorithm, level)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error initializing %s compression of %q", algorithm.Name(), path)
+	}
+	return res, nil
+}
@@ -0,0 +1,73 @@
+package archivecompression
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChoose(t *testing.T) {
+	zstd := compression.Zstd
+	for _, c := range []struct {
+		sys      *types.SystemContext
+		path     string
+		expected string
+	}{
+		{nil, "/tmp/archive.tar", ""},
+		{nil, "/tmp/archive", ""},
+		{&types.SystemContext{}, "/tmp/archive.tar", ""},
+		{nil, "/tmp/archive.tar.gz", compression.Gzip.Name()},
+		{nil, "/tmp/archive.tgz", compression.Gzip.Name()},
+		{nil, "/tmp/archive.tar.zst", compression.Zstd.Name()},
+		{nil, "/tmp/archive.tzst", compression.Zstd.Name()},
+		{nil, "/tmp/archive.tar.xz", compression.Xz.Name()},
+		{nil, "/tmp/archive.txz", compression.Xz.Name()},
+		{nil, "/tmp/archive.gz.tar", ""},
+		{&types.SystemContext{ArchiveCompressionFormat: &zstd}, "/tmp/archive.tar", compression.Zstd.Name()},
+		{&types.SystemContext{ArchiveCompressionFormat: &zstd}, "/tmp/archive.tar.gz", compression.Zstd.Name()},
+	} {
+		res := Choose(c.sys, c.path)
+		if c.expected == "" {
+			assert.Nil(t, res, c.path)
+		} else {
+			require.NotNil(t, res, c.path)
+			assert.Equal(t, c.expected, res.Name(), c.path)
+		}
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	data := []byte("archive contents")
+
+	// Uncompressed
+	var buf bytes.Buffer
+	w, err := NewWriter(nil, "archive.tar", &buf)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+	assert.Equal(t, data, buf.Bytes())
+
+	// Compressed
+	level := 9
+	buf.Reset()
+	w, err = NewWriter(&types.SystemContext{ArchiveCompressionLevel: &level}, "archive.tar.gz", &buf)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+	stream, isCompressed, err := compression.AutoDecompress(&buf)
+	require.NoError(t, err)
+	defer stream.Close()
+	assert.True(t, isCompressed)
+	contents, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, data, contents)
+}
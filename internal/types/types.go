@@ -0,0 +1,101 @@
+package types
+
+import (
+	"context"
+	"io"
+	"time"
+
+	publicTypes "github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ImageDestinationWithOptions extends ImageDestination by adding variants of PutBlob and TryReusingBlob
+// which are told where the blob is used in the image, allowing the destination to process layers
+// in order as they arrive, instead of waiting for Commit().
+//
+// Callers must use PutBlobWithOptions and TryReusingBlobWithOptions for all layers of an image, with
+// LayerIndex set, if they use them for any; mixing them with PutBlob and TryReusingBlob for layers
+// of the same image is not supported.
+type ImageDestinationWithOptions interface {
+	publicTypes.ImageDestination
+	// PutBlobWithOptions is a variant of PutBlob.  If options.LayerIndex is set, the layer may be
+	// processed right away, by the calling goroutine, or by another goroutine handling a preceding layer.
+	PutBlobWithOptions(ctx context.Context, stream io.Reader, inputInfo publicTypes.BlobInfo, options PutBlobOptions) (publicTypes.BlobInfo, error)
+	// TryReusingBlobWithOptions is a variant of TryReusingBlob.  If options.LayerIndex is set, and
+	// the blob is reused, it is recorded as the layer at that index.
+	TryReusingBlobWithOptions(ctx context.Context, info publicTypes.BlobInfo, options TryReusingBlobOptions) (bool, publicTypes.BlobInfo, error)
+}
+
+// PutBlobOptions are used in PutBlobWithOptions.
+type PutBlobOptions struct {
+	Cache      publicTypes.BlobInfoCache // Cache to use and/or update, as in PutBlob
+	IsConfig   bool                      // The blob is a config, as in PutBlob
+	EmptyLayer bool                      // The blob is an “empty”/“throwaway” layer, which does not modify the layer stack
+	LayerIndex *int                      // The index of the layer in the image's LayerInfos(), or nil if the blob is not a layer or the index is unknown
+}
+
+// TryReusingBlobOptions are used in TryReusingBlobWithOptions.
+type TryReusingBlobOptions struct {
+	Cache         publicTypes.BlobInfoCache // Cache to use and/or update, as in TryReusingBlob
+	CanSubstitute bool                      // Whether an equivalent blob may be reused, as in TryReusingBlob
+	EmptyLayer    bool                      // The blob is an “empty”/“throwaway” layer, which does not modify the layer stack
+	LayerIndex    *int                      // The index of the layer in the image's LayerInfos(), or nil if the blob is not a layer or the index is unknown
+}
+
+// ImageDestinationWithCommitOptions extends ImageDestination by adding a variant of Commit, which can report
+// the progress of work done after all blobs have been copied, e.g. applying layers to a storage.
+type ImageDestinationWithCommitOptions interface {
+	publicTypes.ImageDestination
+	// CommitWithOptions is a variant of Commit.  If options.Progress is set, it reports the progress of applying
+	// each layer using the ProgressEventApply* events, sending ProgressEventApplyRead at most once per options.ProgressInterval.
+	CommitWithOptions(ctx context.Context, unparsedToplevel publicTypes.UnparsedImage, options CommitOptions) error
+}
+
+// CommitOptions are used in CommitWithOptions.
+type CommitOptions struct {
+	Progress         chan<- publicTypes.ProgressProperties // Channel to report progress on, or nil
+	ProgressInterval time.Duration                         // Minimal time between ProgressEventApplyRead reports for a single artifact
+}
+
+// ImageSourceChunk is a portion of a blob.
+type ImageSourceChunk struct {
+	Offset uint64
+	Length uint64
+}
+
+// BlobChunkAccessor allows reading only some parts of a blob, instead of all of it.
+type BlobChunkAccessor interface {
+	// GetBlobAt returns a stream containing the concatenated contents of the specified chunks of the blob, in order.
+	// The chunks must be sorted by Offset, and must not overlap.
+	// If the source does not support reading parts of the blob (e.g. a registry ignores range requests),
+	// it returns ErrRangesNotSupported.  If that is only detected later (e.g. a registry omits some of the requested ranges),
+	// reading from the returned stream fails with an error whose cause is ErrRangesNotSupported.
+	// In both cases, the caller should fall back to reading the whole blob.
+	GetBlobAt(ctx context.Context, info publicTypes.BlobInfo, chunks []ImageSourceChunk) (io.ReadCloser, error)
+}
+
+// ErrRangesNotSupported is returned by BlobChunkAccessor.GetBlobAt if the source can't return parts of blobs.
+var ErrRangesNotSupported = errors.New("reading parts of blobs is not supported")
+
+// ImageDestinationPartial extends ImageDestination by allowing a layer to be created from only the parts of a blob
+// which are not already available to the destination, e.g. for layers in the format of pkg/chunked.
+type ImageDestinationPartial interface {
+	publicTypes.ImageDestination
+	// PutBlobPartial creates the layer srcInfo, reading the parts of the blob it needs using chunkAccessor.
+	// It returns ErrFallbackToOrdinaryLayerDownload if the layer can't be created this way, e.g. because it is not in a suitable format;
+	// the caller should then use PutBlob (or PutBlobWithOptions) instead.
+	// The returned BlobInfo describes the blob as stored in the destination; as with PutBlob, it may differ from srcInfo.
+	PutBlobPartial(ctx context.Context, chunkAccessor BlobChunkAccessor, srcInfo publicTypes.BlobInfo, options PutBlobPartialOptions) (publicTypes.BlobInfo, error)
+}
+
+// PutBlobPartialOptions are used in PutBlobPartial.
+type PutBlobPartialOptions struct {
+	Cache      publicTypes.BlobInfoCache // Cache to use and/or update, as in PutBlob
+	EmptyLayer bool                      // The blob is an “empty”/“throwaway” layer, which does not modify the layer stack
+	LayerIndex *int                      // The index of the layer in the image's LayerInfos(), or nil if the index is unknown
+	DiffID     digest.Digest             // The expected digest of the uncompressed layer; the layer is rejected if it doesn't match
+}
+
+// ErrFallbackToOrdinaryLayerDownload is returned by PutBlobPartial if the caller should download the whole blob instead.
+var ErrFallbackToOrdinaryLayerDownload = errors.New("partial pull of the layer is not possible")
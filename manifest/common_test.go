@@ -73,7 +73,7 @@ func TestCompressionVariantMIMEType(t *testing.T) {
 		{"AG", nil, "AU"}, {"AG", &compression.Gzip, "AG"}, {"AG", &compression.Zstd, ""},
 		{"BU", &compression.Zstd, ""},
 		{"BG", &compression.Zstd, ""},
-		{"CG", nil, ""}, {"CG", &compression.Zstd, "CZ"},
+		{"CG", nil, ""}, {"CG", &compression.Zstd, "CZ"}, {"CG", &compression.ZstdFileFrames, "CZ"},
 		{"CZ", nil, ""}, {"CZ", &compression.Gzip, "CG"},
 		{"DG", nil, ""},
 		{"unknown", nil, ""}, {"unknown", &compression.Gzip, ""},
@@ -1,39 +1,61 @@
 package archive
 
 import (
+	"bytes"
 	"context"
 	"io"
+	"io/ioutil"
 	"os"
 
+	"github.com/containers/image/v5/internal/tmpdir"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
-	"github.com/containers/storage/pkg/archive"
 	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 type ociArchiveImageDestination struct {
-	ref          ociArchiveReference
-	unpackedDest types.ImageDestination
-	tempDirRef   tempDirOCIRef
+	ref                      ociArchiveReference
+	archive                  *tarWriter
+	output                   *archiveOutput // nil if the archive is shared
+	sys                      *types.SystemContext
+	acceptUncompressedLayers bool
+	manifestDescriptor       *imgspecv1.Descriptor // The index.json entry to add, set by PutManifest with instanceDigest == nil
 }
 
-// newImageDestination returns an ImageDestination for writing to an existing directory.
+// newImageDestination returns an ImageDestination for writing an oci-archive file.
+// Unless ref refers to a shared Writer, the blobs are streamed directly into a temporary file next to the destination,
+// which replaces the destination on Commit.
 func newImageDestination(ctx context.Context, sys *types.SystemContext, ref ociArchiveReference) (types.ImageDestination, error) {
-	tempDirRef, err := createOCIRef(sys, ref.image)
-	if err != nil {
-		return nil, errors.Wrapf(err, "error creating oci reference")
-	}
-	unpackedDest, err := tempDirRef.ociRefExtracted.NewImageDestination(ctx, sys)
-	if err != nil {
-		if err := tempDirRef.deleteTempDir(); err != nil {
-			return nil, errors.Wrapf(err, "error deleting temp directory %q", tempDirRef.tempDirectory)
+	if ref.sourceIndex != -1 || ref.sourceDigest != "" {
+		return nil, errors.Errorf("Destination reference must not contain a source index or digest: %s", ref.StringWithinTransport())
+	}
+
+	var archive *tarWriter
+	var output *archiveOutput
+	if ref.archiveWriter != nil {
+		archive = ref.archiveWriter
+		output = nil
+	} else {
+		o, err := newArchiveOutput(sys, ref.resolvedFile)
+		if err != nil {
+			return nil, err
 		}
-		return nil, err
+		archive = newTarWriter(o.stream)
+		output = o
+	}
+	d := &ociArchiveImageDestination{
+		ref:     ref,
+		archive: archive,
+		output:  output,
+		sys:     sys,
+	}
+	if sys != nil {
+		d.acceptUncompressedLayers = sys.OCIAcceptUncompressedLayers
 	}
-	return &ociArchiveImageDestination{ref: ref,
-		unpackedDest: unpackedDest,
-		tempDirRef:   tempDirRef}, nil
+	return d, nil
 }
 
 // Reference returns the reference used to set up this destination.
@@ -41,49 +63,55 @@ func (d *ociArchiveImageDestination) Reference() types.ImageReference {
 	return d.ref
 }
 
-// Close removes resources associated with an initialized ImageDestination, if any
-// Close deletes the temp directory of the oci-archive image
+// Close removes resources associated with an initialized ImageDestination, if any.
+// If the destination was not committed, the temporary archive file is deleted.
 func (d *ociArchiveImageDestination) Close() error {
-	defer func() {
-		err := d.tempDirRef.deleteTempDir()
-		logrus.Debugf("Error deleting temporary directory: %v", err)
-	}()
-	return d.unpackedDest.Close()
+	if d.output != nil {
+		return d.output.close()
+	}
+	return nil
 }
 
 func (d *ociArchiveImageDestination) SupportedManifestMIMETypes() []string {
-	return d.unpackedDest.SupportedManifestMIMETypes()
+	return []string{
+		imgspecv1.MediaTypeImageManifest,
+		imgspecv1.MediaTypeImageIndex,
+	}
 }
 
 // SupportsSignatures returns an error (to be displayed to the user) if the destination certainly can't store signatures
 func (d *ociArchiveImageDestination) SupportsSignatures(ctx context.Context) error {
-	return d.unpackedDest.SupportsSignatures(ctx)
+	return nil
 }
 
 func (d *ociArchiveImageDestination) DesiredLayerCompression() types.LayerCompression {
-	return d.unpackedDest.DesiredLayerCompression()
+	if d.acceptUncompressedLayers {
+		return types.PreserveOriginal
+	}
+	return types.Compress
 }
 
 // AcceptsForeignLayerURLs returns false iff foreign layers in manifest should be actually
 // uploaded to the image destination, true otherwise.
 func (d *ociArchiveImageDestination) AcceptsForeignLayerURLs() bool {
-	return d.unpackedDest.AcceptsForeignLayerURLs()
+	return true
 }
 
 // MustMatchRuntimeOS returns true iff the destination can store only images targeted for the current runtime architecture and OS. False otherwise
 func (d *ociArchiveImageDestination) MustMatchRuntimeOS() bool {
-	return d.unpackedDest.MustMatchRuntimeOS()
+	return false
 }
 
 // IgnoresEmbeddedDockerReference returns true iff the destination does not care about Image.EmbeddedDockerReferenceConflicts(),
 // and would prefer to receive an unmodified manifest instead of one modified for the destination.
 // Does not make a difference if Reference().DockerReference() is nil.
 func (d *ociArchiveImageDestination) IgnoresEmbeddedDockerReference() bool {
-	return d.unpackedDest.IgnoresEmbeddedDockerReference()
+	return false // N/A, DockerReference() returns nil.
 }
 
 // HasThreadSafePutBlob indicates whether PutBlob can be executed concurrently.
 func (d *ociArchiveImageDestination) HasThreadSafePutBlob() bool {
+	// The blobs are serialized into a single tar stream, so there is no benefit from concurrency.
 	return false
 }
 
@@ -95,8 +123,52 @@ func (d *ociArchiveImageDestination) HasThreadSafePutBlob() bool {
 // WARNING: The contents of stream are being verified on the fly.  Until stream.Read() returns io.EOF, the contents of the data SHOULD NOT be available
 // to any other readers for download using the supplied digest.
 // If stream.Read() at any time, ESPECIALLY at end of input, returns an error, PutBlob MUST 1) fail, and 2) delete any data stored so far.
+// (The data can't be removed from the middle of the tar stream; instead, any such failure makes the destination unusable,
+// and the archive is never committed.)
 func (d *ociArchiveImageDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
-	return d.unpackedDest.PutBlob(ctx, stream, inputInfo, cache, isConfig)
+	// A tar header must contain the size, so if the size or digest is unknown, we need to stream the blob
+	// into a temporary file first.
+	if inputInfo.Size == -1 || inputInfo.Digest.String() == "" {
+		logrus.Debugf("oci-archive: input with unknown size, streaming to disk first ...")
+		streamCopy, err := ioutil.TempFile(tmpdir.TemporaryDirectoryForBigFiles(d.sys), "oci-archive-blob")
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+		defer os.Remove(streamCopy.Name())
+		defer streamCopy.Close()
+
+		digester := digest.Canonical.Digester()
+		tee := io.TeeReader(stream, digester.Hash())
+		// TODO: This can take quite some time, and should ideally be cancellable using ctx.Done().
+		size, err := io.Copy(streamCopy, tee)
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+		if _, err := streamCopy.Seek(0, io.SeekStart); err != nil {
+			return types.BlobInfo{}, err
+		}
+		if inputInfo.Size != -1 && size != inputInfo.Size {
+			return types.BlobInfo{}, errors.Errorf("Size mismatch when copying %s, expected %d, got %d", digester.Digest(), inputInfo.Size, size)
+		}
+		inputInfo.Size = size // inputInfo is a struct, so we are only modifying our copy.
+		inputInfo.Digest = digester.Digest()
+		stream = streamCopy
+		logrus.Debugf("... streaming done")
+	}
+
+	if err := d.archive.lock(); err != nil {
+		return types.BlobInfo{}, err
+	}
+	defer d.archive.unlock()
+
+	// Maybe the blob has been already sent
+	if ok, size := d.archive.tryReusingBlobLocked(inputInfo.Digest); ok {
+		return types.BlobInfo{Digest: inputInfo.Digest, Size: size}, nil
+	}
+	if err := d.archive.putBlobLocked(stream, inputInfo.Digest, inputInfo.Size); err != nil {
+		return types.BlobInfo{}, err
+	}
+	return types.BlobInfo{Digest: inputInfo.Digest, Size: inputInfo.Size}, nil
 }
 
 // TryReusingBlob checks whether the transport already contains, or can efficiently reuse, a blob, and if so, applies it to the current destination
@@ -109,7 +181,18 @@ func (d *ociArchiveImageDestination) PutBlob(ctx context.Context, stream io.Read
 // If the transport can not reuse the requested blob, TryReusingBlob returns (false, {}, nil); it returns a non-nil error only on an unexpected failure.
 // May use and/or update cache.
 func (d *ociArchiveImageDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
-	return d.unpackedDest.TryReusingBlob(ctx, info, cache, canSubstitute)
+	if info.Digest == "" {
+		return false, types.BlobInfo{}, errors.Errorf("Can not check for a blob with unknown digest")
+	}
+	if err := d.archive.lock(); err != nil {
+		return false, types.BlobInfo{}, err
+	}
+	defer d.archive.unlock()
+
+	if ok, size := d.archive.tryReusingBlobLocked(info.Digest); ok {
+		return true, types.BlobInfo{Digest: info.Digest, Size: size}, nil
+	}
+	return false, types.BlobInfo{}, nil
 }
 
 // PutManifest writes the manifest to the destination.
@@ -118,48 +201,86 @@ func (d *ociArchiveImageDestination) TryReusingBlob(ctx context.Context, info ty
 // It is expected but not enforced that the instanceDigest, when specified, matches the digest of `manifest` as generated
 // by `manifest.Digest()`.
 func (d *ociArchiveImageDestination) PutManifest(ctx context.Context, m []byte, instanceDigest *digest.Digest) error {
-	return d.unpackedDest.PutManifest(ctx, m, instanceDigest)
+	var manifestDigest digest.Digest
+	if instanceDigest != nil {
+		manifestDigest = *instanceDigest
+	} else {
+		var err error
+		manifestDigest, err = manifest.Digest(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := d.archive.lock(); err != nil {
+		return err
+	}
+	defer d.archive.unlock()
+
+	if ok, _ := d.archive.tryReusingBlobLocked(manifestDigest); !ok {
+		if err := d.archive.putBlobLocked(bytes.NewReader(m), manifestDigest, int64(len(m))); err != nil {
+			return err
+		}
+	}
+
+	if instanceDigest != nil {
+		return nil
+	}
+
+	desc := imgspecv1.Descriptor{
+		// If we knew the MIME type, we wouldn't have to guess here.
+		MediaType: manifest.GuessMIMEType(m),
+		Digest:    manifestDigest,
+		Size:      int64(len(m)),
+	}
+	if d.ref.image != "" {
+		desc.Annotations = map[string]string{imgspecv1.AnnotationRefName: d.ref.image}
+	}
+	d.manifestDescriptor = &desc
+	return nil
 }
 
 // PutSignatures writes a set of signatures to the destination.
 // If instanceDigest is not nil, it contains a digest of the specific manifest instance to write or overwrite the signatures for
 // (when the primary manifest is a manifest list); this should always be nil if the primary manifest is not a manifest list.
+// Signatures are stored in the archive using the same "signatures" subdirectory layout as oci/layout.
 func (d *ociArchiveImageDestination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
-	return d.unpackedDest.PutSignatures(ctx, signatures, instanceDigest)
-}
-
-// Commit marks the process of storing the image as successful and asks for the image to be persisted
-// after the directory is made, it is tarred up into a file and the directory is deleted
-func (d *ociArchiveImageDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
-	if err := d.unpackedDest.Commit(ctx, unparsedToplevel); err != nil {
-		return errors.Wrapf(err, "error storing image %q", d.ref.image)
+	if len(signatures) == 0 {
+		return nil
+	}
+	var manifestDigest digest.Digest
+	if instanceDigest != nil {
+		manifestDigest = *instanceDigest
+	} else {
+		if d.manifestDescriptor == nil {
+			return errors.New("Unknown manifest digest, can't add signatures")
+		}
+		manifestDigest = d.manifestDescriptor.Digest
 	}
 
-	// path of directory to tar up
-	src := d.tempDirRef.tempDirectory
-	// path to save tarred up file
-	dst := d.ref.resolvedFile
-	return tarDirectory(src, dst)
+	if err := d.archive.lock(); err != nil {
+		return err
+	}
+	defer d.archive.unlock()
+	return d.archive.putSignaturesLocked(manifestDigest, signatures)
 }
 
-// tar converts the directory at src and saves it to dst
-func tarDirectory(src, dst string) error {
-	// input is a stream of bytes from the archive of the directory at path
-	input, err := archive.Tar(src, archive.Uncompressed)
-	if err != nil {
-		return errors.Wrapf(err, "error retrieving stream of bytes from %q", src)
+// Commit marks the process of storing the image as successful and asks for the image to be persisted.
+// Unless the archive is shared, index.json and oci-layout are written at the end of the archive, and the archive
+// replaces the file at the destination path; otherwise that happens when the Writer is closed.
+func (d *ociArchiveImageDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	if d.manifestDescriptor != nil {
+		if err := d.archive.lock(); err != nil {
+			return err
+		}
+		d.archive.addManifestLocked(*d.manifestDescriptor)
+		d.archive.unlock()
 	}
-
-	// creates the tar file
-	outFile, err := os.Create(dst)
-	if err != nil {
-		return errors.Wrapf(err, "error creating tar file %q", dst)
+	if d.output == nil {
+		return nil
 	}
-	defer outFile.Close()
-
-	// copies the contents of the directory to the tar file
-	// TODO: This can take quite some time, and should ideally be cancellable using a context.Context.
-	_, err = io.Copy(outFile, input)
-
-	return err
+	if err := d.archive.close(); err != nil {
+		return errors.Wrapf(err, "error storing image %q", d.ref.image)
+	}
+	return d.output.commit()
 }
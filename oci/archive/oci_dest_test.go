@@ -0,0 +1,182 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/blobinfocache/memory"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDestinationRoundTrip(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-archive-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	archivePath := filepath.Join(tmpDir, "archive.tar")
+
+	ref, err := NewReference(archivePath, "name:tag")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+
+	cache := memory.New()
+	blob := []byte("layer contents")
+	blobDigest := digest.FromBytes(blob)
+	// One blob with a known size and digest, one which must be staged to a temporary file.
+	info, err := dest.PutBlob(context.Background(), bytes.NewReader(blob), types.BlobInfo{Digest: blobDigest, Size: int64(len(blob))}, cache, false)
+	require.NoError(t, err)
+	assert.Equal(t, types.BlobInfo{Digest: blobDigest, Size: int64(len(blob))}, info)
+	config := []byte("{}")
+	info, err = dest.PutBlob(context.Background(), bytes.NewReader(config), types.BlobInfo{Size: -1}, cache, true)
+	require.NoError(t, err)
+	assert.Equal(t, types.BlobInfo{Digest: digest.FromBytes(config), Size: int64(len(config))}, info)
+
+	reused, info, err := dest.TryReusingBlob(context.Background(), types.BlobInfo{Digest: blobDigest}, cache, false)
+	require.NoError(t, err)
+	assert.True(t, reused)
+	assert.Equal(t, types.BlobInfo{Digest: blobDigest, Size: int64(len(blob))}, info)
+	reused, _, err = dest.TryReusingBlob(context.Background(), types.BlobInfo{Digest: digest.FromString("missing")}, cache, false)
+	require.NoError(t, err)
+	assert.False(t, reused)
+
+	manifest, err := ioutil.ReadFile("../../image/fixtures/oci1.json")
+	require.NoError(t, err)
+	err = dest.PutManifest(context.Background(), manifest, nil)
+	require.NoError(t, err)
+	signatures := [][]byte{[]byte("sig1"), []byte("sig2")}
+	err = dest.PutSignatures(context.Background(), signatures, nil)
+	require.NoError(t, err)
+
+	// Nothing is visible at the destination path before Commit.
+	_, err = os.Lstat(archivePath)
+	assert.True(t, os.IsNotExist(err))
+	err = dest.Commit(context.Background(), nil)
+	require.NoError(t, err)
+	err = dest.Close()
+	require.NoError(t, err)
+
+	// Only the archive remains, no temporary files.
+	entries, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "archive.tar", entries[0].Name())
+
+	desc, err := LoadManifestDescriptorWithContext(nil, ref)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(manifest), desc.Digest)
+	assert.Equal(t, imgspecv1.MediaTypeImageManifest, desc.MediaType)
+	assert.Equal(t, "name:tag", desc.Annotations[imgspecv1.AnnotationRefName])
+
+	src, err := ref.NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	m, mimeType, err := src.GetManifest(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, manifest, m)
+	assert.Equal(t, imgspecv1.MediaTypeImageManifest, mimeType)
+	sigs, err := src.GetSignatures(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, signatures, sigs)
+	for _, expected := range [][]byte{blob, config} {
+		stream, size, err := src.GetBlob(context.Background(), types.BlobInfo{Digest: digest.FromBytes(expected), Size: -1}, cache)
+		require.NoError(t, err)
+		contents, err := ioutil.ReadAll(stream)
+		stream.Close()
+		require.NoError(t, err)
+		assert.Equal(t, expected, contents)
+		assert.Equal(t, int64(len(expected)), size)
+	}
+}
+
+func TestDestinationDigestMismatch(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-archive-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	archivePath := filepath.Join(tmpDir, "archive.tar")
+
+	ref, err := NewReference(archivePath, "")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+
+	cache := memory.New()
+	blob := []byte("layer contents")
+	_, err = dest.PutBlob(context.Background(), bytes.NewReader(blob), types.BlobInfo{Digest: digest.FromString("other"), Size: int64(len(blob))}, cache, false)
+	assert.Error(t, err)
+	// The archive is unusable after the failure.
+	_, err = dest.PutBlob(context.Background(), bytes.NewReader(blob), types.BlobInfo{Digest: digest.FromBytes(blob), Size: int64(len(blob))}, cache, false)
+	assert.Error(t, err)
+	err = dest.Commit(context.Background(), nil)
+	assert.Error(t, err)
+	err = dest.Close()
+	require.NoError(t, err)
+
+	entries, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestDestinationCompressedArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-archive-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	manifest, err := ioutil.ReadFile("../../image/fixtures/oci1.json")
+	require.NoError(t, err)
+	blob := []byte("layer contents")
+	cache := memory.New()
+
+	zstd := compression.Zstd
+	for _, c := range []struct {
+		fileName string
+		sys      *types.SystemContext
+		magic    []byte
+	}{
+		{"archive.tar.gz", nil, []byte{0x1F, 0x8B, 0x08}},
+		{"archive.tar", &types.SystemContext{ArchiveCompressionFormat: &zstd}, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+		{"archive.txz", nil, []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}},
+	} {
+		archivePath := filepath.Join(tmpDir, c.fileName)
+		ref, err := NewReference(archivePath, "name:tag")
+		require.NoError(t, err)
+		dest, err := ref.NewImageDestination(context.Background(), c.sys)
+		require.NoError(t, err)
+		_, err = dest.PutBlob(context.Background(), bytes.NewReader(blob), types.BlobInfo{Digest: digest.FromBytes(blob), Size: int64(len(blob))}, cache, false)
+		require.NoError(t, err)
+		err = dest.PutManifest(context.Background(), manifest, nil)
+		require.NoError(t, err)
+		err = dest.Commit(context.Background(), nil)
+		require.NoError(t, err)
+		err = dest.Close()
+		require.NoError(t, err)
+
+		contents, err := ioutil.ReadFile(archivePath)
+		require.NoError(t, err, c.fileName)
+		assert.True(t, bytes.HasPrefix(contents, c.magic), c.fileName)
+
+		src, err := ref.NewImageSource(context.Background(), nil)
+		require.NoError(t, err, c.fileName)
+		m, _, err := src.GetManifest(context.Background(), nil)
+		require.NoError(t, err, c.fileName)
+		assert.Equal(t, manifest, m, c.fileName)
+		stream, _, err := src.GetBlob(context.Background(), types.BlobInfo{Digest: digest.FromBytes(blob), Size: -1}, cache)
+		require.NoError(t, err, c.fileName)
+		b, err := ioutil.ReadAll(stream)
+		stream.Close()
+		require.NoError(t, err, c.fileName)
+		assert.Equal(t, blob, b, c.fileName)
+		err = src.Close()
+		require.NoError(t, err, c.fileName)
+	}
+}
@@ -3,39 +3,62 @@ package archive
 import (
 	"context"
 	"io"
+	"net/http"
 
-	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/internal/iolimits"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/oci/internal"
 	"github.com/containers/image/v5/types"
 	digest "github.com/opencontainers/go-digest"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 type ociArchiveImageSource struct {
-	ref         ociArchiveReference
-	unpackedSrc types.ImageSource
-	tempDirRef  tempDirOCIRef
+	ref          ociArchiveReference
+	archive      *tarReader
+	closeArchive bool // .Close() the archive when the source is closed.
+	descriptor   imgspecv1.Descriptor
+	client       *http.Client
 }
 
-// newImageSource returns an ImageSource for reading from an existing directory.
-// newImageSource untars the file and saves it in a temp directory
+// newImageSource returns an ImageSource for reading from an existing oci-archive file.
+// The blobs are read in place from the archive; see newTarReaderFromFile.
 func newImageSource(ctx context.Context, sys *types.SystemContext, ref ociArchiveReference) (types.ImageSource, error) {
-	tempDirRef, err := createUntarTempDir(sys, ref)
+	client, err := internal.NewExternalBlobClient(sys)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating temp directory")
+		return nil, err
 	}
-
-	unpackedSrc, err := tempDirRef.ociRefExtracted.NewImageSource(ctx, sys)
+	archive, closeArchive, err := ref.openArchive(sys)
+	if err != nil {
+		return nil, err
+	}
+	descriptor, err := archive.chooseManifestDescriptor(ref.image, ref.sourceIndex, ref.sourceDigest)
 	if err != nil {
-		if err := tempDirRef.deleteTempDir(); err != nil {
-			return nil, errors.Wrapf(err, "error deleting temp directory %q", tempDirRef.tempDirectory)
+		if closeArchive {
+			archive.close()
 		}
 		return nil, err
 	}
-	return &ociArchiveImageSource{ref: ref,
-		unpackedSrc: unpackedSrc,
-		tempDirRef:  tempDirRef}, nil
+	return &ociArchiveImageSource{
+		ref:          ref,
+		archive:      archive,
+		closeArchive: closeArchive,
+		descriptor:   descriptor,
+		client:       client,
+	}, nil
+}
+
+// openArchive returns a tarReader for ref, and true if the caller is responsible for closing it.
+func (ref ociArchiveReference) openArchive(sys *types.SystemContext) (*tarReader, bool, error) {
+	if ref.archiveReader != nil {
+		return ref.archiveReader, false, nil
+	}
+	archive, err := newTarReaderFromFile(sys, ref.resolvedFile)
+	if err != nil {
+		return nil, false, err
+	}
+	return archive, true, nil
 }
 
 // LoadManifestDescriptor loads the manifest
@@ -50,16 +73,15 @@ func LoadManifestDescriptorWithContext(sys *types.SystemContext, imgRef types.Im
 	if !ok {
 		return imgspecv1.Descriptor{}, errors.Errorf("error typecasting, need type ociArchiveReference")
 	}
-	tempDirRef, err := createUntarTempDir(sys, ociArchRef)
+	archive, closeArchive, err := ociArchRef.openArchive(sys)
 	if err != nil {
-		return imgspecv1.Descriptor{}, errors.Wrap(err, "error creating temp directory")
+		return imgspecv1.Descriptor{}, err
+	}
+	if closeArchive {
+		defer archive.close()
 	}
-	defer func() {
-		err := tempDirRef.deleteTempDir()
-		logrus.Debugf("Error deleting temporary directory: %v", err)
-	}()
 
-	descriptor, err := ocilayout.LoadManifestDescriptor(tempDirRef.ociRefExtracted)
+	descriptor, err := archive.chooseManifestDescriptor(ociArchRef.image, ociArchRef.sourceIndex, ociArchRef.sourceDigest)
 	if err != nil {
 		return imgspecv1.Descriptor{}, errors.Wrap(err, "error loading index")
 	}
@@ -72,13 +94,11 @@ func (s *ociArchiveImageSource) Reference() types.ImageReference {
 }
 
 // Close removes resources associated with an initialized ImageSource, if any.
-// Close deletes the temporary directory at dst
 func (s *ociArchiveImageSource) Close() error {
-	defer func() {
-		err := s.tempDirRef.deleteTempDir()
-		logrus.Debugf("error deleting tmp dir: %v", err)
-	}()
-	return s.unpackedSrc.Close()
+	if s.closeArchive {
+		return s.archive.close()
+	}
+	return nil
 }
 
 // GetManifest returns the image's manifest along with its MIME type (which may be empty when it can't be determined but the manifest is available).
@@ -86,19 +106,44 @@ func (s *ociArchiveImageSource) Close() error {
 // If instanceDigest is not nil, it contains a digest of the specific manifest instance to retrieve (when the primary manifest is a manifest list);
 // this never happens if the primary manifest is not a manifest list (e.g. if the source never returns manifest lists).
 func (s *ociArchiveImageSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
-	return s.unpackedSrc.GetManifest(ctx, instanceDigest)
+	var dig digest.Digest
+	var mimeType string
+	if instanceDigest == nil {
+		dig = s.descriptor.Digest
+		mimeType = s.descriptor.MediaType
+	} else {
+		dig = *instanceDigest
+		for _, md := range s.archive.index.Manifests {
+			if md.Digest == dig {
+				mimeType = md.MediaType
+				break
+			}
+		}
+	}
+
+	m, err := s.archive.readBlob(dig, iolimits.MaxManifestBodySize)
+	if err != nil {
+		return nil, "", err
+	}
+	if mimeType == "" {
+		mimeType = manifest.GuessMIMEType(m)
+	}
+	return m, mimeType, nil
 }
 
 // HasThreadSafeGetBlob indicates whether GetBlob can be executed concurrently.
 func (s *ociArchiveImageSource) HasThreadSafeGetBlob() bool {
-	return false
+	return true
 }
 
 // GetBlob returns a stream for the specified blob, and the blob’s size (or -1 if unknown).
 // The Digest field in BlobInfo is guaranteed to be provided, Size may be -1 and MediaType may be optionally provided.
 // May update BlobInfoCache, preferably after it knows for certain that a blob truly exists at a specific location.
 func (s *ociArchiveImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
-	return s.unpackedSrc.GetBlob(ctx, info, cache)
+	if len(info.URLs) != 0 {
+		return internal.GetExternalBlob(ctx, s.client, info.URLs)
+	}
+	return s.archive.openBlob(info.Digest)
 }
 
 // GetSignatures returns the image's signatures.  It may use a remote (= slow) service.
@@ -106,7 +151,11 @@ func (s *ociArchiveImageSource) GetBlob(ctx context.Context, info types.BlobInfo
 // (when the primary manifest is a manifest list); this never happens if the primary manifest is not a manifest list
 // (e.g. if the source never returns manifest lists).
 func (s *ociArchiveImageSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
-	return s.unpackedSrc.GetSignatures(ctx, instanceDigest)
+	manifestDigest := s.descriptor.Digest
+	if instanceDigest != nil {
+		manifestDigest = *instanceDigest
+	}
+	return s.archive.readSignatures(manifestDigest)
 }
 
 // LayerInfosForCopy returns either nil (meaning the values in the manifest are fine), or updated values for the layer
@@ -118,5 +167,5 @@ func (s *ociArchiveImageSource) GetSignatures(ctx context.Context, instanceDiges
 // The Digest field is guaranteed to be provided; Size may be -1.
 // WARNING: The list may contain duplicates, and they are semantically relevant.
 func (s *ociArchiveImageSource) LayerInfosForCopy(ctx context.Context, instanceDigest *digest.Digest) ([]types.BlobInfo, error) {
-	return s.unpackedSrc.LayerInfosForCopy(ctx, instanceDigest)
+	return nil, nil
 }
@@ -3,19 +3,15 @@ package archive
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"strings"
 
 	"github.com/containers/image/v5/directory/explicitfilepath"
 	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/image"
-	"github.com/containers/image/v5/internal/tmpdir"
 	"github.com/containers/image/v5/oci/internal"
-	ocilayout "github.com/containers/image/v5/oci/layout"
 	"github.com/containers/image/v5/transports"
 	"github.com/containers/image/v5/types"
-	"github.com/containers/storage/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -35,6 +31,16 @@ type ociArchiveReference struct {
 	file         string
 	resolvedFile string
 	image        string
+	// If image=="", sourceIndex and sourceDigest can be used to refer to an index.json entry by its position
+	// or by its digest; at most one of image, sourceIndex and sourceDigest is set.
+	// Such references can only be used as sources.
+	sourceIndex  int           // -1 if not used
+	sourceDigest digest.Digest // "" if not used
+	// If not nil, must have been created from resolvedFile (but archiveReader.path may point at a temporary
+	// file, not necessarily resolvedFile).
+	archiveReader *tarReader
+	// If not nil, must have been created for resolvedFile.
+	archiveWriter *tarWriter
 }
 
 func (t ociArchiveTransport) Name() string {
@@ -53,27 +59,71 @@ func (t ociArchiveTransport) ValidatePolicyConfigurationScope(scope string) erro
 }
 
 // ParseReference converts a string, which should not start with the ImageTransport.Name prefix, into an OCI ImageReference.
+// In addition to file[:image], file:@index and file:@digest refer to an index.json entry by its zero-based position
+// or by its manifest digest.
 func ParseReference(reference string) (types.ImageReference, error) {
 	file, image := internal.SplitPathAndImage(reference)
+	if strings.HasPrefix(image, "@") {
+		sourceIndex, sourceDigest, err := internal.ParseSourceSelector(image)
+		if err != nil {
+			return nil, err
+		}
+		if sourceDigest != "" {
+			return NewDigestReference(file, sourceDigest)
+		}
+		return NewIndexReference(file, sourceIndex)
+	}
 	return NewReference(file, image)
 }
 
 // NewReference returns an OCI reference for a file and a image.
 func NewReference(file, image string) (types.ImageReference, error) {
-	resolved, err := explicitfilepath.ResolvePathToFullyExplicit(file)
-	if err != nil {
+	if err := internal.ValidateImageName(image); err != nil {
 		return nil, err
 	}
+	return newReference(file, image, -1, "", nil, nil)
+}
 
-	if err := internal.ValidateOCIPath(file); err != nil {
+// NewIndexReference returns an OCI archive reference for a file and a zero-based position of an entry in its index.json.
+// The returned reference can only be used as a source.
+func NewIndexReference(file string, sourceIndex int) (types.ImageReference, error) {
+	if sourceIndex < 0 {
+		return nil, errors.Errorf("Invalid OCI archive reference: index @%d must not be negative", sourceIndex)
+	}
+	return newReference(file, "", sourceIndex, "", nil, nil)
+}
+
+// NewDigestReference returns an OCI archive reference for a file and the digest of an entry in its index.json.
+// The returned reference can only be used as a source.
+func NewDigestReference(file string, sourceDigest digest.Digest) (types.ImageReference, error) {
+	if err := sourceDigest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "Invalid OCI archive reference: digest %q", sourceDigest)
+	}
+	return newReference(file, "", -1, sourceDigest, nil, nil)
+}
+
+// newReference returns an OCI archive reference for a file, and an image name, a sourceIndex, or a sourceDigest,
+// which have already been validated, and optionally a tarReader and/or a tarWriter matching file.
+func newReference(file, image string, sourceIndex int, sourceDigest digest.Digest,
+	archiveReader *tarReader, archiveWriter *tarWriter) (types.ImageReference, error) {
+	resolved, err := explicitfilepath.ResolvePathToFullyExplicit(file)
+	if err != nil {
 		return nil, err
 	}
 
-	if err := internal.ValidateImageName(image); err != nil {
+	if err := internal.ValidateOCIPath(file); err != nil {
 		return nil, err
 	}
 
-	return ociArchiveReference{file: file, resolvedFile: resolved, image: image}, nil
+	return ociArchiveReference{
+		file:          file,
+		resolvedFile:  resolved,
+		image:         image,
+		sourceIndex:   sourceIndex,
+		sourceDigest:  sourceDigest,
+		archiveReader: archiveReader,
+		archiveWriter: archiveWriter,
+	}, nil
 }
 
 func (ref ociArchiveReference) Transport() types.ImageTransport {
@@ -83,7 +133,14 @@ func (ref ociArchiveReference) Transport() types.ImageTransport {
 // StringWithinTransport returns a string representation of the reference, which MUST be such that
 // reference.Transport().ParseReference(reference.StringWithinTransport()) returns an equivalent reference.
 func (ref ociArchiveReference) StringWithinTransport() string {
-	return fmt.Sprintf("%s:%s", ref.file, ref.image)
+	switch {
+	case ref.sourceIndex != -1:
+		return fmt.Sprintf("%s:@%d", ref.file, ref.sourceIndex)
+	case ref.sourceDigest != "":
+		return fmt.Sprintf("%s:@%s", ref.file, ref.sourceDigest.String())
+	default:
+		return fmt.Sprintf("%s:%s", ref.file, ref.image)
+	}
 }
 
 // DockerReference returns a Docker reference associated with this reference
@@ -146,53 +203,3 @@ func (ref ociArchiveReference) NewImageDestination(ctx context.Context, sys *typ
 func (ref ociArchiveReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
 	return errors.Errorf("Deleting images not implemented for oci: images")
 }
-
-// struct to store the ociReference and temporary directory returned by createOCIRef
-type tempDirOCIRef struct {
-	tempDirectory   string
-	ociRefExtracted types.ImageReference
-}
-
-// deletes the temporary directory created
-func (t *tempDirOCIRef) deleteTempDir() error {
-	return os.RemoveAll(t.tempDirectory)
-}
-
-// createOCIRef creates the oci reference of the image
-// If SystemContext.BigFilesTemporaryDir not "", overrides the temporary directory to use for storing big files
-func createOCIRef(sys *types.SystemContext, image string) (tempDirOCIRef, error) {
-	dir, err := ioutil.TempDir(tmpdir.TemporaryDirectoryForBigFiles(sys), "oci")
-	if err != nil {
-		return tempDirOCIRef{}, errors.Wrapf(err, "error creating temp directory")
-	}
-	ociRef, err := ocilayout.NewReference(dir, image)
-	if err != nil {
-		return tempDirOCIRef{}, err
-	}
-
-	tempDirRef := tempDirOCIRef{tempDirectory: dir, ociRefExtracted: ociRef}
-	return tempDirRef, nil
-}
-
-// creates the temporary directory and copies the tarred content to it
-func createUntarTempDir(sys *types.SystemContext, ref ociArchiveReference) (tempDirOCIRef, error) {
-	tempDirRef, err := createOCIRef(sys, ref.image)
-	if err != nil {
-		return tempDirOCIRef{}, errors.Wrap(err, "error creating oci reference")
-	}
-	src := ref.resolvedFile
-	dst := tempDirRef.tempDirectory
-	// TODO: This can take quite some time, and should ideally be cancellable using a context.Context.
-	arch, err := os.Open(src)
-	if err != nil {
-		return tempDirOCIRef{}, err
-	}
-	defer arch.Close()
-	if err := archive.NewDefaultArchiver().Untar(arch, dst, &archive.TarOptions{NoLchown: true}); err != nil {
-		if err := tempDirRef.deleteTempDir(); err != nil {
-			return tempDirOCIRef{}, errors.Wrapf(err, "error deleting temp directory %q", tempDirRef.tempDirectory)
-		}
-		return tempDirOCIRef{}, errors.Wrapf(err, "error untarring file %q", tempDirRef.tempDirectory)
-	}
-	return tempDirRef, nil
-}
@@ -0,0 +1,112 @@
+package archive
+
+import (
+	"github.com/containers/image/v5/oci/internal"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Reader manages a single OCI archive, allows listing its contents and accessing
+// individual images with less overhead than creating image references individually
+// (because the archive is indexed, and if necessary decompressed, only once).
+type Reader struct {
+	path    string // The original, user-specified path; not the maintained temporary file, if any
+	archive *tarReader
+}
+
+// NewReader returns a Reader for path.
+// The caller should call .Close() on the returned object.
+func NewReader(sys *types.SystemContext, path string) (*Reader, error) {
+	archive, err := newTarReaderFromFile(sys, path)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		path:    path,
+		archive: archive,
+	}, nil
+}
+
+// Close deletes temporary files associated with the Reader, if any.
+func (r *Reader) Close() error {
+	return r.archive.close()
+}
+
+// NewReaderForReference creates a Reader from a Reader-independent imageReference, which must be from oci/archive.Transport,
+// and a variant of imageReference that points at the same image within the reader.
+// The caller should call .Close() on the returned Reader.
+func NewReaderForReference(sys *types.SystemContext, ref types.ImageReference) (*Reader, types.ImageReference, error) {
+	standalone, ok := ref.(ociArchiveReference)
+	if !ok {
+		return nil, nil, errors.Errorf("Internal error: NewReaderForReference called for a non-oci/archive ImageReference %s", transports.ImageName(ref))
+	}
+	if standalone.archiveReader != nil {
+		return nil, nil, errors.Errorf("Internal error: NewReaderForReference called for a reader-bound reference %s", standalone.StringWithinTransport())
+	}
+	reader, err := NewReader(sys, standalone.file)
+	if err != nil {
+		return nil, nil, err
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			reader.Close()
+		}
+	}()
+	readerRef, err := newReference(standalone.file, standalone.image, standalone.sourceIndex, standalone.sourceDigest, reader.archive, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	succeeded = true
+	return reader, readerRef, nil
+}
+
+// List returns the a set of references for images in the Reader,
+// grouped by the image (manifest digest) the references point to, in the order of index.json.
+// Entries with a name (the org.opencontainers.image.ref.name annotation) are referred to by that name;
+// images without a usable name are referred to by digest, or if the digest is invalid, by position in index.json.
+// The references are valid only until the Reader is closed.
+func (r *Reader) List() ([][]types.ImageReference, error) {
+	names := map[string]int{}
+	for _, md := range r.archive.index.Manifests {
+		if refName := md.Annotations[imgspecv1.AnnotationRefName]; refName != "" && isNameableMediaType(md.MediaType) {
+			names[refName]++
+		}
+	}
+
+	res := [][]types.ImageReference{}
+	groups := map[digest.Digest]int{} // Index into res for each manifest digest
+	known := map[string]struct{}{}    // StringWithinTransport() values of references in res
+	for i, md := range r.archive.index.Manifests {
+		refName := md.Annotations[imgspecv1.AnnotationRefName]
+		var ref types.ImageReference
+		var err error
+		switch {
+		case refName != "" && names[refName] == 1 && isNameableMediaType(md.MediaType) && internal.ValidateImageName(refName) == nil:
+			ref, err = newReference(r.path, refName, -1, "", r.archive, nil)
+		case md.Digest.Validate() == nil:
+			ref, err = newReference(r.path, "", -1, md.Digest, r.archive, nil)
+		default:
+			ref, err = newReference(r.path, "", i, "", r.archive, nil)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error creating a reference for index.json entry @%d", i)
+		}
+		refString := ref.StringWithinTransport()
+		if _, ok := known[refString]; ok {
+			continue // E.g. several unnamed entries for the same image
+		}
+		known[refString] = struct{}{}
+
+		if group, ok := groups[md.Digest]; ok {
+			res[group] = append(res[group], ref)
+		} else {
+			groups[md.Digest] = len(res)
+			res = append(res, []types.ImageReference{ref})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,308 @@
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/containers/image/v5/internal/iolimits"
+	"github.com/containers/image/v5/internal/tmpdir"
+	"github.com/containers/image/v5/oci/internal"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// tarEntry is the location of a regular file within an uncompressed tar file.
+type tarEntry struct {
+	offset int64
+	size   int64
+}
+
+// tarReader is an oci-archive tar file, indexed so that any component can be read in place,
+// without extracting the archive.
+type tarReader struct {
+	// None of the fields below are modified after the archive is created, until .close();
+	// this allows concurrent readers of the same archive.
+	file          *os.File            // An uncompressed tar file; nil if the archive has already been closed.
+	removeOnClose bool                // Remove file on close if true
+	entries       map[string]tarEntry // Indexed by path.Clean(name)
+	index         imgspecv1.Index     // Guaranteed to exist after the archive is created.
+}
+
+// newTarReaderFromFile returns a tarReader for the oci-archive at path.
+// If path is an uncompressed regular file, it is read in place; otherwise (e.g. if it is compressed,
+// or a pipe), it is copied, uncompressed, to a temporary file first.
+// The caller should call .close() on the returned archive when done.
+func newTarReaderFromFile(sys *types.SystemContext, path string) (*tarReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening file %q", path)
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			file.Close()
+		}
+	}()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error statting file %q", path)
+	}
+	stream, isCompressed, err := compression.AutoDecompress(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error detecting compression for file %q", path)
+	}
+	defer stream.Close()
+	if !isCompressed && fi.Mode().IsRegular() {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, errors.Wrapf(err, "error seeking in file %q", path)
+		}
+		succeeded = true
+		return newTarReader(file, false)
+	}
+	return newTarReaderFromStream(sys, stream)
+}
+
+// newTarReaderFromStream returns a tarReader for the uncompressed oci-archive in inputStream,
+// which is first copied to a temporary file.
+// The caller should call .close() on the returned archive when done.
+func newTarReaderFromStream(sys *types.SystemContext, inputStream io.Reader) (*tarReader, error) {
+	tarCopyFile, err := ioutil.TempFile(tmpdir.TemporaryDirectoryForBigFiles(sys), "oci-archive")
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating temporary file")
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			tarCopyFile.Close()
+			os.Remove(tarCopyFile.Name())
+		}
+	}()
+
+	// TODO: This can take quite some time, and should ideally be cancellable using a context.Context.
+	if _, err := io.Copy(tarCopyFile, inputStream); err != nil {
+		return nil, errors.Wrapf(err, "error copying contents to temporary file %q", tarCopyFile.Name())
+	}
+	if _, err := tarCopyFile.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "error seeking in temporary file %q", tarCopyFile.Name())
+	}
+	succeeded = true
+	return newTarReader(tarCopyFile, true)
+}
+
+// newTarReader creates a tarReader for file, which must be positioned at its start, and the removeOnClose flag.
+// The tarReader takes ownership of file, even on failure.
+// The caller should call .close() on the returned archive when done.
+func newTarReader(file *os.File, removeOnClose bool) (*tarReader, error) {
+	// This is a valid enough archive, except entries and index are not yet filled.
+	r := tarReader{
+		file:          file,
+		removeOnClose: removeOnClose,
+		entries:       map[string]tarEntry{},
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			r.close()
+		}
+	}()
+
+	if err := r.readEntries(); err != nil {
+		return nil, err
+	}
+	indexBytes, err := r.readFile("index.json", iolimits.MaxManifestBodySize)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(indexBytes, &r.index); err != nil {
+		return nil, errors.Wrap(err, "Error decoding index.json")
+	}
+
+	succeeded = true
+	return &r, nil
+}
+
+// readEntries scans the tar file once, and records the locations of all regular files in r.entries.
+func (r *tarReader) readEntries() error {
+	links := map[string]string{} // Resolved targets of symbolic and hard links, indexed by path.Clean(name)
+	t := tar.NewReader(r.file)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "Error reading tar archive")
+		}
+		name := path.Clean(h.Name)
+		switch h.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			// tar.Reader does not buffer, so the file is now positioned at the start of the contents of h.
+			offset, err := r.file.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return errors.Wrap(err, "Error determining position in tar archive")
+			}
+			r.entries[name] = tarEntry{offset: offset, size: h.Size}
+		case tar.TypeLink:
+			links[name] = path.Clean(h.Linkname)
+		case tar.TypeSymlink:
+			// The new path could easily point "outside" the archive, but we only compare it to existing tar headers without extracting the archive,
+			// so we don't care.
+			links[name] = path.Join(path.Dir(name), h.Linkname)
+		}
+	}
+	// We follow only one link; so no loops are possible.
+	for name, target := range links {
+		if e, ok := r.entries[target]; ok {
+			r.entries[name] = e
+		}
+	}
+	return nil
+}
+
+// close removes resources associated with an initialized tarReader, if any.
+func (r *tarReader) close() error {
+	file := r.file
+	if file == nil {
+		return nil
+	}
+	r.file = nil // Mark the archive as closed
+	err := file.Close()
+	if r.removeOnClose {
+		if err2 := os.Remove(file.Name()); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// openFile returns a ReadCloser for the regular file at componentPath within the archive, and its size.
+// It is safe to call this method from multiple goroutines simultaneously.
+// The caller should call .Close() on the returned stream.
+func (r *tarReader) openFile(componentPath string) (io.ReadCloser, int64, error) {
+	// This is only a sanity check; if anyone did concurrently close r, this access is technically
+	// racy against the write in .close().
+	if r.file == nil {
+		return nil, -1, errors.New("Internal error: trying to read an already closed oci-archive reader")
+	}
+	e, ok := r.entries[path.Clean(componentPath)]
+	if !ok {
+		return nil, -1, errors.Wrapf(os.ErrNotExist, "Error reading %s from oci-archive", componentPath)
+	}
+	// io.SectionReader uses ReadAt, so concurrent readers don't interfere with each other.
+	return ioutil.NopCloser(io.NewSectionReader(r.file, e.offset, e.size)), e.size, nil
+}
+
+// readFile returns full contents of componentPath, which must not be larger than limit.
+// It is safe to call this method from multiple goroutines simultaneously.
+func (r *tarReader) readFile(componentPath string, limit int) ([]byte, error) {
+	file, _, err := r.openFile(componentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return iolimits.ReadAtMost(file, limit)
+}
+
+// openBlob returns a ReadCloser for the blob with the specified digest, and its size.
+// It is safe to call this method from multiple goroutines simultaneously.
+// The caller should call .Close() on the returned stream.
+func (r *tarReader) openBlob(blobDigest digest.Digest) (io.ReadCloser, int64, error) {
+	blobPath, err := blobPath(blobDigest)
+	if err != nil {
+		return nil, -1, err
+	}
+	return r.openFile(blobPath)
+}
+
+// readBlob returns full contents of the blob with the specified digest, which must not be larger than limit.
+// It is safe to call this method from multiple goroutines simultaneously.
+func (r *tarReader) readBlob(blobDigest digest.Digest, limit int) ([]byte, error) {
+	blobPath, err := blobPath(blobDigest)
+	if err != nil {
+		return nil, err
+	}
+	return r.readFile(blobPath, limit)
+}
+
+// readSignatures returns the signatures stored for the manifest with the specified digest.
+// It is safe to call this method from multiple goroutines simultaneously.
+func (r *tarReader) readSignatures(manifestDigest digest.Digest) ([][]byte, error) {
+	signatures := [][]byte{}
+	for i := 0; ; i++ {
+		sigPath, err := internal.SignaturePath(manifestDigest, i)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := r.readFile(sigPath, iolimits.MaxSignatureBodySize)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				break
+			}
+			return nil, err
+		}
+		signatures = append(signatures, sig)
+	}
+	return signatures, nil
+}
+
+// chooseManifestDescriptor returns the index.json entry matching (image, sourceIndex, sourceDigest), at most one of which
+// should be set, following the same rules as oci/layout: if none is set, the index must contain exactly one entry.
+func (r *tarReader) chooseManifestDescriptor(image string, sourceIndex int, sourceDigest digest.Digest) (imgspecv1.Descriptor, error) {
+	switch {
+	case sourceIndex != -1:
+		if sourceIndex >= len(r.index.Manifests) {
+			return imgspecv1.Descriptor{}, errors.Errorf("Invalid source index @%d, only %d entries available", sourceIndex, len(r.index.Manifests))
+		}
+		return r.index.Manifests[sourceIndex], nil
+
+	case sourceDigest != "":
+		for _, md := range r.index.Manifests {
+			if md.Digest == sourceDigest {
+				return md, nil
+			}
+		}
+		return imgspecv1.Descriptor{}, errors.Errorf("no descriptor found for digest %s", sourceDigest)
+
+	case image == "":
+		// return manifest if only one image is in the oci archive
+		if len(r.index.Manifests) == 1 {
+			return r.index.Manifests[0], nil
+		}
+		// ask user to choose image when more than one image in the oci archive
+		return imgspecv1.Descriptor{}, ocilayout.ErrMoreThanOneImage
+
+	default:
+		// if image specified, look through all manifests for a match
+		for _, md := range r.index.Manifests {
+			if !isNameableMediaType(md.MediaType) {
+				continue
+			}
+			if refName, ok := md.Annotations[imgspecv1.AnnotationRefName]; ok && refName == image {
+				return md, nil
+			}
+		}
+		return imgspecv1.Descriptor{}, errors.Errorf("no descriptor found for reference %q", image)
+	}
+}
+
+// isNameableMediaType returns true if an index.json entry with mediaType can be looked up by its name.
+func isNameableMediaType(mediaType string) bool {
+	return mediaType == imgspecv1.MediaTypeImageManifest || mediaType == imgspecv1.MediaTypeImageIndex
+}
+
+// blobPath returns the path of a blob with the specified digest within an OCI layout.
+func blobPath(blobDigest digest.Digest) (string, error) {
+	if err := blobDigest.Validate(); err != nil {
+		return "", errors.Wrapf(err, "unexpected digest reference %s", blobDigest)
+	}
+	return path.Join("blobs", blobDigest.Algorithm().String(), blobDigest.Hex()), nil
+}
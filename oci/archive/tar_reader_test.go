@@ -0,0 +1,97 @@
+package archive
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// layoutToTempArchive creates an OCI layout with a single blob and an index.json entry, and returns
+// the path to an archive created from it using tarDirectory, and the blob contents.
+func layoutToTempArchive(t *testing.T, tmpDir string) (string, []byte) {
+	layoutDir := filepath.Join(tmpDir, "layout")
+	blob := []byte("blob contents")
+	blobDigest := digest.FromBytes(blob)
+	blobDir := filepath.Join(layoutDir, "blobs", "sha256")
+	err := os.MkdirAll(blobDir, 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(blobDir, blobDigest.Hex()), blob, 0644)
+	require.NoError(t, err)
+	err = os.Symlink(blobDigest.Hex(), filepath.Join(blobDir, "symlinked"))
+	require.NoError(t, err)
+	index := `{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + blobDigest.String() + `","size":13}]}`
+	err = ioutil.WriteFile(filepath.Join(layoutDir, "index.json"), []byte(index), 0644)
+	require.NoError(t, err)
+
+	archivePath := filepath.Join(tmpDir, "archive.tar")
+	err = tarDirectory(layoutDir, archivePath)
+	require.NoError(t, err)
+	return archivePath, blob
+}
+
+func TestNewTarReaderFromFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-archive-reader")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	archivePath, blob := layoutToTempArchive(t, tmpDir)
+
+	// Compressed variant of the same archive
+	compressedPath := filepath.Join(tmpDir, "archive.tar.gz")
+	func() {
+		src, err := os.Open(archivePath)
+		require.NoError(t, err)
+		defer src.Close()
+		dest, err := os.Create(compressedPath)
+		require.NoError(t, err)
+		defer dest.Close()
+		gz := gzip.NewWriter(dest)
+		_, err = io.Copy(gz, src)
+		require.NoError(t, err)
+		err = gz.Close()
+		require.NoError(t, err)
+	}()
+
+	for _, c := range []struct {
+		path          string
+		removeOnClose bool
+	}{
+		{archivePath, false},
+		{compressedPath, true},
+	} {
+		r, err := newTarReaderFromFile(nil, c.path)
+		require.NoError(t, err, c.path)
+		assert.Equal(t, c.removeOnClose, r.removeOnClose, c.path)
+		require.Len(t, r.index.Manifests, 1, c.path)
+		tempPath := r.file.Name()
+
+		contents, err := r.readBlob(digest.FromBytes(blob), 1024)
+		require.NoError(t, err, c.path)
+		assert.Equal(t, blob, contents, c.path)
+		contents, err = r.readFile("blobs/sha256/symlinked", 1024)
+		require.NoError(t, err, c.path)
+		assert.Equal(t, blob, contents, c.path)
+		_, _, err = r.openBlob(digest.FromString("missing"))
+		assert.Error(t, err, c.path)
+		_, err = r.readBlob(digest.FromBytes(blob), 1)
+		assert.Error(t, err, c.path)
+
+		err = r.close()
+		require.NoError(t, err, c.path)
+		_, err = os.Lstat(tempPath)
+		if c.removeOnClose {
+			assert.True(t, os.IsNotExist(err), c.path)
+		} else {
+			assert.NoError(t, err, c.path)
+		}
+	}
+
+	_, err = newTarReaderFromFile(nil, filepath.Join(tmpDir, "thisdoesnotexist"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,248 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/oci/internal"
+	digest "github.com/opencontainers/go-digest"
+	imgspec "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// tarWriter allows creating an oci-archive tar file by streaming blobs directly into it;
+// index.json and oci-layout are written when the tarWriter is closed.
+type tarWriter struct {
+	mutex sync.Mutex
+	// ALL of the following members can only be accessed with the mutex held.
+	// Use tarWriter.lock() to obtain the mutex.
+	tar *tar.Writer // nil if the tarWriter has already been closed.
+	// err is set if writing to tar failed, possibly in the middle of a file; the archive can't be completed after that.
+	err error
+	// Other state.
+	dirs       map[string]struct{}        // A set of directories that have been already sent.
+	blobs      map[digest.Digest]int64    // Sizes of already-sent blobs.
+	signatures map[digest.Digest][][]byte // Signatures to write on close, indexed by manifest digest.
+	index      imgspecv1.Index
+}
+
+// newTarWriter returns a tarWriter for the specified io.Writer.
+// The caller must eventually call .close() on the returned object to create a valid archive.
+func newTarWriter(dest io.Writer) *tarWriter {
+	return &tarWriter{
+		tar:        tar.NewWriter(dest),
+		dirs:       map[string]struct{}{},
+		blobs:      map[digest.Digest]int64{},
+		signatures: map[digest.Digest][][]byte{},
+		index: imgspecv1.Index{
+			Versioned: imgspec.Versioned{
+				SchemaVersion: 2,
+			},
+			Annotations: make(map[string]string),
+		},
+	}
+}
+
+// lock does some sanity checks and locks the tarWriter.
+// If this function succeeds, the caller must call w.unlock.
+// Do not use tarWriter.mutex directly.
+func (w *tarWriter) lock() error {
+	w.mutex.Lock()
+	if w.tar == nil {
+		w.mutex.Unlock()
+		return errors.New("Internal error: trying to use an already closed oci-archive writer")
+	}
+	if w.err != nil {
+		err := w.err
+		w.mutex.Unlock()
+		return errors.Wrap(err, "oci-archive writer is unusable after a previous error")
+	}
+	return nil
+}
+
+// unlock releases the lock obtained by tarWriter.lock
+// Do not use tarWriter.mutex directly.
+func (w *tarWriter) unlock() {
+	w.mutex.Unlock()
+}
+
+// tryReusingBlobLocked returns the size of the blob with the specified digest, if it has already been sent.
+// The caller must have locked the tarWriter.
+func (w *tarWriter) tryReusingBlobLocked(blobDigest digest.Digest) (bool, int64) {
+	size, ok := w.blobs[blobDigest]
+	return ok, size
+}
+
+// putBlobLocked sends a blob with the specified digest and size, reading it from stream, into the tar stream,
+// and verifies that the contents match blobDigest.
+// The caller must have locked the tarWriter.
+func (w *tarWriter) putBlobLocked(stream io.Reader, blobDigest digest.Digest, size int64) error {
+	blobPath, err := blobPath(blobDigest)
+	if err != nil {
+		return err
+	}
+	if err := w.ensureDirLocked(path.Dir(blobPath)); err != nil {
+		return err
+	}
+	digester := blobDigest.Algorithm().Digester()
+	if err := w.sendFileLocked(blobPath, size, io.TeeReader(stream, digester.Hash())); err != nil {
+		return err
+	}
+	if computed := digester.Digest(); computed != blobDigest {
+		// The data is already in the archive; there's no way to take it back.
+		w.err = errors.Errorf("Digest mismatch when writing blob: expected %s, got %s", blobDigest, computed)
+		return w.err
+	}
+	w.blobs[blobDigest] = size
+	return nil
+}
+
+// addManifestLocked adds desc to the index.json which will be written to the archive, replacing any conflicting entries,
+// following the same rules as oci/layout.
+// The caller must have locked the tarWriter.
+func (w *tarWriter) addManifestLocked(desc imgspecv1.Descriptor) {
+	// If the new entry has a name, remove any conflicting names which we already have.
+	if refName := desc.Annotations[imgspecv1.AnnotationRefName]; refName != "" {
+		for i, manifest := range w.index.Manifests {
+			if manifest.Annotations[imgspecv1.AnnotationRefName] == refName {
+				delete(w.index.Manifests[i].Annotations, imgspecv1.AnnotationRefName)
+				break
+			}
+		}
+	}
+	// If it has the same digest as another unnamed entry in the index, replace it.
+	for i, manifest := range w.index.Manifests {
+		if manifest.Digest == desc.Digest && manifest.Annotations[imgspecv1.AnnotationRefName] == "" {
+			w.index.Manifests[i] = desc
+			return
+		}
+	}
+	w.index.Manifests = append(w.index.Manifests, desc)
+}
+
+// putSignaturesLocked records signatures for the manifest with the specified digest, replacing any signatures
+// recorded for it earlier; they are written to the archive on close.
+// The caller must have locked the tarWriter.
+func (w *tarWriter) putSignaturesLocked(manifestDigest digest.Digest, signatures [][]byte) error {
+	if err := manifestDigest.Validate(); err != nil {
+		return errors.Wrapf(err, "unexpected digest reference %s", manifestDigest)
+	}
+	w.signatures[manifestDigest] = signatures
+	return nil
+}
+
+// close writes signatures, index.json and oci-layout to the archive, and finishes writing data
+// to the underlying io.Writer.
+// No more blobs or manifests can be added after this is called.
+func (w *tarWriter) close() error {
+	if err := w.lock(); err != nil {
+		return err
+	}
+	defer w.unlock()
+
+	manifestDigests := make([]digest.Digest, 0, len(w.signatures))
+	for manifestDigest := range w.signatures {
+		manifestDigests = append(manifestDigests, manifestDigest)
+	}
+	sort.Slice(manifestDigests, func(i, j int) bool { return manifestDigests[i] < manifestDigests[j] })
+	for _, manifestDigest := range manifestDigests {
+		for i, sig := range w.signatures[manifestDigest] {
+			sigPath, err := internal.SignaturePath(manifestDigest, i)
+			if err != nil {
+				return err
+			}
+			if err := w.ensureDirLocked(path.Dir(sigPath)); err != nil {
+				return err
+			}
+			if err := w.sendBytesLocked(sigPath, sig); err != nil {
+				return errors.Wrapf(err, "Error writing signature for %s", manifestDigest)
+			}
+		}
+	}
+
+	if err := w.sendBytesLocked("oci-layout", []byte(`{"imageLayoutVersion": "1.0.0"}`)); err != nil {
+		return errors.Wrap(err, "Error writing oci-layout")
+	}
+	b, err := json.Marshal(&w.index)
+	if err != nil {
+		return errors.Wrap(err, "Error marshaling index.json")
+	}
+	if err := w.sendBytesLocked("index.json", b); err != nil {
+		return errors.Wrap(err, "Error writing index.json")
+	}
+
+	if err := w.tar.Close(); err != nil {
+		return err
+	}
+	w.tar = nil // Mark the tarWriter as closed.
+	return nil
+}
+
+// ensureDirLocked sends dir, and all of its parents, into the tar stream, unless they have already been sent.
+// The caller must have locked the tarWriter.
+func (w *tarWriter) ensureDirLocked(dir string) error {
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	if _, ok := w.dirs[dir]; ok {
+		return nil
+	}
+	if err := w.ensureDirLocked(path.Dir(dir)); err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     dir + "/",
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	}
+	logrus.Debugf("Sending as tar directory %s", dir)
+	if err := w.tar.WriteHeader(hdr); err != nil {
+		w.err = err
+		return err
+	}
+	w.dirs[dir] = struct{}{}
+	return nil
+}
+
+// sendBytesLocked sends a path into the tar stream.
+// The caller must have locked the tarWriter.
+func (w *tarWriter) sendBytesLocked(path string, b []byte) error {
+	return w.sendFileLocked(path, int64(len(b)), bytes.NewReader(b))
+}
+
+// sendFileLocked sends a file into the tar stream.
+// The caller must have locked the tarWriter.
+func (w *tarWriter) sendFileLocked(path string, expectedSize int64, stream io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path,
+		Size:     expectedSize,
+		Mode:     0644,
+		ModTime:  time.Unix(0, 0),
+	}
+	logrus.Debugf("Sending as tar file %s", path)
+	if err := w.tar.WriteHeader(hdr); err != nil {
+		w.err = err
+		return err
+	}
+	// TODO: This can take quite some time, and should ideally be cancellable using a context.Context.
+	size, err := io.Copy(w.tar, stream)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	if size != expectedSize {
+		w.err = errors.Errorf("Size mismatch when copying %s, expected %d, got %d", path, expectedSize, size)
+		return w.err
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package archive
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/containers/image/v5/internal/archivecompression"
+	"github.com/containers/image/v5/oci/internal"
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+// Writer manages a single in-progress OCI archive and allows adding images to it.
+// If path is a regular file or does not exist, the archive is written to a temporary file, which replaces the file at path
+// only when the Writer is closed; otherwise (e.g. for a FIFO or /dev/stdout) it is written directly to path.
+type Writer struct {
+	path    string // The original, user-specified path; not the maintained temporary file
+	archive *tarWriter
+	output  *archiveOutput
+}
+
+// NewWriter returns a Writer for path.
+// The archive is compressed if requested by sys.ArchiveCompressionFormat, or by the suffix of path.
+// The caller should call .Close() on the returned object.
+func NewWriter(sys *types.SystemContext, path string) (*Writer, error) {
+	if err := internal.ValidateOCIPath(path); err != nil {
+		return nil, err
+	}
+	output, err := newArchiveOutput(sys, path)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		path:    path,
+		archive: newTarWriter(output.stream),
+		output:  output,
+	}, nil
+}
+
+// Close writes all outstanding data about images to the archive, and replaces the file at the Writer's path
+// with the archive, unless adding any of the images failed; in that case, the archive is discarded.
+// No more images can be added after this is called.
+func (w *Writer) Close() error {
+	err := w.archive.close()
+	if err == nil {
+		err = w.output.commit()
+	}
+	if err2 := w.output.close(); err2 != nil && err == nil {
+		err = err2
+	}
+	return err
+}
+
+// NewReference returns an ImageReference that allows adding an image to Writer,
+// with an optional image name (the org.opencontainers.image.ref.name annotation).
+// Blobs shared between the images are stored in the archive only once.
+func (w *Writer) NewReference(image string) (types.ImageReference, error) {
+	if err := internal.ValidateImageName(image); err != nil {
+		return nil, err
+	}
+	return newReference(w.path, image, -1, "", nil, w.archive)
+}
+
+// archiveOutput is a temporary file which replaces the file at path when committed, or path itself if it is not a regular file.
+type archiveOutput struct {
+	file      *os.File
+	stream    io.WriteCloser // Writes the archive, compressed if requested, into file; nil after it has been closed
+	path      string
+	target    string      // The file replaced by file when committed: path, with symbolic links resolved; unused if inPlace
+	mode      os.FileMode // Permissions of the committed file
+	inPlace   bool        // file is path itself, not a temporary file
+	committed bool
+}
+
+// newArchiveOutput creates a temporary file in the same directory as path, so that it can be atomically renamed to path,
+// and prepares for compressing the archive as chosen by sys and path.
+// If path is a symbolic link, the file it points to is replaced instead, like os.Create would have done, and
+// the permissions of an existing file are preserved.
+// If path exists and is not a regular file (e.g. a FIFO or a character device like /dev/stdout), which can't be replaced
+// by renaming, and whose directory may not be writable, the archive is written directly to path instead.
+// The caller must call .close() on the returned object.
+func newArchiveOutput(sys *types.SystemContext, path string) (*archiveOutput, error) {
+	var file *os.File
+	target := ""
+	mode := os.FileMode(0644) // The permissions os.Create would have used, with the usual umask.
+	inPlace := false
+	if fi, err := os.Stat(path); err == nil && !fi.Mode().IsRegular() && !fi.IsDir() {
+		file, err = os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error opening %q", path)
+		}
+		inPlace = true
+	} else {
+		if err == nil && fi.Mode().IsRegular() {
+			mode = fi.Mode().Perm()
+		}
+		target = path
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			target = resolved
+		}
+		target, err = filepath.Abs(target)
+		if err != nil {
+			return nil, err
+		}
+		file, err = ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".")
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating a temporary file for %q", path)
+		}
+	}
+	stream, err := archivecompression.NewWriter(sys, path, file)
+	if err != nil {
+		file.Close()
+		if !inPlace {
+			os.Remove(file.Name())
+		}
+		return nil, err
+	}
+	return &archiveOutput{file: file, stream: stream, path: path, target: target, mode: mode, inPlace: inPlace}, nil
+}
+
+// commit finishes writing o.stream, and replaces the file at o.target with the contents written to o.file.
+func (o *archiveOutput) commit() error {
+	stream := o.stream
+	o.stream = nil
+	if err := stream.Close(); err != nil {
+		return err
+	}
+	if o.inPlace {
+		o.committed = true
+		return nil
+	}
+	if err := o.file.Sync(); err != nil {
+		return err
+	}
+	// On POSIX systems, the temporary file was created with mode 0600; use the permissions of the replaced file, if any,
+	// or those os.Create would have used. On Windows, the permissions are ignored, and Chmod always fails.
+	if runtime.GOOS != "windows" {
+		if err := o.file.Chmod(o.mode); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(o.file.Name(), o.target); err != nil {
+		return errors.Wrapf(err, "error creating tar file %q", o.path)
+	}
+	o.committed = true
+	return nil
+}
+
+// close releases resources associated with o, and deletes the temporary file unless it was committed.
+func (o *archiveOutput) close() error {
+	if o.stream != nil { // Not committed; release the compressor's resources, the archive is incomplete anyway.
+		o.stream.Close()
+	}
+	err := o.file.Close()
+	if !o.committed && !o.inPlace {
+		if err2 := os.Remove(o.file.Name()); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+// +build linux
+
+package archive
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/blobinfocache/memory"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterToFIFO(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-archive-fifo")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	fifoPath := filepath.Join(tmpDir, "fifo")
+	err = syscall.Mkfifo(fifoPath, 0600)
+	require.NoError(t, err)
+
+	type readResult struct {
+		data []byte
+		err  error
+	}
+	readDone := make(chan readResult, 1)
+	go func() {
+		data, err := ioutil.ReadFile(fifoPath)
+		readDone <- readResult{data, err}
+	}()
+
+	manifest, err := ioutil.ReadFile("../../image/fixtures/oci1.json")
+	require.NoError(t, err)
+	blob := []byte("blob")
+	writer, err := NewWriter(nil, fifoPath)
+	require.NoError(t, err)
+	ref, err := writer.NewReference("name")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	_, err = dest.PutBlob(context.Background(), bytes.NewReader(blob), types.BlobInfo{Digest: digest.FromBytes(blob), Size: int64(len(blob))}, memory.New(), false)
+	require.NoError(t, err)
+	err = dest.PutManifest(context.Background(), manifest, nil)
+	require.NoError(t, err)
+	err = dest.Commit(context.Background(), nil)
+	require.NoError(t, err)
+	err = dest.Close()
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	res := <-readDone
+	require.NoError(t, res.err)
+	// The FIFO was not replaced, and no temporary files were created next to it.
+	fi, err := os.Lstat(fifoPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeNamedPipe, fi.Mode()&os.ModeType)
+	entries, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// The data read from the FIFO is a valid archive.
+	archivePath := filepath.Join(tmpDir, "archive.tar")
+	err = ioutil.WriteFile(archivePath, res.data, 0644)
+	require.NoError(t, err)
+	reader, err := NewReader(nil, archivePath)
+	require.NoError(t, err)
+	defer reader.Close()
+	refs, err := reader.List()
+	require.NoError(t, err)
+	assert.Len(t, refs, 1)
+}
+
+func TestWriterThroughSymlink(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-archive-symlink")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	targetDir := filepath.Join(tmpDir, "target")
+	err = os.Mkdir(targetDir, 0755)
+	require.NoError(t, err)
+	targetPath := filepath.Join(targetDir, "archive.tar")
+	err = ioutil.WriteFile(targetPath, []byte("previous contents"), 0640)
+	require.NoError(t, err)
+	err = os.Chmod(targetPath, 0640) // Not affected by the umask.
+	require.NoError(t, err)
+	linkPath := filepath.Join(tmpDir, "link.tar")
+	err = os.Symlink(targetPath, linkPath)
+	require.NoError(t, err)
+
+	manifest, err := ioutil.ReadFile("../../image/fixtures/oci1.json")
+	require.NoError(t, err)
+	blob := []byte("blob")
+	writer, err := NewWriter(nil, linkPath)
+	require.NoError(t, err)
+	ref, err := writer.NewReference("name")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	_, err = dest.PutBlob(context.Background(), bytes.NewReader(blob), types.BlobInfo{Digest: digest.FromBytes(blob), Size: int64(len(blob))}, memory.New(), false)
+	require.NoError(t, err)
+	err = dest.PutManifest(context.Background(), manifest, nil)
+	require.NoError(t, err)
+	err = dest.Commit(context.Background(), nil)
+	require.NoError(t, err)
+	err = dest.Close()
+	require.NoError(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	// The symbolic link was not replaced; the file it points to was, keeping its permissions.
+	fi, err := os.Lstat(linkPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSymlink, fi.Mode()&os.ModeType)
+	fi, err = os.Lstat(targetPath)
+	require.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+	entries, err := ioutil.ReadDir(targetDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	reader, err := NewReader(nil, linkPath)
+	require.NoError(t, err)
+	defer reader.Close()
+	refs, err := reader.List()
+	require.NoError(t, err)
+	assert.Len(t, refs, 1)
+}
@@ -0,0 +1,117 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/blobinfocache/memory"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterAndReader(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-archive-writer")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	archivePath := filepath.Join(tmpDir, "archive.tar")
+
+	manifest, err := ioutil.ReadFile("../../image/fixtures/oci1.json")
+	require.NoError(t, err)
+	manifestDigest := digest.FromBytes(manifest)
+	blob := []byte("shared blob")
+	cache := memory.New()
+
+	writer, err := NewWriter(nil, archivePath)
+	require.NoError(t, err)
+	// The same image with two names, and once without a name.
+	for _, name := range []string{"first", "second", ""} {
+		ref, err := writer.NewReference(name)
+		require.NoError(t, err)
+		dest, err := ref.NewImageDestination(context.Background(), nil)
+		require.NoError(t, err)
+		_, err = dest.PutBlob(context.Background(), bytes.NewReader(blob), types.BlobInfo{Digest: digest.FromBytes(blob), Size: int64(len(blob))}, cache, false)
+		require.NoError(t, err)
+		err = dest.PutManifest(context.Background(), manifest, nil)
+		require.NoError(t, err)
+		err = dest.Commit(context.Background(), nil)
+		require.NoError(t, err)
+		err = dest.Close()
+		require.NoError(t, err)
+		// Nothing is visible at the destination path before the Writer is closed.
+		_, err = os.Lstat(archivePath)
+		assert.True(t, os.IsNotExist(err))
+	}
+	_, err = writer.NewReference("invalid'image!value@")
+	assert.Error(t, err)
+	err = writer.Close()
+	require.NoError(t, err)
+
+	reader, err := NewReader(nil, archivePath)
+	require.NoError(t, err)
+	defer reader.Close()
+	// The shared blob and manifest are stored only once.
+	blobPaths := []string{}
+	for p := range reader.archive.entries {
+		if filepath.Dir(filepath.Dir(p)) == "blobs" {
+			blobPaths = append(blobPaths, p)
+		}
+	}
+	assert.ElementsMatch(t, []string{"blobs/sha256/" + digest.FromBytes(blob).Hex(), "blobs/sha256/" + manifestDigest.Hex()}, blobPaths)
+
+	refs, err := reader.List()
+	require.NoError(t, err)
+	require.Len(t, refs, 1)
+	refStrings := []string{}
+	for _, ref := range refs[0] {
+		refStrings = append(refStrings, ref.StringWithinTransport())
+	}
+	assert.Equal(t, []string{archivePath + ":first", archivePath + ":second", archivePath + ":@" + manifestDigest.String()}, refStrings)
+
+	for _, ref := range refs[0] {
+		src, err := ref.NewImageSource(context.Background(), nil)
+		require.NoError(t, err)
+		m, _, err := src.GetManifest(context.Background(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, manifest, m)
+		err = src.Close()
+		require.NoError(t, err)
+	}
+	// Closing the sources does not close the Reader.
+	desc, err := LoadManifestDescriptorWithContext(nil, refs[0][1])
+	require.NoError(t, err)
+	assert.Equal(t, "second", desc.Annotations[imgspecv1.AnnotationRefName])
+
+	// Reader-independent references work the same.
+	ref, err := ParseReference(archivePath + ":@2")
+	require.NoError(t, err)
+	desc, err = LoadManifestDescriptorWithContext(nil, ref)
+	require.NoError(t, err)
+	assert.Equal(t, manifestDigest, desc.Digest)
+	assert.Empty(t, desc.Annotations[imgspecv1.AnnotationRefName])
+	ref, err = ParseReference(archivePath + ":@3")
+	require.NoError(t, err)
+	_, err = LoadManifestDescriptorWithContext(nil, ref)
+	assert.Error(t, err)
+	_, err = ref.NewImageDestination(context.Background(), nil)
+	assert.Error(t, err)
+
+	reader2, ref2, err := NewReaderForReference(nil, refs[0][0])
+	assert.Error(t, err) // Already reader-bound
+	assert.Nil(t, reader2)
+	assert.Nil(t, ref2)
+	ref, err = NewReference(archivePath, "second")
+	require.NoError(t, err)
+	reader2, ref2, err = NewReaderForReference(nil, ref)
+	require.NoError(t, err)
+	defer reader2.Close()
+	desc, err = LoadManifestDescriptorWithContext(nil, ref2)
+	require.NoError(t, err)
+	assert.Equal(t, "second", desc.Annotations[imgspecv1.AnnotationRefName])
+}
@@ -1,11 +1,16 @@
 package internal
 
 import (
-	"github.com/pkg/errors"
+	"fmt"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 )
 
 // annotation spex from https://github.com/opencontainers/image-spec/blob/master/annotations.md#pre-defined-annotation-keys
@@ -32,6 +37,31 @@ func ValidateImageName(image string) error {
 	return err
 }
 
+// ParseSourceSelector parses the image part of an OCI reference which starts with "@", i.e. either @index,
+// a zero-based position of an entry in index.json, or @digest, the digest of an entry in index.json.
+// It returns (index, "", nil) or (-1, digest, nil).
+// "@" can't start a valid image name, so the two syntaxes are unambiguous; image must start with "@".
+func ParseSourceSelector(image string) (int, digest.Digest, error) {
+	if !strings.HasPrefix(image, "@") {
+		return -1, "", errors.Errorf("Internal error: source selector %q does not start with @", image)
+	}
+	if strings.Contains(image, ":") {
+		d, err := digest.Parse(image[1:])
+		if err != nil {
+			return -1, "", errors.Wrapf(err, "Invalid source digest %s", image)
+		}
+		return -1, d, nil
+	}
+	i, err := strconv.Atoi(image[1:])
+	if err != nil {
+		return -1, "", errors.Wrapf(err, "Invalid source index %s", image)
+	}
+	if i < 0 {
+		return -1, "", errors.Errorf("Invalid source index @%d: must not be negative", i)
+	}
+	return i, "", nil
+}
+
 // SplitPathAndImage tries to split the provided OCI reference into the OCI path and image.
 // Neither path nor image parts are validated at this stage.
 func SplitPathAndImage(reference string) (string, string) {
@@ -124,3 +154,16 @@ func validateScopeNonWindows(scope string) error {
 
 	return nil
 }
+
+// SignaturesDir is the directory, relative to the root of an OCI layout, which contains signatures stored by
+// this library.  This is a containers/image extension, not a part of the OCI image-layout specification.
+const SignaturesDir = "signatures"
+
+// SignaturePath returns the slash-separated path, relative to the root of an OCI layout, of the signature with
+// the specified zero-based index for the manifest with the specified digest.
+func SignaturePath(manifestDigest digest.Digest, index int) (string, error) {
+	if err := manifestDigest.Validate(); err != nil {
+		return "", errors.Wrapf(err, "unexpected digest reference %s", manifestDigest)
+	}
+	return path.Join(SignaturesDir, manifestDigest.Algorithm().String(), manifestDigest.Hex(), fmt.Sprintf("signature-%d", index+1)), nil
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"fmt"
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -60,3 +61,40 @@ func TestValidateScopeWindows(t *testing.T) {
 		}
 	}
 }
+
+func TestParseSourceSelector(t *testing.T) {
+	const testDigest = "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f"
+
+	for _, c := range []struct {
+		input  string
+		index  int
+		digest digest.Digest
+	}{
+		{"@0", 0, ""},
+		{"@12", 12, ""},
+		{"@" + testDigest, -1, testDigest},
+	} {
+		index, d, err := ParseSourceSelector(c.input)
+		assert.NoError(t, err, c.input)
+		assert.Equal(t, c.index, index, c.input)
+		assert.Equal(t, c.digest, d, c.input)
+	}
+
+	for _, input := range []string{"", "0", "@", "@-1", "@notanumber", "@sha256:notadigest"} {
+		_, _, err := ParseSourceSelector(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestSignaturePath(t *testing.T) {
+	const testDigest = digest.Digest("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	p, err := SignaturePath(testDigest, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "signatures/sha256/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/signature-1", p)
+	p, err = SignaturePath(testDigest, 9)
+	assert.NoError(t, err)
+	assert.Equal(t, "signatures/sha256/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/signature-10", p)
+
+	_, err = SignaturePath("sha256:notadigest", 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,249 @@
+package layout
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/internal/iolimits"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/oci/internal"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// GarbageCollect deletes all blobs in the OCI layout at dir which are not reachable from any entry in its index.json,
+// following nested indexes/manifest lists and the configs and layers of image manifests, and signatures of manifests
+// which are not reachable.
+//
+// If sys.OCISharedBlobDirPath is set, manifests are read from the shared blob directory, but blobs in the shared
+// directory are never deleted, because they may be used by other layouts; only unreferenced blobs in the layout's own
+// "blobs" subdirectory are.
+//
+// Blobs which were written or reused by an image destination that has not been committed or closed yet are not deleted,
+// so this can safely run concurrently with copies into the same layout.  If such a destination is never closed
+// (e.g. because the process was killed), its blobs are kept until the file recording them in the "index.json.pending"
+// subdirectory is removed.
+func GarbageCollect(ctx context.Context, sys *types.SystemContext, dir string) error {
+	ref, err := NewReference(dir, "")
+	if err != nil {
+		return err
+	}
+	return ref.(ociReference).garbageCollect(ctx, sys)
+}
+
+// garbageCollect implements GarbageCollect for ref.dir.
+func (ref ociReference) garbageCollect(ctx context.Context, sys *types.SystemContext) error {
+	unlock, err := ref.lockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return ref.garbageCollectLocked(ctx, sys)
+}
+
+// garbageCollectLocked implements GarbageCollect for ref.dir.
+// The caller must hold the lock returned by ref.lockIndex.
+func (ref ociReference) garbageCollectLocked(ctx context.Context, sys *types.SystemContext) error {
+	sharedBlobDir := ""
+	if sys != nil {
+		sharedBlobDir = sys.OCISharedBlobDirPath
+	}
+	index, err := ref.getIndex()
+	if err != nil {
+		return err
+	}
+	reachable := map[digest.Digest]struct{}{}
+	for _, desc := range index.Manifests {
+		if err := ref.markReachable(ctx, reachable, desc, sharedBlobDir); err != nil {
+			return err
+		}
+	}
+	// Only after following index.json, so that markReachable does not skip manifests which are also pending.
+	if err := ref.addPendingBlobs(reachable); err != nil {
+		return err
+	}
+	if err := ref.deleteUnreachableBlobs(reachable); err != nil {
+		return err
+	}
+	return ref.deleteUnreachableSignatures(reachable)
+}
+
+// addPendingBlobs adds all blobs recorded by image destinations which have not been committed yet to reachable.
+// The caller must hold the lock returned by ref.lockIndex.
+func (ref ociReference) addPendingBlobs(reachable map[digest.Digest]struct{}) error {
+	files, err := ioutil.ReadDir(ref.pendingBlobsDirPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(filepath.Join(ref.pendingBlobsDirPath(), file.Name()))
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(contents), "\n") {
+			if line == "" {
+				continue
+			}
+			d, err := digest.Parse(line)
+			if err != nil {
+				return errors.Wrapf(err, "error parsing pending blobs in %s", file.Name())
+			}
+			reachable[d] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// markReachable adds desc, and if it is a manifest or an index, all blobs it references, to reachable.
+func (ref ociReference) markReachable(ctx context.Context, reachable map[digest.Digest]struct{}, desc imgspecv1.Descriptor, sharedBlobDir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, ok := reachable[desc.Digest]; ok {
+		return nil // Already processed
+	}
+	reachable[desc.Digest] = struct{}{}
+
+	mimeType := desc.MediaType
+	switch mimeType {
+	case "", imgspecv1.MediaTypeImageManifest, imgspecv1.MediaTypeImageIndex,
+		manifest.DockerV2Schema2MediaType, manifest.DockerV2ListMediaType,
+		manifest.DockerV2Schema1MediaType, manifest.DockerV2Schema1SignedMediaType:
+	default:
+		return nil // Not a manifest, so it does not reference any other blobs
+	}
+
+	blobPath, err := ref.blobPath(desc.Digest, sharedBlobDir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(blobPath)
+	if err != nil {
+		// We can't tell what the manifest references, so we must not delete anything.
+		return errors.Wrapf(err, "error reading manifest %s", desc.Digest)
+	}
+	defer f.Close()
+	blob, err := iolimits.ReadAtMost(f, iolimits.MaxManifestBodySize)
+	if err != nil {
+		return errors.Wrapf(err, "error reading manifest %s", desc.Digest)
+	}
+	if mimeType == "" {
+		mimeType = manifest.GuessMIMEType(blob)
+	}
+
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(blob, mimeType)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing manifest list %s", desc.Digest)
+		}
+		for _, instanceDigest := range list.Instances() {
+			instance, err := list.Instance(instanceDigest)
+			if err != nil {
+				return err
+			}
+			if err := ref.markReachable(ctx, reachable, imgspecv1.Descriptor{MediaType: instance.MediaType, Digest: instance.Digest, Size: instance.Size}, sharedBlobDir); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	m, err := manifest.FromBlob(blob, mimeType)
+	if err != nil {
+		return errors.Wrapf(err, "error parsing manifest %s", desc.Digest)
+	}
+	if config := m.ConfigInfo(); config.Digest != "" {
+		reachable[config.Digest] = struct{}{}
+	}
+	for _, layer := range m.LayerInfos() {
+		reachable[layer.Digest] = struct{}{}
+	}
+	return nil
+}
+
+// deleteUnreachableBlobs deletes all blobs in ref's own blobs directory which are not in reachable.
+func (ref ociReference) deleteUnreachableBlobs(reachable map[digest.Digest]struct{}) error {
+	blobsDir := filepath.Join(ref.dir, "blobs")
+	algorithms, err := ioutil.ReadDir(blobsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, algorithm := range algorithms {
+		if !algorithm.IsDir() {
+			continue
+		}
+		algorithmDir := filepath.Join(blobsDir, algorithm.Name())
+		blobs, err := ioutil.ReadDir(algorithmDir)
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			if blob.IsDir() {
+				continue
+			}
+			d := digest.NewDigestFromEncoded(digest.Algorithm(algorithm.Name()), blob.Name())
+			if err := d.Validate(); err != nil {
+				continue // Not a blob we know how to handle, leave it alone
+			}
+			if _, ok := reachable[d]; ok {
+				continue
+			}
+			logrus.Debugf("Deleting unreferenced blob %s from OCI layout %s", d, ref.dir)
+			if err := os.Remove(filepath.Join(algorithmDir, blob.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteUnreachableSignatures deletes signatures of all manifests in ref which are not in reachable.
+func (ref ociReference) deleteUnreachableSignatures(reachable map[digest.Digest]struct{}) error {
+	signaturesDir := filepath.Join(ref.dir, internal.SignaturesDir)
+	algorithms, err := ioutil.ReadDir(signaturesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, algorithm := range algorithms {
+		if !algorithm.IsDir() {
+			continue
+		}
+		algorithmDir := filepath.Join(signaturesDir, algorithm.Name())
+		manifests, err := ioutil.ReadDir(algorithmDir)
+		if err != nil {
+			return err
+		}
+		for _, m := range manifests {
+			if !m.IsDir() {
+				continue
+			}
+			d := digest.NewDigestFromEncoded(digest.Algorithm(algorithm.Name()), m.Name())
+			if err := d.Validate(); err != nil {
+				continue // Not a manifest digest we know how to handle, leave it alone
+			}
+			if _, ok := reachable[d]; ok {
+				continue
+			}
+			logrus.Debugf("Deleting signatures of unreferenced manifest %s from OCI layout %s", d, ref.dir)
+			if err := os.RemoveAll(filepath.Join(algorithmDir, m.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
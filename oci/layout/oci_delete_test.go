@@ -0,0 +1,216 @@
+package layout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspec "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestBlob writes contents as a blob into the blobs directory blobDir, and returns its descriptor.
+func writeTestBlob(t *testing.T, blobDir string, mediaType string, contents []byte) imgspecv1.Descriptor {
+	d := digest.FromBytes(contents)
+	path := filepath.Join(blobDir, d.Algorithm().String(), d.Encoded())
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, contents, 0644))
+	return imgspecv1.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(contents))}
+}
+
+// writeTestJSONBlob writes the JSON representation of value as a blob into blobDir, and returns its descriptor.
+func writeTestJSONBlob(t *testing.T, blobDir string, mediaType string, value interface{}) imgspecv1.Descriptor {
+	contents, err := json.Marshal(value)
+	require.NoError(t, err)
+	return writeTestBlob(t, blobDir, mediaType, contents)
+}
+
+// testLayoutBlobs describes blobs created by makeTestLayout
+type testLayoutBlobs struct {
+	sharedLayer, layer2, config1, config2, manifest1, manifest2, nestedIndex, orphan imgspecv1.Descriptor
+}
+
+// makeTestLayout creates an OCI layout in dir with two images, "one" (a manifest) and "two" (an index containing a manifest),
+// which share a layer, with their blobs stored in blobDir. It also adds an unreferenced blob.
+func makeTestLayout(t *testing.T, dir, blobDir string) testLayoutBlobs {
+	b := testLayoutBlobs{}
+	b.sharedLayer = writeTestBlob(t, blobDir, imgspecv1.MediaTypeImageLayerGzip, []byte("shared layer"))
+	b.layer2 = writeTestBlob(t, blobDir, imgspecv1.MediaTypeImageLayerGzip, []byte("layer 2"))
+	b.config1 = writeTestJSONBlob(t, blobDir, imgspecv1.MediaTypeImageConfig, imgspecv1.Image{OS: "linux", Architecture: "amd64"})
+	b.config2 = writeTestJSONBlob(t, blobDir, imgspecv1.MediaTypeImageConfig, imgspecv1.Image{OS: "linux", Architecture: "arm64"})
+	b.manifest1 = writeTestJSONBlob(t, blobDir, imgspecv1.MediaTypeImageManifest, imgspecv1.Manifest{
+		Versioned: imgspec.Versioned{SchemaVersion: 2},
+		Config:    b.config1,
+		Layers:    []imgspecv1.Descriptor{b.sharedLayer},
+	})
+	b.manifest2 = writeTestJSONBlob(t, blobDir, imgspecv1.MediaTypeImageManifest, imgspecv1.Manifest{
+		Versioned: imgspec.Versioned{SchemaVersion: 2},
+		Config:    b.config2,
+		Layers:    []imgspecv1.Descriptor{b.sharedLayer, b.layer2},
+	})
+	b.nestedIndex = writeTestJSONBlob(t, blobDir, imgspecv1.MediaTypeImageIndex, imgspecv1.Index{
+		Versioned: imgspec.Versioned{SchemaVersion: 2},
+		Manifests: []imgspecv1.Descriptor{b.manifest2},
+	})
+	b.orphan = writeTestBlob(t, filepath.Join(dir, "blobs"), "", []byte("orphan"))
+
+	named1 := b.manifest1
+	named1.Annotations = map[string]string{imgspecv1.AnnotationRefName: "one"}
+	named2 := b.nestedIndex
+	named2.Annotations = map[string]string{imgspecv1.AnnotationRefName: "two"}
+	index, err := json.Marshal(imgspecv1.Index{
+		Versioned: imgspec.Versioned{SchemaVersion: 2},
+		Manifests: []imgspecv1.Descriptor{named1, named2},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644))
+	return b
+}
+
+// blobExists returns true if the blob desc exists in blobDir.
+func blobExists(t *testing.T, blobDir string, desc imgspecv1.Descriptor) bool {
+	_, err := os.Stat(filepath.Join(blobDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err == nil {
+		return true
+	}
+	require.True(t, os.IsNotExist(err))
+	return false
+}
+
+// writeTestSignature writes a signature for the manifest desc into the layout in dir.
+func writeTestSignature(t *testing.T, dir string, desc imgspecv1.Descriptor) {
+	path := filepath.Join(dir, "signatures", desc.Digest.Algorithm().String(), desc.Digest.Encoded(), "signature-1")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, []byte("signature"), 0644))
+}
+
+// signatureExists returns true if a signature for the manifest desc exists in the layout in dir.
+func signatureExists(t *testing.T, dir string, desc imgspecv1.Descriptor) bool {
+	_, err := os.Stat(filepath.Join(dir, "signatures", desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err == nil {
+		return true
+	}
+	require.True(t, os.IsNotExist(err))
+	return false
+}
+
+func TestDeleteImage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-delete-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	blobDir := filepath.Join(tmpDir, "blobs")
+	b := makeTestLayout(t, tmpDir, blobDir)
+	writeTestSignature(t, tmpDir, b.manifest1)
+	writeTestSignature(t, tmpDir, b.manifest2)
+
+	ref, err := NewReference(tmpDir, "two")
+	require.NoError(t, err)
+	err = ref.DeleteImage(context.Background(), nil)
+	require.NoError(t, err)
+
+	index, err := ref.(ociReference).getIndex()
+	require.NoError(t, err)
+	require.Len(t, index.Manifests, 1)
+	assert.Equal(t, "one", index.Manifests[0].Annotations[imgspecv1.AnnotationRefName])
+
+	for _, desc := range []imgspecv1.Descriptor{b.sharedLayer, b.config1, b.manifest1} {
+		assert.True(t, blobExists(t, blobDir, desc), desc.Digest.String())
+	}
+	for _, desc := range []imgspecv1.Descriptor{b.layer2, b.config2, b.manifest2, b.nestedIndex, b.orphan} {
+		assert.False(t, blobExists(t, blobDir, desc), desc.Digest.String())
+	}
+	assert.True(t, signatureExists(t, tmpDir, b.manifest1))
+	assert.False(t, signatureExists(t, tmpDir, b.manifest2))
+
+	// The remaining image can be deleted as well
+	ref, err = NewReference(tmpDir, "")
+	require.NoError(t, err)
+	err = ref.DeleteImage(context.Background(), nil)
+	require.NoError(t, err)
+	index, err = ref.(ociReference).getIndex()
+	require.NoError(t, err)
+	assert.Len(t, index.Manifests, 0)
+	for _, desc := range []imgspecv1.Descriptor{b.sharedLayer, b.config1, b.manifest1} {
+		assert.False(t, blobExists(t, blobDir, desc), desc.Digest.String())
+	}
+}
+
+func TestGarbageCollect(t *testing.T) {
+	// Without a shared blob directory
+	tmpDir, err := ioutil.TempDir("", "oci-delete-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	blobDir := filepath.Join(tmpDir, "blobs")
+	b := makeTestLayout(t, tmpDir, blobDir)
+	err = GarbageCollect(context.Background(), nil, tmpDir)
+	require.NoError(t, err)
+	for _, desc := range []imgspecv1.Descriptor{b.sharedLayer, b.layer2, b.config1, b.config2, b.manifest1, b.manifest2, b.nestedIndex} {
+		assert.True(t, blobExists(t, blobDir, desc), desc.Digest.String())
+	}
+	assert.False(t, blobExists(t, blobDir, b.orphan))
+
+	// With a shared blob directory
+	tmpDir, err = ioutil.TempDir("", "oci-delete-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	sharedBlobDir, err := ioutil.TempDir("", "oci-delete-test-shared")
+	require.NoError(t, err)
+	defer os.RemoveAll(sharedBlobDir)
+	b = makeTestLayout(t, tmpDir, sharedBlobDir)
+	sharedOrphan := writeTestBlob(t, sharedBlobDir, "", []byte("shared orphan"))
+	err = GarbageCollect(context.Background(), nil, tmpDir)
+	assert.Error(t, err) // Manifests can't be found without OCISharedBlobDirPath
+	assert.True(t, blobExists(t, filepath.Join(tmpDir, "blobs"), b.orphan))
+	err = GarbageCollect(context.Background(), &types.SystemContext{OCISharedBlobDirPath: sharedBlobDir}, tmpDir)
+	require.NoError(t, err)
+	assert.False(t, blobExists(t, filepath.Join(tmpDir, "blobs"), b.orphan))
+	assert.True(t, blobExists(t, sharedBlobDir, sharedOrphan)) // May be used by other layouts
+	for _, desc := range []imgspecv1.Descriptor{b.sharedLayer, b.layer2, b.config1, b.config2, b.manifest1, b.manifest2, b.nestedIndex} {
+		assert.True(t, blobExists(t, sharedBlobDir, desc), desc.Digest.String())
+	}
+}
+
+func TestGarbageCollectKeepsPendingBlobs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-delete-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	blobDir := filepath.Join(tmpDir, "blobs")
+	b := makeTestLayout(t, tmpDir, blobDir)
+
+	ref, err := NewReference(tmpDir, "three")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	info, err := dest.PutBlob(context.Background(), bytes.NewReader([]byte("pending layer")), types.BlobInfo{Size: -1}, nil, false)
+	require.NoError(t, err)
+	pendingLayer := imgspecv1.Descriptor{Digest: info.Digest, Size: info.Size}
+	reused, _, err := dest.TryReusingBlob(context.Background(), types.BlobInfo{Digest: b.orphan.Digest, Size: -1}, nil, false)
+	require.NoError(t, err)
+	assert.True(t, reused)
+
+	// Blobs used by the uncommitted destination are not deleted.
+	err = GarbageCollect(context.Background(), nil, tmpDir)
+	require.NoError(t, err)
+	assert.True(t, blobExists(t, blobDir, pendingLayer))
+	assert.True(t, blobExists(t, blobDir, b.orphan))
+
+	// After the destination is closed without a Commit, they can be deleted.
+	err = dest.Close()
+	require.NoError(t, err)
+	err = GarbageCollect(context.Background(), nil, tmpDir)
+	require.NoError(t, err)
+	assert.False(t, blobExists(t, blobDir, pendingLayer))
+	assert.False(t, blobExists(t, blobDir, b.orphan))
+	for _, desc := range []imgspecv1.Descriptor{b.sharedLayer, b.layer2, b.config1, b.config2, b.manifest1, b.manifest2, b.nestedIndex} {
+		assert.True(t, blobExists(t, blobDir, desc), desc.Digest.String())
+	}
+}
@@ -2,7 +2,6 @@ package layout
 
 import (
 	"context"
-	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
@@ -11,6 +10,7 @@ import (
 
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
+	"github.com/containers/storage/pkg/ioutils"
 	digest "github.com/opencontainers/go-digest"
 	imgspec "github.com/opencontainers/image-spec/specs-go"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
@@ -19,30 +19,27 @@ import (
 
 type ociImageDestination struct {
 	ref                      ociReference
-	index                    imgspecv1.Index
+	newManifests             []imgspecv1.Descriptor // Entries to add to index.json at Commit, in order
+	manifestDigest           digest.Digest          // Digest of the top-level manifest, set by PutManifest
 	sharedBlobDir            string
 	acceptUncompressedLayers bool
+	pendingBlobsPath         string // Path of the file recording blobs used by this destination, or "" if not created yet
 }
 
 // newImageDestination returns an ImageDestination for writing to an existing directory.
 func newImageDestination(sys *types.SystemContext, ref ociReference) (types.ImageDestination, error) {
-	var index *imgspecv1.Index
+	if ref.sourceIndex != -1 || ref.sourceDigest != "" {
+		return nil, errors.Errorf("Destination reference must not contain a source index or digest: %s", ref.StringWithinTransport())
+	}
 	if indexExists(ref) {
-		var err error
-		index, err = ref.getIndex()
-		if err != nil {
+		// Fail early if the existing index is not usable; it is read again at Commit time, so that concurrent
+		// writers to the same layout don't lose each other's entries.
+		if _, err := ref.getIndex(); err != nil {
 			return nil, err
 		}
-	} else {
-		index = &imgspecv1.Index{
-			Versioned: imgspec.Versioned{
-				SchemaVersion: 2,
-			},
-			Annotations: make(map[string]string),
-		}
 	}
 
-	d := &ociImageDestination{ref: ref, index: *index}
+	d := &ociImageDestination{ref: ref}
 	if sys != nil {
 		d.sharedBlobDir = sys.OCISharedBlobDirPath
 		d.acceptUncompressedLayers = sys.OCIAcceptUncompressedLayers
@@ -68,6 +65,61 @@ func (d *ociImageDestination) Reference() types.ImageReference {
 
 // Close removes resources associated with an initialized ImageDestination, if any.
 func (d *ociImageDestination) Close() error {
+	if d.pendingBlobsPath == "" {
+		return nil
+	}
+	unlock, err := d.ref.lockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return d.removePendingBlobsLocked()
+}
+
+// recordPendingBlob records that blobDigest is used by this destination, so that GarbageCollect does not delete it
+// before the destination's manifests are added to index.json at Commit.
+// This must be called before the blob is written, or checked for existence when reusing it.
+func (d *ociImageDestination) recordPendingBlob(blobDigest digest.Digest) error {
+	unlock, err := d.ref.lockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if d.pendingBlobsPath == "" {
+		if err := ensureDirectoryExists(d.ref.pendingBlobsDirPath()); err != nil {
+			return err
+		}
+		f, err := ioutil.TempFile(d.ref.pendingBlobsDirPath(), "pending")
+		if err != nil {
+			return err
+		}
+		d.pendingBlobsPath = f.Name()
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(d.pendingBlobsPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(blobDigest.String() + "\n")
+	return err
+}
+
+// removePendingBlobsLocked removes the record of blobs used by this destination, if any.
+// The caller must hold the lock returned by d.ref.lockIndex.
+func (d *ociImageDestination) removePendingBlobsLocked() error {
+	if d.pendingBlobsPath == "" {
+		return nil
+	}
+	if err := os.Remove(d.pendingBlobsPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	d.pendingBlobsPath = ""
+	// Remove the directory if this was the last destination using it; this fails harmlessly if it is not empty.
+	_ = os.Remove(d.ref.pendingBlobsDirPath())
 	return nil
 }
 
@@ -81,7 +133,7 @@ func (d *ociImageDestination) SupportedManifestMIMETypes() []string {
 // SupportsSignatures returns an error (to be displayed to the user) if the destination certainly can't store signatures.
 // Note: It is still possible for PutSignatures to fail if SupportsSignatures returns nil.
 func (d *ociImageDestination) SupportsSignatures(ctx context.Context) error {
-	return errors.Errorf("Pushing signatures for OCI images is not supported")
+	return nil
 }
 
 func (d *ociImageDestination) DesiredLayerCompression() types.LayerCompression {
@@ -171,6 +223,9 @@ func (d *ociImageDestination) PutBlob(ctx context.Context, stream io.Reader, inp
 	if err := ensureParentDirectoryExists(blobPath); err != nil {
 		return types.BlobInfo{}, err
 	}
+	if err := d.recordPendingBlob(computedDigest); err != nil {
+		return types.BlobInfo{}, err
+	}
 
 	// need to explicitly close the file, since a rename won't otherwise not work on Windows
 	blobFile.Close()
@@ -199,6 +254,10 @@ func (d *ociImageDestination) TryReusingBlob(ctx context.Context, info types.Blo
 	if err != nil {
 		return false, types.BlobInfo{}, err
 	}
+	// Record the blob first, so that it can't be garbage-collected between the check and Commit.
+	if err := d.recordPendingBlob(info.Digest); err != nil {
+		return false, types.BlobInfo{}, err
+	}
 	finfo, err := os.Stat(blobPath)
 	if err != nil && os.IsNotExist(err) {
 		return false, types.BlobInfo{}, nil
@@ -239,6 +298,9 @@ func (d *ociImageDestination) PutManifest(ctx context.Context, m []byte, instanc
 	if err := ensureParentDirectoryExists(blobPath); err != nil {
 		return err
 	}
+	if err := d.recordPendingBlob(digest); err != nil {
+		return err
+	}
 	if err := ioutil.WriteFile(blobPath, m, 0644); err != nil {
 		return err
 	}
@@ -246,6 +308,7 @@ func (d *ociImageDestination) PutManifest(ctx context.Context, m []byte, instanc
 	if instanceDigest != nil {
 		return nil
 	}
+	d.manifestDigest = digest
 
 	// If we had platform information, we'd build an imgspecv1.Platform structure here.
 
@@ -261,43 +324,81 @@ func (d *ociImageDestination) PutManifest(ctx context.Context, m []byte, instanc
 	// If we knew the MIME type, we wouldn't have to guess here.
 	desc.MediaType = manifest.GuessMIMEType(m)
 
-	d.addManifest(&desc)
+	d.newManifests = append(d.newManifests, desc)
 
 	return nil
 }
 
-func (d *ociImageDestination) addManifest(desc *imgspecv1.Descriptor) {
+// addManifest adds desc to index, replacing any conflicting entries.
+func addManifest(index *imgspecv1.Index, desc *imgspecv1.Descriptor) {
 	// If the new entry has a name, remove any conflicting names which we already have.
 	if desc.Annotations != nil && desc.Annotations[imgspecv1.AnnotationRefName] != "" {
 		// The name is being set on a new entry, so remove any older ones that had the same name.
 		// We might be storing an index and all of its component images, and we'll want to attach
 		// the name to the last one, which is the index.
-		for i, manifest := range d.index.Manifests {
+		for i, manifest := range index.Manifests {
 			if manifest.Annotations[imgspecv1.AnnotationRefName] == desc.Annotations[imgspecv1.AnnotationRefName] {
-				delete(d.index.Manifests[i].Annotations, imgspecv1.AnnotationRefName)
+				delete(index.Manifests[i].Annotations, imgspecv1.AnnotationRefName)
 				break
 			}
 		}
 	}
 	// If it has the same digest as another entry in the index, we already overwrote the file,
 	// so just pick up the other information.
-	for i, manifest := range d.index.Manifests {
+	for i, manifest := range index.Manifests {
 		if manifest.Digest == desc.Digest && manifest.Annotations[imgspecv1.AnnotationRefName] == "" {
 			// Replace it completely.
-			d.index.Manifests[i] = *desc
+			index.Manifests[i] = *desc
 			return
 		}
 	}
 	// It's a new entry to be added to the index.
-	d.index.Manifests = append(d.index.Manifests, *desc)
+	index.Manifests = append(index.Manifests, *desc)
 }
 
-// PutSignatures would add the given signatures to the oci layout (currently not supported).
+// PutSignatures writes a set of signatures to the destination.
 // If instanceDigest is not nil, it contains a digest of the specific manifest instance to write or overwrite the signatures for
 // (when the primary manifest is a manifest list); this should always be nil if the primary manifest is not a manifest list.
+//
+// Signatures are stored in a "signatures" subdirectory, indexed by the manifest digest, and shared by all index.json entries
+// which refer to that manifest.  Writing a non-empty set replaces any signatures already stored for the manifest;
+// an empty set leaves them unchanged.
 func (d *ociImageDestination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
-	if len(signatures) != 0 {
-		return errors.Errorf("Pushing signatures for OCI images is not supported")
+	if len(signatures) == 0 {
+		return nil
+	}
+	manifestDigest := d.manifestDigest
+	if instanceDigest != nil {
+		manifestDigest = *instanceDigest
+	}
+	if manifestDigest == "" {
+		return errors.New("Unknown manifest digest, can't add signatures")
+	}
+
+	for i, sig := range signatures {
+		path, err := d.ref.signaturePath(manifestDigest, i)
+		if err != nil {
+			return err
+		}
+		if err := ensureParentDirectoryExists(path); err != nil {
+			return err
+		}
+		if err := ioutils.AtomicWriteFile(path, sig, 0644); err != nil {
+			return err
+		}
+	}
+	// Remove any signatures left over from an earlier, longer, set.
+	for i := len(signatures); ; i++ {
+		path, err := d.ref.signaturePath(manifestDigest, i)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return err
+		}
 	}
 	return nil
 }
@@ -306,15 +407,42 @@ func (d *ociImageDestination) PutSignatures(ctx context.Context, signatures [][]
 // WARNING: This does not have any transactional semantics:
 // - Uploaded data MAY be visible to others before Commit() is called
 // - Uploaded data MAY be removed or MAY remain around if Close() is called without Commit() (i.e. rollback is allowed but not guaranteed)
+//
+// The entries added by this destination are merged into the current contents of index.json, which is locked
+// while doing so and replaced atomically, so that concurrent writers to the same layout don't lose each other's entries.
 func (d *ociImageDestination) Commit(context.Context, types.UnparsedImage) error {
-	if err := ioutil.WriteFile(d.ref.ociLayoutPath(), []byte(`{"imageLayoutVersion": "1.0.0"}`), 0644); err != nil {
+	if err := ioutils.AtomicWriteFile(d.ref.ociLayoutPath(), []byte(`{"imageLayoutVersion": "1.0.0"}`), 0644); err != nil {
 		return err
 	}
-	indexJSON, err := json.Marshal(d.index)
+
+	unlock, err := d.ref.lockIndex()
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(d.ref.indexPath(), indexJSON, 0644)
+	defer unlock()
+
+	var index *imgspecv1.Index
+	if indexExists(d.ref) {
+		index, err = d.ref.getIndex()
+		if err != nil {
+			return err
+		}
+	} else {
+		index = &imgspecv1.Index{
+			Versioned: imgspec.Versioned{
+				SchemaVersion: 2,
+			},
+			Annotations: make(map[string]string),
+		}
+	}
+	for i := range d.newManifests {
+		addManifest(index, &d.newManifests[i])
+	}
+	if err := d.ref.writeIndex(index); err != nil {
+		return err
+	}
+	// The blobs are now referenced from index.json, so they don't need to be protected from garbage collection any more.
+	return d.removePendingBlobsLocked()
 }
 
 func ensureDirectoryExists(path string) error {
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/containers/image/v5/pkg/blobinfocache/memory"
@@ -133,6 +134,116 @@ func TestPutTwoDifferentTags(t *testing.T) {
 	assert.Equal(t, "zomg", index.Manifests[2].Annotations[imgspecv1.AnnotationRefName])
 }
 
+// TestConcurrentDestinations tests that destinations created before each other's Commit don't lose entries.
+func TestConcurrentDestinations(t *testing.T) {
+	ref, tmpDir := refToTempOCI(t)
+	defer os.RemoveAll(tmpDir)
+
+	data, err := ioutil.ReadFile("../../image/fixtures/oci1.json")
+	require.NoError(t, err)
+
+	dests := []types.ImageDestination{}
+	for _, name := range []string{"first", "second", "third"} {
+		ref, err := NewReference(tmpDir, name)
+		require.NoError(t, err)
+		dest, err := ref.NewImageDestination(context.Background(), nil)
+		require.NoError(t, err)
+		defer dest.Close()
+		err = dest.PutManifest(context.Background(), data, nil)
+		require.NoError(t, err)
+		dests = append(dests, dest)
+	}
+
+	var wg sync.WaitGroup
+	for _, dest := range dests {
+		wg.Add(1)
+		go func(dest types.ImageDestination) {
+			defer wg.Done()
+			err := dest.Commit(context.Background(), nil)
+			assert.NoError(t, err)
+		}(dest)
+	}
+	wg.Wait()
+
+	index, err := ref.(ociReference).getIndex()
+	require.NoError(t, err)
+	names := []string{}
+	for _, m := range index.Manifests {
+		names = append(names, m.Annotations[imgspecv1.AnnotationRefName])
+	}
+	assert.ElementsMatch(t, []string{"imageValue", "first", "second", "third"}, names)
+
+	// No temporary files are left behind.
+	entries, err := ioutil.ReadDir(tmpDir)
+	require.NoError(t, err)
+	files := []string{}
+	for _, e := range entries {
+		files = append(files, e.Name())
+	}
+	assert.ElementsMatch(t, []string{"blobs", "index.json", "index.json.lock", "oci-layout"}, files)
+}
+
+func TestPutSignatures(t *testing.T) {
+	ref, tmpDir := refToTempOCI(t)
+	defer os.RemoveAll(tmpDir)
+
+	data, err := ioutil.ReadFile("../../image/fixtures/oci1.json")
+	require.NoError(t, err)
+	manifestDigest := digest.FromBytes(data)
+
+	putSignatures := func(signatures [][]byte) {
+		dest, err := ref.NewImageDestination(context.Background(), nil)
+		require.NoError(t, err)
+		defer dest.Close()
+		assert.NoError(t, dest.SupportsSignatures(context.Background()))
+		err = dest.PutManifest(context.Background(), data, nil)
+		require.NoError(t, err)
+		err = dest.PutSignatures(context.Background(), signatures, nil)
+		require.NoError(t, err)
+		err = dest.Commit(context.Background(), nil)
+		require.NoError(t, err)
+	}
+	getSignatures := func() [][]byte {
+		src, err := ref.NewImageSource(context.Background(), nil)
+		require.NoError(t, err)
+		defer src.Close()
+		sigs, err := src.GetSignatures(context.Background(), nil)
+		require.NoError(t, err)
+		return sigs
+	}
+
+	putSignatures([][]byte{[]byte("sig1"), []byte("sig2")})
+	assert.Equal(t, [][]byte{[]byte("sig1"), []byte("sig2")}, getSignatures())
+	sigPath, err := ref.(ociReference).signaturePath(manifestDigest, 0)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(tmpDir, "signatures", "sha256", manifestDigest.Hex(), "signature-1"), sigPath)
+
+	// A new set replaces the old one
+	putSignatures([][]byte{[]byte("sig3")})
+	assert.Equal(t, [][]byte{[]byte("sig3")}, getSignatures())
+	// An empty set does not remove existing signatures
+	putSignatures([][]byte{})
+	assert.Equal(t, [][]byte{[]byte("sig3")}, getSignatures())
+
+	// Signatures for a specific instance
+	dest, err := ref.NewImageDestination(context.Background(), nil)
+	require.NoError(t, err)
+	defer dest.Close()
+	instanceDigest := digest.FromString("instance")
+	err = dest.PutSignatures(context.Background(), [][]byte{[]byte("instance sig")}, &instanceDigest)
+	require.NoError(t, err)
+	src, err := ref.NewImageSource(context.Background(), nil)
+	require.NoError(t, err)
+	defer src.Close()
+	sigs, err := src.GetSignatures(context.Background(), &instanceDigest)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("instance sig")}, sigs)
+
+	// Signatures before PutManifest are rejected
+	err = dest.PutSignatures(context.Background(), [][]byte{[]byte("sig")}, nil)
+	assert.Error(t, err)
+}
+
 func putTestConfig(t *testing.T, ociRef ociReference, tmpDir string) {
 	data, err := ioutil.ReadFile("../../image/fixtures/oci1-config.json")
 	assert.NoError(t, err)
@@ -0,0 +1,69 @@
+package layout
+
+import (
+	"github.com/containers/image/v5/oci/internal"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ListResult describes a single entry in the index.json of an OCI layout.
+type ListResult struct {
+	// Reference refers to this entry. It uses the entry's name if the name unambiguously identifies it,
+	// otherwise the entry's digest if that is unambiguous, otherwise the entry's position in index.json.
+	Reference types.ImageReference
+	// RefName is the value of the org.opencontainers.image.ref.name annotation, or "" if the entry is not named.
+	RefName string
+	// Descriptor is the index.json entry, including its platform (if any) and annotations.
+	Descriptor imgspecv1.Descriptor
+}
+
+// List returns a ListResult for every entry in the index.json of the OCI layout in dir, in the order of index.json.
+func List(dir string) ([]ListResult, error) {
+	dirRef, err := newReference(dir, "", -1, "")
+	if err != nil {
+		return nil, err
+	}
+	index, err := dirRef.(ociReference).getIndex()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading index of %s", dir)
+	}
+
+	names := map[string]int{}
+	digests := map[digest.Digest]int{}
+	for _, md := range index.Manifests {
+		if refName, ok := md.Annotations[imgspecv1.AnnotationRefName]; ok && isNameableMediaType(md.MediaType) {
+			names[refName]++
+		}
+		digests[md.Digest]++
+	}
+
+	res := make([]ListResult, 0, len(index.Manifests))
+	for i, md := range index.Manifests {
+		refName := md.Annotations[imgspecv1.AnnotationRefName]
+		var ref types.ImageReference
+		switch {
+		case refName != "" && names[refName] == 1 && internal.ValidateImageName(refName) == nil:
+			ref, err = newReference(dir, refName, -1, "")
+		case digests[md.Digest] == 1 && md.Digest.Validate() == nil:
+			ref, err = newReference(dir, "", -1, md.Digest)
+		default:
+			ref, err = newReference(dir, "", i, "")
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating a reference for index.json entry @%d", i)
+		}
+		res = append(res, ListResult{
+			Reference:  ref,
+			RefName:    refName,
+			Descriptor: md,
+		})
+	}
+	return res, nil
+}
+
+// isNameableMediaType returns true if an index.json entry with mediaType can be looked up by its name.
+func isNameableMediaType(mediaType string) bool {
+	return mediaType == imgspecv1.MediaTypeImageManifest || mediaType == imgspecv1.MediaTypeImageIndex
+}
@@ -0,0 +1,102 @@
+package layout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestList(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-list-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	const (
+		digest1 = digest.Digest("sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f")
+		digest2 = digest.Digest("sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270")
+		digest3 = digest.Digest("sha256:a6b3f5b4b7a5b8f3d33e5e0e0e4e5cd9a5de1e6e0e2db6a1c4ab07a1d4cfc1f1")
+	)
+	m := `{
+		"schemaVersion": 2,
+		"manifests": [
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"size": 7143,
+			"digest": "` + digest1.String() + `",
+			"platform": {
+				"architecture": "ppc64le",
+				"os": "linux"
+			},
+			"annotations": {
+				"org.opencontainers.image.ref.name": "named",
+				"other": "value"
+			}
+		},
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"size": 7682,
+			"digest": "` + digest2.String() + `"
+		},
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"size": 7143,
+			"digest": "` + digest1.String() + `"
+		},
+		{
+			"mediaType": "application/vnd.oci.image.index.v1+json",
+			"size": 100,
+			"digest": "` + digest3.String() + `",
+			"annotations": {
+				"org.opencontainers.image.ref.name": "dup"
+			}
+		},
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"size": 200,
+			"digest": "` + digest3.String() + `",
+			"annotations": {
+				"org.opencontainers.image.ref.name": "dup"
+			}
+		}
+		]
+	}
+`
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "index.json"), []byte(m), 0644)
+	require.NoError(t, err)
+
+	res, err := List(tmpDir)
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+
+	for i, e := range []struct {
+		refName, stringWithinTransport string
+		digest                         digest.Digest
+	}{
+		{"named", tmpDir + ":named", digest1},
+		{"", tmpDir + ":@" + digest2.String(), digest2},
+		{"", tmpDir + ":@2", digest1},
+		{"dup", tmpDir + ":@3", digest3},
+		{"dup", tmpDir + ":@4", digest3},
+	} {
+		assert.Equal(t, e.refName, res[i].RefName, i)
+		assert.Equal(t, e.digest, res[i].Descriptor.Digest, i)
+		assert.Equal(t, e.stringWithinTransport, res[i].Reference.StringWithinTransport(), i)
+
+		// The reference must resolve to the same entry.
+		desc, err := LoadManifestDescriptor(res[i].Reference)
+		require.NoError(t, err, i)
+		assert.Equal(t, res[i].Descriptor, desc, i)
+	}
+	require.NotNil(t, res[0].Descriptor.Platform)
+	assert.Equal(t, "ppc64le", res[0].Descriptor.Platform.Architecture)
+	assert.Equal(t, map[string]string{imgspecv1.AnnotationRefName: "named", "other": "value"}, res[0].Descriptor.Annotations)
+
+	_, err = List(filepath.Join(tmpDir, "thisdoesnotexist"))
+	assert.Error(t, err)
+}
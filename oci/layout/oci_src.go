@@ -6,15 +6,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
-	"strconv"
 
 	"github.com/containers/image/v5/manifest"
-	"github.com/containers/image/v5/pkg/tlsclientconfig"
+	"github.com/containers/image/v5/oci/internal"
 	"github.com/containers/image/v5/types"
-	"github.com/docker/go-connections/tlsconfig"
 	"github.com/opencontainers/go-digest"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/pkg/errors"
 )
 
 type ociImageSource struct {
@@ -27,18 +24,10 @@ type ociImageSource struct {
 
 // newImageSource returns an ImageSource for reading from an existing directory.
 func newImageSource(sys *types.SystemContext, ref ociReference) (types.ImageSource, error) {
-	tr := tlsclientconfig.NewTransport()
-	tr.TLSClientConfig = tlsconfig.ServerDefault()
-
-	if sys != nil && sys.OCICertPath != "" {
-		if err := tlsclientconfig.SetupCertificates(sys.OCICertPath, tr.TLSClientConfig); err != nil {
-			return nil, err
-		}
-		tr.TLSClientConfig.InsecureSkipVerify = sys.OCIInsecureSkipTLSVerify
+	client, err := internal.NewExternalBlobClient(sys)
+	if err != nil {
+		return nil, err
 	}
-
-	client := &http.Client{}
-	client.Transport = tr
 	descriptor, err := ref.getManifestDescriptor()
 	if err != nil {
 		return nil, err
@@ -113,7 +102,7 @@ func (s *ociImageSource) HasThreadSafeGetBlob() bool {
 // May update BlobInfoCache, preferably after it knows for certain that a blob truly exists at a specific location.
 func (s *ociImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
 	if len(info.URLs) != 0 {
-		return s.getExternalBlob(ctx, info.URLs)
+		return internal.GetExternalBlob(ctx, s.client, info.URLs)
 	}
 
 	path, err := s.ref.blobPath(info.Digest, s.sharedBlobDir)
@@ -137,39 +126,26 @@ func (s *ociImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache
 // (when the primary manifest is a manifest list); this never happens if the primary manifest is not a manifest list
 // (e.g. if the source never returns manifest lists).
 func (s *ociImageSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
-	return [][]byte{}, nil
-}
-
-func (s *ociImageSource) getExternalBlob(ctx context.Context, urls []string) (io.ReadCloser, int64, error) {
-	if len(urls) == 0 {
-		return nil, 0, errors.New("internal error: getExternalBlob called with no URLs")
+	manifestDigest := s.descriptor.Digest
+	if instanceDigest != nil {
+		manifestDigest = *instanceDigest
 	}
-
-	errWrap := errors.New("failed fetching external blob from all urls")
-	for _, url := range urls {
-
-		req, err := http.NewRequest("GET", url, nil)
+	signatures := [][]byte{}
+	for i := 0; ; i++ {
+		path, err := s.ref.signaturePath(manifestDigest, i)
 		if err != nil {
-			errWrap = errors.Wrapf(errWrap, "fetching %s failed %s", url, err.Error())
-			continue
+			return nil, err
 		}
-
-		resp, err := s.client.Do(req.WithContext(ctx))
+		signature, err := ioutil.ReadFile(path)
 		if err != nil {
-			errWrap = errors.Wrapf(errWrap, "fetching %s failed %s", url, err.Error())
-			continue
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			errWrap = errors.Wrapf(errWrap, "fetching %s failed, response code not 200", url)
-			continue
+			if os.IsNotExist(err) {
+				break
+			}
+			return nil, err
 		}
-
-		return resp.Body, getBlobSize(resp), nil
+		signatures = append(signatures, signature)
 	}
-
-	return nil, 0, errWrap
+	return signatures, nil
 }
 
 // LayerInfosForCopy returns either nil (meaning the values in the manifest are fine), or updated values for the layer
@@ -183,11 +159,3 @@ func (s *ociImageSource) getExternalBlob(ctx context.Context, urls []string) (io
 func (s *ociImageSource) LayerInfosForCopy(context.Context, *digest.Digest) ([]types.BlobInfo, error) {
 	return nil, nil
 }
-
-func getBlobSize(resp *http.Response) int64 {
-	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-	if err != nil {
-		size = -1
-	}
-	return size
-}
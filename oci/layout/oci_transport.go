@@ -14,6 +14,8 @@ import (
 	"github.com/containers/image/v5/oci/internal"
 	"github.com/containers/image/v5/transports"
 	"github.com/containers/image/v5/types"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/lockfile"
 	"github.com/opencontainers/go-digest"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -64,11 +66,28 @@ type ociReference struct {
 	// If image=="", it means the "only image" in the index.json is used in the case it is a source
 	// for destinations, the image name annotation "image.ref.name" is not added to the index.json
 	image string
+	// If image=="", sourceIndex and sourceDigest can be used to refer to an index.json entry by its position
+	// or by its digest; at most one of image, sourceIndex and sourceDigest is set.
+	// Such references can only be used as sources (and for DeleteImage).
+	sourceIndex  int           // -1 if not used
+	sourceDigest digest.Digest // "" if not used
 }
 
 // ParseReference converts a string, which should not start with the ImageTransport.Name prefix, into an OCI ImageReference.
+// In addition to dir[:image], dir:@index and dir:@digest refer to an index.json entry by its zero-based position
+// or by its manifest digest.
 func ParseReference(reference string) (types.ImageReference, error) {
 	dir, image := internal.SplitPathAndImage(reference)
+	if strings.HasPrefix(image, "@") {
+		sourceIndex, sourceDigest, err := internal.ParseSourceSelector(image)
+		if err != nil {
+			return nil, err
+		}
+		if sourceDigest != "" {
+			return NewDigestReference(dir, sourceDigest)
+		}
+		return NewIndexReference(dir, sourceIndex)
+	}
 	return NewReference(dir, image)
 }
 
@@ -77,20 +96,43 @@ func ParseReference(reference string) (types.ImageReference, error) {
 // We do not expose an API supplying the resolvedDir; we could, but recomputing it
 // is generally cheap enough that we prefer being confident about the properties of resolvedDir.
 func NewReference(dir, image string) (types.ImageReference, error) {
-	resolved, err := explicitfilepath.ResolvePathToFullyExplicit(dir)
-	if err != nil {
+	if err := internal.ValidateImageName(image); err != nil {
 		return nil, err
 	}
+	return newReference(dir, image, -1, "")
+}
 
-	if err := internal.ValidateOCIPath(dir); err != nil {
+// NewIndexReference returns an OCI reference for a directory and a zero-based position of an entry in its index.json.
+// The returned reference can only be used as a source, or to delete the image.
+func NewIndexReference(dir string, sourceIndex int) (types.ImageReference, error) {
+	if sourceIndex < 0 {
+		return nil, errors.Errorf("Invalid OCI reference: index @%d must not be negative", sourceIndex)
+	}
+	return newReference(dir, "", sourceIndex, "")
+}
+
+// NewDigestReference returns an OCI reference for a directory and the digest of an entry in its index.json.
+// The returned reference can only be used as a source, or to delete the image.
+func NewDigestReference(dir string, sourceDigest digest.Digest) (types.ImageReference, error) {
+	if err := sourceDigest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "Invalid OCI reference: digest %q", sourceDigest)
+	}
+	return newReference(dir, "", -1, sourceDigest)
+}
+
+// newReference returns an OCI reference for a directory, and an image name, a sourceIndex, or a sourceDigest,
+// which have already been validated.
+func newReference(dir, image string, sourceIndex int, sourceDigest digest.Digest) (types.ImageReference, error) {
+	resolved, err := explicitfilepath.ResolvePathToFullyExplicit(dir)
+	if err != nil {
 		return nil, err
 	}
 
-	if err = internal.ValidateImageName(image); err != nil {
+	if err := internal.ValidateOCIPath(dir); err != nil {
 		return nil, err
 	}
 
-	return ociReference{dir: dir, resolvedDir: resolved, image: image}, nil
+	return ociReference{dir: dir, resolvedDir: resolved, image: image, sourceIndex: sourceIndex, sourceDigest: sourceDigest}, nil
 }
 
 func (ref ociReference) Transport() types.ImageTransport {
@@ -103,7 +145,14 @@ func (ref ociReference) Transport() types.ImageTransport {
 // e.g. default attribute values omitted by the user may be filled in in the return value, or vice versa.
 // WARNING: Do not use the return value in the UI to describe an image, it does not contain the Transport().Name() prefix.
 func (ref ociReference) StringWithinTransport() string {
-	return fmt.Sprintf("%s:%s", ref.dir, ref.image)
+	switch {
+	case ref.sourceIndex != -1:
+		return fmt.Sprintf("%s:@%d", ref.dir, ref.sourceIndex)
+	case ref.sourceDigest != "":
+		return fmt.Sprintf("%s:@%s", ref.dir, ref.sourceDigest.String())
+	default:
+		return fmt.Sprintf("%s:%s", ref.dir, ref.image)
+	}
 }
 
 // DockerReference returns a Docker reference associated with this reference
@@ -177,41 +226,77 @@ func (ref ociReference) getIndex() (*imgspecv1.Index, error) {
 	return index, nil
 }
 
+// writeIndex atomically replaces the index.json referenced by this ociReference with index.
+// The caller should hold the lock returned by lockIndex.
+func (ref ociReference) writeIndex(index *imgspecv1.Index) error {
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(ref.indexPath(), indexJSON, 0644)
+}
+
+// lockIndex acquires the lock which serializes read-modify-write updates of index.json, both within this process and
+// across processes, and returns a function which releases it.
+func (ref ociReference) lockIndex() (func(), error) {
+	lock, err := lockfile.GetLockfile(ref.indexLockPath())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating lock for %s", ref.indexPath())
+	}
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
 func (ref ociReference) getManifestDescriptor() (imgspecv1.Descriptor, error) {
 	index, err := ref.getIndex()
 	if err != nil {
 		return imgspecv1.Descriptor{}, err
 	}
+	i, err := ref.getManifestDescriptorIndex(index)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	return index.Manifests[i], nil
+}
 
-	var d *imgspecv1.Descriptor
+// getManifestDescriptorIndex returns the position of the descriptor of ref in index.Manifests.
+func (ref ociReference) getManifestDescriptorIndex(index *imgspecv1.Index) (int, error) {
+	if ref.sourceIndex != -1 {
+		if ref.sourceIndex >= len(index.Manifests) {
+			return -1, errors.Errorf("Invalid source index @%d, only %d entries available", ref.sourceIndex, len(index.Manifests))
+		}
+		return ref.sourceIndex, nil
+	}
+	if ref.sourceDigest != "" {
+		for i, md := range index.Manifests {
+			if md.Digest == ref.sourceDigest {
+				return i, nil
+			}
+		}
+		return -1, errors.Errorf("no descriptor found for digest %s", ref.sourceDigest)
+	}
 	if ref.image == "" {
 		// return manifest if only one image is in the oci directory
 		if len(index.Manifests) == 1 {
-			d = &index.Manifests[0]
-		} else {
-			// ask user to choose image when more than one image in the oci directory
-			return imgspecv1.Descriptor{}, ErrMoreThanOneImage
-		}
-	} else {
-		// if image specified, look through all manifests for a match
-		for _, md := range index.Manifests {
-			if md.MediaType != imgspecv1.MediaTypeImageManifest && md.MediaType != imgspecv1.MediaTypeImageIndex {
-				continue
-			}
-			refName, ok := md.Annotations[imgspecv1.AnnotationRefName]
-			if !ok {
-				continue
-			}
-			if refName == ref.image {
-				d = &md
-				break
-			}
+			return 0, nil
 		}
+		// ask user to choose image when more than one image in the oci directory
+		return -1, ErrMoreThanOneImage
 	}
-	if d == nil {
-		return imgspecv1.Descriptor{}, fmt.Errorf("no descriptor found for reference %q", ref.image)
+	// if image specified, look through all manifests for a match
+	for i, md := range index.Manifests {
+		if !isNameableMediaType(md.MediaType) {
+			continue
+		}
+		refName, ok := md.Annotations[imgspecv1.AnnotationRefName]
+		if !ok {
+			continue
+		}
+		if refName == ref.image {
+			return i, nil
+		}
 	}
-	return *d, nil
+	return -1, fmt.Errorf("no descriptor found for reference %q", ref.image)
 }
 
 // LoadManifestDescriptor loads the manifest descriptor to be used to retrieve the image name
@@ -237,8 +322,28 @@ func (ref ociReference) NewImageDestination(ctx context.Context, sys *types.Syst
 }
 
 // DeleteImage deletes the named image from the registry, if supported.
+// For OCI layouts, it removes the image's entry from index.json, and then deletes all blobs which are no longer
+// referenced by any remaining entry; see GarbageCollect.
 func (ref ociReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
-	return errors.Errorf("Deleting images not implemented for oci: images")
+	unlock, err := ref.lockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := ref.getIndex()
+	if err != nil {
+		return err
+	}
+	i, err := ref.getManifestDescriptorIndex(index)
+	if err != nil {
+		return err
+	}
+	index.Manifests = append(index.Manifests[:i], index.Manifests[i+1:]...)
+	if err := ref.writeIndex(index); err != nil {
+		return err
+	}
+	return ref.garbageCollectLocked(ctx, sys)
 }
 
 // ociLayoutPath returns a path for the oci-layout within a directory using OCI conventions.
@@ -251,6 +356,26 @@ func (ref ociReference) indexPath() string {
 	return filepath.Join(ref.dir, "index.json")
 }
 
+// indexLockPath returns a path for the lock file protecting updates of index.json.
+func (ref ociReference) indexLockPath() string {
+	return filepath.Join(ref.dir, "index.json.lock")
+}
+
+// pendingBlobsDirPath returns a path for the directory in which destinations record blobs they have written or reused,
+// but which are not yet referenced from index.json.
+func (ref ociReference) pendingBlobsDirPath() string {
+	return filepath.Join(ref.dir, "index.json.pending")
+}
+
+// signaturePath returns a path for the signature with the specified zero-based index for the manifest with the specified digest.
+func (ref ociReference) signaturePath(manifestDigest digest.Digest, index int) (string, error) {
+	path, err := internal.SignaturePath(manifestDigest, index)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(ref.dir, filepath.FromSlash(path)), nil
+}
+
 // blobPath returns a path for a blob within a directory using OCI image-layout conventions.
 func (ref ociReference) blobPath(digest digest.Digest, sharedBlobDir string) (string, error) {
 	if err := digest.Validate(); err != nil {
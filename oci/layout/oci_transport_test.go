@@ -9,6 +9,7 @@ import (
 
 	_ "github.com/containers/image/v5/internal/testing/explicitfilepath-tmpdir"
 	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -90,6 +91,33 @@ func testParseReference(t *testing.T, fn func(string) (types.ImageReference, err
 
 	_, err = fn(tmpDir + ":invalid'image!value@")
 	assert.Error(t, err)
+
+	ref, err := fn(tmpDir + ":@2")
+	require.NoError(t, err)
+	ociRef, ok := ref.(ociReference)
+	require.True(t, ok)
+	assert.Equal(t, "", ociRef.image)
+	assert.Equal(t, 2, ociRef.sourceIndex)
+	assert.Equal(t, digest.Digest(""), ociRef.sourceDigest)
+
+	const testDigest = "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f"
+	ref, err = fn(tmpDir + ":@" + testDigest)
+	require.NoError(t, err)
+	ociRef, ok = ref.(ociReference)
+	require.True(t, ok)
+	assert.Equal(t, "", ociRef.image)
+	assert.Equal(t, -1, ociRef.sourceIndex)
+	assert.Equal(t, digest.Digest(testDigest), ociRef.sourceDigest)
+
+	for _, input := range []string{
+		":@",
+		":@-1",
+		":@notanumber",
+		":@sha256:notadigest",
+	} {
+		_, err = fn(tmpDir + input)
+		assert.Error(t, err, input)
+	}
 }
 
 func TestNewReference(t *testing.T) {
@@ -124,6 +152,48 @@ func TestNewReference(t *testing.T) {
 
 	_, err = NewReference(tmpDir+"/has:colon", imageValue)
 	assert.Error(t, err)
+
+	_, err = NewReference(tmpDir, "@0")
+	assert.Error(t, err)
+}
+
+func TestNewIndexReference(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oci-transport-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	ref, err := NewIndexReference(tmpDir, 1)
+	require.NoError(t, err)
+	ociRef, ok := ref.(ociReference)
+	require.True(t, ok)
+	assert.Equal(t, tmpDir, ociRef.dir)
+	assert.Equal(t, 1, ociRef.sourceIndex)
+
+	_, err = NewIndexReference(tmpDir, -1)
+	assert.Error(t, err)
+	_, err = NewIndexReference(tmpDir+"/has:colon", 0)
+	assert.Error(t, err)
+}
+
+func TestNewDigestReference(t *testing.T) {
+	const testDigest = "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f"
+
+	tmpDir, err := ioutil.TempDir("", "oci-transport-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	ref, err := NewDigestReference(tmpDir, testDigest)
+	require.NoError(t, err)
+	ociRef, ok := ref.(ociReference)
+	require.True(t, ok)
+	assert.Equal(t, tmpDir, ociRef.dir)
+	assert.Equal(t, -1, ociRef.sourceIndex)
+	assert.Equal(t, digest.Digest(testDigest), ociRef.sourceDigest)
+
+	_, err = NewDigestReference(tmpDir, "sha256:notadigest")
+	assert.Error(t, err)
+	_, err = NewDigestReference(tmpDir+"/has:colon", testDigest)
+	assert.Error(t, err)
 }
 
 // refToTempOCI creates a temporary directory and returns an reference to it.
@@ -170,7 +240,10 @@ func TestReferenceStringWithinTransport(t *testing.T) {
 
 	for _, c := range []struct{ input, result string }{
 		{"/dir1:notlatest:notlatest", "/dir1:notlatest:notlatest"}, // Explicit image
-		{"/dir3:", "/dir3:"}, // No image
+		{"/dir3:", "/dir3:"},     // No image
+		{"/dir4:@1", "/dir4:@1"}, // Source index
+		{"/dir5:@sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f",
+			"/dir5:@sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f"}, // Source digest
 	} {
 		ref, err := ParseReference(tmpDir + c.input)
 		require.NoError(t, err, c.input)
@@ -259,12 +332,22 @@ func TestReferenceNewImageDestination(t *testing.T) {
 	dest, err := ref.NewImageDestination(context.Background(), nil)
 	assert.NoError(t, err)
 	defer dest.Close()
+
+	for _, input := range []string{":@0", ":@sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f"} {
+		ref, err := ParseReference(tmpDir + input)
+		require.NoError(t, err, input)
+		_, err = ref.NewImageDestination(context.Background(), nil)
+		assert.Error(t, err, input)
+	}
 }
 
 func TestReferenceDeleteImage(t *testing.T) {
-	ref, tmpDir := refToTempOCI(t)
+	// Successful deletion is tested in TestDeleteImage.
+	_, tmpDir := refToTempOCI(t)
 	defer os.RemoveAll(tmpDir)
-	err := ref.DeleteImage(context.Background(), nil)
+	ref, err := NewReference(tmpDir, "this-image-does-not-exist")
+	require.NoError(t, err)
+	err = ref.DeleteImage(context.Background(), nil)
 	assert.Error(t, err)
 }
 
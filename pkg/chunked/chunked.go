@@ -0,0 +1,244 @@
+// Package chunked implements the zstd:file-frames layer format: a zstd-compressed tar stream in which the contents
+// of every regular file are compressed as a separate zstd frame, followed by a table of contents describing
+// each frame.
+// The format is similar to, but not compatible with, the zstd:chunked format of containers/storage.
+//
+// A blob in this format is an ordinary zstd stream which decompresses to the original tar stream
+// (the table of contents and the footer which locates it are stored in skippable frames),
+// but it also allows a consumer to fetch only the frames for files it does not already have.
+package chunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ChunkTypeMetadata is the Chunk.Type of chunks containing tar headers, padding and the end-of-archive marker.
+	ChunkTypeMetadata = "metadata"
+	// ChunkTypeFile is the Chunk.Type of chunks containing the contents of a regular file.
+	ChunkTypeFile = "file"
+
+	// FooterSize is the size of the footer at the end of every blob in this format.
+	FooterSize = skippableFrameHeaderSize + footerPayloadSize + len(footerMagic)
+
+	tocVersion               = 1
+	skippableFrameHeaderSize = 8
+	footerPayloadSize        = 24
+	footerMagic              = "ZCHUNKED"
+)
+
+// skippableFrameMagic is the little-endian magic number of a zstd skippable frame, which zstd decoders ignore.
+var skippableFrameMagic = []byte{0x50, 0x2a, 0x4d, 0x18}
+
+// ErrNotChunked is returned when a blob is not in the chunked format.
+var ErrNotChunked = errors.New("blob is not in the chunked format")
+
+// Chunk is a single zstd frame in a blob.
+type Chunk struct {
+	Type   string        `json:"type"`           // ChunkTypeMetadata or ChunkTypeFile
+	Name   string        `json:"name,omitempty"` // For ChunkTypeFile, the path of the file in the layer
+	Offset int64         `json:"offset"`         // Offset of the compressed frame in the blob
+	Length int64         `json:"length"`         // Length of the compressed frame
+	Size   int64         `json:"size"`           // Size of the uncompressed data
+	Digest digest.Digest `json:"digest"`         // Digest of the uncompressed data
+}
+
+// TOC is the table of contents of a blob; its Chunks, in order, cover all of the compressed tar stream.
+type TOC struct {
+	Version int     `json:"version"`
+	Chunks  []Chunk `json:"chunks"`
+}
+
+// ParseFooter parses the last FooterSize bytes of a blob, and returns the offset and length of the compressed
+// table of contents, or ErrNotChunked.
+func ParseFooter(footer []byte) (int64, int64, error) {
+	if len(footer) != FooterSize || !bytes.Equal(footer[:4], skippableFrameMagic) ||
+		binary.LittleEndian.Uint32(footer[4:8]) != footerPayloadSize+uint32(len(footerMagic)) ||
+		string(footer[FooterSize-len(footerMagic):]) != footerMagic {
+		return -1, -1, ErrNotChunked
+	}
+	offset := int64(binary.LittleEndian.Uint64(footer[8:16]))
+	length := int64(binary.LittleEndian.Uint64(footer[16:24]))
+	if offset < 0 || length <= 0 {
+		return -1, -1, errors.Errorf("invalid table of contents position %d, length %d", offset, length)
+	}
+	return offset, length, nil
+}
+
+// ParseTOC decompresses and parses a table of contents, as located by ParseFooter, and validates that its chunks
+// are contiguous, and that the names of files are relative paths within the layer.
+func ParseTOC(compressed []byte) (*TOC, error) {
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	data, err := decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decompressing table of contents")
+	}
+	toc := TOC{}
+	if err := json.Unmarshal(data, &toc); err != nil {
+		return nil, errors.Wrap(err, "error parsing table of contents")
+	}
+	if toc.Version != tocVersion {
+		return nil, errors.Errorf("unsupported table of contents version %d", toc.Version)
+	}
+	offset := int64(0)
+	for i, chunk := range toc.Chunks {
+		if chunk.Type != ChunkTypeMetadata && chunk.Type != ChunkTypeFile {
+			return nil, errors.Errorf("unknown type %q of chunk %d", chunk.Type, i)
+		}
+		if chunk.Offset != offset || chunk.Length <= 0 || chunk.Size < 0 {
+			return nil, errors.Errorf("invalid position of chunk %d", i)
+		}
+		if err := chunk.Digest.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid digest of chunk %d", i)
+		}
+		if chunk.Type == ChunkTypeFile && !isRelativePathInLayer(chunk.Name) {
+			return nil, errors.Errorf("invalid file name %q of chunk %d", chunk.Name, i)
+		}
+		offset += chunk.Length
+	}
+	return &toc, nil
+}
+
+// VerifyTOC checks that the non-empty regular files in the uncompressed tar stream have the names, sizes and digests
+// recorded in the file chunks of toc, in order, so that the names in toc can be used to find the files in the layer
+// created from that stream.
+func VerifyTOC(toc *TOC, uncompressed io.Reader) error {
+	files := []Chunk{}
+	for _, chunk := range toc.Chunks {
+		if chunk.Type == ChunkTypeFile {
+			files = append(files, chunk)
+		}
+	}
+	tr := tar.NewReader(uncompressed)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "error reading tar stream")
+		}
+		if (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) || hdr.Size == 0 {
+			continue
+		}
+		if len(files) == 0 {
+			return errors.Errorf("file %q is not in the table of contents", hdr.Name)
+		}
+		chunk := files[0]
+		files = files[1:]
+		if hdr.Name != chunk.Name || hdr.Size != chunk.Size {
+			return errors.Errorf("file %q does not match the table of contents entry for %q", hdr.Name, chunk.Name)
+		}
+		verifier := chunk.Digest.Verifier()
+		if _, err := io.Copy(verifier, tr); err != nil {
+			return errors.Wrapf(err, "error reading file %q", hdr.Name)
+		}
+		if !verifier.Verified() {
+			return errors.Errorf("contents of file %q do not match the table of contents", hdr.Name)
+		}
+	}
+	if len(files) != 0 {
+		return errors.Errorf("file %q in the table of contents is not in the tar stream", files[0].Name)
+	}
+	return nil
+}
+
+// isRelativePathInLayer returns true if name is a non-empty relative path which does not refer to a parent directory.
+func isRelativePathInLayer(name string) bool {
+	if name == "" || path.IsAbs(name) {
+		return false
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// chunkReader is the io.ReadCloser returned by NewChunkReader.
+type chunkReader struct {
+	limited  *io.LimitedReader
+	decoder  *zstd.Decoder
+	chunk    Chunk
+	verifier digest.Verifier
+	size     int64
+}
+
+// NewChunkReader returns the uncompressed data of chunk, reading exactly chunk.Length bytes of its compressed frame from r.
+// The data is verified against chunk.Size and chunk.Digest; reaching io.EOF means it is valid, and that r is positioned
+// right after the frame, so chunks stored contiguously can be read from a single stream.
+func NewChunkReader(r io.Reader, chunk Chunk) (io.ReadCloser, error) {
+	limited := &io.LimitedReader{R: r, N: chunk.Length}
+	decoder, err := zstd.NewReader(limited, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{
+		limited:  limited,
+		decoder:  decoder,
+		chunk:    chunk,
+		verifier: chunk.Digest.Verifier(),
+	}, nil
+}
+
+// Read implements io.Reader.
+func (r *chunkReader) Read(p []byte) (int, error) {
+	n, err := r.decoder.Read(p)
+	r.size += int64(n)
+	if r.size > r.chunk.Size {
+		return 0, errors.Errorf("chunk %q at offset %d is larger than expected", r.chunk.Name, r.chunk.Offset)
+	}
+	_, _ = r.verifier.Write(p[:n]) // Writes to a hash never fail
+	if err == io.EOF {
+		if r.size != r.chunk.Size || !r.verifier.Verified() {
+			return n, errors.Errorf("chunk %q at offset %d does not match its digest %s", r.chunk.Name, r.chunk.Offset, r.chunk.Digest)
+		}
+		// Consume any data the decoder did not need (e.g. a trailing skippable frame).
+		if _, err := io.Copy(ioutil.Discard, r.limited); err != nil {
+			return n, err
+		}
+		if r.limited.N != 0 {
+			return n, errors.Errorf("chunk %q at offset %d is shorter than expected", r.chunk.Name, r.chunk.Offset)
+		}
+	}
+	return n, err
+}
+
+// Close implements io.Closer.
+func (r *chunkReader) Close() error {
+	r.decoder.Close()
+	return nil
+}
+
+// skippableFrame returns a skippable frame containing payload.
+func skippableFrame(payload []byte) []byte {
+	frame := make([]byte, skippableFrameHeaderSize, skippableFrameHeaderSize+len(payload))
+	copy(frame, skippableFrameMagic)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// footer returns the footer pointing at a compressed table of contents at offset with length.
+func footer(offset, length int64) []byte {
+	payload := make([]byte, footerPayloadSize, footerPayloadSize+len(footerMagic))
+	binary.LittleEndian.PutUint64(payload[0:8], uint64(offset))
+	binary.LittleEndian.PutUint64(payload[8:16], uint64(length))
+	// payload[16:24] is reserved, and zero.
+	return skippableFrame(append(payload, footerMagic...))
+}
@@ -0,0 +1,213 @@
+package chunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeTestTar returns a tar stream containing a directory, two regular files, an empty file and a symlink.
+func makeTestTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []struct {
+		header   tar.Header
+		contents []byte
+	}{
+		{tar.Header{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0755}, nil},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "dir/file1", Mode: 0644}, bytes.Repeat([]byte{'a'}, 10000)},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "dir/empty", Mode: 0644}, nil},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "dir/link", Linkname: "file1"}, nil},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "file2", Mode: 0644}, []byte("file2 contents")},
+	} {
+		hdr.header.Size = int64(len(hdr.contents))
+		err := tw.WriteHeader(&hdr.header)
+		require.NoError(t, err)
+		_, err = tw.Write(hdr.contents)
+		require.NoError(t, err)
+	}
+	err := tw.Close()
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+// compressTestTar returns uncompressed in the chunked format.
+func compressTestTar(t *testing.T, uncompressed []byte) []byte {
+	var compressed bytes.Buffer
+	w, err := NewCompressor(&compressed, nil)
+	require.NoError(t, err)
+	_, err = w.Write(uncompressed)
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+	return compressed.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	uncompressed := makeTestTar(t)
+	compressed := compressTestTar(t, uncompressed)
+
+	// The blob is an ordinary zstd stream.
+	decoder, err := zstd.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	defer decoder.Close()
+	decompressed, err := ioutil.ReadAll(decoder)
+	require.NoError(t, err)
+	assert.Equal(t, uncompressed, decompressed)
+
+	require.True(t, len(compressed) > FooterSize)
+	tocOffset, tocLength, err := ParseFooter(compressed[len(compressed)-FooterSize:])
+	require.NoError(t, err)
+	toc, err := ParseTOC(compressed[tocOffset : tocOffset+tocLength])
+	require.NoError(t, err)
+
+	files := []string{}
+	for _, chunk := range toc.Chunks {
+		if chunk.Type == ChunkTypeFile {
+			files = append(files, chunk.Name)
+		}
+	}
+	assert.Equal(t, []string{"dir/file1", "file2"}, files)
+
+	// Reading all chunks, in order, from a single stream, reproduces the tar stream.
+	r := bytes.NewReader(compressed)
+	var reconstructed bytes.Buffer
+	for _, chunk := range toc.Chunks {
+		cr, err := NewChunkReader(r, chunk)
+		require.NoError(t, err)
+		_, err = io.Copy(&reconstructed, cr)
+		require.NoError(t, err)
+		err = cr.Close()
+		require.NoError(t, err)
+	}
+	assert.Equal(t, uncompressed, reconstructed.Bytes())
+	for _, chunk := range toc.Chunks {
+		if chunk.Name == "file2" {
+			assert.Equal(t, digest.FromString("file2 contents"), chunk.Digest)
+		}
+	}
+}
+
+func TestParseFooter(t *testing.T) {
+	compressed := compressTestTar(t, makeTestTar(t))
+
+	for _, c := range [][]byte{
+		nil,
+		compressed[len(compressed)-FooterSize-1 : len(compressed)-1],
+		bytes.Repeat([]byte{0}, FooterSize),
+		footer(0, 0),
+	} {
+		_, _, err := ParseFooter(c)
+		assert.Error(t, err)
+	}
+	_, _, err := ParseFooter(bytes.Repeat([]byte{0}, FooterSize))
+	assert.Equal(t, ErrNotChunked, err)
+}
+
+func TestParseTOC(t *testing.T) {
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	defer encoder.Close()
+	d := digest.FromString("").String()
+	for _, c := range []string{
+		`{"version":1,"chunks":[{"type":"metadata","offset":0,"length":10,"size":1,"digest":"` + d + `"}]}`,
+		`{"version":1,"chunks":[]}`,
+		`{"version":1,"chunks":[{"type":"file","name":"dir/file..name","offset":0,"length":10,"size":1,"digest":"` + d + `"}]}`,
+		`{"version":1,"chunks":[{"type":"file","name":"./dir/file","offset":0,"length":10,"size":1,"digest":"` + d + `"}]}`,
+	} {
+		_, err := ParseTOC(encoder.EncodeAll([]byte(c), nil))
+		assert.NoError(t, err, c)
+	}
+	for _, c := range []string{
+		`not JSON`,
+		`{"version":2,"chunks":[]}`,
+		`{"version":1,"chunks":[{"type":"unknown","offset":0,"length":10,"size":1,"digest":"` + d + `"}]}`,
+		`{"version":1,"chunks":[{"type":"metadata","offset":1,"length":10,"size":1,"digest":"` + d + `"}]}`,
+		`{"version":1,"chunks":[{"type":"metadata","offset":0,"length":0,"size":1,"digest":"` + d + `"}]}`,
+		`{"version":1,"chunks":[{"type":"metadata","offset":0,"length":10,"size":1,"digest":"sha256:invalid"}]}`,
+		`{"version":1,"chunks":[{"type":"file","offset":0,"length":10,"size":1,"digest":"` + d + `"}]}`,
+		`{"version":1,"chunks":[{"type":"file","name":"/etc/passwd","offset":0,"length":10,"size":1,"digest":"` + d + `"}]}`,
+		`{"version":1,"chunks":[{"type":"file","name":"../file","offset":0,"length":10,"size":1,"digest":"` + d + `"}]}`,
+		`{"version":1,"chunks":[{"type":"file","name":"dir/../../file","offset":0,"length":10,"size":1,"digest":"` + d + `"}]}`,
+	} {
+		_, err := ParseTOC(encoder.EncodeAll([]byte(c), nil))
+		assert.Error(t, err, c)
+	}
+	_, err = ParseTOC([]byte("not zstd"))
+	assert.Error(t, err)
+}
+
+func TestChunkReaderVerifiesContents(t *testing.T) {
+	compressed := compressTestTar(t, makeTestTar(t))
+	tocOffset, tocLength, err := ParseFooter(compressed[len(compressed)-FooterSize:])
+	require.NoError(t, err)
+	toc, err := ParseTOC(compressed[tocOffset : tocOffset+tocLength])
+	require.NoError(t, err)
+	var chunk Chunk
+	for _, c := range toc.Chunks {
+		if c.Name == "file2" {
+			chunk = c
+		}
+	}
+	require.Equal(t, "file2", chunk.Name)
+
+	for _, edit := range []func(*Chunk){
+		func(c *Chunk) { c.Digest = digest.FromString("other") },
+		func(c *Chunk) { c.Size-- },
+		func(c *Chunk) { c.Size++ },
+	} {
+		c := chunk
+		edit(&c)
+		cr, err := NewChunkReader(bytes.NewReader(compressed[c.Offset:]), c)
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(cr)
+		assert.Error(t, err)
+		cr.Close()
+	}
+}
+
+func TestVerifyTOC(t *testing.T) {
+	uncompressed := makeTestTar(t)
+	compressed := compressTestTar(t, uncompressed)
+	tocOffset, tocLength, err := ParseFooter(compressed[len(compressed)-FooterSize:])
+	require.NoError(t, err)
+	toc, err := ParseTOC(compressed[tocOffset : tocOffset+tocLength])
+	require.NoError(t, err)
+
+	err = VerifyTOC(toc, bytes.NewReader(uncompressed))
+	assert.NoError(t, err)
+
+	for _, edit := range []func(*Chunk){
+		func(c *Chunk) { c.Name = "dir/other" },
+		func(c *Chunk) { c.Digest = digest.FromString("other") },
+		func(c *Chunk) { c.Size-- },
+	} {
+		edited := TOC{Version: toc.Version, Chunks: append([]Chunk{}, toc.Chunks...)}
+		for i := range edited.Chunks {
+			if edited.Chunks[i].Name == "file2" {
+				edit(&edited.Chunks[i])
+			}
+		}
+		err := VerifyTOC(&edited, bytes.NewReader(uncompressed))
+		assert.Error(t, err)
+	}
+
+	// A TOC which describes some other tar stream is rejected.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "dir/file1", Mode: 0644, Size: 1})
+	require.NoError(t, err)
+	_, err = tw.Write([]byte{'a'})
+	require.NoError(t, err)
+	err = tw.Close()
+	require.NoError(t, err)
+	err = VerifyTOC(toc, &buf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,179 @@
+package chunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// countingWriter is an io.Writer which counts the bytes written to dest.
+type countingWriter struct {
+	dest  io.Writer
+	count int64
+}
+
+// Write implements io.Writer.
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.dest.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// teeingReader is an io.Reader which copies everything read from reader to the current value of dest.
+type teeingReader struct {
+	reader io.Reader
+	dest   io.Writer
+}
+
+// Read implements io.Reader.
+func (r *teeingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if _, err := r.dest.Write(p[:n]); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// compressor is the io.WriteCloser returned by NewCompressor.
+type compressor struct {
+	pipeWriter *io.PipeWriter
+	done       chan error
+}
+
+// NewCompressor returns a writer which converts an uncompressed tar stream written to it into the chunked format,
+// written to dest, using the specified zstd compression level, if any.
+// The caller must call Close() on the returned writer; the output is only complete after Close() succeeds.
+func NewCompressor(dest io.Writer, level *int) (io.WriteCloser, error) {
+	options := []zstd.EOption{}
+	if level != nil {
+		options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(*level)))
+	}
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return nil, err
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	c := &compressor{
+		pipeWriter: pipeWriter,
+		done:       make(chan error, 1),
+	}
+	go func() {
+		err := compressTarStream(&countingWriter{dest: dest}, pipeReader, encoder)
+		encoder.Close()
+		// Make sure any further writes fail instead of blocking forever.
+		if err != nil {
+			pipeReader.CloseWithError(err)
+		} else {
+			pipeReader.CloseWithError(errors.New("Internal error: data written after the end of the tar stream"))
+		}
+		c.done <- err
+	}()
+	return c, nil
+}
+
+// Write implements io.Writer.
+func (c *compressor) Write(p []byte) (int, error) {
+	return c.pipeWriter.Write(p)
+}
+
+// Close implements io.Closer.
+func (c *compressor) Close() error {
+	if err := c.pipeWriter.Close(); err != nil {
+		return err
+	}
+	return <-c.done
+}
+
+// compressTarStream reads a tar stream from input, and writes it to dest in the chunked format, using encoder.
+func compressTarStream(dest *countingWriter, input io.Reader, encoder *zstd.Encoder) error {
+	toc := TOC{Version: tocVersion}
+	// writeChunk writes a frame containing everything fill() writes to the provided io.Writer, and records it in toc.
+	writeChunk := func(chunkType, name string, fill func(io.Writer) error) error {
+		offset := dest.count
+		digester := digest.Canonical.Digester()
+		counter := &countingWriter{dest: digester.Hash()}
+		encoder.Reset(dest)
+		if err := fill(io.MultiWriter(encoder, counter)); err != nil {
+			return err
+		}
+		if err := encoder.Close(); err != nil {
+			return err
+		}
+		toc.Chunks = append(toc.Chunks, Chunk{
+			Type:   chunkType,
+			Name:   name,
+			Offset: offset,
+			Length: dest.count - offset,
+			Size:   counter.count,
+			Digest: digester.Digest(),
+		})
+		return nil
+	}
+
+	// Everything the tar reader consumes is copied, unmodified, either to metadata, or to the frame of a regular file,
+	// so that decompressing the chunks reproduces input exactly.
+	metadata := bytes.Buffer{}
+	tee := &teeingReader{reader: input, dest: &metadata}
+	flushMetadata := func() error {
+		if metadata.Len() == 0 {
+			return nil
+		}
+		err := writeChunk(ChunkTypeMetadata, "", func(w io.Writer) error {
+			_, err := metadata.WriteTo(w)
+			return err
+		})
+		metadata.Reset()
+		return err
+	}
+	tr := tar.NewReader(tee)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "error reading tar stream")
+		}
+		if (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) || hdr.Size == 0 {
+			continue
+		}
+		if err := flushMetadata(); err != nil {
+			return err
+		}
+		if err := writeChunk(ChunkTypeFile, hdr.Name, func(w io.Writer) error {
+			tee.dest = w
+			defer func() { tee.dest = &metadata }()
+			_, err := io.Copy(ioutil.Discard, tr)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	// Include anything after the end-of-archive marker, typically more zero padding.
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return err
+	}
+	if err := flushMetadata(); err != nil {
+		return err
+	}
+
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		return err
+	}
+	compressedTOC := encoder.EncodeAll(tocJSON, nil)
+	tocOffset := dest.count + skippableFrameHeaderSize
+	if _, err := dest.Write(skippableFrame(compressedTOC)); err != nil {
+		return err
+	}
+	_, err = dest.Write(footer(tocOffset, int64(len(compressedTOC))))
+	return err
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 
+	"github.com/containers/image/v5/pkg/chunked"
 	"github.com/containers/image/v5/pkg/compression/internal"
 	"github.com/containers/image/v5/pkg/compression/types"
 	"github.com/klauspost/pgzip"
@@ -20,13 +21,17 @@ type Algorithm = types.Algorithm
 
 var (
 	// Gzip compression.
-	Gzip = internal.NewAlgorithm("gzip", []byte{0x1F, 0x8B, 0x08}, GzipDecompressor, gzipCompressor)
+	Gzip = internal.NewAlgorithm("gzip", "gzip", []byte{0x1F, 0x8B, 0x08}, GzipDecompressor, gzipCompressor)
 	// Bzip2 compression.
-	Bzip2 = internal.NewAlgorithm("bzip2", []byte{0x42, 0x5A, 0x68}, Bzip2Decompressor, bzip2Compressor)
+	Bzip2 = internal.NewAlgorithm("bzip2", "bzip2", []byte{0x42, 0x5A, 0x68}, Bzip2Decompressor, bzip2Compressor)
 	// Xz compression.
-	Xz = internal.NewAlgorithm("Xz", []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}, XzDecompressor, xzCompressor)
+	Xz = internal.NewAlgorithm("Xz", "Xz", []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}, XzDecompressor, xzCompressor)
 	// Zstd compression.
-	Zstd = internal.NewAlgorithm("zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}, ZstdDecompressor, zstdCompressor)
+	Zstd = internal.NewAlgorithm("zstd", "zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}, ZstdDecompressor, zstdCompressor)
+	// ZstdFileFrames is zstd compression in the format of pkg/chunked, which allows consumers to fetch
+	// individual files.  It is not detected by DetectCompressionFormat, which reports such data as Zstd.
+	// Note that this format is not compatible with the "zstd:chunked" format of containers/storage.
+	ZstdFileFrames = internal.NewAlgorithm("zstd:file-frames", "zstd", nil, ZstdDecompressor, chunked.NewCompressor)
 
 	compressionAlgorithms = map[string]Algorithm{
 		Gzip.Name():  Gzip,
@@ -42,6 +47,9 @@ func AlgorithmByName(name string) (Algorithm, error) {
 	if ok {
 		return algorithm, nil
 	}
+	if name == ZstdFileFrames.Name() {
+		return ZstdFileFrames, nil
+	}
 	return Algorithm{}, fmt.Errorf("cannot find compressor for %q", name)
 }
 
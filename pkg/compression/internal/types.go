@@ -12,21 +12,25 @@ type DecompressorFunc func(io.Reader) (io.ReadCloser, error)
 
 // Algorithm is a compression algorithm that can be used for CompressStream.
 type Algorithm struct {
-	name         string
-	prefix       []byte
-	decompressor DecompressorFunc
-	compressor   CompressorFunc
+	name            string
+	baseVariantName string
+	prefix          []byte
+	decompressor    DecompressorFunc
+	compressor      CompressorFunc
 }
 
 // NewAlgorithm creates an Algorithm instance.
 // This function exists so that Algorithm instances can only be created by code that
 // is allowed to import this internal subpackage.
-func NewAlgorithm(name string, prefix []byte, decompressor DecompressorFunc, compressor CompressorFunc) Algorithm {
+// baseVariantName is the name of the algorithm whose format is a superset of this one's, if any, or name;
+// it is used to choose MIME types.
+func NewAlgorithm(name, baseVariantName string, prefix []byte, decompressor DecompressorFunc, compressor CompressorFunc) Algorithm {
 	return Algorithm{
-		name:         name,
-		prefix:       prefix,
-		decompressor: decompressor,
-		compressor:   compressor,
+		name:            name,
+		baseVariantName: baseVariantName,
+		prefix:          prefix,
+		decompressor:    decompressor,
+		compressor:      compressor,
 	}
 }
 
@@ -35,6 +39,12 @@ func (c Algorithm) Name() string {
 	return c.name
 }
 
+// BaseVariantName returns the name of the algorithm whose MIME types should be used for data compressed using c;
+// e.g. data in the zstd:file-frames format is also valid zstd data.
+func (c Algorithm) BaseVariantName() string {
+	return c.baseVariantName
+}
+
 // AlgorithmCompressor returns the compressor field of algo.
 // This is a function instead of a public method so that it is only callable from by code
 // that is allowed to import this internal subpackage.
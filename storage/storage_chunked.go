@@ -0,0 +1,443 @@
+// +build !containers_image_storage_stub
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	internalTypes "github.com/containers/image/v5/internal/types"
+	"github.com/containers/image/v5/pkg/chunked"
+	"github.com/containers/image/v5/types"
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// chunkedTOCBigDataKey is the key of the layer big data item containing the compressed table of contents
+// of a layer pulled from a blob in the pkg/chunked format; it is used to find files in later partial pulls.
+const chunkedTOCBigDataKey = "chunked-toc"
+
+// localFile is a file in a layer in the store.
+type localFile struct {
+	layerID string
+	path    string
+}
+
+// PutBlobPartial creates the layer srcInfo from a blob in the pkg/chunked format, reading only the chunks of the blob
+// which are not available in layers already in the store, and verifying the result against options.DiffID.
+// It returns internalTypes.ErrFallbackToOrdinaryLayerDownload if the blob is not in that format, or if the source
+// can't return parts of blobs.
+func (s *storageImageDestination) PutBlobPartial(ctx context.Context, chunkAccessor internalTypes.BlobChunkAccessor, srcInfo types.BlobInfo, options internalTypes.PutBlobPartialOptions) (types.BlobInfo, error) {
+	errorBlobInfo := types.BlobInfo{
+		Digest: "",
+		Size:   -1,
+	}
+	if srcInfo.Size < int64(chunked.FooterSize) || options.DiffID.Validate() != nil {
+		return errorBlobInfo, internalTypes.ErrFallbackToOrdinaryLayerDownload
+	}
+	footer, err := readBlobChunk(ctx, chunkAccessor, srcInfo, srcInfo.Size-int64(chunked.FooterSize), int64(chunked.FooterSize))
+	if err != nil {
+		if errors.Cause(err) == internalTypes.ErrRangesNotSupported {
+			return errorBlobInfo, internalTypes.ErrFallbackToOrdinaryLayerDownload
+		}
+		return errorBlobInfo, errors.Wrapf(err, "error reading footer of blob %q", srcInfo.Digest)
+	}
+	tocOffset, tocLength, err := chunked.ParseFooter(footer)
+	if err != nil {
+		logrus.Debugf("Not pulling blob %q partially: %v", srcInfo.Digest, err)
+		return errorBlobInfo, internalTypes.ErrFallbackToOrdinaryLayerDownload
+	}
+	if tocOffset+tocLength > srcInfo.Size-int64(chunked.FooterSize) {
+		logrus.Debugf("Not pulling blob %q partially: invalid table of contents position", srcInfo.Digest)
+		return errorBlobInfo, internalTypes.ErrFallbackToOrdinaryLayerDownload
+	}
+	compressedTOC, err := readBlobChunk(ctx, chunkAccessor, srcInfo, tocOffset, tocLength)
+	if err != nil {
+		return errorBlobInfo, errors.Wrapf(err, "error reading table of contents of blob %q", srcInfo.Digest)
+	}
+	toc, err := chunked.ParseTOC(compressedTOC)
+	if err != nil {
+		logrus.Debugf("Not pulling blob %q partially: %v", srcInfo.Digest, err)
+		return errorBlobInfo, internalTypes.ErrFallbackToOrdinaryLayerDownload
+	}
+
+	// Find the files we already have, and the chunks we need to fetch.
+	localFiles, err := s.findLocalFiles(toc)
+	if err != nil {
+		return errorBlobInfo, err
+	}
+	getter, err := s.newLocalFileGetter()
+	if err != nil {
+		return errorBlobInfo, err
+	}
+	if getter != nil {
+		defer getter.close()
+	}
+	local := make([]*localFile, len(toc.Chunks))
+	localCount := 0
+	remote := []internalTypes.ImageSourceChunk{}
+	for i, chunk := range toc.Chunks {
+		if candidates, ok := localFiles[chunk.Digest]; ok && chunk.Type == chunked.ChunkTypeFile && getter != nil {
+			for j := range candidates {
+				if getter.verify(candidates[j], chunk) {
+					local[i] = &candidates[j]
+					break
+				}
+			}
+		}
+		if local[i] != nil {
+			localCount++
+			continue
+		}
+		// Merge adjacent chunks into a single range.
+		if n := len(remote); n > 0 && remote[n-1].Offset+remote[n-1].Length == uint64(chunk.Offset) {
+			remote[n-1].Length += uint64(chunk.Length)
+		} else {
+			remote = append(remote, internalTypes.ImageSourceChunk{Offset: uint64(chunk.Offset), Length: uint64(chunk.Length)})
+		}
+	}
+	logrus.Debugf("Pulling blob %q partially: %d of %d chunks available locally, fetching %d ranges", srcInfo.Digest, localCount, len(toc.Chunks), len(remote))
+
+	// Reconstruct the uncompressed layer in a temporary file.
+	remoteStream, err := chunkAccessor.GetBlobAt(ctx, srcInfo, remote)
+	if err != nil {
+		if errors.Cause(err) == internalTypes.ErrRangesNotSupported {
+			return errorBlobInfo, internalTypes.ErrFallbackToOrdinaryLayerDownload
+		}
+		return errorBlobInfo, errors.Wrapf(err, "error reading chunks of blob %q", srcInfo.Digest)
+	}
+	defer remoteStream.Close()
+	filename := s.computeNextBlobCacheFile()
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return errorBlobInfo, errors.Wrapf(err, "error creating temporary file %q", filename)
+	}
+	defer file.Close()
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			if err := os.Remove(filename); err != nil {
+				logrus.Debugf("error removing temporary file %q: %v", filename, err)
+			}
+		}
+	}()
+	diffID := digest.Canonical.Digester()
+	counter := ioutils.NewWriteCounter(diffID.Hash())
+	dest := io.MultiWriter(file, counter)
+	remoteReader := &errorRecordingReader{reader: &contextReader{ctx: ctx, reader: remoteStream}}
+	for i, chunk := range toc.Chunks {
+		if local[i] != nil {
+			err = getter.copy(dest, *local[i], chunk)
+		} else {
+			err = copyRemoteChunk(dest, remoteReader, chunk)
+		}
+		if err != nil {
+			// The source may only find out that it can't return the chunks while we are reading them.
+			if errors.Cause(remoteReader.err) == internalTypes.ErrRangesNotSupported {
+				logrus.Debugf("Not pulling blob %q partially: %v", srcInfo.Digest, remoteReader.err)
+				return errorBlobInfo, internalTypes.ErrFallbackToOrdinaryLayerDownload
+			}
+			return errorBlobInfo, errors.Wrapf(err, "error reconstructing blob %q", srcInfo.Digest)
+		}
+	}
+	if diffID.Digest() != options.DiffID {
+		return errorBlobInfo, errors.Errorf("reconstructed layer of blob %q has digest %s, expected %s", srcInfo.Digest, diffID.Digest(), options.DiffID)
+	}
+
+	// Record information about the blob.  The compressed blob has not been read, so, unlike PutBlob,
+	// we must not record the pair of digests in the BlobInfoCache.
+	s.putBlobMutex.Lock()
+	s.blobDiffIDs[srcInfo.Digest] = options.DiffID
+	s.fileSizes[srcInfo.Digest] = counter.Count
+	s.partialBlobSizes[srcInfo.Digest] = srcInfo.Size
+	s.filenames[srcInfo.Digest] = filename
+	s.chunkedTOCs[srcInfo.Digest] = compressedTOC
+	s.putBlobMutex.Unlock()
+	succeeded = true
+	if s.streamLayers && options.LayerIndex != nil {
+		if err := s.queueOrApplyLayer(ctx, *options.LayerIndex, pendingLayer{digest: srcInfo.Digest, emptyLayer: options.EmptyLayer}); err != nil {
+			return errorBlobInfo, err
+		}
+	}
+	return types.BlobInfo{
+		Digest:    srcInfo.Digest,
+		Size:      srcInfo.Size,
+		MediaType: srcInfo.MediaType,
+	}, nil
+}
+
+// readBlobChunk returns length bytes at offset of the blob info, read using chunkAccessor.
+func readBlobChunk(ctx context.Context, chunkAccessor internalTypes.BlobChunkAccessor, info types.BlobInfo, offset, length int64) ([]byte, error) {
+	stream, err := chunkAccessor.GetBlobAt(ctx, info, []internalTypes.ImageSourceChunk{{Offset: uint64(offset), Length: uint64(length)}})
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	data := make([]byte, length)
+	if _, err := io.ReadFull(stream, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// copyRemoteChunk copies the verified uncompressed data of chunk, read from the next compressed frame in stream, to dest.
+func copyRemoteChunk(dest io.Writer, stream io.Reader, chunk chunked.Chunk) error {
+	reader, err := chunked.NewChunkReader(stream, chunk)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(dest, reader)
+	return err
+}
+
+// errorRecordingReader is an io.Reader which records the first error, other than io.EOF, returned by reader;
+// this allows finding the cause of a failure even if a consumer of the data does not preserve it.
+type errorRecordingReader struct {
+	reader io.Reader
+	err    error
+}
+
+// Read implements io.Reader.
+func (r *errorRecordingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// findLocalFiles returns files in layers in the store which were recorded to have the same digest as a file chunk in toc.
+func (s *storageImageDestination) findLocalFiles(toc *chunked.TOC) (map[digest.Digest][]localFile, error) {
+	wanted := map[digest.Digest]struct{}{}
+	for _, chunk := range toc.Chunks {
+		if chunk.Type == chunked.ChunkTypeFile {
+			wanted[chunk.Digest] = struct{}{}
+		}
+	}
+	res := map[digest.Digest][]localFile{}
+	if len(wanted) == 0 {
+		return res, nil
+	}
+	layers, err := s.imageRef.transport.store.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing layers")
+	}
+	for _, layer := range layers {
+		hasTOC := false
+		for _, name := range layer.BigDataNames {
+			if name == chunkedTOCBigDataKey {
+				hasTOC = true
+				break
+			}
+		}
+		if !hasTOC {
+			continue
+		}
+		layerTOC, err := s.readLayerChunkedTOC(layer.ID)
+		if err != nil {
+			logrus.Debugf("error reading table of contents of layer %q: %v", layer.ID, err)
+			continue
+		}
+		for _, chunk := range layerTOC.Chunks {
+			if _, ok := wanted[chunk.Digest]; ok && chunk.Type == chunked.ChunkTypeFile {
+				res[chunk.Digest] = append(res[chunk.Digest], localFile{layerID: layer.ID, path: chunk.Name})
+			}
+		}
+	}
+	return res, nil
+}
+
+// readLayerChunkedTOC returns the table of contents recorded for layerID.
+func (s *storageImageDestination) readLayerChunkedTOC(layerID string) (*chunked.TOC, error) {
+	rc, err := s.imageRef.transport.store.LayerBigData(layerID, chunkedTOCBigDataKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	compressed, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return chunked.ParseTOC(compressed)
+}
+
+// localFileGetter reads files from layers in the store.
+type localFileGetter struct {
+	driver  drivers.DiffGetterDriver
+	getters map[string]drivers.FileGetCloser // By layer ID
+	dirs    map[string]*os.File              // Directories containing the files of layers, by layer ID
+}
+
+// newLocalFileGetter returns a localFileGetter for the store, or nil if the store's driver does not support reading individual files.
+func (s *storageImageDestination) newLocalFileGetter() (*localFileGetter, error) {
+	driver, err := s.imageRef.transport.store.GraphDriver()
+	if err != nil {
+		return nil, errors.Wrap(err, "error accessing the storage driver")
+	}
+	diffGetterDriver, ok := driver.(drivers.DiffGetterDriver)
+	if !ok {
+		return nil, nil
+	}
+	return &localFileGetter{
+		driver:  diffGetterDriver,
+		getters: map[string]drivers.FileGetCloser{},
+		dirs:    map[string]*os.File{},
+	}, nil
+}
+
+// open returns the contents of file, which must be a regular file within its layer.
+func (g *localFileGetter) open(file localFile) (io.ReadCloser, error) {
+	dir, ok := g.dirs[file.layerID]
+	if !ok {
+		getter, ok := g.getters[file.layerID]
+		if !ok {
+			var err error
+			getter, err = g.driver.DiffGetter(file.layerID)
+			if err != nil {
+				return nil, err
+			}
+			g.getters[file.layerID] = getter
+		}
+		// The getter follows symbolic links, so only use it to open the layer's directory.
+		rc, err := getter.Get(".")
+		if err != nil {
+			return nil, err
+		}
+		dir, ok = rc.(*os.File)
+		if !ok {
+			rc.Close()
+			return nil, errors.Errorf("files of layer %q are not stored in a directory", file.layerID)
+		}
+		g.dirs[file.layerID] = dir
+	}
+	return openRegularFileInDirectory(dir, file.path)
+}
+
+// verify returns true if file exists and matches the size and digest of chunk.
+func (g *localFileGetter) verify(file localFile, chunk chunked.Chunk) bool {
+	rc, err := g.open(file)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	verifier := chunk.Digest.Verifier()
+	n, err := io.Copy(verifier, rc)
+	return err == nil && n == chunk.Size && verifier.Verified()
+}
+
+// copy copies the contents of file to dest, verifying them against chunk once more, because the file might have changed
+// since verify() was called.
+func (g *localFileGetter) copy(dest io.Writer, file localFile, chunk chunked.Chunk) error {
+	rc, err := g.open(file)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	verifier := chunk.Digest.Verifier()
+	n, err := io.Copy(io.MultiWriter(dest, verifier), rc)
+	if err != nil {
+		return err
+	}
+	if n != chunk.Size || !verifier.Verified() {
+		return errors.Errorf("local copy of %q in layer %q has changed", file.path, file.layerID)
+	}
+	return nil
+}
+
+// close releases resources used by g.
+func (g *localFileGetter) close() {
+	for layerID, dir := range g.dirs {
+		if err := dir.Close(); err != nil {
+			logrus.Debugf("error closing directory of layer %q: %v", layerID, err)
+		}
+	}
+	for layerID, getter := range g.getters {
+		if err := getter.Close(); err != nil {
+			logrus.Debugf("error closing file getter for layer %q: %v", layerID, err)
+		}
+	}
+}
+
+// readChunkedTOCFromFile returns the compressed table of contents of a blob stored in file with size, or nil if the blob
+// is not in the pkg/chunked format.
+func readChunkedTOCFromFile(file io.ReaderAt, size int64) []byte {
+	if size < int64(chunked.FooterSize) {
+		return nil
+	}
+	footer := make([]byte, chunked.FooterSize)
+	if _, err := file.ReadAt(footer, size-int64(chunked.FooterSize)); err != nil {
+		return nil
+	}
+	tocOffset, tocLength, err := chunked.ParseFooter(footer)
+	if err != nil || tocOffset+tocLength > size-int64(chunked.FooterSize) {
+		return nil
+	}
+	compressedTOC := make([]byte, tocLength)
+	if _, err := file.ReadAt(compressedTOC, tocOffset); err != nil {
+		return nil
+	}
+	if _, err := chunked.ParseTOC(compressedTOC); err != nil {
+		return nil
+	}
+	return compressedTOC
+}
+
+// chunkedTOCVerifier checks a table of contents against the data of a layer blob, as it is being applied.
+type chunkedTOCVerifier struct {
+	pipeWriter *io.PipeWriter
+	result     chan error
+}
+
+// newChunkedTOCVerifier returns a reader which passes through the data of diff, a layer blob with the compressed table
+// of contents compressedTOC, and a verifier which checks the table of contents against all of the data read from it.
+func newChunkedTOCVerifier(diff io.Reader, compressedTOC []byte) (io.Reader, *chunkedTOCVerifier) {
+	pipeReader, pipeWriter := io.Pipe()
+	v := &chunkedTOCVerifier{
+		pipeWriter: pipeWriter,
+		result:     make(chan error, 1),
+	}
+	go func() {
+		err := func() error {
+			toc, err := chunked.ParseTOC(compressedTOC)
+			if err != nil {
+				return err
+			}
+			uncompressed, err := archive.DecompressStream(pipeReader)
+			if err != nil {
+				return err
+			}
+			defer uncompressed.Close()
+			return chunked.VerifyTOC(toc, uncompressed)
+		}()
+		// Keep consuming the data, so that the reader returned by newChunkedTOCVerifier is never blocked.
+		_, _ = io.Copy(ioutil.Discard, pipeReader)
+		v.result <- err
+	}()
+	return io.TeeReader(diff, pipeWriter), v
+}
+
+// finish must be called after the reader returned by newChunkedTOCVerifier is no longer used; it returns nil if
+// the table of contents matches the data which has been read.
+func (v *chunkedTOCVerifier) finish() error {
+	v.pipeWriter.Close()
+	return <-v.result
+}
+
+// setLayerChunkedTOC records compressedTOC, if any, as the table of contents of layerID.
+func (s *storageImageDestination) setLayerChunkedTOC(layerID string, compressedTOC []byte) error {
+	if compressedTOC == nil {
+		return nil
+	}
+	if err := s.imageRef.transport.store.SetLayerBigData(layerID, chunkedTOCBigDataKey, bytes.NewReader(compressedTOC)); err != nil {
+		return errors.Wrapf(err, "error recording table of contents of layer %q", layerID)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// +build !containers_image_storage_stub
+// +build linux
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// openRegularFileInDirectory opens the regular file at the relative path name within dir, without following
+// symbolic links in any of its components, so that the file can't be outside of dir.
+func openRegularFileInDirectory(dir *os.File, name string) (*os.File, error) {
+	elements := []string{}
+	for _, element := range strings.Split(name, "/") {
+		if element != "" && element != "." {
+			elements = append(elements, element)
+		}
+	}
+	if len(elements) == 0 {
+		return nil, errors.Errorf("%q is not a file name", name)
+	}
+	dirFD := int(dir.Fd())
+	fd := dirFD
+	for i, element := range elements {
+		flags := unix.O_RDONLY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+		if i < len(elements)-1 {
+			flags |= unix.O_DIRECTORY
+		} else {
+			// Don't block if this turns out to be a FIFO; it is rejected below.
+			flags |= unix.O_NONBLOCK
+		}
+		next, err := unix.Openat(fd, element, flags, 0)
+		if fd != dirFD {
+			unix.Close(fd)
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "openat", Path: name, Err: err}
+		}
+		fd = next
+	}
+	file := os.NewFile(uintptr(fd), filepath.Join(dir.Name(), name))
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		file.Close()
+		return nil, errors.Errorf("%q is not a regular file", name)
+	}
+	return file, nil
+}
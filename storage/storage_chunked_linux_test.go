@@ -0,0 +1,55 @@
+// +build !containers_image_storage_stub
+// +build linux
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenRegularFileInDirectory(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "storage-chunked")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	layerDir := filepath.Join(tmpDir, "layer")
+	err = os.MkdirAll(filepath.Join(layerDir, "dir"), 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(layerDir, "dir", "file"), []byte("contents"), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "outside"), []byte("outside"), 0644)
+	require.NoError(t, err)
+	err = os.Symlink("file", filepath.Join(layerDir, "dir", "link"))
+	require.NoError(t, err)
+	err = os.Symlink("..", filepath.Join(layerDir, "parent"))
+	require.NoError(t, err)
+	err = os.Symlink("dir", filepath.Join(layerDir, "dirlink"))
+	require.NoError(t, err)
+	err = syscall.Mkfifo(filepath.Join(layerDir, "fifo"), 0600)
+	require.NoError(t, err)
+
+	dir, err := os.Open(layerDir)
+	require.NoError(t, err)
+	defer dir.Close()
+
+	for _, name := range []string{"dir/file", "./dir/file", "dir//file"} {
+		file, err := openRegularFileInDirectory(dir, name)
+		require.NoError(t, err, name)
+		contents, err := ioutil.ReadAll(file)
+		file.Close()
+		require.NoError(t, err, name)
+		require.Equal(t, []byte("contents"), contents, name)
+	}
+	for _, name := range []string{"dir/link", "parent/outside", "dirlink/file", "fifo", "dir", "", ".", "missing"} {
+		file, err := openRegularFileInDirectory(dir, name)
+		if err == nil {
+			file.Close()
+		}
+		require.Error(t, err, name)
+	}
+}
@@ -0,0 +1,16 @@
+// +build !containers_image_storage_stub
+// +build !linux
+
+package storage
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// openRegularFileInDirectory would open the regular file at the relative path name within dir, without following
+// symbolic links; that is not supported on this platform, so files in layers are never reused by partial pulls.
+func openRegularFileInDirectory(dir *os.File, name string) (*os.File, error) {
+	return nil, errors.New("reading files from layers without following symbolic links is not supported on this platform")
+}
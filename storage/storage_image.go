@@ -14,10 +14,12 @@ import (
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/image"
 	"github.com/containers/image/v5/internal/tmpdir"
+	internalTypes "github.com/containers/image/v5/internal/types"
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/pkg/blobinfocache/none"
 	"github.com/containers/image/v5/types"
@@ -43,28 +45,127 @@ var (
 )
 
 type storageImageSource struct {
-	imageRef        storageReference
-	image           *storage.Image
-	layerPosition   map[digest.Digest]int   // Where we are in reading a blob's layers
-	cachedManifest  []byte                  // A cached copy of the manifest, if already known, or nil
-	getBlobMutex    sync.Mutex              // Mutex to sync state for parallel GetBlob executions
-	SignatureSizes  []int                   `json:"signature-sizes,omitempty"`  // List of sizes of each signature slice
-	SignaturesSizes map[digest.Digest][]int `json:"signatures-sizes,omitempty"` // List of sizes of each signature slice
+	imageRef           storageReference
+	image              *storage.Image
+	layerPosition      map[digest.Digest]int    // Where we are in reading a blob's layers
+	cachedManifest     []byte                   // A cached copy of the manifest, if already known, or nil
+	getBlobMutex       sync.Mutex               // Mutex to sync state for parallel GetBlob executions
+	SignatureSizes     []int                    `json:"signature-sizes,omitempty"`      // List of sizes of each signature slice
+	SignaturesSizes    map[digest.Digest][]int  `json:"signatures-sizes,omitempty"`     // List of sizes of each signature slice
+	ManifestListDigest digest.Digest            `json:"manifest-list-digest,omitempty"` // Digest of the manifest list, if the image was stored with its instances
+	InstanceImages     map[digest.Digest]string `json:"instance-images,omitempty"`      // IDs of the images holding layers of non-default instances of the manifest list
 }
 
 type storageImageDestination struct {
-	imageRef        storageReference
-	directory       string                          // Temporary directory where we store blobs until Commit() time
-	nextTempFileID  int32                           // A counter that we use for computing filenames to assign to blobs
-	manifest        []byte                          // Manifest contents, temporary
-	signatures      []byte                          // Signature contents, temporary
-	signatureses    map[digest.Digest][]byte        // Instance signature contents, temporary
-	putBlobMutex    sync.Mutex                      // Mutex to sync state for parallel PutBlob executions
-	blobDiffIDs     map[digest.Digest]digest.Digest // Mapping from layer blobsums to their corresponding DiffIDs
-	fileSizes       map[digest.Digest]int64         // Mapping from layer blobsums to their sizes
-	filenames       map[digest.Digest]string        // Mapping from layer blobsums to names of files we used to hold them
-	SignatureSizes  []int                           `json:"signature-sizes,omitempty"`  // List of sizes of each signature slice
-	SignaturesSizes map[digest.Digest][]int         `json:"signatures-sizes,omitempty"` // Sizes of each manifest's signature slice
+	imageRef           storageReference
+	directory          string                          // Temporary directory where we store blobs until Commit() time
+	nextTempFileID     int32                           // A counter that we use for computing filenames to assign to blobs
+	manifest           []byte                          // Manifest contents, temporary
+	instances          map[digest.Digest][]byte        // Per-instance manifests, set by PutManifest with instanceDigest != nil
+	sys                *types.SystemContext            // Used to choose the default instance of a manifest list
+	signatures         []byte                          // Signature contents, temporary
+	signatureses       map[digest.Digest][]byte        // Instance signature contents, temporary
+	putBlobMutex       sync.Mutex                      // Mutex to sync state for parallel PutBlob executions
+	blobDiffIDs        map[digest.Digest]digest.Digest // Mapping from layer blobsums to their corresponding DiffIDs
+	fileSizes          map[digest.Digest]int64         // Mapping from layer blobsums to the sizes of the files in filenames
+	partialBlobSizes   map[digest.Digest]int64         // Mapping from blobsums of layers written by PutBlobPartial, whose files contain uncompressed data, to the blob sizes
+	filenames          map[digest.Digest]string        // Mapping from layer blobsums to names of files we used to hold them
+	chunkedTOCs        map[digest.Digest][]byte        // Mapping from layer blobsums in the pkg/chunked format to their compressed tables of contents
+	streamLayers       bool                            // Apply layers to the store as they arrive, if their index is known
+	nextLayerIndex     int                             // Index of the next layer to be applied to the store, if streamLayers
+	pendingLayers      map[int]pendingLayer            // Layers which have arrived before their parent was applied, by index
+	appliedLayers      []appliedLayer                  // Non-empty layers applied to the store as they arrived, in order
+	createdLayers      []string                        // IDs of layers created in the store by this destination, in order
+	committed          bool                            // Set once Commit has succeeded; until then, Close deletes createdLayers
+	createdImages      []string                        // IDs of instance images created by the current Commit, deleted if it fails
+	progress           chan<- types.ProgressProperties // Set by CommitWithOptions, to report the progress of applying layers, or nil
+	progressInterval   time.Duration                   // Minimal time between ProgressEventApplyRead reports, if progress is set
+	SignatureSizes     []int                           `json:"signature-sizes,omitempty"`      // List of sizes of each signature slice
+	SignaturesSizes    map[digest.Digest][]int         `json:"signatures-sizes,omitempty"`     // Sizes of each manifest's signature slice
+	ManifestListDigest digest.Digest                   `json:"manifest-list-digest,omitempty"` // Digest of the manifest list, if the image was stored with its instances
+	InstanceImages     map[digest.Digest]string        `json:"instance-images,omitempty"`      // IDs of the images holding layers of non-default instances of the manifest list
+}
+
+// pendingLayer is a layer which is waiting for its parent to be applied to the store.
+type pendingLayer struct {
+	digest     digest.Digest // The layer blob, stored in a temporary file or available in the store
+	emptyLayer bool          // The layer does not modify the layer stack
+}
+
+// appliedLayer is a layer which has been applied to the store as it arrived.
+type appliedLayer struct {
+	diffID digest.Digest
+	id     string
+}
+
+// contextReader is an io.Reader which fails with ctx.Err() once ctx is done, so that long-running
+// copies and layer applications can be interrupted.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+// Read implements io.Reader.
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// applyProgressReader is an io.Reader which reports the progress of applying artifact to the store,
+// sending ProgressEventApplyRead at most once per interval.
+type applyProgressReader struct {
+	reader       io.Reader
+	channel      chan<- types.ProgressProperties
+	interval     time.Duration
+	artifact     types.BlobInfo
+	lastUpdate   time.Time
+	offset       uint64
+	offsetUpdate uint64
+}
+
+// newApplyProgressReader returns an applyProgressReader for artifact read from reader, and reports that applying it has started.
+func newApplyProgressReader(reader io.Reader, channel chan<- types.ProgressProperties, interval time.Duration, artifact types.BlobInfo) *applyProgressReader {
+	channel <- types.ProgressProperties{
+		Event:    types.ProgressEventApplyNewArtifact,
+		Artifact: artifact,
+	}
+	return &applyProgressReader{
+		reader:     reader,
+		channel:    channel,
+		interval:   interval,
+		artifact:   artifact,
+		lastUpdate: time.Now(),
+	}
+}
+
+// Read implements io.Reader.
+func (r *applyProgressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.offset += uint64(n)
+	r.offsetUpdate += uint64(n)
+	if time.Since(r.lastUpdate) > r.interval {
+		r.channel <- types.ProgressProperties{
+			Event:        types.ProgressEventApplyRead,
+			Artifact:     r.artifact,
+			Offset:       r.offset,
+			OffsetUpdate: r.offsetUpdate,
+		}
+		r.lastUpdate = time.Now()
+		r.offsetUpdate = 0
+	}
+	return n, err
+}
+
+// reportDone reports that applying the artifact has finished.
+func (r *applyProgressReader) reportDone() {
+	r.channel <- types.ProgressProperties{
+		Event:        types.ProgressEventApplyDone,
+		Artifact:     r.artifact,
+		Offset:       r.offset,
+		OffsetUpdate: r.offsetUpdate,
+	}
 }
 
 type storageImageCloser struct {
@@ -213,6 +314,15 @@ func (s *storageImageSource) GetManifest(ctx context.Context, instanceDigest *di
 				}
 			}
 		}
+		// If the image was stored along with all of the instances of its manifest list, return the list, so that copying the image
+		// reproduces it.
+		if len(s.cachedManifest) == 0 && s.ManifestListDigest != "" {
+			blob, err := s.imageRef.transport.store.ImageBigData(s.image.ID, manifestBigDataKey(s.ManifestListDigest))
+			if err != nil {
+				return nil, "", errors.Wrapf(err, "error reading manifest list %s", s.ManifestListDigest)
+			}
+			s.cachedManifest = blob
+		}
 		// If the user did not specify a digest, or this is an old image stored before manifestBigDataKey was introduced, use the default manifest.
 		// Note that the manifest may not match the expected digest, and that is likely to fail eventually, e.g. in c/image/image/UnparsedImage.Manifest().
 		if len(s.cachedManifest) == 0 {
@@ -251,7 +361,10 @@ func (s *storageImageSource) LayerInfosForCopy(ctx context.Context, instanceDige
 	}
 
 	physicalBlobInfos := []types.BlobInfo{}
-	layerID := s.image.TopLayer
+	layerID, err := s.topLayer(ctx, instanceDigest)
+	if err != nil {
+		return nil, err
+	}
 	for layerID != "" {
 		layer, err := s.imageRef.transport.store.Layer(layerID)
 		if err != nil {
@@ -279,6 +392,72 @@ func (s *storageImageSource) LayerInfosForCopy(ctx context.Context, instanceDige
 	return res, nil
 }
 
+// topLayer returns the ID of the top layer of the image instance with instanceDigest, if not nil, or of the instance
+// the reference refers to.
+func (s *storageImageSource) topLayer(ctx context.Context, instanceDigest *digest.Digest) (string, error) {
+	if instanceDigest == nil && s.imageRef.named != nil {
+		if digested, ok := s.imageRef.named.(reference.Digested); ok {
+			d := digested.Digest()
+			instanceDigest = &d
+		}
+	}
+	if instanceDigest != nil {
+		if imageID, ok := s.InstanceImages[*instanceDigest]; ok {
+			img, err := s.imageRef.transport.store.Image(imageID)
+			if err == nil {
+				return img.TopLayer, nil
+			}
+			if errors.Cause(err) != storage.ErrImageUnknown {
+				return "", errors.Wrapf(err, "error reading image %q with layers of instance %s", imageID, instanceDigest.String())
+			}
+			// The image may have been removed by someone who didn't know that this one refers to it; its layers
+			// may still be available, e.g. if they are used by another image.
+			logrus.Debugf("image %q with layers of instance %s does not exist, looking for the layers", imageID, instanceDigest.String())
+			return s.findInstanceTopLayer(ctx, *instanceDigest)
+		}
+	}
+	return s.image.TopLayer, nil
+}
+
+// findInstanceTopLayer returns the ID of a layer in the store which is the top of a stack of layers with the DiffIDs
+// listed in the config of the instance with instanceDigest.
+func (s *storageImageSource) findInstanceTopLayer(ctx context.Context, instanceDigest digest.Digest) (string, error) {
+	manifestBlob, manifestType, err := s.GetManifest(ctx, &instanceDigest)
+	if err != nil {
+		return "", err
+	}
+	man, err := manifest.FromBlob(manifestBlob, manifestType)
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing manifest of instance %s", instanceDigest.String())
+	}
+	configBlob, err := s.imageRef.transport.store.ImageBigData(s.image.ID, man.ConfigInfo().Digest.String())
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading config of instance %s", instanceDigest.String())
+	}
+	config := imgspecv1.Image{}
+	if err := json.Unmarshal(configBlob, &config); err != nil {
+		return "", errors.Wrapf(err, "error parsing config of instance %s", instanceDigest.String())
+	}
+	topLayer := ""
+	for _, diffID := range config.RootFS.DiffIDs {
+		layers, err := s.imageRef.transport.store.LayersByUncompressedDigest(diffID)
+		if err != nil && errors.Cause(err) != storage.ErrLayerUnknown {
+			return "", errors.Wrapf(err, "error looking for layers with digest %q", diffID)
+		}
+		parent := topLayer
+		for _, layer := range layers {
+			if layer.Parent == parent {
+				topLayer = layer.ID
+				break
+			}
+		}
+		if topLayer == parent {
+			return "", errors.Wrapf(ErrNoSuchImage, "layers of instance %s are no longer available", instanceDigest.String())
+		}
+	}
+	return topLayer, nil
+}
+
 // buildLayerInfosForCopy builds a LayerInfosForCopy return value based on manifestInfos from the original manifest,
 // but using layer data which we can actually produce — physicalInfos for non-empty layers,
 // and image.GzippedEmptyLayer for empty ones.
@@ -348,14 +527,20 @@ func newImageDestination(sys *types.SystemContext, imageRef storageReference) (*
 		return nil, errors.Wrapf(err, "error creating a temporary directory")
 	}
 	image := &storageImageDestination{
-		imageRef:        imageRef,
-		directory:       directory,
-		signatureses:    make(map[digest.Digest][]byte),
-		blobDiffIDs:     make(map[digest.Digest]digest.Digest),
-		fileSizes:       make(map[digest.Digest]int64),
-		filenames:       make(map[digest.Digest]string),
-		SignatureSizes:  []int{},
-		SignaturesSizes: make(map[digest.Digest][]int),
+		imageRef:         imageRef,
+		directory:        directory,
+		instances:        make(map[digest.Digest][]byte),
+		sys:              sys,
+		signatureses:     make(map[digest.Digest][]byte),
+		blobDiffIDs:      make(map[digest.Digest]digest.Digest),
+		fileSizes:        make(map[digest.Digest]int64),
+		partialBlobSizes: make(map[digest.Digest]int64),
+		filenames:        make(map[digest.Digest]string),
+		chunkedTOCs:      make(map[digest.Digest][]byte),
+		streamLayers:     sys != nil && sys.ContainersStorageStreamLayers,
+		pendingLayers:    make(map[int]pendingLayer),
+		SignatureSizes:   []int{},
+		SignaturesSizes:  make(map[digest.Digest][]int),
 	}
 	return image, nil
 }
@@ -366,11 +551,24 @@ func (s *storageImageDestination) Reference() types.ImageReference {
 	return s.imageRef
 }
 
-// Close cleans up the temporary directory.
+// Close deletes the layers created by this destination if the image has not been committed, and cleans up the temporary directory.
 func (s *storageImageDestination) Close() error {
+	if !s.committed {
+		s.deleteCreatedLayers(s.createdLayers)
+	}
 	return os.RemoveAll(s.directory)
 }
 
+// deleteCreatedLayers deletes layers, which were created by this destination, from the store, starting with the last one.
+// Layers which are in use, e.g. by an image or by a layer created by someone else, are left alone.
+func (s *storageImageDestination) deleteCreatedLayers(layers []string) {
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := s.imageRef.transport.store.DeleteLayer(layers[i]); err != nil {
+			logrus.Debugf("error deleting layer %q: %v", layers[i], err)
+		}
+	}
+}
+
 func (s *storageImageDestination) DesiredLayerCompression() types.LayerCompression {
 	// We ultimately have to decompress layers to populate trees on disk
 	// and need to explicitly ask for it here, so that the layers' MIME
@@ -416,14 +614,21 @@ func (s *storageImageDestination) PutBlob(ctx context.Context, stream io.Reader,
 		return errorBlobInfo, errors.Wrapf(err, "error creating temporary file %q", filename)
 	}
 	defer file.Close()
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			if err := os.Remove(filename); err != nil {
+				logrus.Debugf("error removing temporary file %q: %v", filename, err)
+			}
+		}
+	}()
 	counter := ioutils.NewWriteCounter(hasher.Hash())
-	reader := io.TeeReader(io.TeeReader(stream, counter), file)
+	reader := io.TeeReader(io.TeeReader(&contextReader{ctx: ctx, reader: stream}, counter), file)
 	decompressed, err := archive.DecompressStream(reader)
 	if err != nil {
 		return errorBlobInfo, errors.Wrap(err, "error setting up to decompress blob")
 	}
 	// Copy the data to the file.
-	// TODO: This can take quite some time, and should ideally be cancellable using ctx.Done().
 	_, err = io.Copy(diffID.Hash(), decompressed)
 	decompressed.Close()
 	if err != nil {
@@ -436,12 +641,24 @@ func (s *storageImageDestination) PutBlob(ctx context.Context, stream io.Reader,
 	if blobinfo.Size >= 0 && blobinfo.Size != counter.Count {
 		return errorBlobInfo, errors.WithStack(ErrBlobSizeMismatch)
 	}
+	// If the blob is a layer in the pkg/chunked format, remember its table of contents, so that later partial pulls can find its files.
+	var compressedTOC []byte
+	if !isConfig {
+		if f, err := os.Open(filename); err == nil {
+			compressedTOC = readChunkedTOCFromFile(f, counter.Count)
+			f.Close()
+		}
+	}
 	// Record information about the blob.
 	s.putBlobMutex.Lock()
 	s.blobDiffIDs[hasher.Digest()] = diffID.Digest()
 	s.fileSizes[hasher.Digest()] = counter.Count
 	s.filenames[hasher.Digest()] = filename
+	if compressedTOC != nil {
+		s.chunkedTOCs[hasher.Digest()] = compressedTOC
+	}
 	s.putBlobMutex.Unlock()
+	succeeded = true
 	blobDigest := blobinfo.Digest
 	if blobDigest.Validate() != nil {
 		blobDigest = hasher.Digest()
@@ -459,6 +676,201 @@ func (s *storageImageDestination) PutBlob(ctx context.Context, stream io.Reader,
 	}, nil
 }
 
+// PutBlobWithOptions is a variant of PutBlob; if streamLayers and options.LayerIndex is set, the layer is applied to the store
+// right away if its parent is already available, or as soon as it becomes available otherwise.
+// A layer whose parent is available is applied straight from stream; a layer which arrives before its parent, or a blob
+// which has already been written for another layer, is stored in a temporary file until it is applied.
+func (s *storageImageDestination) PutBlobWithOptions(ctx context.Context, stream io.Reader, blobinfo types.BlobInfo, options internalTypes.PutBlobOptions) (types.BlobInfo, error) {
+	if !s.streamLayers || options.LayerIndex == nil || options.IsConfig {
+		return s.PutBlob(ctx, stream, blobinfo, options.Cache, options.IsConfig)
+	}
+	index := *options.LayerIndex
+	if !options.EmptyLayer {
+		// Only the caller handling the layer at s.nextLayerIndex can change it, so this can't become stale.
+		s.putBlobMutex.Lock()
+		parentApplied := index == s.nextLayerIndex
+		_, seen := s.blobDiffIDs[blobinfo.Digest]
+		s.putBlobMutex.Unlock()
+		if parentApplied && !seen {
+			info, err := s.putLayerFromStream(ctx, stream, blobinfo, options.Cache)
+			if err != nil {
+				return info, err
+			}
+			if err := s.applyQueuedLayers(ctx); err != nil {
+				return types.BlobInfo{Digest: "", Size: -1}, err
+			}
+			return info, nil
+		}
+	}
+	info, err := s.PutBlob(ctx, stream, blobinfo, options.Cache, false)
+	if err != nil {
+		return info, err
+	}
+	if err := s.queueOrApplyLayer(ctx, index, pendingLayer{digest: info.Digest, emptyLayer: options.EmptyLayer}); err != nil {
+		return types.BlobInfo{Digest: "", Size: -1}, err
+	}
+	return info, nil
+}
+
+// putLayerFromStream applies the layer in stream on top of the most recently applied layer, computing the digest of the
+// compressed stream as it is being read, and returns data representing the result, like PutBlob.
+// The store's layers are locked while stream is being read.  If anything fails, the partially applied layer is deleted.
+// The blob is not kept, so a table of contents of a layer in the pkg/chunked format is not recorded.
+func (s *storageImageDestination) putLayerFromStream(ctx context.Context, stream io.Reader, blobinfo types.BlobInfo, cache types.BlobInfoCache) (types.BlobInfo, error) {
+	errorBlobInfo := types.BlobInfo{
+		Digest: "",
+		Size:   -1,
+	}
+	hasher := digest.Canonical.Digester()
+	if blobinfo.Digest.Validate() == nil {
+		if a := blobinfo.Digest.Algorithm(); a.Available() {
+			hasher = a.Digester()
+		}
+	}
+	s.putBlobMutex.Lock()
+	parentLayer := ""
+	if len(s.appliedLayers) > 0 {
+		parentLayer = s.appliedLayers[len(s.appliedLayers)-1].id
+	}
+	s.putBlobMutex.Unlock()
+	layer, err := s.imageRef.transport.store.CreateLayer("", parentLayer, nil, "", false, nil)
+	if err != nil {
+		return errorBlobInfo, errors.Wrapf(err, "error creating layer for blob %q", blobinfo.Digest)
+	}
+	layerID := layer.ID
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			if err := s.imageRef.transport.store.DeleteLayer(layerID); err != nil {
+				logrus.Debugf("error deleting incomplete layer %q: %v", layerID, err)
+			}
+		}
+	}()
+	counter := ioutils.NewWriteCounter(hasher.Hash())
+	reader := io.TeeReader(&contextReader{ctx: ctx, reader: stream}, counter)
+	if _, err := s.imageRef.transport.store.ApplyDiff(layerID, reader); err != nil {
+		return errorBlobInfo, errors.Wrapf(err, "error applying blob %q to layer %q", blobinfo.Digest, layerID)
+	}
+	// ApplyDiff may stop reading at the end of the tar archive; make sure we have seen all of the blob.
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return errorBlobInfo, errors.Wrapf(err, "error reading blob %q", blobinfo.Digest)
+	}
+	// Ensure that any information that we were given about the blob is correct.
+	if blobinfo.Digest.Validate() == nil && blobinfo.Digest != hasher.Digest() {
+		return errorBlobInfo, errors.WithStack(ErrBlobDigestMismatch)
+	}
+	if blobinfo.Size >= 0 && blobinfo.Size != counter.Count {
+		return errorBlobInfo, errors.WithStack(ErrBlobSizeMismatch)
+	}
+	// ApplyDiff has computed the uncompressed digest for us.
+	layer, err = s.imageRef.transport.store.Layer(layerID)
+	if err != nil {
+		return errorBlobInfo, errors.Wrapf(err, "error reading layer %q", layerID)
+	}
+	diffID := layer.UncompressedDigest
+	s.putBlobMutex.Lock()
+	s.blobDiffIDs[hasher.Digest()] = diffID
+	s.appliedLayers = append(s.appliedLayers, appliedLayer{diffID: diffID, id: layerID})
+	s.createdLayers = append(s.createdLayers, layerID)
+	s.putBlobMutex.Unlock()
+	succeeded = true
+	logrus.Debugf("applied blob %q as layer %q", hasher.Digest(), layerID)
+	blobDigest := blobinfo.Digest
+	if blobDigest.Validate() != nil {
+		blobDigest = hasher.Digest()
+	}
+	blobSize := blobinfo.Size
+	if blobSize < 0 {
+		blobSize = counter.Count
+	}
+	// This is safe because we have just computed both values ourselves.
+	cache.RecordDigestUncompressedPair(blobDigest, diffID)
+	return types.BlobInfo{
+		Digest:    blobDigest,
+		Size:      blobSize,
+		MediaType: blobinfo.MediaType,
+	}, nil
+}
+
+// queueOrApplyLayer applies layer, which is at index in the image's layers, to the store, followed by any layers
+// which were waiting for it, if its parent has already been applied; otherwise it queues layer, to be applied by
+// the caller which applies its parent.
+func (s *storageImageDestination) queueOrApplyLayer(ctx context.Context, index int, layer pendingLayer) error {
+	s.putBlobMutex.Lock()
+	if index != s.nextLayerIndex {
+		s.pendingLayers[index] = layer
+		s.putBlobMutex.Unlock()
+		return nil
+	}
+	s.putBlobMutex.Unlock()
+	if err := s.applyPendingLayer(ctx, layer); err != nil {
+		return err
+	}
+	return s.applyQueuedLayers(ctx)
+}
+
+// applyQueuedLayers is called after the layer at s.nextLayerIndex has been applied; it moves on to the next index,
+// and applies layers which have already arrived, for as long as there are any.
+func (s *storageImageDestination) applyQueuedLayers(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.putBlobMutex.Lock()
+		s.nextLayerIndex++
+		index := s.nextLayerIndex
+		layer, ok := s.pendingLayers[index]
+		delete(s.pendingLayers, index)
+		s.putBlobMutex.Unlock()
+		if !ok {
+			return nil
+		}
+		if err := s.applyPendingLayer(ctx, layer); err != nil {
+			return errors.Wrapf(err, "error applying layer %d", index)
+		}
+	}
+}
+
+// applyPendingLayer applies layer on top of the most recently applied layer, and removes its temporary file, if any.
+func (s *storageImageDestination) applyPendingLayer(ctx context.Context, layer pendingLayer) error {
+	if layer.emptyLayer {
+		return nil
+	}
+	s.putBlobMutex.Lock()
+	parentLayer := ""
+	if len(s.appliedLayers) > 0 {
+		parentLayer = s.appliedLayers[len(s.appliedLayers)-1].id
+	}
+	s.putBlobMutex.Unlock()
+	id, err := s.commitLayer(ctx, types.BlobInfo{Digest: layer.digest, Size: -1}, parentLayer)
+	if err != nil {
+		return err
+	}
+	s.putBlobMutex.Lock()
+	defer s.putBlobMutex.Unlock()
+	s.appliedLayers = append(s.appliedLayers, appliedLayer{diffID: s.blobDiffIDs[layer.digest], id: id})
+	if filename, ok := s.filenames[layer.digest]; ok {
+		delete(s.filenames, layer.digest)
+		if err := os.Remove(filename); err != nil {
+			logrus.Debugf("error removing temporary file %q: %v", filename, err)
+		}
+	}
+	return nil
+}
+
+// TryReusingBlobWithOptions is a variant of TryReusingBlob; if streamLayers and options.LayerIndex is set, a reused layer
+// is applied to the store like in PutBlobWithOptions.
+func (s *storageImageDestination) TryReusingBlobWithOptions(ctx context.Context, blobinfo types.BlobInfo, options internalTypes.TryReusingBlobOptions) (bool, types.BlobInfo, error) {
+	reused, info, err := s.TryReusingBlob(ctx, blobinfo, options.Cache, options.CanSubstitute)
+	if err != nil || !reused || !s.streamLayers || options.LayerIndex == nil {
+		return reused, info, err
+	}
+	if err := s.queueOrApplyLayer(ctx, *options.LayerIndex, pendingLayer{digest: info.Digest, emptyLayer: options.EmptyLayer}); err != nil {
+		return false, types.BlobInfo{}, err
+	}
+	return true, info, nil
+}
+
 // TryReusingBlob checks whether the transport already contains, or can efficiently reuse, a blob, and if so, applies it to the current destination
 // (e.g. if the blob is a filesystem layer, this signifies that the changes it describes need to be applied again when composing a filesystem tree).
 // info.Digest must not be empty.
@@ -469,6 +881,9 @@ func (s *storageImageDestination) PutBlob(ctx context.Context, stream io.Reader,
 // If the transport can not reuse the requested blob, TryReusingBlob returns (false, {}, nil); it returns a non-nil error only on an unexpected failure.
 // May use and/or update cache.
 func (s *storageImageDestination) TryReusingBlob(ctx context.Context, blobinfo types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return false, types.BlobInfo{}, err
+	}
 	// lock the entire method as it executes fairly quickly
 	s.putBlobMutex.Lock()
 	defer s.putBlobMutex.Unlock()
@@ -481,6 +896,9 @@ func (s *storageImageDestination) TryReusingBlob(ctx context.Context, blobinfo t
 
 	// Check if we've already cached it in a file.
 	if size, ok := s.fileSizes[blobinfo.Digest]; ok {
+		if blobSize, ok := s.partialBlobSizes[blobinfo.Digest]; ok {
+			size = blobSize // The file contains the uncompressed layer, not the blob.
+		}
 		return true, types.BlobInfo{
 			Digest:    blobinfo.Digest,
 			Size:      size,
@@ -608,7 +1026,318 @@ func (s *storageImageDestination) getConfigBlob(info types.BlobInfo) ([]byte, er
 	return nil, errors.New("blob not found")
 }
 
+// commitLayer applies the layer blob on top of parentLayer ("" for a base layer) in the store, reusing an existing layer
+// with the same contents and parent if there is one, and returns the ID of the resulting layer.
+func (s *storageImageDestination) commitLayer(ctx context.Context, blob types.BlobInfo, parentLayer string) (string, error) {
+	// Check if there's already a layer with the ID that we'd give to the result of applying
+	// this layer blob to its parent, if it has one, or the blob's hex value otherwise.
+	s.putBlobMutex.Lock()
+	diffID, haveDiffID := s.blobDiffIDs[blob.Digest]
+	s.putBlobMutex.Unlock()
+	if !haveDiffID {
+		// Check if it's elsewhere and the caller just forgot to pass it to us in a PutBlob(),
+		// or to even check if we had it.
+		// Use none.NoCache to avoid a repeated DiffID lookup in the BlobInfoCache; a caller
+		// that relies on using a blob digest that has never been seen by the store had better call
+		// TryReusingBlob; not calling PutBlob already violates the documented API, so there’s only
+		// so far we are going to accommodate that (if we should be doing that at all).
+		logrus.Debugf("looking for diffID for blob %+v", blob.Digest)
+		has, _, err := s.TryReusingBlob(ctx, blob, none.NoCache, false)
+		if err != nil {
+			return "", errors.Wrapf(err, "error checking for a layer based on blob %q", blob.Digest.String())
+		}
+		if !has {
+			return "", errors.Errorf("error determining uncompressed digest for blob %q", blob.Digest.String())
+		}
+		s.putBlobMutex.Lock()
+		diffID, haveDiffID = s.blobDiffIDs[blob.Digest]
+		s.putBlobMutex.Unlock()
+		if !haveDiffID {
+			return "", errors.Errorf("we have blob %q, but don't know its uncompressed digest", blob.Digest.String())
+		}
+	}
+	id := diffID.Hex()
+	if parentLayer != "" {
+		id = digest.Canonical.FromBytes([]byte(parentLayer + "+" + diffID.Hex())).Hex()
+	}
+	if layer, err2 := s.imageRef.transport.store.Layer(id); layer != nil && err2 == nil {
+		// There's already a layer that should have the right contents, just reuse it.
+		return layer.ID, nil
+	}
+	// Layers applied as they arrived don't use that ID; look for one with the same contents and parent.
+	if layers, err2 := s.imageRef.transport.store.LayersByUncompressedDigest(diffID); err2 == nil {
+		for _, layer := range layers {
+			if layer.Parent == parentLayer {
+				return layer.ID, nil
+			}
+		}
+	}
+	// Check if we previously cached a file with that blob's contents.  If we didn't,
+	// then we need to read the desired contents from a layer.
+	s.putBlobMutex.Lock()
+	filename, ok := s.filenames[blob.Digest]
+	s.putBlobMutex.Unlock()
+	if !ok {
+		// Try to find the layer with contents matching that blobsum.
+		layer := ""
+		layers, err2 := s.imageRef.transport.store.LayersByUncompressedDigest(diffID)
+		if err2 == nil && len(layers) > 0 {
+			layer = layers[0].ID
+		} else {
+			layers, err2 = s.imageRef.transport.store.LayersByCompressedDigest(blob.Digest)
+			if err2 == nil && len(layers) > 0 {
+				layer = layers[0].ID
+			}
+		}
+		if layer == "" {
+			return "", errors.Wrapf(err2, "error locating layer for blob %q", blob.Digest)
+		}
+		// Read the layer's contents.
+		noCompression := archive.Uncompressed
+		diffOptions := &storage.DiffOptions{
+			Compression: &noCompression,
+		}
+		diff, err2 := s.imageRef.transport.store.Diff("", layer, diffOptions)
+		if err2 != nil {
+			return "", errors.Wrapf(err2, "error reading layer %q for blob %q", layer, blob.Digest)
+		}
+		// Copy the layer diff to a file.  Diff() takes a lock that it holds
+		// until the ReadCloser that it returns is closed, and PutLayer() wants
+		// the same lock, so the diff can't just be directly streamed from one
+		// to the other.
+		filename = s.computeNextBlobCacheFile()
+		file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_EXCL, 0600)
+		if err != nil {
+			diff.Close()
+			return "", errors.Wrapf(err, "error creating temporary file %q", filename)
+		}
+		// Copy the data to the file.
+		_, err = io.Copy(file, &contextReader{ctx: ctx, reader: diff})
+		diff.Close()
+		file.Close()
+		if err != nil {
+			if err2 := os.Remove(filename); err2 != nil {
+				logrus.Debugf("error removing temporary file %q: %v", filename, err2)
+			}
+			return "", errors.Wrapf(err, "error storing blob to file %q", filename)
+		}
+		// Make sure that we can find this file later, should we need the layer's
+		// contents again.
+		s.putBlobMutex.Lock()
+		s.filenames[blob.Digest] = filename
+		s.putBlobMutex.Unlock()
+	}
+	// Read the cached blob and use it as a diff.
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", errors.Wrapf(err, "error opening file %q", filename)
+	}
+	defer file.Close()
+	var diff io.Reader = &contextReader{ctx: ctx, reader: file}
+	if s.progress != nil {
+		fileInfo, err := file.Stat()
+		if err != nil {
+			return "", errors.Wrapf(err, "error reading size of file %q", filename)
+		}
+		progressReader := newApplyProgressReader(diff, s.progress, s.progressInterval, types.BlobInfo{Digest: blob.Digest, Size: fileInfo.Size()})
+		defer progressReader.reportDone()
+		diff = progressReader
+	}
+	// If the blob has a table of contents, check it against the data which is actually applied before recording it.
+	s.putBlobMutex.Lock()
+	compressedTOC := s.chunkedTOCs[blob.Digest]
+	s.putBlobMutex.Unlock()
+	var tocVerifier *chunkedTOCVerifier
+	if compressedTOC != nil {
+		diff, tocVerifier = newChunkedTOCVerifier(diff, compressedTOC)
+	}
+	// Build the new layer using the diff, regardless of where it came from.
+	// If reading the diff fails, e.g. because ctx is cancelled, PutLayer deletes the incomplete layer.
+	layer, _, err := s.imageRef.transport.store.PutLayer(id, parentLayer, nil, "", false, nil, diff)
+	if tocVerifier != nil {
+		if err := tocVerifier.finish(); err != nil {
+			logrus.Debugf("not recording table of contents of blob %q: %v", blob.Digest, err)
+			compressedTOC = nil
+		}
+	}
+	if err != nil && errors.Cause(err) != storage.ErrDuplicateID {
+		return "", errors.Wrapf(err, "error adding layer with blob %q", blob.Digest)
+	}
+	if err == nil {
+		s.putBlobMutex.Lock()
+		s.createdLayers = append(s.createdLayers, layer.ID)
+		s.putBlobMutex.Unlock()
+	}
+	if err := s.setLayerChunkedTOC(layer.ID, compressedTOC); err != nil {
+		return "", err
+	}
+	return layer.ID, nil
+}
+
+// commitLayers applies the non-empty layers among layerBlobs to the store, in order, and returns the ID of the top layer.
+// appliedLayers, if any, are used for as long as they match the layer blobs.
+func (s *storageImageDestination) commitLayers(ctx context.Context, layerBlobs []manifest.LayerInfo, appliedLayers []appliedLayer) (string, error) {
+	lastLayer := ""
+	for _, blob := range layerBlobs {
+		if blob.EmptyLayer {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		// Use the layers which were applied as they arrived, for as long as they match the manifest.
+		s.putBlobMutex.Lock()
+		diffID := s.blobDiffIDs[blob.Digest]
+		s.putBlobMutex.Unlock()
+		if len(appliedLayers) > 0 && diffID == appliedLayers[0].diffID {
+			lastLayer = appliedLayers[0].id
+			appliedLayers = appliedLayers[1:]
+			continue
+		}
+		appliedLayers = nil
+		layer, err := s.commitLayer(ctx, blob.BlobInfo, lastLayer)
+		if err != nil {
+			return "", err
+		}
+		lastLayer = layer
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return lastLayer, nil
+}
+
+// chooseDefaultInstance returns the digest of the instance of list which should be stored as the image itself:
+// the one matching sys, if it has been written, or the first written one otherwise.
+func (s *storageImageDestination) chooseDefaultInstance(list manifest.List) (digest.Digest, error) {
+	if instanceDigest, err := list.ChooseInstance(s.sys); err == nil {
+		if _, ok := s.instances[instanceDigest]; ok {
+			return instanceDigest, nil
+		}
+	}
+	for _, instanceDigest := range list.Instances() {
+		if _, ok := s.instances[instanceDigest]; ok {
+			logrus.Debugf("Using instance %s as the default image of the manifest list", instanceDigest)
+			return instanceDigest, nil
+		}
+	}
+	return "", errors.New("None of the instances of the manifest list have been written")
+}
+
+// commitInstanceImages stores the layers of all written instances of list, other than defaultInstance,
+// in separate images, and records their IDs in s.InstanceImages.
+func (s *storageImageDestination) commitInstanceImages(ctx context.Context, list manifest.List, defaultInstance digest.Digest) error {
+	s.InstanceImages = make(map[digest.Digest]string)
+	for _, instanceDigest := range list.Instances() {
+		instanceManifest, ok := s.instances[instanceDigest]
+		if !ok || instanceDigest == defaultInstance {
+			continue
+		}
+		id, err := s.commitInstanceImage(ctx, instanceDigest, instanceManifest)
+		if err != nil {
+			return err
+		}
+		s.InstanceImages[instanceDigest] = id
+	}
+	return nil
+}
+
+// commitInstanceImage stores the layers, manifest and config of a non-default instance of a manifest list in an image,
+// which keeps the layers in use and can also be used on its own, and returns the ID of that image.
+// If the destination has a name, the image is named after its repository and the instance digest, so that it is not
+// treated as a dangling image and pruned while the manifest list refers to it.
+func (s *storageImageDestination) commitInstanceImage(ctx context.Context, instanceDigest digest.Digest, instanceManifest []byte) (string, error) {
+	man, err := manifest.FromBlob(instanceManifest, manifest.GuessMIMEType(instanceManifest))
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing manifest of instance %s", instanceDigest.String())
+	}
+	lastLayer, err := s.commitLayers(ctx, man.LayerInfos(), nil)
+	if err != nil {
+		return "", err
+	}
+	options := &storage.ImageOptions{}
+	if inspect, err := man.Inspect(s.getConfigBlob); err == nil && inspect.Created != nil {
+		options.CreationDate = *inspect.Created
+	}
+	intendedID := s.computeID(man)
+	img, err := s.imageRef.transport.store.CreateImage(intendedID, nil, lastLayer, "", options)
+	if err != nil {
+		if errors.Cause(err) != storage.ErrDuplicateID {
+			return "", errors.Wrapf(err, "error creating image %q for instance %s", intendedID, instanceDigest.String())
+		}
+		img, err = s.imageRef.transport.store.Image(intendedID)
+		if err != nil {
+			return "", errors.Wrapf(err, "error reading image %q", intendedID)
+		}
+		if img.TopLayer != lastLayer {
+			return "", errors.Wrapf(storage.ErrDuplicateID, "image with ID %q already exists, but uses a different top layer", intendedID)
+		}
+		logrus.Debugf("reusing image ID %q for instance %s", img.ID, instanceDigest)
+	} else {
+		logrus.Debugf("created new image ID %q for instance %s", img.ID, instanceDigest)
+		s.createdImages = append(s.createdImages, img.ID)
+	}
+	if s.imageRef.named != nil {
+		name, err := reference.WithDigest(reference.TrimNamed(s.imageRef.named), instanceDigest)
+		if err != nil {
+			return "", errors.Wrapf(err, "error creating name for instance %s", instanceDigest.String())
+		}
+		names := append(append([]string{}, img.Names...), name.String())
+		if err := s.imageRef.transport.store.SetNames(img.ID, names); err != nil {
+			return "", errors.Wrapf(err, "error setting names %v on image %q", names, img.ID)
+		}
+		logrus.Debugf("set names of image %q to %v", img.ID, names)
+	}
+	data := map[string][]byte{
+		manifestBigDataKey(instanceDigest): instanceManifest,
+		storage.ImageDigestBigDataKey:      instanceManifest,
+	}
+	if configInfo := man.ConfigInfo(); configInfo.Digest != "" {
+		config, err := s.getConfigBlob(configInfo)
+		if err != nil {
+			return "", errors.Wrapf(err, "error reading config of instance %s", instanceDigest.String())
+		}
+		data[configInfo.Digest.String()] = config
+	}
+	for key, value := range data {
+		if err := s.imageRef.transport.store.SetImageBigData(img.ID, key, value, manifest.Digest); err != nil {
+			return "", errors.Wrapf(err, "error saving big data %q for image %q", key, img.ID)
+		}
+	}
+	return img.ID, nil
+}
+
+// Commit marks the process of storing the image as successful and asks for the image to be persisted.
 func (s *storageImageDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	return s.CommitWithOptions(ctx, unparsedToplevel, internalTypes.CommitOptions{})
+}
+
+// CommitWithOptions is a variant of Commit; if options.Progress is set, it reports the progress of applying each layer to the store.
+func (s *storageImageDestination) CommitWithOptions(ctx context.Context, unparsedToplevel types.UnparsedImage, commitOptions internalTypes.CommitOptions) error {
+	s.progress = commitOptions.Progress
+	s.progressInterval = commitOptions.ProgressInterval
+	// If we fail, e.g. because ctx is cancelled, delete the images and layers created so far, which nothing else uses.
+	// Layers applied before Commit was called are left for Close.
+	s.putBlobMutex.Lock()
+	layersBeforeCommit := len(s.createdLayers)
+	s.putBlobMutex.Unlock()
+	s.createdImages = nil
+	defer func() {
+		if s.committed {
+			return
+		}
+		for i := len(s.createdImages) - 1; i >= 0; i-- {
+			if _, err := s.imageRef.transport.store.DeleteImage(s.createdImages[i], true); err != nil {
+				logrus.Debugf("error deleting incomplete image %q: %v", s.createdImages[i], err)
+			}
+		}
+		s.createdImages = nil
+		s.putBlobMutex.Lock()
+		layers := s.createdLayers[layersBeforeCommit:]
+		s.createdLayers = s.createdLayers[:layersBeforeCommit]
+		s.putBlobMutex.Unlock()
+		s.deleteCreatedLayers(layers)
+	}()
 	if len(s.manifest) == 0 {
 		return errors.New("Internal error: storageImageDestination.Commit() called without PutManifest()")
 	}
@@ -636,117 +1365,39 @@ func (s *storageImageDestination) Commit(ctx context.Context, unparsedToplevel t
 			}
 		}
 	}
-	// Find the list of layer blobs.
-	if len(s.manifest) == 0 {
-		return errors.New("Internal error: storageImageDestination.Commit() called without PutManifest()")
+	// If we are storing a manifest list, the image is its default instance, and the other instances are stored as separate images.
+	imageManifest := s.manifest
+	var list manifest.List
+	var defaultInstance digest.Digest
+	if mimeType := manifest.GuessMIMEType(s.manifest); manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err = manifest.ListFromBlob(s.manifest, mimeType)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing manifest list")
+		}
+		defaultInstance, err = s.chooseDefaultInstance(list)
+		if err != nil {
+			return err
+		}
+		imageManifest = s.instances[defaultInstance]
 	}
-	man, err := manifest.FromBlob(s.manifest, manifest.GuessMIMEType(s.manifest))
+	// Find the list of layer blobs.
+	man, err := manifest.FromBlob(imageManifest, manifest.GuessMIMEType(imageManifest))
 	if err != nil {
 		return errors.Wrapf(err, "error parsing manifest")
 	}
 	layerBlobs := man.LayerInfos()
 	// Extract or find the layers.
-	lastLayer := ""
-	for _, blob := range layerBlobs {
-		if blob.EmptyLayer {
-			continue
-		}
-
-		// Check if there's already a layer with the ID that we'd give to the result of applying
-		// this layer blob to its parent, if it has one, or the blob's hex value otherwise.
-		diffID, haveDiffID := s.blobDiffIDs[blob.Digest]
-		if !haveDiffID {
-			// Check if it's elsewhere and the caller just forgot to pass it to us in a PutBlob(),
-			// or to even check if we had it.
-			// Use none.NoCache to avoid a repeated DiffID lookup in the BlobInfoCache; a caller
-			// that relies on using a blob digest that has never been seen by the store had better call
-			// TryReusingBlob; not calling PutBlob already violates the documented API, so there’s only
-			// so far we are going to accommodate that (if we should be doing that at all).
-			logrus.Debugf("looking for diffID for blob %+v", blob.Digest)
-			has, _, err := s.TryReusingBlob(ctx, blob.BlobInfo, none.NoCache, false)
-			if err != nil {
-				return errors.Wrapf(err, "error checking for a layer based on blob %q", blob.Digest.String())
-			}
-			if !has {
-				return errors.Errorf("error determining uncompressed digest for blob %q", blob.Digest.String())
-			}
-			diffID, haveDiffID = s.blobDiffIDs[blob.Digest]
-			if !haveDiffID {
-				return errors.Errorf("we have blob %q, but don't know its uncompressed digest", blob.Digest.String())
-			}
-		}
-		id := diffID.Hex()
-		if lastLayer != "" {
-			id = digest.Canonical.FromBytes([]byte(lastLayer + "+" + diffID.Hex())).Hex()
-		}
-		if layer, err2 := s.imageRef.transport.store.Layer(id); layer != nil && err2 == nil {
-			// There's already a layer that should have the right contents, just reuse it.
-			lastLayer = layer.ID
-			continue
-		}
-		// Check if we previously cached a file with that blob's contents.  If we didn't,
-		// then we need to read the desired contents from a layer.
-		filename, ok := s.filenames[blob.Digest]
-		if !ok {
-			// Try to find the layer with contents matching that blobsum.
-			layer := ""
-			layers, err2 := s.imageRef.transport.store.LayersByUncompressedDigest(diffID)
-			if err2 == nil && len(layers) > 0 {
-				layer = layers[0].ID
-			} else {
-				layers, err2 = s.imageRef.transport.store.LayersByCompressedDigest(blob.Digest)
-				if err2 == nil && len(layers) > 0 {
-					layer = layers[0].ID
-				}
-			}
-			if layer == "" {
-				return errors.Wrapf(err2, "error locating layer for blob %q", blob.Digest)
-			}
-			// Read the layer's contents.
-			noCompression := archive.Uncompressed
-			diffOptions := &storage.DiffOptions{
-				Compression: &noCompression,
-			}
-			diff, err2 := s.imageRef.transport.store.Diff("", layer, diffOptions)
-			if err2 != nil {
-				return errors.Wrapf(err2, "error reading layer %q for blob %q", layer, blob.Digest)
-			}
-			// Copy the layer diff to a file.  Diff() takes a lock that it holds
-			// until the ReadCloser that it returns is closed, and PutLayer() wants
-			// the same lock, so the diff can't just be directly streamed from one
-			// to the other.
-			filename = s.computeNextBlobCacheFile()
-			file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_EXCL, 0600)
-			if err != nil {
-				diff.Close()
-				return errors.Wrapf(err, "error creating temporary file %q", filename)
-			}
-			// Copy the data to the file.
-			// TODO: This can take quite some time, and should ideally be cancellable using
-			// ctx.Done().
-			_, err = io.Copy(file, diff)
-			diff.Close()
-			file.Close()
-			if err != nil {
-				return errors.Wrapf(err, "error storing blob to file %q", filename)
-			}
-			// Make sure that we can find this file later, should we need the layer's
-			// contents again.
-			s.filenames[blob.Digest] = filename
-		}
-		// Read the cached blob and use it as a diff.
-		file, err := os.Open(filename)
-		if err != nil {
-			return errors.Wrapf(err, "error opening file %q", filename)
-		}
-		defer file.Close()
-		// Build the new layer using the diff, regardless of where it came from.
-		// TODO: This can take quite some time, and should ideally be cancellable using ctx.Done().
-		layer, _, err := s.imageRef.transport.store.PutLayer(id, lastLayer, nil, "", false, nil, file)
-		if err != nil && errors.Cause(err) != storage.ErrDuplicateID {
-			return errors.Wrapf(err, "error adding layer with blob %q", blob.Digest)
+	s.putBlobMutex.Lock()
+	appliedLayers := s.appliedLayers
+	s.putBlobMutex.Unlock()
+	lastLayer, err := s.commitLayers(ctx, layerBlobs, appliedLayers)
+	if err != nil {
+		return err
+	}
+	if list != nil {
+		if err := s.commitInstanceImages(ctx, list, defaultInstance); err != nil {
+			return err
 		}
-		lastLayer = layer.ID
 	}
 
 	// If one of those blobs was a configuration blob, then we can try to dig out the date when the image
@@ -790,6 +1441,13 @@ func (s *storageImageDestination) Commit(ctx context.Context, unparsedToplevel t
 	for _, layerBlob := range layerBlobs {
 		delete(dataBlobs, layerBlob.Digest)
 	}
+	for _, instanceManifest := range s.instances {
+		if instance, err := manifest.FromBlob(instanceManifest, manifest.GuessMIMEType(instanceManifest)); err == nil {
+			for _, layerBlob := range instance.LayerInfos() {
+				delete(dataBlobs, layerBlob.Digest)
+			}
+		}
+	}
 	for blob := range dataBlobs {
 		v, err := ioutil.ReadFile(s.filenames[blob])
 		if err != nil {
@@ -837,15 +1495,36 @@ func (s *storageImageDestination) Commit(ctx context.Context, unparsedToplevel t
 			return errors.Wrapf(err, "error saving top-level manifest for image %q", img.ID)
 		}
 	}
+	// Save the manifest list, if any, and the manifests of all of its instances, so that they can be copied elsewhere as they were.
+	if list != nil {
+		manifestDigest, err := manifest.Digest(s.manifest)
+		if err != nil {
+			return errors.Wrapf(err, "error computing manifest list digest")
+		}
+		s.ManifestListDigest = manifestDigest
+		toSave := map[digest.Digest][]byte{manifestDigest: s.manifest}
+		for instanceDigest, instanceManifest := range s.instances {
+			toSave[instanceDigest] = instanceManifest
+		}
+		for manifestDigest, manifestBlob := range toSave {
+			if err := s.imageRef.transport.store.SetImageBigData(img.ID, manifestBigDataKey(manifestDigest), manifestBlob, manifest.Digest); err != nil {
+				if _, err2 := s.imageRef.transport.store.DeleteImage(img.ID, true); err2 != nil {
+					logrus.Debugf("error deleting incomplete image %q: %v", img.ID, err2)
+				}
+				logrus.Debugf("error saving manifest %s for image %q: %v", manifestDigest, img.ID, err)
+				return errors.Wrapf(err, "error saving manifest %s for image %q", manifestDigest.String(), img.ID)
+			}
+		}
+	}
 	// Save the image's manifest.  Allow looking it up by digest by using the key convention defined by the Store.
 	// Record the manifest twice: using a digest-specific key to allow references to that specific digest instance,
 	// and using storage.ImageDigestBigDataKey for future users that don’t specify any digest and for compatibility with older readers.
-	manifestDigest, err := manifest.Digest(s.manifest)
+	manifestDigest, err := manifest.Digest(imageManifest)
 	if err != nil {
 		return errors.Wrapf(err, "error computing manifest digest")
 	}
 	key := manifestBigDataKey(manifestDigest)
-	if err := s.imageRef.transport.store.SetImageBigData(img.ID, key, s.manifest, manifest.Digest); err != nil {
+	if err := s.imageRef.transport.store.SetImageBigData(img.ID, key, imageManifest, manifest.Digest); err != nil {
 		if _, err2 := s.imageRef.transport.store.DeleteImage(img.ID, true); err2 != nil {
 			logrus.Debugf("error deleting incomplete image %q: %v", img.ID, err2)
 		}
@@ -853,7 +1532,7 @@ func (s *storageImageDestination) Commit(ctx context.Context, unparsedToplevel t
 		return errors.Wrapf(err, "error saving manifest for image %q", img.ID)
 	}
 	key = storage.ImageDigestBigDataKey
-	if err := s.imageRef.transport.store.SetImageBigData(img.ID, key, s.manifest, manifest.Digest); err != nil {
+	if err := s.imageRef.transport.store.SetImageBigData(img.ID, key, imageManifest, manifest.Digest); err != nil {
 		if _, err2 := s.imageRef.transport.store.DeleteImage(img.ID, true); err2 != nil {
 			logrus.Debugf("error deleting incomplete image %q: %v", img.ID, err2)
 		}
@@ -899,6 +1578,7 @@ func (s *storageImageDestination) Commit(ctx context.Context, unparsedToplevel t
 		}
 		logrus.Debugf("saved image metadata %q", string(metadata))
 	}
+	s.committed = true
 	return nil
 }
 
@@ -907,6 +1587,8 @@ var manifestMIMETypes = []string{
 	manifest.DockerV2Schema2MediaType,
 	manifest.DockerV2Schema1SignedMediaType,
 	manifest.DockerV2Schema1MediaType,
+	imgspecv1.MediaTypeImageIndex,
+	manifest.DockerV2ListMediaType,
 }
 
 func (s *storageImageDestination) SupportedManifestMIMETypes() []string {
@@ -914,9 +1596,15 @@ func (s *storageImageDestination) SupportedManifestMIMETypes() []string {
 }
 
 // PutManifest writes the manifest to the destination.
+// If instanceDigest is not nil, it contains a digest of the specific manifest instance to write the manifest for
+// (when the primary manifest is a manifest list); the instances are committed along with the list, each with its own layers.
 func (s *storageImageDestination) PutManifest(ctx context.Context, manifestBlob []byte, instanceDigest *digest.Digest) error {
 	newBlob := make([]byte, len(manifestBlob))
 	copy(newBlob, manifestBlob)
+	if instanceDigest != nil {
+		s.instances[*instanceDigest] = newBlob
+		return nil
+	}
 	s.manifest = newBlob
 	return nil
 }
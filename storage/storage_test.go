@@ -15,13 +15,16 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	internalTypes "github.com/containers/image/v5/internal/types"
 	imanifest "github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/pkg/blobinfocache/memory"
+	"github.com/containers/image/v5/pkg/chunked"
 	"github.com/containers/image/v5/types"
 	"github.com/containers/storage"
 	"github.com/containers/storage/pkg/archive"
@@ -252,6 +255,7 @@ func makeLayer(t *testing.T, compression archive.Compression) (ddigest.Digest, i
 	errs := make(chan error)
 	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		defer pwriter.Close()
 		if cwriter != nil {
 			defer cwriter.Close()
@@ -285,13 +289,13 @@ func makeLayer(t *testing.T, compression archive.Compression) (ddigest.Digest, i
 		wg.Wait()
 		close(errs)
 	}()
+	_, err = io.Copy(&tbuffer, preader)
 	for err := range errs {
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	_, err = io.Copy(&tbuffer, preader)
 	if err != nil {
 		t.Fatalf("Error reading layer tar: %v", err)
 	}
@@ -1133,6 +1137,827 @@ func TestDuplicateBlob(t *testing.T) {
 	img.Close()
 }
 
+func TestStreamLayers(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("TestStreamLayers requires root privileges")
+	}
+
+	config := `{"config":{"labels":{}},"created":"2006-01-02T15:04:05Z"}`
+	sum := ddigest.SHA256.FromBytes([]byte(config))
+	configInfo := types.BlobInfo{
+		Digest: sum,
+		Size:   int64(len(config)),
+	}
+
+	store := newStore(t)
+	cache := memory.New()
+	sys := systemContext()
+	sys.ContainersStorageStreamLayers = true
+
+	ref, err := Transport.ParseReference("test")
+	if err != nil {
+		t.Fatalf("ParseReference(%q) returned error %v", "test", err)
+	}
+
+	// A layer which fails verification is not left behind.
+	dest, err := ref.NewImageDestination(context.Background(), sys)
+	if err != nil {
+		t.Fatalf("NewImageDestination(%q) returned error %v", ref.StringWithinTransport(), err)
+	}
+	destWithOptions, ok := dest.(internalTypes.ImageDestinationWithOptions)
+	if !ok {
+		t.Fatalf("ImageDestination does not support PutBlobWithOptions")
+	}
+	_, _, size, blob := makeLayer(t, archive.Gzip)
+	index := 0
+	if _, err := destWithOptions.PutBlobWithOptions(context.Background(), bytes.NewBuffer(blob), types.BlobInfo{
+		Size:   size,
+		Digest: ddigest.SHA256.FromBytes([]byte("something else")),
+	}, internalTypes.PutBlobOptions{Cache: cache, LayerIndex: &index}); err == nil {
+		t.Fatalf("PutBlobWithOptions succeeded with a mismatched digest")
+	}
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	if len(layers) != 0 {
+		t.Fatalf("Incomplete layer was not deleted: %v", layers)
+	}
+	dest.Close()
+
+	// Layers applied to the store are deleted if the image is never committed.
+	dest, err = ref.NewImageDestination(context.Background(), sys)
+	if err != nil {
+		t.Fatalf("NewImageDestination(%q) returned error %v", ref.StringWithinTransport(), err)
+	}
+	destWithOptions = dest.(internalTypes.ImageDestinationWithOptions)
+	for i := 0; i < 2; i++ {
+		digest, _, size, blob := makeLayer(t, archive.Gzip)
+		index := i
+		reader := &directoryWatchingReader{reader: bytes.NewBuffer(blob), directory: dest.(*storageImageDestination).directory}
+		if _, err := destWithOptions.PutBlobWithOptions(context.Background(), reader, types.BlobInfo{
+			Size:   size,
+			Digest: digest,
+		}, internalTypes.PutBlobOptions{Cache: cache, LayerIndex: &index}); err != nil {
+			t.Fatalf("Error saving randomly-generated layer %d to destination: %v", i, err)
+		}
+		// Layers which arrive in order are not stored in temporary files.
+		if reader.files != 0 {
+			t.Fatalf("Layer %d was stored in a temporary file", i)
+		}
+	}
+	layers, err = store.Layers()
+	require.NoError(t, err)
+	if len(layers) != 2 {
+		t.Fatalf("Unexpected number of layers before closing: %d", len(layers))
+	}
+	dest.Close()
+	layers, err = store.Layers()
+	require.NoError(t, err)
+	if len(layers) != 0 {
+		t.Fatalf("Layers of an uncommitted image were not deleted: %v", layers)
+	}
+
+	dest, err = ref.NewImageDestination(context.Background(), sys)
+	if err != nil {
+		t.Fatalf("NewImageDestination(%q) returned error %v", ref.StringWithinTransport(), err)
+	}
+	destWithOptions = dest.(internalTypes.ImageDestinationWithOptions)
+	digests := make([]ddigest.Digest, 3)
+	sizes := make([]int64, 3)
+	blobs := make([][]byte, 3)
+	for i := range blobs {
+		digests[i], _, sizes[i], blobs[i] = makeLayer(t, archive.Gzip)
+	}
+	// Layers may arrive in any order; each is applied as soon as its parent is available.
+	for _, i := range []int{2, 0, 1} {
+		index := i
+		if _, err := destWithOptions.PutBlobWithOptions(context.Background(), bytes.NewBuffer(blobs[i]), types.BlobInfo{
+			Size:   sizes[i],
+			Digest: digests[i],
+		}, internalTypes.PutBlobOptions{Cache: cache, LayerIndex: &index}); err != nil {
+			t.Fatalf("Error saving randomly-generated layer %d to destination: %v", i, err)
+		}
+		layers, err := store.Layers()
+		require.NoError(t, err)
+		expected := i + 1
+		if i == 2 {
+			expected = 0
+		} else if i == 1 {
+			expected = 3
+		}
+		if len(layers) != expected {
+			t.Fatalf("Unexpected number of layers after writing layer %d: %d", i, len(layers))
+		}
+	}
+	if _, err := dest.PutBlob(context.Background(), bytes.NewBufferString(config), configInfo, cache, true); err != nil {
+		t.Fatalf("Error saving config to destination: %v", err)
+	}
+	// Only the config is kept in a temporary file.
+	files, err := ioutil.ReadDir(dest.(*storageImageDestination).directory)
+	require.NoError(t, err)
+	if len(files) != 1 {
+		t.Fatalf("Unexpected number of temporary files: %d", len(files))
+	}
+	manifest := fmt.Sprintf(`
+	        {
+		    "schemaVersion": 2,
+		    "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		    "config": {
+			"mediaType": "application/vnd.docker.container.image.v1+json",
+			"size": %d,
+			"digest": "%s"
+		    },
+		    "layers": [
+			{
+			    "mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+			    "digest": "%s",
+			    "size": %d
+			},
+			{
+			    "mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+			    "digest": "%s",
+			    "size": %d
+			},
+			{
+			    "mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+			    "digest": "%s",
+			    "size": %d
+			}
+		    ]
+		}
+	`, configInfo.Size, configInfo.Digest, digests[0], sizes[0], digests[1], sizes[1], digests[2], sizes[2])
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
+		t.Fatalf("Error storing manifest to destination: %v", err)
+	}
+	unparsedToplevel := unparsedImage{
+		imageReference: nil,
+		manifestBytes:  []byte(manifest),
+		manifestType:   imanifest.GuessMIMEType([]byte(manifest)),
+		signatures:     nil,
+	}
+	if err := dest.Commit(context.Background(), &unparsedToplevel); err != nil {
+		t.Fatalf("Error committing changes to destination: %v", err)
+	}
+	dest.Close()
+
+	// The image uses the layers which were applied while writing it, in order.
+	layers, err = store.Layers()
+	require.NoError(t, err)
+	if len(layers) != 3 {
+		t.Fatalf("Unexpected number of layers after committing: %d", len(layers))
+	}
+	img, err := ref.(*storageReference).resolveImage(sys)
+	if err != nil {
+		t.Fatalf("Error resolving image %q: %v", ref.StringWithinTransport(), err)
+	}
+	layerID := img.TopLayer
+	for i := 2; i >= 0; i-- {
+		layer, err := store.Layer(layerID)
+		if err != nil {
+			t.Fatalf("Error reading layer %q: %v", layerID, err)
+		}
+		if layer.CompressedDigest != digests[i] {
+			t.Fatalf("Layer %d has digest %q, expected %q", i, layer.CompressedDigest, digests[i])
+		}
+		layerID = layer.Parent
+	}
+	if layerID != "" {
+		t.Fatalf("Base layer has parent %q", layerID)
+	}
+}
+
+func TestCommitProgress(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("TestCommitProgress requires root privileges")
+	}
+
+	newStore(t)
+	ref, err := Transport.ParseReference("test")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), systemContext())
+	require.NoError(t, err)
+	defer dest.Close()
+	destWithOptions, ok := dest.(internalTypes.ImageDestinationWithCommitOptions)
+	if !ok {
+		t.Fatalf("ImageDestination does not support CommitWithOptions")
+	}
+
+	layerInfos := make([]types.BlobInfo, 2)
+	layerJSON := []string{}
+	for i := range layerInfos {
+		_, _, size, blob := makeLayer(t, archive.Gzip)
+		layerInfos[i] = types.BlobInfo{Digest: ddigest.FromBytes(blob), Size: size}
+		if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), layerInfos[i], memory.New(), false); err != nil {
+			t.Fatalf("Error saving layer to destination: %v", err)
+		}
+		layerJSON = append(layerJSON, fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","size":%d,"digest":"%s"}`, size, layerInfos[i].Digest))
+	}
+	config := `{"config":{},"rootfs":{"type":"layers"}}`
+	configInfo := types.BlobInfo{Digest: ddigest.FromString(config), Size: int64(len(config))}
+	if _, err := dest.PutBlob(context.Background(), bytes.NewBufferString(config), configInfo, memory.New(), true); err != nil {
+		t.Fatalf("Error saving config to destination: %v", err)
+	}
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","size":%d,"digest":"%s"},"layers":[%s]}`,
+		configInfo.Size, configInfo.Digest, strings.Join(layerJSON, ","))
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
+		t.Fatalf("Error storing manifest to destination: %v", err)
+	}
+
+	progress := make(chan types.ProgressProperties)
+	events := []types.ProgressProperties{}
+	done := make(chan struct{})
+	go func() {
+		for p := range progress {
+			events = append(events, p)
+		}
+		close(done)
+	}()
+	unparsedToplevel := unparsedImage{
+		imageReference: nil,
+		manifestBytes:  []byte(manifest),
+		manifestType:   imanifest.GuessMIMEType([]byte(manifest)),
+		signatures:     nil,
+	}
+	err = destWithOptions.CommitWithOptions(context.Background(), &unparsedToplevel, internalTypes.CommitOptions{
+		Progress:         progress,
+		ProgressInterval: time.Nanosecond,
+	})
+	close(progress)
+	<-done
+	if err != nil {
+		t.Fatalf("Error committing changes to destination: %v", err)
+	}
+
+	// Each layer is reported as started, read, and done, in order.
+	for _, layerInfo := range layerInfos {
+		require.NotEmpty(t, events)
+		require.Equal(t, types.ProgressEventApplyNewArtifact, events[0].Event)
+		require.Equal(t, layerInfo, events[0].Artifact)
+		events = events[1:]
+		for len(events) > 0 && events[0].Event == types.ProgressEventApplyRead {
+			require.Equal(t, layerInfo.Digest, events[0].Artifact.Digest)
+			events = events[1:]
+		}
+		require.NotEmpty(t, events)
+		require.Equal(t, types.ProgressEventApplyDone, events[0].Event)
+		require.Equal(t, layerInfo.Digest, events[0].Artifact.Digest)
+		require.Equal(t, uint64(layerInfo.Size), events[0].Offset)
+		events = events[1:]
+	}
+	require.Empty(t, events)
+}
+
+// cancellingReader calls cancel after the first Read from reader.
+// directoryWatchingReader reads from reader, and records the largest number of files in directory seen while doing so.
+type directoryWatchingReader struct {
+	reader    io.Reader
+	directory string
+	files     int
+}
+
+func (r *directoryWatchingReader) Read(p []byte) (int, error) {
+	if files, err := ioutil.ReadDir(r.directory); err == nil && len(files) > r.files {
+		r.files = len(files)
+	}
+	return r.reader.Read(p)
+}
+
+type cancellingReader struct {
+	reader io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	defer r.cancel()
+	return r.reader.Read(p[:1])
+}
+
+func TestCancellation(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("TestCancellation requires root privileges")
+	}
+
+	config := `{"config":{"labels":{}},"created":"2006-01-02T15:04:05Z"}`
+	sum := ddigest.SHA256.FromBytes([]byte(config))
+	configInfo := types.BlobInfo{
+		Digest: sum,
+		Size:   int64(len(config)),
+	}
+
+	store := newStore(t)
+	cache := memory.New()
+	sys := systemContext()
+	sys.ContainersStorageStreamLayers = true
+
+	ref, err := Transport.ParseReference("test")
+	if err != nil {
+		t.Fatalf("ParseReference(%q) returned error %v", "test", err)
+	}
+	digest, _, size, blob := makeLayer(t, archive.Gzip)
+	layerInfo := types.BlobInfo{
+		Size:   size,
+		Digest: digest,
+	}
+
+	dest, err := ref.NewImageDestination(context.Background(), sys)
+	if err != nil {
+		t.Fatalf("NewImageDestination(%q) returned error %v", ref.StringWithinTransport(), err)
+	}
+	directory := dest.(*storageImageDestination).directory
+
+	// PutBlob stops reading, and removes its temporary file.
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := dest.PutBlob(ctx, &cancellingReader{reader: bytes.NewReader(blob), cancel: cancel}, layerInfo, cache, false); errors.Cause(err) != context.Canceled {
+		t.Fatalf("PutBlob with a cancelled context returned %v", err)
+	}
+	files, err := ioutil.ReadDir(directory)
+	require.NoError(t, err)
+	if len(files) != 0 {
+		t.Fatalf("Temporary files left behind: %v", files)
+	}
+	if _, _, err := dest.TryReusingBlob(ctx, layerInfo, cache, false); errors.Cause(err) != context.Canceled {
+		t.Fatalf("TryReusingBlob with a cancelled context returned %v", err)
+	}
+
+	// A layer being applied as it arrives is deleted.
+	ctx, cancel = context.WithCancel(context.Background())
+	index := 0
+	if _, err := dest.(internalTypes.ImageDestinationWithOptions).PutBlobWithOptions(ctx, &cancellingReader{reader: bytes.NewReader(blob), cancel: cancel}, layerInfo,
+		internalTypes.PutBlobOptions{Cache: cache, LayerIndex: &index}); errors.Cause(err) != context.Canceled {
+		t.Fatalf("PutBlobWithOptions with a cancelled context returned %v", err)
+	}
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	if len(layers) != 0 {
+		t.Fatalf("Incomplete layer was not deleted: %v", layers)
+	}
+	dest.Close()
+
+	// Commit does not create the layers or the image.
+	dest, err = ref.NewImageDestination(context.Background(), systemContext())
+	if err != nil {
+		t.Fatalf("NewImageDestination(%q) returned error %v", ref.StringWithinTransport(), err)
+	}
+	defer dest.Close()
+	if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), layerInfo, cache, false); err != nil {
+		t.Fatalf("Error saving randomly-generated layer to destination: %v", err)
+	}
+	if _, err := dest.PutBlob(context.Background(), bytes.NewBufferString(config), configInfo, cache, true); err != nil {
+		t.Fatalf("Error saving config to destination: %v", err)
+	}
+	manifest := fmt.Sprintf(`
+	        {
+		    "schemaVersion": 2,
+		    "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		    "config": {
+			"mediaType": "application/vnd.docker.container.image.v1+json",
+			"size": %d,
+			"digest": "%s"
+		    },
+		    "layers": [
+			{
+			    "mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+			    "digest": "%s",
+			    "size": %d
+			}
+		    ]
+		}
+	`, configInfo.Size, configInfo.Digest, digest, size)
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
+		t.Fatalf("Error storing manifest to destination: %v", err)
+	}
+	unparsedToplevel := unparsedImage{
+		imageReference: nil,
+		manifestBytes:  []byte(manifest),
+		manifestType:   imanifest.GuessMIMEType([]byte(manifest)),
+		signatures:     nil,
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := dest.Commit(ctx, &unparsedToplevel); errors.Cause(err) != context.Canceled {
+		t.Fatalf("Commit with a cancelled context returned %v", err)
+	}
+	layers, err = store.Layers()
+	require.NoError(t, err)
+	if len(layers) != 0 {
+		t.Fatalf("Layers were created: %v", layers)
+	}
+	images, err := store.Images()
+	require.NoError(t, err)
+	if len(images) != 0 {
+		t.Fatalf("Images were created: %v", images)
+	}
+
+	// Layers created by a Commit which is cancelled after the first layer are deleted.
+	dest, err = ref.NewImageDestination(context.Background(), systemContext())
+	if err != nil {
+		t.Fatalf("NewImageDestination(%q) returned error %v", ref.StringWithinTransport(), err)
+	}
+	defer dest.Close()
+	layerJSON := []string{}
+	for i := 0; i < 2; i++ {
+		digest, _, size, blob := makeLayer(t, archive.Gzip)
+		if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), types.BlobInfo{Digest: digest, Size: size}, cache, false); err != nil {
+			t.Fatalf("Error saving randomly-generated layer %d to destination: %v", i, err)
+		}
+		layerJSON = append(layerJSON, fmt.Sprintf(`{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","size":%d,"digest":"%s"}`, size, digest))
+	}
+	if _, err := dest.PutBlob(context.Background(), bytes.NewBufferString(config), configInfo, cache, true); err != nil {
+		t.Fatalf("Error saving config to destination: %v", err)
+	}
+	manifest = fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":%d,"digest":"%s"},"layers":[%s]}`,
+		configInfo.Size, configInfo.Digest, strings.Join(layerJSON, ","))
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
+		t.Fatalf("Error storing manifest to destination: %v", err)
+	}
+	unparsedToplevel = unparsedImage{
+		imageReference: nil,
+		manifestBytes:  []byte(manifest),
+		manifestType:   imanifest.GuessMIMEType([]byte(manifest)),
+		signatures:     nil,
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	progress := make(chan types.ProgressProperties)
+	done := make(chan struct{})
+	go func() {
+		for p := range progress {
+			if p.Event == types.ProgressEventApplyDone {
+				cancel()
+			}
+		}
+		close(done)
+	}()
+	err = dest.(internalTypes.ImageDestinationWithCommitOptions).CommitWithOptions(ctx, &unparsedToplevel, internalTypes.CommitOptions{
+		Progress:         progress,
+		ProgressInterval: time.Hour,
+	})
+	close(progress)
+	<-done
+	if err == nil {
+		t.Fatalf("CommitWithOptions cancelled after the first layer succeeded")
+	}
+	layers, err = store.Layers()
+	require.NoError(t, err)
+	if len(layers) != 0 {
+		t.Fatalf("Layers were left behind: %v", layers)
+	}
+	images, err = store.Images()
+	require.NoError(t, err)
+	if len(images) != 0 {
+		t.Fatalf("Images were created: %v", images)
+	}
+}
+
+// makeChunkedLayer returns a layer containing files, in the pkg/chunked format, and its DiffID.
+func makeChunkedLayer(t *testing.T, files map[string][]byte) ([]byte, ddigest.Digest) {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var uncompressed bytes.Buffer
+	tw := tar.NewWriter(&uncompressed)
+	for _, name := range names {
+		err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(files[name])), Mode: 0644, ModTime: time.Unix(0, 0)})
+		require.NoError(t, err)
+		_, err = tw.Write(files[name])
+		require.NoError(t, err)
+	}
+	err := tw.Close()
+	require.NoError(t, err)
+	var compressed bytes.Buffer
+	w, err := chunked.NewCompressor(&compressed, nil)
+	require.NoError(t, err)
+	_, err = w.Write(uncompressed.Bytes())
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+	return compressed.Bytes(), ddigest.FromBytes(uncompressed.Bytes())
+}
+
+// recordingChunkAccessor is a BlobChunkAccessor for blob, which counts the bytes requested.
+type recordingChunkAccessor struct {
+	blob      []byte
+	requested uint64
+}
+
+func (a *recordingChunkAccessor) GetBlobAt(ctx context.Context, info types.BlobInfo, chunks []internalTypes.ImageSourceChunk) (io.ReadCloser, error) {
+	data := []byte{}
+	for _, chunk := range chunks {
+		data = append(data, a.blob[chunk.Offset:chunk.Offset+chunk.Length]...)
+		a.requested += chunk.Length
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// incompleteChunkAccessor is a BlobChunkAccessor which returns the footer and the table of contents of the blob,
+// but for requests of the layer data (starting at offset 0), only the first half of the requested data,
+// and then fails as if the source turned out not to return all of the requested ranges.
+type incompleteChunkAccessor struct {
+	blob []byte
+}
+
+func (a *incompleteChunkAccessor) GetBlobAt(ctx context.Context, info types.BlobInfo, chunks []internalTypes.ImageSourceChunk) (io.ReadCloser, error) {
+	data := []byte{}
+	for _, chunk := range chunks {
+		data = append(data, a.blob[chunk.Offset:chunk.Offset+chunk.Length]...)
+	}
+	if len(chunks) == 0 || chunks[0].Offset != 0 {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return ioutil.NopCloser(io.MultiReader(bytes.NewReader(data[:len(data)/2]), failingReader{})), nil
+}
+
+// failingReader is an io.Reader which always fails with an error whose cause is internalTypes.ErrRangesNotSupported.
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.Wrap(internalTypes.ErrRangesNotSupported, "some ranges are missing")
+}
+
+// commitPartialImage creates an image named name in ref's store, containing the single layer blob, which was written using PutBlobPartial.
+func commitPartialImage(t *testing.T, name string, blob []byte, diffID ddigest.Digest) {
+	ref, err := Transport.ParseReference(name)
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), systemContext())
+	require.NoError(t, err)
+	defer dest.Close()
+	partialDest, ok := dest.(internalTypes.ImageDestinationPartial)
+	if !ok {
+		t.Fatalf("ImageDestination does not support PutBlobPartial")
+	}
+	blobInfo := types.BlobInfo{Digest: ddigest.FromBytes(blob), Size: int64(len(blob))}
+	if _, err := partialDest.PutBlobPartial(context.Background(), &recordingChunkAccessor{blob: blob}, blobInfo, internalTypes.PutBlobPartialOptions{
+		Cache:  memory.New(),
+		DiffID: diffID,
+	}); err != nil {
+		t.Fatalf("PutBlobPartial returned error %v", err)
+	}
+	config := fmt.Sprintf(`{"config":{},"rootfs":{"type":"layers","diff_ids":["%s"]}}`, diffID)
+	configInfo := types.BlobInfo{Digest: ddigest.FromString(config), Size: int64(len(config))}
+	if _, err := dest.PutBlob(context.Background(), bytes.NewBufferString(config), configInfo, memory.New(), true); err != nil {
+		t.Fatalf("Error saving config to destination: %v", err)
+	}
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","size":%d,"digest":"%s"},`+
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+zstd","size":%d,"digest":"%s"}]}`,
+		configInfo.Size, configInfo.Digest, blobInfo.Size, blobInfo.Digest)
+	if err := dest.PutManifest(context.Background(), []byte(manifest), nil); err != nil {
+		t.Fatalf("Error storing manifest to destination: %v", err)
+	}
+	unparsedToplevel := unparsedImage{
+		imageReference: nil,
+		manifestBytes:  []byte(manifest),
+		manifestType:   imanifest.GuessMIMEType([]byte(manifest)),
+		signatures:     nil,
+	}
+	if err := dest.Commit(context.Background(), &unparsedToplevel); err != nil {
+		t.Fatalf("Error committing changes to destination: %v", err)
+	}
+}
+
+func TestPutBlobPartial(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("TestPutBlobPartial requires root privileges")
+	}
+
+	store := newStore(t)
+	ref, err := Transport.ParseReference("test")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), systemContext())
+	require.NoError(t, err)
+	defer dest.Close()
+	partialDest := dest.(internalTypes.ImageDestinationPartial)
+
+	// Layers in other formats are rejected, so that the caller can fall back to a full download.
+	_, _, size, gzipBlob := makeLayer(t, archive.Gzip)
+	_, err = partialDest.PutBlobPartial(context.Background(), &recordingChunkAccessor{blob: gzipBlob}, types.BlobInfo{Digest: ddigest.FromBytes(gzipBlob), Size: size},
+		internalTypes.PutBlobPartialOptions{Cache: memory.New(), DiffID: ddigest.FromString("unknown")})
+	require.Equal(t, internalTypes.ErrFallbackToOrdinaryLayerDownload, errors.Cause(err))
+
+	shared := make([]byte, 100000)
+	_, err = rand.Read(shared)
+	require.NoError(t, err)
+	blob1, diffID1 := makeChunkedLayer(t, map[string][]byte{"shared": shared, "file1": []byte("file1")})
+	blob2, diffID2 := makeChunkedLayer(t, map[string][]byte{"shared": shared, "file2": []byte("file2")})
+
+	// If the source fails to return the chunks while they are being read, the caller can fall back to a full download.
+	_, err = partialDest.PutBlobPartial(context.Background(), &incompleteChunkAccessor{blob: blob1}, types.BlobInfo{Digest: ddigest.FromBytes(blob1), Size: int64(len(blob1))},
+		internalTypes.PutBlobPartialOptions{Cache: memory.New(), DiffID: diffID1})
+	require.Equal(t, internalTypes.ErrFallbackToOrdinaryLayerDownload, errors.Cause(err))
+
+	// A layer which does not match the expected DiffID is rejected.
+	_, err = partialDest.PutBlobPartial(context.Background(), &recordingChunkAccessor{blob: blob1}, types.BlobInfo{Digest: ddigest.FromBytes(blob1), Size: int64(len(blob1))},
+		internalTypes.PutBlobPartialOptions{Cache: memory.New(), DiffID: diffID2})
+	require.Error(t, err)
+	require.NotEqual(t, internalTypes.ErrFallbackToOrdinaryLayerDownload, errors.Cause(err))
+
+	commitPartialImage(t, "test1", blob1, diffID1)
+	layers, err := store.LayersByUncompressedDigest(diffID1)
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	names, err := store.ListLayerBigData(layers[0].ID)
+	require.NoError(t, err)
+	require.Contains(t, names, chunkedTOCBigDataKey)
+
+	// The second layer is reconstructed using the shared file from the first one.
+	accessor := &recordingChunkAccessor{blob: blob2}
+	blobInfo := types.BlobInfo{Digest: ddigest.FromBytes(blob2), Size: int64(len(blob2))}
+	if _, err := partialDest.PutBlobPartial(context.Background(), accessor, blobInfo, internalTypes.PutBlobPartialOptions{
+		Cache:  memory.New(),
+		DiffID: diffID2,
+	}); err != nil {
+		t.Fatalf("PutBlobPartial returned error %v", err)
+	}
+	if accessor.requested >= uint64(len(shared)) {
+		t.Fatalf("Fetched %d bytes of a %d-byte blob, although a %d-byte file was available locally", accessor.requested, len(blob2), len(shared))
+	}
+	filename := dest.(*storageImageDestination).filenames[blobInfo.Digest]
+	reconstructed, err := os.Open(filename)
+	require.NoError(t, err)
+	defer reconstructed.Close()
+	reconstructedDigest, err := ddigest.FromReader(reconstructed)
+	require.NoError(t, err)
+	require.Equal(t, diffID2, reconstructedDigest)
+	// The recorded file size is that of the reconstructed, uncompressed, file, but reusing the blob reports the blob's size.
+	fi, err := reconstructed.Stat()
+	require.NoError(t, err)
+	require.Equal(t, fi.Size(), dest.(*storageImageDestination).fileSizes[blobInfo.Digest])
+	reused, reusedInfo, err := dest.TryReusingBlob(context.Background(), blobInfo, memory.New(), false)
+	require.NoError(t, err)
+	require.True(t, reused)
+	require.Equal(t, blobInfo.Size, reusedInfo.Size)
+}
+
+func TestChunkedTOCVerifier(t *testing.T) {
+	blob1, _ := makeChunkedLayer(t, map[string][]byte{"file": []byte("contents 1")})
+	blob2, _ := makeChunkedLayer(t, map[string][]byte{"file": []byte("contents 2")})
+	toc1 := readChunkedTOCFromFile(bytes.NewReader(blob1), int64(len(blob1)))
+	require.NotNil(t, toc1)
+	toc2 := readChunkedTOCFromFile(bytes.NewReader(blob2), int64(len(blob2)))
+	require.NotNil(t, toc2)
+
+	for _, c := range []struct {
+		toc     []byte
+		success bool
+	}{
+		{toc1, true},
+		{toc2, false},
+	} {
+		reader, verifier := newChunkedTOCVerifier(bytes.NewReader(blob1), c.toc)
+		data, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, blob1, data)
+		err = verifier.finish()
+		if c.success {
+			require.NoError(t, err)
+		} else {
+			require.Error(t, err)
+		}
+	}
+
+	// Data which is not read completely can't be verified.
+	reader, verifier := newChunkedTOCVerifier(bytes.NewReader(blob1), toc1)
+	_, err := reader.Read(make([]byte, 10))
+	require.NoError(t, err)
+	err = verifier.finish()
+	require.Error(t, err)
+}
+
+// manifestListInstance is an instance of a manifest list written by putManifestList.
+type manifestListInstance struct {
+	manifest   []byte
+	digest     ddigest.Digest
+	diffID     ddigest.Digest
+	config     types.BlobInfo
+	signatures [][]byte
+}
+
+// putManifestList writes a manifest list with an instance, containing a single layer, for each of archs, to dest,
+// and returns the list and its instances.
+func putManifestList(t *testing.T, dest types.ImageDestination, archs []string) ([]byte, []manifestListInstance) {
+	instances := []manifestListInstance{}
+	listEntries := []string{}
+	for _, arch := range archs {
+		diffID, _, size, blob := makeLayer(t, archive.Uncompressed)
+		layerInfo := types.BlobInfo{Digest: diffID, Size: size}
+		if _, err := dest.PutBlob(context.Background(), bytes.NewBuffer(blob), layerInfo, memory.New(), false); err != nil {
+			t.Fatalf("Error saving layer to destination: %v", err)
+		}
+		config := fmt.Sprintf(`{"architecture":"%s","os":"linux","config":{},"rootfs":{"type":"layers","diff_ids":["%s"]}}`, arch, diffID)
+		configInfo := types.BlobInfo{Digest: ddigest.FromString(config), Size: int64(len(config))}
+		if _, err := dest.PutBlob(context.Background(), bytes.NewBufferString(config), configInfo, memory.New(), true); err != nil {
+			t.Fatalf("Error saving config to destination: %v", err)
+		}
+		manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+			`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","size":%d,"digest":"%s"},`+
+			`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar","size":%d,"digest":"%s"}]}`,
+			configInfo.Size, configInfo.Digest, size, diffID)
+		manifestDigest := ddigest.FromString(manifest)
+		if err := dest.PutManifest(context.Background(), []byte(manifest), &manifestDigest); err != nil {
+			t.Fatalf("Error storing manifest to destination: %v", err)
+		}
+		signatures := [][]byte{[]byte("signature of " + arch)}
+		if err := dest.PutSignatures(context.Background(), signatures, &manifestDigest); err != nil {
+			t.Fatalf("Error storing signatures to destination: %v", err)
+		}
+		instances = append(instances, manifestListInstance{
+			manifest:   []byte(manifest),
+			digest:     manifestDigest,
+			diffID:     diffID,
+			config:     configInfo,
+			signatures: signatures,
+		})
+		listEntries = append(listEntries, fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","size":%d,"digest":"%s","platform":{"architecture":"%s","os":"linux"}}`,
+			len(manifest), manifestDigest, arch))
+	}
+	list := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` + strings.Join(listEntries, ",") + `]}`)
+	if err := dest.PutManifest(context.Background(), list, nil); err != nil {
+		t.Fatalf("Error storing manifest list to destination: %v", err)
+	}
+	return list, instances
+}
+
+func TestManifestList(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("TestManifestList requires root privileges")
+	}
+
+	store := newStore(t)
+	sys := &types.SystemContext{OSChoice: "linux", ArchitectureChoice: "arm64"}
+	ref, err := Transport.ParseReference("test")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), sys)
+	require.NoError(t, err)
+	defer dest.Close()
+
+	list, instances := putManifestList(t, dest, []string{"amd64", "arm64"})
+	unparsedToplevel := unparsedImage{
+		imageReference: nil,
+		manifestBytes:  list,
+		manifestType:   imanifest.GuessMIMEType(list),
+		signatures:     nil,
+	}
+	if err := dest.Commit(context.Background(), &unparsedToplevel); err != nil {
+		t.Fatalf("Error committing changes to destination: %v", err)
+	}
+	dest.Close()
+
+	// The named image is the instance matching sys.
+	img, err := store.Image(ref.(*storageReference).named.String())
+	require.NoError(t, err)
+	require.Equal(t, instances[1].config.Digest.Encoded(), img.ID)
+
+	src, err := ref.NewImageSource(context.Background(), sys)
+	require.NoError(t, err)
+	defer src.Close()
+	manifest, _, err := src.GetManifest(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, list, manifest)
+	for _, instance := range instances {
+		manifest, _, err := src.GetManifest(context.Background(), &instance.digest)
+		require.NoError(t, err)
+		require.Equal(t, instance.manifest, manifest)
+		layerInfos, err := src.LayerInfosForCopy(context.Background(), &instance.digest)
+		require.NoError(t, err)
+		require.Len(t, layerInfos, 1)
+		require.Equal(t, instance.diffID, layerInfos[0].Digest)
+		rc, _, err := src.GetBlob(context.Background(), instance.config, memory.New())
+		require.NoError(t, err)
+		config, err := ioutil.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		require.Equal(t, instance.config.Digest, ddigest.FromBytes(config))
+		signatures, err := src.GetSignatures(context.Background(), &instance.digest)
+		require.NoError(t, err)
+		require.Equal(t, instance.signatures, signatures)
+	}
+
+	// The image holding the layers of the other instance is named after it, so that it isn't treated as dangling.
+	instanceImage, err := store.Image("docker.io/library/test@" + instances[0].digest.String())
+	require.NoError(t, err)
+	require.Equal(t, instances[0].config.Digest.Encoded(), instanceImage.ID)
+
+	// If that image is removed, its layers are still found, for as long as they exist.
+	_, err = store.CreateImage("", nil, instanceImage.TopLayer, "", &storage.ImageOptions{})
+	require.NoError(t, err)
+	_, err = store.DeleteImage(instanceImage.ID, true)
+	require.NoError(t, err)
+	layerInfos, err := src.LayerInfosForCopy(context.Background(), &instances[0].digest)
+	require.NoError(t, err)
+	require.Len(t, layerInfos, 1)
+	require.Equal(t, instances[0].diffID, layerInfos[0].Digest)
+	images, err := store.Images()
+	require.NoError(t, err)
+	for _, image := range images {
+		if image.TopLayer == instanceImage.TopLayer {
+			_, err = store.DeleteImage(image.ID, true)
+			require.NoError(t, err)
+		}
+	}
+	_, err = src.LayerInfosForCopy(context.Background(), &instances[0].digest)
+	require.Equal(t, ErrNoSuchImage, errors.Cause(err))
+}
+
 type unparsedImage struct {
 	imageReference types.ImageReference
 	manifestBytes  []byte
@@ -1149,3 +1974,63 @@ func (u *unparsedImage) Manifest(context.Context) ([]byte, string, error) {
 func (u *unparsedImage) Signatures(context.Context) ([][]byte, error) {
 	return u.signatures, nil
 }
+
+func TestCancellationWithManifestList(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("TestCancellationWithManifestList requires root privileges")
+	}
+
+	store := newStore(t)
+	sys := &types.SystemContext{OSChoice: "linux", ArchitectureChoice: "arm64"}
+	ref, err := Transport.ParseReference("test")
+	require.NoError(t, err)
+	dest, err := ref.NewImageDestination(context.Background(), sys)
+	require.NoError(t, err)
+	defer dest.Close()
+	list, _ := putManifestList(t, dest, []string{"amd64", "arm64", "s390x", "ppc64le"})
+	unparsedToplevel := unparsedImage{
+		imageReference: nil,
+		manifestBytes:  list,
+		manifestType:   imanifest.GuessMIMEType(list),
+		signatures:     nil,
+	}
+
+	// The default instance is committed first, then the others, in order; cancel after the layer of the second
+	// other instance has been applied, when the image of the first one has been created.  The progress channel is
+	// not buffered, so the next layer can't start being applied before cancel() has returned.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	progress := make(chan types.ProgressProperties)
+	done := make(chan struct{})
+	go func() {
+		layersDone := 0
+		for p := range progress {
+			if p.Event == types.ProgressEventApplyDone {
+				layersDone++
+				if layersDone == 3 {
+					cancel()
+				}
+			}
+		}
+		close(done)
+	}()
+	err = dest.(internalTypes.ImageDestinationWithCommitOptions).CommitWithOptions(ctx, &unparsedToplevel, internalTypes.CommitOptions{
+		Progress:         progress,
+		ProgressInterval: time.Hour,
+	})
+	close(progress)
+	<-done
+	if err == nil {
+		t.Fatalf("CommitWithOptions cancelled while committing instances succeeded")
+	}
+	images, err := store.Images()
+	require.NoError(t, err)
+	if len(images) != 0 {
+		t.Fatalf("Images were left behind: %v", images)
+	}
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	if len(layers) != 0 {
+		t.Fatalf("Layers were left behind: %v", layers)
+	}
+}
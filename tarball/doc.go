@@ -1,6 +1,15 @@
 // Package tarball provides a way to generate images using one or more layer
 // tarballs and an optional template configuration.
 //
+// Conversely, when a reference consisting of a single directory is used as a
+// destination, the image's layers are written into that directory as individual
+// tarballs (decompressed if types.SystemContext.TarballDecompressLayers is set),
+// along with its configuration.
+//
+// For more control over the generated image, such as per-layer history entries
+// and media types, a fixed creation time, or a Docker schema2 manifest instead of
+// an OCI one, construct references using a tarball.Builder.
+//
 // An example:
 //	package main
 //
@@ -0,0 +1,164 @@
+package tarball
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BuilderLayer describes a layer of an image constructed by a Builder.
+type BuilderLayer struct {
+	// Path is the path of the layer tarball, which may be compressed using gzip.
+	Path string
+	// MediaType is the media type of the layer in the manifest; if empty, it is chosen depending on
+	// the compression of the tarball and the manifest type.
+	MediaType string
+	// Annotations are added to the layer's descriptor in the manifest; this is only supported in OCI manifests.
+	Annotations map[string]string
+	// History is the layer's history entry in the config; if nil, a default one is generated.
+	// If its Created field is not set, it is filled in the same way as for a default entry.
+	// If it is marked as an EmptyLayer (e.g. for an ENV or LABEL instruction), the BuilderLayer only adds
+	// this entry to the history, and Path, MediaType and Annotations must not be set; in that case an unset
+	// Created field is only filled in if Builder.Created is set.
+	History *imgspecv1.History
+}
+
+// Builder constructs "tarball:" references with more control over the generated image than ConfigUpdater.
+// The zero value is usable, and creates an image with an OCI manifest and no layers.
+type Builder struct {
+	// Layers are the layers of the image, in order.
+	Layers []BuilderLayer
+	// Config is the template configuration of the image, as for ConfigUpdater.ConfigUpdate;
+	// its RootFS and History are replaced by values generated from Layers.
+	Config imgspecv1.Image
+	// Annotations are added to the manifest; this is only supported in OCI manifests.
+	Annotations map[string]string
+	// Created, if set, is used as the creation time of the image and of the layers, instead of the
+	// modification times of the layer tarballs, so that the image can be built reproducibly.
+	Created *time.Time
+	// ManifestMIMEType is the type of the generated manifest, either imgspecv1.MediaTypeImageManifest or
+	// manifest.DockerV2Schema2MediaType; if empty, an OCI manifest is generated.
+	ManifestMIMEType string
+}
+
+// Reference returns a "tarball:" reference for the image described by b.
+// Later changes to b do not affect the returned reference.
+func (b *Builder) Reference() (types.ImageReference, error) {
+	switch b.ManifestMIMEType {
+	case "", imgspecv1.MediaTypeImageManifest:
+	case manifest.DockerV2Schema2MediaType:
+		if len(b.Annotations) != 0 {
+			return nil, fmt.Errorf("annotations are not supported in %s manifests", b.ManifestMIMEType)
+		}
+		for _, layer := range b.Layers {
+			if len(layer.Annotations) != 0 {
+				return nil, fmt.Errorf("layer annotations are not supported in %s manifests", b.ManifestMIMEType)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported manifest type %q", b.ManifestMIMEType)
+	}
+
+	filenames := []string{}
+	layers := []BuilderLayer{}
+	for i, layer := range b.Layers {
+		if layer.History != nil && layer.History.EmptyLayer {
+			if layer.Path != "" || layer.MediaType != "" || len(layer.Annotations) != 0 {
+				return nil, fmt.Errorf("layer %d has an empty-layer history entry, but also a path, media type or annotations", i)
+			}
+		} else {
+			if layer.Path == "-" {
+				return nil, fmt.Errorf(`reading layers from standard input is not supported by tarball.Builder`)
+			}
+			filenames = append(filenames, layer.Path)
+		}
+		annotations := map[string]string{}
+		for k, v := range layer.Annotations {
+			annotations[k] = v
+		}
+		layer.Annotations = annotations
+		if layer.History != nil {
+			history := copyHistory(*layer.History)
+			layer.History = &history
+		}
+		layers = append(layers, layer)
+	}
+	ref, err := NewReference(filenames, nil)
+	if err != nil {
+		return nil, err
+	}
+	r := ref.(*tarballReference)
+	if err := r.ConfigUpdate(copyImageConfig(b.Config), b.Annotations); err != nil {
+		return nil, err
+	}
+	r.layers = layers
+	r.created = copyTime(b.Created)
+	r.manifestMIMEType = b.ManifestMIMEType
+	return r, nil
+}
+
+// copyImageConfig returns a copy of config which does not share any maps, slices or pointers with it.
+func copyImageConfig(config imgspecv1.Image) imgspecv1.Image {
+	res := config
+	res.Created = copyTime(config.Created)
+	res.Config.ExposedPorts = copyStringSet(config.Config.ExposedPorts)
+	res.Config.Env = copyStringSlice(config.Config.Env)
+	res.Config.Entrypoint = copyStringSlice(config.Config.Entrypoint)
+	res.Config.Cmd = copyStringSlice(config.Config.Cmd)
+	res.Config.Volumes = copyStringSet(config.Config.Volumes)
+	if config.Config.Labels != nil {
+		res.Config.Labels = make(map[string]string, len(config.Config.Labels))
+		for k, v := range config.Config.Labels {
+			res.Config.Labels[k] = v
+		}
+	}
+	if config.RootFS.DiffIDs != nil {
+		res.RootFS.DiffIDs = append([]digest.Digest{}, config.RootFS.DiffIDs...)
+	}
+	if config.History != nil {
+		res.History = make([]imgspecv1.History, 0, len(config.History))
+		for _, h := range config.History {
+			res.History = append(res.History, copyHistory(h))
+		}
+	}
+	return res
+}
+
+// copyHistory returns a copy of h which does not share its Created value with it.
+func copyHistory(h imgspecv1.History) imgspecv1.History {
+	h.Created = copyTime(h.Created)
+	return h
+}
+
+// copyTime returns a pointer to a copy of *t, or nil if t is nil.
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	res := *t
+	return &res
+}
+
+// copyStringSlice returns a copy of s, preserving the difference between nil and empty slices.
+func copyStringSlice(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// copyStringSet returns a copy of set, preserving the difference between nil and empty maps.
+func copyStringSet(set map[string]struct{}) map[string]struct{} {
+	if set == nil {
+		return nil
+	}
+	res := make(map[string]struct{}, len(set))
+	for k := range set {
+		res[k] = struct{}{}
+	}
+	return res
+}
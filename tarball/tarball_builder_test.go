@@ -0,0 +1,159 @@
+package tarball
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilderReference(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tarball-builder")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	uncompressed, compressed := makeTestLayer(t)
+	compressedPath := filepath.Join(tmpDir, "layer.tar.gz")
+	err = ioutil.WriteFile(compressedPath, compressed, 0644)
+	require.NoError(t, err)
+	uncompressedPath := filepath.Join(tmpDir, "layer.tar")
+	err = ioutil.WriteFile(uncompressedPath, uncompressed, 0644)
+	require.NoError(t, err)
+
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	history := imgspecv1.History{CreatedBy: "custom", Comment: "custom comment"}
+	b := Builder{
+		Layers: []BuilderLayer{
+			{Path: compressedPath, History: &history, Annotations: map[string]string{"layer": "annotation"}},
+			{History: &imgspecv1.History{CreatedBy: "ENV a=b", EmptyLayer: true}},
+			{Path: uncompressedPath, MediaType: "application/x-custom"},
+		},
+		Config: imgspecv1.Image{Architecture: "arm64", OS: "linux", Config: imgspecv1.ImageConfig{
+			Env:    []string{"a=b"},
+			Labels: map[string]string{"label": "value"},
+		}},
+		Annotations: map[string]string{"image": "annotation"},
+		Created:     &created,
+	}
+	getRefImage := func(ref types.ImageReference) ([]byte, string, imgspecv1.Image) {
+		src, err := ref.NewImageSource(context.Background(), nil)
+		require.NoError(t, err)
+		defer src.Close()
+		manifestBlob, mimeType, err := src.GetManifest(context.Background(), nil)
+		require.NoError(t, err)
+		m, err := manifest.FromBlob(manifestBlob, mimeType)
+		require.NoError(t, err)
+		configBlob, _, err := src.GetBlob(context.Background(), m.ConfigInfo(), nil)
+		require.NoError(t, err)
+		defer configBlob.Close()
+		var config imgspecv1.Image
+		err = json.NewDecoder(configBlob).Decode(&config)
+		require.NoError(t, err)
+		return manifestBlob, mimeType, config
+	}
+	getImage := func(b Builder) ([]byte, string, imgspecv1.Image) {
+		ref, err := b.Reference()
+		require.NoError(t, err)
+		return getRefImage(ref)
+	}
+
+	// OCI
+	manifestBlob, mimeType, config := getImage(b)
+	assert.Equal(t, imgspecv1.MediaTypeImageManifest, mimeType)
+	var ociManifest imgspecv1.Manifest
+	err = json.Unmarshal(manifestBlob, &ociManifest)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"image": "annotation"}, ociManifest.Annotations)
+	require.Len(t, ociManifest.Layers, 2)
+	assert.Equal(t, imgspecv1.MediaTypeImageLayerGzip, ociManifest.Layers[0].MediaType)
+	assert.Equal(t, map[string]string{"layer": "annotation"}, ociManifest.Layers[0].Annotations)
+	assert.Equal(t, "application/x-custom", ociManifest.Layers[1].MediaType)
+	assert.Nil(t, ociManifest.Layers[1].Annotations)
+	assert.Equal(t, "arm64", config.Architecture)
+	require.NotNil(t, config.Created)
+	assert.True(t, created.Equal(*config.Created))
+	assert.Equal(t, []string{"a=b"}, config.Config.Env)
+	require.Len(t, config.RootFS.DiffIDs, 2)
+	require.Len(t, config.History, 3)
+	assert.Equal(t, "custom", config.History[0].CreatedBy)
+	assert.Equal(t, "custom comment", config.History[0].Comment)
+	assert.False(t, config.History[0].EmptyLayer)
+	require.NotNil(t, config.History[0].Created)
+	assert.True(t, created.Equal(*config.History[0].Created))
+	assert.Equal(t, "ENV a=b", config.History[1].CreatedBy)
+	assert.True(t, config.History[1].EmptyLayer)
+	require.NotNil(t, config.History[1].Created)
+	assert.True(t, created.Equal(*config.History[1].Created))
+	assert.False(t, config.History[2].EmptyLayer)
+	require.NotNil(t, config.History[2].Created)
+	assert.True(t, created.Equal(*config.History[2].Created))
+	assert.Nil(t, history.Created) // The caller's value is not modified.
+
+	// The image does not depend on the modification times of the files.
+	later := created.Add(time.Hour)
+	err = os.Chtimes(compressedPath, later, later)
+	require.NoError(t, err)
+	manifestBlob2, _, _ := getImage(b)
+	assert.Equal(t, manifestBlob, manifestBlob2)
+
+	// The reference does not depend on later changes to the builder, including values it points to.
+	historyCreated := created.Add(-time.Hour)
+	history.Created = &historyCreated
+	ref, err := b.Reference()
+	require.NoError(t, err)
+	historyCreated = created.Add(-2 * time.Hour)
+	b.Layers[0].History.Comment = "modified"
+	b.Layers[0].Annotations["layer"] = "modified"
+	b.Config.Config.Env[0] = "a=modified"
+	b.Config.Config.Labels["label"] = "modified"
+	manifestBlob, _, config = getRefImage(ref)
+	var ociManifest2 imgspecv1.Manifest
+	err = json.Unmarshal(manifestBlob, &ociManifest2)
+	require.NoError(t, err)
+	require.Len(t, ociManifest2.Layers, 2)
+	assert.Equal(t, map[string]string{"layer": "annotation"}, ociManifest2.Layers[0].Annotations)
+	require.Len(t, config.History, 3)
+	assert.Equal(t, "custom comment", config.History[0].Comment)
+	require.NotNil(t, config.History[0].Created)
+	assert.True(t, created.Add(-time.Hour).Equal(*config.History[0].Created))
+	assert.Equal(t, []string{"a=b"}, config.Config.Env)
+	assert.Equal(t, map[string]string{"label": "value"}, config.Config.Labels)
+	b.Layers[0].History.Comment = "custom comment"
+	b.Layers[0].History.Created = nil
+
+	// schema2
+	b.Annotations = nil
+	b.Layers[0].Annotations = nil
+	b.Layers[2].MediaType = ""
+	b.ManifestMIMEType = manifest.DockerV2Schema2MediaType
+	manifestBlob, mimeType, _ = getImage(b)
+	assert.Equal(t, manifest.DockerV2Schema2MediaType, mimeType)
+	s2, err := manifest.Schema2FromManifest(manifestBlob)
+	require.NoError(t, err)
+	assert.Equal(t, manifest.DockerV2Schema2ConfigMediaType, s2.ConfigDescriptor.MediaType)
+	require.Len(t, s2.LayersDescriptors, 2)
+	assert.Equal(t, manifest.DockerV2Schema2LayerMediaType, s2.LayersDescriptors[0].MediaType)
+	assert.Equal(t, manifest.DockerV2SchemaLayerMediaTypeUncompressed, s2.LayersDescriptors[1].MediaType)
+
+	// Invalid options
+	for _, c := range []Builder{
+		{ManifestMIMEType: "application/x-unknown"},
+		{ManifestMIMEType: manifest.DockerV2Schema2MediaType, Annotations: map[string]string{"a": "b"}},
+		{ManifestMIMEType: manifest.DockerV2Schema2MediaType, Layers: []BuilderLayer{{Path: compressedPath, Annotations: map[string]string{"a": "b"}}}},
+		{Layers: []BuilderLayer{{Path: "-"}}},
+		{Layers: []BuilderLayer{{Path: compressedPath, History: &imgspecv1.History{EmptyLayer: true}}}},
+		{Layers: []BuilderLayer{{MediaType: "application/x-custom", History: &imgspecv1.History{EmptyLayer: true}}}},
+	} {
+		_, err := c.Reference()
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,283 @@
+package tarball
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/containers/image/v5/internal/iolimits"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// configFileName is the name of the file holding the image's config in a "tarball:" destination directory.
+const configFileName = "config.json"
+
+// compressedLayerSuffixes are the suffixes of layer files in a "tarball:" destination directory,
+// indexed by the name of the compression algorithm of the layer.
+var compressedLayerSuffixes = map[string]string{
+	compression.Gzip.Name():  ".gz",
+	compression.Bzip2.Name(): ".bz2",
+	compression.Xz.Name():    ".xz",
+	compression.Zstd.Name():  ".zst",
+}
+
+// storedBlob is a blob written to a tarballImageDestination.
+type storedBlob struct {
+	path   string // Temporary file holding the blob, until it is moved to its final path by Commit
+	size   int64
+	suffix string // Suffix for the layer file name, depending on the compression of the blob
+}
+
+type tarballImageDestination struct {
+	reference  tarballReference
+	dir        string
+	decompress bool
+	blobs      map[digest.Digest]storedBlob
+	config     []byte // Set by PutBlob, if it has been called with isConfig
+	manifest   []byte // Set by PutManifest
+}
+
+// NewImageDestination returns a types.ImageDestination for this reference, which must consist of a single path:
+// a directory which is created if it does not exist, and which must be empty otherwise.
+// When the image is committed, its layers are written to the directory as individual layer-N.tar files (with a suffix
+// like .gz if the layer is compressed; see types.SystemContext.TarballDecompressLayers), and its config as config.json.
+// The caller must call .Close() on the returned ImageDestination.
+func (r *tarballReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	if len(r.filenames) != 1 || r.filenames[0] == "-" {
+		return nil, fmt.Errorf(`"tarball:" destinations must be a single directory, not %q`, r.StringWithinTransport())
+	}
+	dir := r.filenames[0]
+	entries, err := ioutil.ReadDir(dir)
+	switch {
+	case err == nil:
+		if len(entries) != 0 {
+			return nil, fmt.Errorf("destination directory %q is not empty", dir)
+		}
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating directory %q: %v", dir, err)
+		}
+	default:
+		return nil, fmt.Errorf("error reading directory %q: %v", dir, err)
+	}
+	return &tarballImageDestination{
+		reference:  *r,
+		dir:        dir,
+		decompress: sys != nil && sys.TarballDecompressLayers,
+		blobs:      map[digest.Digest]storedBlob{},
+	}, nil
+}
+
+// Reference returns the reference used to set up this destination.
+func (d *tarballImageDestination) Reference() types.ImageReference {
+	return &d.reference
+}
+
+// Close removes resources associated with an initialized ImageDestination, if any.
+func (d *tarballImageDestination) Close() error {
+	for _, blob := range d.blobs {
+		if err := os.Remove(blob.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing %q: %v", blob.path, err)
+		}
+	}
+	d.blobs = map[digest.Digest]storedBlob{}
+	return nil
+}
+
+// SupportedManifestMIMETypes tells which manifest mime types the destination supports
+// If an empty slice or nil it's returned, then any mime type can be tried to upload
+func (d *tarballImageDestination) SupportedManifestMIMETypes() []string {
+	return nil
+}
+
+// SupportsSignatures returns an error (to be displayed to the user) if the destination certainly can't store signatures.
+// Note: It is still possible for PutSignatures to fail if SupportsSignatures returns nil.
+func (d *tarballImageDestination) SupportsSignatures(ctx context.Context) error {
+	return fmt.Errorf("signatures are not supported by the %q transport", transportName)
+}
+
+// DesiredLayerCompression indicates if layers must be compressed, decompressed or preserved
+func (d *tarballImageDestination) DesiredLayerCompression() types.LayerCompression {
+	if d.decompress {
+		return types.Decompress
+	}
+	return types.PreserveOriginal
+}
+
+// AcceptsForeignLayerURLs returns false iff foreign layers in manifest should be actually
+// uploaded to the image destination, true otherwise.
+func (d *tarballImageDestination) AcceptsForeignLayerURLs() bool {
+	return false
+}
+
+// MustMatchRuntimeOS returns true iff the destination can store only images targeted for the current runtime architecture and OS. False otherwise.
+func (d *tarballImageDestination) MustMatchRuntimeOS() bool {
+	return false
+}
+
+// IgnoresEmbeddedDockerReference returns true iff the destination does not care about Image.EmbeddedDockerReferenceConflicts(),
+// and would prefer to receive an unmodified manifest instead of one modified for the destination.
+// Does not make a difference if Reference().DockerReference() is nil.
+func (d *tarballImageDestination) IgnoresEmbeddedDockerReference() bool {
+	return false // N/A, DockerReference() returns nil.
+}
+
+// HasThreadSafePutBlob indicates whether PutBlob can be executed concurrently.
+func (d *tarballImageDestination) HasThreadSafePutBlob() bool {
+	return false
+}
+
+// PutBlob writes contents of stream and returns data representing the result (with all data filled in).
+// inputInfo.Digest can be optionally provided if known; it is not mandatory for the implementation to verify it.
+// inputInfo.Size is the expected length of stream, if known.
+// May update cache.
+// WARNING: The contents of stream are being verified on the fly.  Until stream.Read() returns io.EOF, the contents of the data SHOULD NOT be available
+// to any other readers for download using the supplied digest.
+// If stream.Read() at any time, ESPECIALLY at end of input, returns an error, PutBlob MUST 1) fail, and 2) delete any data stored so far.
+func (d *tarballImageDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	digester := digest.Canonical.Digester()
+	stream = io.TeeReader(stream, digester.Hash())
+
+	if isConfig {
+		config, err := iolimits.ReadAtMost(stream, iolimits.MaxConfigBodySize)
+		if err != nil {
+			return types.BlobInfo{}, fmt.Errorf("error reading config: %v", err)
+		}
+		d.config = config
+		return types.BlobInfo{Digest: digester.Digest(), Size: int64(len(config))}, nil
+	}
+
+	algorithm, decompressor, stream, err := compression.DetectCompressionFormat(stream)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	suffix := ""
+	if decompressor != nil {
+		suffix = compressedLayerSuffixes[algorithm.Name()]
+	}
+	blobFile, err := ioutil.TempFile(d.dir, ".tarball-put-blob")
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	succeeded := false
+	defer func() {
+		blobFile.Close()
+		if !succeeded {
+			os.Remove(blobFile.Name())
+		}
+	}()
+	size, err := io.Copy(blobFile, stream)
+	if err != nil {
+		return types.BlobInfo{}, fmt.Errorf("error writing %q: %v", blobFile.Name(), err)
+	}
+	computedDigest := digester.Digest()
+	if inputInfo.Size != -1 && size != inputInfo.Size {
+		return types.BlobInfo{}, fmt.Errorf("size mismatch when copying %s, expected %d, got %d", computedDigest, inputInfo.Size, size)
+	}
+	// blobFile was created with mode 0600 on POSIX systems; make the resulting layer files readable,
+	// like those written by other tools. (This is not necessary, and fails, on Windows.)
+	if runtime.GOOS != "windows" {
+		if err := blobFile.Chmod(0644); err != nil {
+			return types.BlobInfo{}, err
+		}
+	}
+	if old, ok := d.blobs[computedDigest]; ok {
+		os.Remove(old.path)
+	}
+	d.blobs[computedDigest] = storedBlob{path: blobFile.Name(), size: size, suffix: suffix}
+	succeeded = true
+	return types.BlobInfo{Digest: computedDigest, Size: size}, nil
+}
+
+// TryReusingBlob checks whether the transport already contains, or can efficiently reuse, a blob, and if so, applies it to the current destination
+// (e.g. if the blob is a filesystem layer, this signifies that the changes it describes need to be applied again when composing a filesystem tree).
+// info.Digest must not be empty.
+// If canSubstitute, TryReusingBlob can use an equivalent equivalent of the desired blob; in that case the returned info may not match the input.
+// If the blob has been successfully reused, returns (true, info, nil); info must contain at least a digest and size, and may
+// include CompressionOperation and CompressionAlgorithm fields to indicate that a change to the compression type should be
+// reflected in the manifest that will be written.
+// If the transport can not reuse the requested blob, TryReusingBlob returns (false, {}, nil); it returns a non-nil error only on an unexpected failure.
+// May use and/or update cache.
+func (d *tarballImageDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	if blob, ok := d.blobs[info.Digest]; ok {
+		return true, types.BlobInfo{Digest: info.Digest, Size: blob.size}, nil
+	}
+	return false, types.BlobInfo{}, nil
+}
+
+// PutManifest writes manifest to the destination.
+// If instanceDigest is not nil, it contains a digest of the specific manifest instance to write the manifest for
+// (when the primary manifest is a manifest list); this should always be nil if the primary manifest is not a manifest list.
+// The manifest is not stored; it only determines the order of the layers written by Commit.
+// If the destination is in principle available, refuses this manifest type (e.g. it does not recognize the schema),
+// but may accept a different manifest type, the returned error must be an ManifestTypeRejectedError.
+func (d *tarballImageDestination) PutManifest(ctx context.Context, m []byte, instanceDigest *digest.Digest) error {
+	if instanceDigest != nil {
+		return fmt.Errorf("manifest lists are not supported by the %q transport", transportName)
+	}
+	if manifest.MIMETypeIsMultiImage(manifest.GuessMIMEType(m)) {
+		return fmt.Errorf("manifest lists are not supported by the %q transport", transportName)
+	}
+	d.manifest = m
+	return nil
+}
+
+// PutSignatures writes a set of signatures to the destination.
+// If instanceDigest is not nil, it contains a digest of the specific manifest instance to write or overwrite the signatures for
+// (when the primary manifest is a manifest list); this should always be nil if the primary manifest is not a manifest list.
+// MUST be called after PutManifest (signatures may reference manifest contents).
+func (d *tarballImageDestination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
+	if len(signatures) != 0 {
+		return fmt.Errorf("signatures are not supported by the %q transport", transportName)
+	}
+	return nil
+}
+
+// Commit marks the process of storing the image as successful and asks for the image to be persisted.
+// It writes the layers, in the order listed in the manifest, and the config, to the destination directory.
+// WARNING: This does not have any transactional semantics:
+// - Uploaded data MAY be visible to others before Commit() is called
+// - Uploaded data MAY be removed or MAY remain around if Close() is called without Commit() (i.e. rollback is allowed but not guaranteed)
+func (d *tarballImageDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	if d.manifest == nil {
+		return fmt.Errorf("internal error: Commit() called without PutManifest()")
+	}
+	man, err := manifest.FromBlob(d.manifest, manifest.GuessMIMEType(d.manifest))
+	if err != nil {
+		return fmt.Errorf("error parsing manifest: %v", err)
+	}
+	written := map[digest.Digest]string{} // Paths of layers already written, if the image contains a layer more than once
+	for i, layer := range man.LayerInfos() {
+		blob, ok := d.blobs[layer.Digest]
+		if !ok {
+			return fmt.Errorf("layer %s has not been written", layer.Digest)
+		}
+		layerPath := filepath.Join(d.dir, fmt.Sprintf("layer-%d.tar%s", i, blob.suffix))
+		if previousPath, ok := written[layer.Digest]; ok {
+			err = os.Link(previousPath, layerPath)
+		} else {
+			err = os.Rename(blob.path, layerPath)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing %q: %v", layerPath, err)
+		}
+		written[layer.Digest] = layerPath
+	}
+	for layerDigest := range written {
+		delete(d.blobs, layerDigest)
+	}
+	if d.config != nil {
+		configPath := filepath.Join(d.dir, configFileName)
+		if err := ioutil.WriteFile(configPath, d.config, 0644); err != nil {
+			return fmt.Errorf("error writing %q: %v", configPath, err)
+		}
+	}
+	return d.Close() // Remove the temporary files of any blobs which are not layers of the image.
+}
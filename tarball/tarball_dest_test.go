@@ -0,0 +1,124 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeTestLayer returns an uncompressed tar stream containing a single file, and its gzip-compressed version.
+func makeTestLayer(t *testing.T) ([]byte, []byte) {
+	var uncompressed bytes.Buffer
+	tw := tar.NewWriter(&uncompressed)
+	contents := []byte("file contents")
+	err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "file", Size: int64(len(contents)), Mode: 0644})
+	require.NoError(t, err)
+	_, err = tw.Write(contents)
+	require.NoError(t, err)
+	err = tw.Close()
+	require.NoError(t, err)
+
+	var compressed bytes.Buffer
+	w, err := compression.CompressStream(&compressed, compression.Gzip, nil)
+	require.NoError(t, err)
+	_, err = w.Write(uncompressed.Bytes())
+	require.NoError(t, err)
+	err = w.Close()
+	require.NoError(t, err)
+	return uncompressed.Bytes(), compressed.Bytes()
+}
+
+func TestTarballDestination(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "tarball-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	uncompressed, compressed := makeTestLayer(t)
+	layerPath := filepath.Join(tmpDir, "layer.tar.gz")
+	err = ioutil.WriteFile(layerPath, compressed, 0644)
+	require.NoError(t, err)
+	srcRef, err := NewReference([]string{layerPath, layerPath}, nil)
+	require.NoError(t, err)
+
+	policyContext, err := signature.NewPolicyContext(&signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}})
+	require.NoError(t, err)
+	defer policyContext.Destroy()
+
+	for _, c := range []struct {
+		decompress bool
+		layerName  string
+		layer      []byte
+	}{
+		{false, "layer-%d.tar.gz", compressed},
+		{true, "layer-%d.tar", uncompressed},
+	} {
+		// The destination directory does not need to exist when the reference is parsed.
+		destDir := filepath.Join(tmpDir, "dest")
+		destRef, err := Transport.ParseReference(destDir)
+		require.NoError(t, err)
+		_, err = copy.Image(context.Background(), policyContext, destRef, srcRef, &copy.Options{
+			DestinationCtx: &types.SystemContext{TarballDecompressLayers: c.decompress},
+		})
+		require.NoError(t, err)
+
+		entries, err := ioutil.ReadDir(destDir)
+		require.NoError(t, err)
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		layer0, layer1 := fmt.Sprintf(c.layerName, 0), fmt.Sprintf(c.layerName, 1)
+		assert.ElementsMatch(t, []string{configFileName, layer0, layer1}, names)
+		for _, name := range []string{layer0, layer1} {
+			contents, err := ioutil.ReadFile(filepath.Join(destDir, name))
+			require.NoError(t, err)
+			assert.Equal(t, c.layer, contents, name)
+		}
+		configBytes, err := ioutil.ReadFile(filepath.Join(destDir, configFileName))
+		require.NoError(t, err)
+		var config imgspecv1.Image
+		err = json.Unmarshal(configBytes, &config)
+		require.NoError(t, err)
+		assert.Equal(t, []digest.Digest{digest.FromBytes(uncompressed), digest.FromBytes(uncompressed)}, config.RootFS.DiffIDs)
+
+		// A non-empty directory is refused.
+		_, err = destRef.NewImageDestination(context.Background(), nil)
+		assert.Error(t, err)
+		err = os.RemoveAll(destDir)
+		require.NoError(t, err)
+	}
+
+	// Only a single directory can be a destination.
+	_, err = srcRef.NewImageDestination(context.Background(), nil)
+	assert.Error(t, err)
+
+	// A file is not a valid destination, and nothing is created when it is refused.
+	fileRef, err := Transport.ParseReference(layerPath)
+	require.NoError(t, err)
+	_, err = fileRef.NewImageDestination(context.Background(), nil)
+	assert.Error(t, err)
+	contents, err := ioutil.ReadFile(layerPath)
+	require.NoError(t, err)
+	assert.Equal(t, compressed, contents)
+
+	// Files which don't exist are only reported when they are read.
+	missingRef, err := Transport.ParseReference(filepath.Join(tmpDir, "missing.tar"))
+	require.NoError(t, err)
+	_, err = missingRef.NewImageSource(context.Background(), nil)
+	assert.Error(t, err)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/image"
@@ -26,6 +27,10 @@ type tarballReference struct {
 	annotations map[string]string
 	filenames   []string
 	stdin       []byte
+	// The following are only set by Builder.Reference.
+	layers           []BuilderLayer // Options for each of filenames, interleaved with empty-layer history entries, or nil
+	created          *time.Time     // If set, overrides modification times of the files
+	manifestMIMEType string         // "" for imgspecv1.MediaTypeImageManifest
 }
 
 // ConfigUpdate updates the image's default configuration and adds annotations
@@ -41,6 +46,20 @@ func (r *tarballReference) ConfigUpdate(config imgspecv1.Image, annotations map[
 	return nil
 }
 
+// fileLayers returns the options set by Builder.Reference for each of r.filenames, or nil if there are none.
+func (r *tarballReference) fileLayers() []BuilderLayer {
+	if r.layers == nil {
+		return nil
+	}
+	res := []BuilderLayer{}
+	for _, layer := range r.layers {
+		if layer.History == nil || !layer.History.EmptyLayer {
+			res = append(res, layer)
+		}
+	}
+	return res
+}
+
 func (r *tarballReference) Transport() types.ImageTransport {
 	return Transport
 }
@@ -87,7 +106,3 @@ func (r *tarballReference) DeleteImage(ctx context.Context, sys *types.SystemCon
 	}
 	return nil
 }
-
-func (r *tarballReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
-	return nil, fmt.Errorf(`"tarball:" locations can only be read from, not written to`)
-}
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
 	"github.com/klauspost/pgzip"
 	digest "github.com/opencontainers/go-digest"
@@ -31,6 +32,8 @@ type tarballImageSource struct {
 	configID   digest.Digest
 	configSize int64
 	manifest   []byte
+	// manifestMIMEType is the MIME type of manifest
+	manifestMIMEType string
 }
 
 func (r *tarballReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
@@ -66,6 +69,9 @@ func (r *tarballReference) NewImageSource(ctx context.Context, sys *types.System
 			blobSize = fileinfo.Size()
 			blobTime = fileinfo.ModTime()
 		}
+		if r.created != nil {
+			blobTime = *r.created
+		}
 
 		// Default to assuming the layer is compressed.
 		layerType := imgspecv1.MediaTypeImageLayerGzip
@@ -117,22 +123,46 @@ func (r *tarballReference) NewImageSource(ctx context.Context, sys *types.System
 	if len(r.config.History) > 0 && r.config.History[0].Comment != "" {
 		comment = r.config.History[0].Comment
 	}
-	for i := range diffIDs {
-		createdBy := fmt.Sprintf("/bin/sh -c #(nop) ADD file:%s in %c", diffIDs[i].Hex(), os.PathSeparator)
-		history = append(history, imgspecv1.History{
-			Created:   &blobTimes[i],
-			CreatedBy: createdBy,
-			Comment:   comment,
-		})
+	historyLayers := r.layers
+	if historyLayers == nil {
+		historyLayers = make([]BuilderLayer, len(diffIDs))
+	}
+	i := 0 // Index of the next layer in diffIDs
+	for _, layer := range historyLayers {
+		if layer.History != nil && layer.History.EmptyLayer {
+			h := *layer.History
+			if h.Created == nil {
+				h.Created = r.created
+			}
+			history = append(history, h)
+			continue
+		}
+		if layer.History != nil {
+			h := *layer.History
+			if h.Created == nil {
+				h.Created = &blobTimes[i]
+			}
+			history = append(history, h)
+		} else {
+			createdBy := fmt.Sprintf("/bin/sh -c #(nop) ADD file:%s in %c", diffIDs[i].Hex(), os.PathSeparator)
+			history = append(history, imgspecv1.History{
+				Created:   &blobTimes[i],
+				CreatedBy: createdBy,
+				Comment:   comment,
+			})
+		}
 		// Use the mtime of the most recently modified file as the image's creation time.
 		if created.Before(blobTimes[i]) {
 			created = blobTimes[i]
 		}
+		i++
 	}
 
 	// Pick up other defaults from the config in the reference.
 	config := r.config
-	if config.Created == nil {
+	if r.created != nil {
+		config.Created = r.created
+	} else if config.Created == nil {
 		config.Created = &created
 	}
 	if config.Architecture == "" {
@@ -152,34 +182,71 @@ func (r *tarballReference) NewImageSource(ctx context.Context, sys *types.System
 	configID := digest.Canonical.FromBytes(configBytes)
 	configSize := int64(len(configBytes))
 
-	// Populate a manifest with the configuration blob and the file as the single layer.
-	layerDescriptors := []imgspecv1.Descriptor{}
-	for i := range blobIDs {
-		layerDescriptors = append(layerDescriptors, imgspecv1.Descriptor{
-			Digest:    blobIDs[i],
-			Size:      blobSizes[i],
-			MediaType: blobTypes[i],
-		})
+	// Populate a manifest with the configuration blob and the files as the layers.
+	manifestMIMEType := imgspecv1.MediaTypeImageManifest
+	if r.manifestMIMEType != "" {
+		manifestMIMEType = r.manifestMIMEType
 	}
-	annotations := make(map[string]string)
-	for k, v := range r.annotations {
-		annotations[k] = v
-	}
-	manifest := imgspecv1.Manifest{
-		Versioned: imgspecs.Versioned{
-			SchemaVersion: 2,
-		},
-		Config: imgspecv1.Descriptor{
+	fileLayers := r.fileLayers()
+	var manifestBytes []byte
+	switch manifestMIMEType {
+	case manifest.DockerV2Schema2MediaType:
+		layerDescriptors := []manifest.Schema2Descriptor{}
+		for i := range blobIDs {
+			mediaType := manifest.DockerV2Schema2LayerMediaType
+			if blobTypes[i] == imgspecv1.MediaTypeImageLayer {
+				mediaType = manifest.DockerV2SchemaLayerMediaTypeUncompressed
+			}
+			if fileLayers != nil && fileLayers[i].MediaType != "" {
+				mediaType = fileLayers[i].MediaType
+			}
+			layerDescriptors = append(layerDescriptors, manifest.Schema2Descriptor{
+				Digest:    blobIDs[i],
+				Size:      blobSizes[i],
+				MediaType: mediaType,
+			})
+		}
+		manifestBytes, err = manifest.Schema2FromComponents(manifest.Schema2Descriptor{
 			Digest:    configID,
 			Size:      configSize,
-			MediaType: imgspecv1.MediaTypeImageConfig,
-		},
-		Layers:      layerDescriptors,
-		Annotations: annotations,
+			MediaType: manifest.DockerV2Schema2ConfigMediaType,
+		}, layerDescriptors).Serialize()
+	default:
+		layerDescriptors := []imgspecv1.Descriptor{}
+		for i := range blobIDs {
+			descriptor := imgspecv1.Descriptor{
+				Digest:    blobIDs[i],
+				Size:      blobSizes[i],
+				MediaType: blobTypes[i],
+			}
+			if fileLayers != nil {
+				if fileLayers[i].MediaType != "" {
+					descriptor.MediaType = fileLayers[i].MediaType
+				}
+				if len(fileLayers[i].Annotations) != 0 {
+					descriptor.Annotations = fileLayers[i].Annotations
+				}
+			}
+			layerDescriptors = append(layerDescriptors, descriptor)
+		}
+		annotations := make(map[string]string)
+		for k, v := range r.annotations {
+			annotations[k] = v
+		}
+		manifest := imgspecv1.Manifest{
+			Versioned: imgspecs.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: imgspecv1.Descriptor{
+				Digest:    configID,
+				Size:      configSize,
+				MediaType: imgspecv1.MediaTypeImageConfig,
+			},
+			Layers:      layerDescriptors,
+			Annotations: annotations,
+		}
+		manifestBytes, err = json.Marshal(&manifest)
 	}
-
-	// Encode the manifest.
-	manifestBytes, err := json.Marshal(&manifest)
 	if err != nil {
 		return nil, fmt.Errorf("error generating manifest for %q: %v", strings.Join(r.filenames, separator), err)
 	}
@@ -197,6 +264,8 @@ func (r *tarballReference) NewImageSource(ctx context.Context, sys *types.System
 		configID:   configID,
 		configSize: configSize,
 		manifest:   manifestBytes,
+
+		manifestMIMEType: manifestMIMEType,
 	}
 
 	return src, nil
@@ -244,7 +313,7 @@ func (is *tarballImageSource) GetManifest(ctx context.Context, instanceDigest *d
 	if instanceDigest != nil {
 		return nil, "", fmt.Errorf("manifest lists are not supported by the %q transport", transportName)
 	}
-	return is.manifest, imgspecv1.MediaTypeImageManifest, nil
+	return is.manifest, is.manifestMIMEType, nil
 }
 
 // GetSignatures returns the image's signatures.  It may use a remote (= slow) service.
@@ -30,6 +30,8 @@ func (t *tarballTransport) Name() string {
 	return transportName
 }
 
+// ParseReference converts a string, which should not start with the ImageTransport.Name prefix, into an ImageReference.
+// The files are not accessed until the reference is used, so that a destination directory need not exist yet.
 func (t *tarballTransport) ParseReference(reference string) (types.ImageReference, error) {
 	var stdin []byte
 	var err error
@@ -40,13 +42,7 @@ func (t *tarballTransport) ParseReference(reference string) (types.ImageReferenc
 			if err != nil {
 				return nil, fmt.Errorf("error buffering stdin: %v", err)
 			}
-			continue
 		}
-		f, err := os.Open(filename)
-		if err != nil {
-			return nil, fmt.Errorf("error opening %q: %v", filename, err)
-		}
-		f.Close()
 	}
 	return NewReference(filenames, stdin)
 }
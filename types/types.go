@@ -577,6 +577,11 @@ type SystemContext struct {
 	BlobInfoCacheDir string
 	// Additional tags when creating or copying a docker-archive.
 	DockerArchiveAdditionalTags []reference.NamedTagged
+	// If not nil, docker-archive and oci-archive files are compressed using this algorithm when created,
+	// overriding the default choice based on the file name suffix (e.g. ".tar.gz").
+	ArchiveCompressionFormat *compression.Algorithm
+	// If not nil, the compression level to use when creating compressed docker-archive and oci-archive files.
+	ArchiveCompressionLevel *int
 	// If not "", overrides the temporary directory to use for storing big files
 	BigFilesTemporaryDir string
 
@@ -630,10 +635,20 @@ type SystemContext struct {
 	// Used to skip TLS verification, off by default. To take effect DockerDaemonCertPath needs to be specified as well.
 	DockerDaemonInsecureSkipTLSVerify bool
 
+	// === containers-storage.Transport overrides ===
+	// If true, layers copied by copy.Image are applied to the store as soon as their parent layer is available,
+	// instead of being kept in temporary files until the image is committed.
+	// A layer applied as it is downloaded keeps the store's layers locked for the duration of the download.
+	ContainersStorageStreamLayers bool
+
 	// === dir.Transport overrides ===
 	// DirForceCompress compresses the image layers if set to true
 	DirForceCompress bool
 
+	// === tarball.Transport overrides ===
+	// TarballDecompressLayers decompresses the layers written to a tarball: destination if set to true
+	TarballDecompressLayers bool
+
 	// CompressionFormat is the format to use for the compression of the blobs
 	CompressionFormat *compression.Algorithm
 	// CompressionLevel specifies what compression level is used
@@ -659,6 +674,17 @@ const (
 	// ProgressEventSkipped is fired when the artifact has been skipped because
 	// its already available at the destination
 	ProgressEventSkipped
+
+	// ProgressEventApplyNewArtifact is fired when the destination starts applying
+	// a copied artifact, typically a layer, to its storage (e.g. in Commit)
+	ProgressEventApplyNewArtifact
+
+	// ProgressEventApplyRead indicates that the artifact is currently being
+	// applied; Offset counts the bytes of the artifact applied so far
+	ProgressEventApplyRead
+
+	// ProgressEventApplyDone is fired when the artifact has been applied
+	ProgressEventApplyDone
 )
 
 // ProgressProperties is used to pass information from the copy code to a monitor which